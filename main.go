@@ -2,21 +2,121 @@ package main
 
 import (
 	"context"
+	"html/template"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/imaging"
 	"flue-frontend/pkg/server"
 
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/log"
 )
 
+// version is the release of the application.
+const version = "0.1.0"
+
 // CLI holds the command line flags for the application.
 type CLI struct {
-	Host string `default:"localhost" help:"Host to run the server on."`
-	Port int `default:"8080" help:"Port to run the server on."`
-	Backend string `default:"http://localhost:8000" help:"URL of the backend API to send requests to."`
+	Host                    string            `default:"localhost" help:"Host to run the server on."`
+	Port                    int               `default:"8080" help:"Port to run the server on."`
+	Backends                []string          `default:"http://localhost:8000" sep:"," help:"URLs of the backend APIs to send requests to, balanced round-robin."`
+	BreakerThreshold        int               `default:"5" help:"Consecutive backend failures before its circuit opens."`
+	BreakerCooldown         time.Duration     `default:"30s" help:"How long an open circuit fast-fails before probing the backend again."`
+	BackendTimeout          time.Duration     `default:"5m" help:"Maximum time for a backend to deliver a complete generation response. Zero means no timeout."`
+	SlowThreshold           time.Duration     `default:"2m" help:"Log a warning and count the generation in flue_slow_generations_total when the backend reports a generation time above this. Zero disables the warning."`
+	MaxBackendResponse      int64             `default:"0" help:"Maximum backend response size in bytes. Zero derives it from the maximum image dimensions."`
+	BackendHeaders          map[string]string `mapsep:"," help:"Static headers added to every backend request, as Name=value pairs."`
+	SigningSecret           string            `env:"SIGNING_SECRET" help:"Secret to sign backend requests with, for backends that reject unsigned ones. The HMAC of the Unix timestamp, a dot and the request body is sent with the timestamp in X-Signature-Timestamp. If empty, requests are not signed."`
+	SigningAlgorithm        string            `default:"sha256" enum:"sha256,sha384,sha512" help:"Hash of the backend request signatures (sha256, sha384, sha512)."`
+	SignatureHeader         string            `default:"X-Signature" help:"Header the backend request signatures are sent in."`
+	PayloadKeys             map[string]string `mapsep:"," help:"Generation payload keys renamed for backend versions expecting other names, as key=name pairs such as steps=num_inference_steps,guidance=guidance_scale. Keys not given keep their names."`
+	ProbeBackendVersion     bool              `help:"Query the backends for their version at startup and log it along with the payload keys in use."`
+	ForwardHeaders          []string          `sep:"," help:"Names of client request headers passed on to the backends. Hop-by-hop headers are never passed."`
+	DefaultQuality          int               `default:"90" help:"Default encoder quality (1-100) for JPEG and WebP output."`
+	DefaultModel            string            `help:"Model to use when a request does not select one."`
+	AvailableModels         []string          `sep:"," help:"Models users may select. If empty, any model is passed through to the backend."`
+	ModelConfig             string            `help:"JSON file mapping model names to their default steps and guidance and limits narrower than the general ones."`
+	ExamplePrompts          string            `help:"JSON file listing example prompts shown on the index page, each with a prompt and optionally a label, model, width, height, steps, guidance and seed."`
+	PNGMetadata             string            `default:"parameters" enum:"parameters,fields,none" help:"How to embed generation parameters in PNG images: a single A1111-style parameters chunk, a chunk per parameter, or none."`
+	SafetyMode              string            `default:"off" enum:"off,blur,block" help:"How to handle images the backend flags as NSFW (off, blur, block)."`
+	AuditLog                string            `help:"File to append one JSON line per generation to, reopened on SIGHUP for rotation. If empty, no audit log is kept."`
+	OTLPEndpoint            string            `name:"otlp-endpoint" help:"OTLP/HTTP URL to export generation traces to, e.g. http://localhost:4318/v1/traces. If empty, tracing is disabled."`
+	ImageStore              string            `default:"disk" enum:"disk,memory,s3" help:"Where to archive generated images (disk, memory, s3). Disk keeps them in the output directory, memory until the server restarts, s3 in an S3 compatible bucket."`
+	S3Endpoint              string            `name:"s3-endpoint" help:"URL of the S3 compatible service images are archived in when the image store is s3, such as https://s3.amazonaws.com or http://minio:9000."`
+	S3Bucket                string            `name:"s3-bucket" help:"Bucket images are archived in when the image store is s3."`
+	S3Prefix                string            `name:"s3-prefix" help:"Prefix of the names of archived images in the S3 bucket."`
+	S3Region                string            `name:"s3-region" help:"Region of the S3 bucket."`
+	S3AccessKey             string            `name:"s3-access-key" env:"S3_ACCESS_KEY" help:"Access key of the S3 bucket."`
+	S3SecretKey             string            `name:"s3-secret-key" env:"S3_SECRET_KEY" help:"Secret key of the S3 bucket."`
+	PresignExpiry           time.Duration     `default:"0" help:"Redirect requests for archived images to presigned URLs of the S3 bucket valid this long. Zero streams images through the server."`
+	ShareExpiry             time.Duration     `default:"0" help:"How long public links to archived images stay valid. Zero keeps them until revoked."`
+	BaseURL                 string            `name:"base-url" help:"External URL the server is reached at, such as https://images.example.com, for absolute links in the feed and public links. Derived from each request if empty."`
+	FeedSize                int               `default:"20" help:"Number of generations listed in the Atom feed at /feed.atom. Zero disables the feed."`
+	FeedScope               string            `default:"public" enum:"public,all" help:"Generations listed in the feed: those with a public link, or all archived images. All cannot be used with per-user galleries."`
+	OutputDir               string            `help:"Directory to archive every generated image in, with a JSON sidecar of its metadata, when the image store is disk. If empty, images are not kept."`
+	RetentionMaxAge         time.Duration     `default:"0" help:"Remove archived images older than this, except favorites. Zero keeps them regardless of age."`
+	RetentionMaxBytes       int64             `default:"0" help:"Remove the oldest archived images, except favorites, while they take up more bytes than this. Zero means no limit."`
+	RetentionMaxCount       int               `default:"0" help:"Remove the oldest archived images, except favorites, while there are more than this many. Zero means no limit."`
+	RetentionInterval       time.Duration     `default:"1h" help:"How often to enforce the retention limits after the cleanup on startup. Zero cleans up only on startup."`
+	RetentionDryRun         bool              `help:"Only log the archived images the retention limits would remove."`
+	GalleryPageSize         int               `default:"24" help:"Number of archived images per gallery page."`
+	PerUserGalleries        bool              `help:"Give every browser its own gallery and job history through a long-lived session cookie, with favorites and deletion limited to the images of its session. Administrators see all images at /admin/gallery."`
+	LegacyOwner             string            `default:"legacy" help:"Session that archived images created before per-user galleries were enabled are assigned to."`
+	SessionSecret           string            `env:"SESSION_SECRET" help:"Key session IDs are digested with before they are stored as the owner of images and jobs. If empty, a random key is kept in the job store, or sessions lose their images on restart without one."`
+	ThumbnailSize           int               `default:"256" help:"Longest side in pixels of the gallery thumbnails of archived images."`
+	ThumbnailFormat         string            `default:"jpeg" enum:"${formats}" help:"Format of the gallery thumbnails (${formats})."`
+	MaxConcurrent           int               `default:"1" help:"Maximum concurrent backend generations; further requests queue. Zero means unlimited."`
+	MaxQueued               int               `default:"32" help:"Maximum number of queued generations; further requests are rejected with 503. Zero means unbounded."`
+	MaxQueueWait            time.Duration     `default:"5m" help:"How long a synchronous request waits for a generation slot before 503. Zero rejects immediately when all slots are busy."`
+	MaxRunningPerClient     int               `default:"0" help:"Maximum generations a single client IP may have running. Zero means unlimited."`
+	MaxQueuedPerClient      int               `default:"0" help:"Maximum generations a single client IP may have queued. Zero means unlimited."`
+	TrustedProxies          []string          `sep:"," help:"IPs or CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted for client IPs."`
+	BlockedPatterns         []string          `sep:"," help:"Case-insensitive regular expressions for prompts to reject."`
+	RedactFilteredPrompts   bool              `help:"Do not log the prompt text when a prompt is rejected."`
+	DedupWindow             time.Duration     `default:"2s" help:"Window in which an identical request from the same client shares the first one's result. Zero disables."`
+	MaxBatchSize            int               `default:"50" help:"Maximum number of prompts in a batch submission. Zero means unlimited."`
+	MaxScheduleHorizon      time.Duration     `default:"24h" help:"How far ahead a job may be scheduled with run_at. Zero means no limit."`
+	JobTTL                  time.Duration     `default:"1h" help:"How long finished asynchronous jobs remain retrievable."`
+	JobHistory              time.Duration     `default:"168h" help:"How long finished jobs stay in the job history. At least the job TTL."`
+	Database                string            `help:"Path of a SQLite database keeping the metadata of archived images, and jobs unless a job store is given. If empty, the metadata is kept in memory."`
+	JobStore                string            `help:"Path of a database file persisting jobs across restarts. If empty, jobs are kept in memory."`
+	WarmupOnStart           bool              `help:"Send a throwaway generation on startup so the backend model is loaded."`
+	WarmupPrompt            string            `default:"warmup" help:"Prompt of the startup warmup generation."`
+	WarmupWidth             int               `default:"256" help:"Width of the startup warmup generation."`
+	WarmupHeight            int               `default:"256" help:"Height of the startup warmup generation."`
+	StreamProgress          bool              `help:"Ask backends to stream per-step progress as newline-delimited JSON."`
+	CapabilitiesRefresh     time.Duration     `default:"10m" help:"How often to re-query backend capabilities for parameter limits. Zero queries only at startup."`
+	HealthPollInterval      time.Duration     `default:"15s" help:"How often to probe the backends to notice them going down or recovering. Zero disables polling."`
+	ConnectionCheckInterval time.Duration     `default:"0" help:"How often to check whether a backend was redeployed or restarted, closing idle connections to it if so. Zero disables the check."`
+	DrainDelay              time.Duration     `default:"5s" help:"How long to keep answering once shutdown starts, failing readiness checks and refusing new generations, so load balancers stop sending traffic before connections are refused."`
+	DrainTimeout            time.Duration     `default:"10s" help:"How long in-flight requests may take to finish during shutdown, after the drain delay."`
+	NoCompression           bool              `help:"Do not gzip responses, such as when a reverse proxy compresses them already."`
+	CompressionMinBytes     int               `default:"1024" help:"Size in bytes below which responses are not gzipped."`
+	MaxWidth                int               `default:"2048" help:"Maximum image width, unless the backends report their own."`
+	MaxHeight               int               `default:"2048" help:"Maximum image height, unless the backends report their own."`
+	MaxSteps                int               `default:"100" help:"Maximum number of steps, unless the backends report their own."`
+	Debug                   bool              `help:"Enable diagnostic endpoints such as POST /api/v1/generate/raw and log the payload of every backend request, prompts included. Do not expose publicly."`
+	Pprof                   bool              `help:"Serve runtime profiles under /debug/pprof to administrators."`
+	AdminUsers              map[string]string `mapsep:"," help:"Administrators allowed to use the /admin endpoints with HTTP basic auth, as name=password pairs. The endpoints are disabled if empty."`
+	APIOnly                 bool              `name:"api-only" help:"Serve only the JSON API, without the HTML UI or its templates."`
+	MaintenanceMode         bool              `help:"Start in maintenance mode, refusing generations with 503 while the UI stays up. Administrators can toggle it at runtime."`
+	SiteTitle               string            `help:"Site title replacing the default in the HTML UI."`
+	LogoURL                 string            `name:"logo-url" help:"URL of a logo shown next to the site title."`
+	FooterHTML              string            `name:"footer-html" help:"HTML shown at the bottom of every page. It is not escaped, so only use trusted markup."`
+	BusyMessage             string            `help:"Message shown in place of the result when a submission is rejected by rate or concurrency limits. If empty, a default is used."`
+	BusyImageURL            string            `name:"busy-image-url" help:"URL of an image shown with the busy message."`
+	TimeFormat              string            `default:"2006-01-02 15:04:05 MST" help:"Go layout of the times shown in the HTML UI."`
+	TimeZone                string            `help:"IANA time zone the HTML UI shows times in, such as Europe/Berlin. If empty, the server's local zone is used."`
+	PrefsSecret             string            `env:"PREFS_SECRET" help:"Key the cookie of browser preferences, such as the color theme, is signed with. If empty, a random key is used and preferences reset on restart."`
+	InlineMaxBytes          int               `default:"32768" help:"Largest image in bytes embedded in the result page as a data URI. Larger ones are linked from the archive or image cache."`
+	AltText                 string            `default:"{{ .Prompt }}" help:"Template of the alt text of result images, given .Prompt (shortened), .Seed, .Width, .Height, .Steps and .Model. Empty uses a generic text."`
+	PreviewMaxDimension     int               `default:"0" help:"Downscale images shown in the browser to this maximum width and height, keeping full resolution for download. Zero disables."`
+	BlockingSubmit          bool              `help:"Make the browser form wait for the generation to finish instead of polling a queued job."`
 }
 
 func main() {
@@ -30,7 +130,7 @@ func main() {
 		kong.Bind(&ctx, &stop),
 		kong.Name("flue-frontend"),
 		kong.Description("Flue Frontend: A simple web interface for generating images using Flue."),
-		kong.Vars{"version": "0.1.0"},
+		kong.Vars{"version": version, "formats": formats()},
 	)
 
 	// Run the application.
@@ -38,9 +138,117 @@ func main() {
 	kctx.FatalIfErrorf(err)
 }
 
+// formats returns the image formats this build can encode, as a kong enum.
+func formats() string {
+	var names []string
+	for _, f := range imaging.SupportedFormats() {
+		names = append(names, string(f))
+	}
+	return strings.Join(names, ",")
+}
+
 func (c *CLI) Run(ctx *context.Context, stop *context.CancelFunc) error {
-	log.Infof("Starting Flue Frontend on %s:%d, backend: %s", c.Host, c.Port, c.Backend)
-	srv := server.New(c.Host, c.Port, c.Backend)
+	log.Infof("Starting Flue Frontend on %s:%d, backends: %s", c.Host, c.Port, strings.Join(c.Backends, ", "))
+	srv, err := server.New(c.Host, c.Port, c.Backends)
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+		return err
+	}
+	srv.BreakerThreshold = c.BreakerThreshold
+	srv.BreakerCooldown = c.BreakerCooldown
+	srv.BackendTimeout = c.BackendTimeout
+	srv.SlowThreshold = c.SlowThreshold
+	srv.MaxBackendResponse = c.MaxBackendResponse
+	srv.BackendHeaders = c.BackendHeaders
+	srv.ForwardHeaders = c.ForwardHeaders
+	srv.SigningSecret = c.SigningSecret
+	srv.SigningAlgorithm = c.SigningAlgorithm
+	srv.SignatureHeader = c.SignatureHeader
+	srv.PayloadKeys = c.PayloadKeys
+	srv.ProbeBackendVersion = c.ProbeBackendVersion
+	srv.DefaultQuality = c.DefaultQuality
+	srv.DefaultModel = c.DefaultModel
+	srv.AvailableModels = c.AvailableModels
+	srv.ModelConfig = c.ModelConfig
+	srv.ExamplePrompts = c.ExamplePrompts
+	srv.SafetyMode = c.SafetyMode
+	srv.PNGMetadata = c.PNGMetadata
+	srv.Version = version
+	srv.AuditLog = c.AuditLog
+	srv.OTLPEndpoint = c.OTLPEndpoint
+	srv.ImageStore = c.ImageStore
+	srv.OutputDir = c.OutputDir
+	srv.S3 = archive.S3Config{
+		Endpoint:  c.S3Endpoint,
+		Bucket:    c.S3Bucket,
+		Prefix:    c.S3Prefix,
+		Region:    c.S3Region,
+		AccessKey: c.S3AccessKey,
+		SecretKey: c.S3SecretKey,
+	}
+	srv.PresignExpiry = c.PresignExpiry
+	srv.ShareExpiry = c.ShareExpiry
+	srv.BaseURL = c.BaseURL
+	srv.FeedSize = c.FeedSize
+	srv.FeedScope = c.FeedScope
+	srv.TimeFormat = c.TimeFormat
+	srv.TimeZone = c.TimeZone
+	srv.PrefsSecret = c.PrefsSecret
+	srv.RetentionMaxAge = c.RetentionMaxAge
+	srv.RetentionMaxBytes = c.RetentionMaxBytes
+	srv.RetentionMaxCount = c.RetentionMaxCount
+	srv.RetentionInterval = c.RetentionInterval
+	srv.RetentionDryRun = c.RetentionDryRun
+	srv.GalleryPageSize = c.GalleryPageSize
+	srv.PerUserGalleries = c.PerUserGalleries
+	srv.LegacyOwner = c.LegacyOwner
+	srv.SessionSecret = c.SessionSecret
+	srv.ThumbnailSize = c.ThumbnailSize
+	srv.ThumbnailFormat = c.ThumbnailFormat
+	srv.MaxConcurrent = c.MaxConcurrent
+	srv.MaxQueued = c.MaxQueued
+	srv.MaxQueueWait = c.MaxQueueWait
+	srv.MaxRunningPerClient = c.MaxRunningPerClient
+	srv.MaxQueuedPerClient = c.MaxQueuedPerClient
+	srv.TrustedProxies = c.TrustedProxies
+	srv.BlockedPatterns = c.BlockedPatterns
+	srv.RedactFilteredPrompts = c.RedactFilteredPrompts
+	srv.DedupWindow = c.DedupWindow
+	srv.MaxBatchSize = c.MaxBatchSize
+	srv.MaxScheduleHorizon = c.MaxScheduleHorizon
+	srv.JobTTL = c.JobTTL
+	srv.JobHistory = c.JobHistory
+	srv.Database = c.Database
+	srv.JobStore = c.JobStore
+	srv.WarmupOnStart = c.WarmupOnStart
+	srv.WarmupParams.Prompt = c.WarmupPrompt
+	srv.WarmupParams.Width = c.WarmupWidth
+	srv.WarmupParams.Height = c.WarmupHeight
+	srv.StreamProgress = c.StreamProgress
+	srv.CapabilitiesRefresh = c.CapabilitiesRefresh
+	srv.HealthPollInterval = c.HealthPollInterval
+	srv.ConnectionCheckInterval = c.ConnectionCheckInterval
+	srv.DrainDelay = c.DrainDelay
+	srv.DrainTimeout = c.DrainTimeout
+	srv.NoCompression = c.NoCompression
+	srv.CompressionMinBytes = c.CompressionMinBytes
+	srv.Limits.Width.Max = c.MaxWidth
+	srv.Limits.Height.Max = c.MaxHeight
+	srv.Limits.Steps.Max = c.MaxSteps
+	srv.Debug = c.Debug
+	srv.Pprof = c.Pprof
+	srv.AdminUsers = c.AdminUsers
+	srv.APIOnly = c.APIOnly
+	srv.MaintenanceMode = c.MaintenanceMode
+	srv.Branding.Title = c.SiteTitle
+	srv.Branding.LogoURL = c.LogoURL
+	srv.Branding.FooterHTML = template.HTML(c.FooterHTML)
+	srv.Branding.BusyMessage = c.BusyMessage
+	srv.Branding.BusyImageURL = c.BusyImageURL
+	srv.InlineMaxBytes = c.InlineMaxBytes
+	srv.PreviewMaxDimension = c.PreviewMaxDimension
+	srv.AltText = c.AltText
+	srv.BlockingSubmit = c.BlockingSubmit
 	if err := srv.Run(*ctx, *stop); err != nil {
 		log.Errorf("Failed to run server: %v", err)
 		return err
@@ -0,0 +1,118 @@
+// Package archive stores generated images along with their metadata.
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"time"
+
+	"flue-frontend/pkg/store"
+)
+
+// ErrNotFound is returned for IDs with no archived image.
+var ErrNotFound = store.ErrNotFound
+
+// idPattern matches the IDs images are archived under. Other sidecar file
+// names are ignored.
+var idPattern = regexp.MustCompile(`^[a-z2-7]{1,32}$`)
+
+// ImageStore keeps generated images and their metadata. The metadata is kept
+// in a store.Store, so looking it up or listing the store never touches the
+// images themselves.
+type ImageStore interface {
+	// Put stores an image under id along with its metadata, whose Format
+	// names the image's format. The metadata's ID, Size and Hash are set
+	// from id and data. An image identical to a stored one shares its copy,
+	// which is only removed along with the last image referring to it.
+	Put(ctx context.Context, id string, data []byte, meta store.Metadata) error
+	// Get returns a stored image and its metadata, or ErrNotFound.
+	Get(ctx context.Context, id string) ([]byte, store.Metadata, error)
+	// Delete removes a stored image along with its metadata and thumbnails,
+	// or returns ErrNotFound.
+	Delete(ctx context.Context, id string) error
+	// SetFavorite marks a stored image as a favorite or not, returning its
+	// updated metadata.
+	SetFavorite(ctx context.Context, id string, favorite bool) (store.Metadata, error)
+
+	// Metadata returns the metadata of a stored image, or ErrNotFound.
+	Metadata(ctx context.Context, id string) (store.Metadata, error)
+	// List returns up to limit stored images matching q newest first,
+	// skipping the offset newest, along with the total number of matching
+	// images.
+	List(ctx context.Context, q store.Query, offset, limit int) ([]store.Metadata, int, error)
+	// Stats sums up the stored images.
+	Stats(ctx context.Context) (store.Stats, error)
+	// Usage breaks the stored images down, counting them per day since
+	// since and listing the top most frequent dimensions and step counts.
+	Usage(ctx context.Context, since time.Time, top int) (store.Usage, error)
+	// Adopt assigns the stored images without an owner to owner, returning
+	// how many it assigned.
+	Adopt(ctx context.Context, owner string) (int, error)
+
+	// Thumbnail returns the thumbnail of a stored image saved by
+	// SaveThumbnail under variant, a file extension naming its size and
+	// format, or ErrNotFound.
+	Thumbnail(ctx context.Context, id, variant string) ([]byte, error)
+	// SaveThumbnail stores a thumbnail of a stored image.
+	SaveThumbnail(ctx context.Context, id, variant string, data []byte) error
+}
+
+// Opener is implemented by image stores that can stream an image instead of
+// reading it whole.
+type Opener interface {
+	// OpenImage returns a reader of a stored image and its metadata, or
+	// ErrNotFound.
+	OpenImage(ctx context.Context, id string) (io.ReadSeekCloser, store.Metadata, error)
+}
+
+// Linker is implemented by image stores that clients can fetch images from
+// directly.
+type Linker interface {
+	// ImageURL returns a URL of a stored image valid for expiry, "" if the
+	// store does not serve clients, or ErrNotFound.
+	ImageURL(ctx context.Context, id string, expiry time.Duration) (string, error)
+}
+
+// contentHash returns the Hash of an image, the hex SHA-256 of its bytes.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// references returns the number of records of images with the given hash,
+// which is how many share the stored copy of their content.
+func references(ctx context.Context, records store.Store, hash string) (int, error) {
+	_, n, err := records.List(ctx, store.Query{Hash: hash}, 0, 0)
+	return n, err
+}
+
+// indexed implements the metadata lookups of an ImageStore with its
+// records.
+type indexed struct {
+	records store.Store
+}
+
+func (x indexed) Metadata(ctx context.Context, id string) (store.Metadata, error) {
+	return x.records.Get(ctx, id)
+}
+
+func (x indexed) List(ctx context.Context, q store.Query, offset, limit int) ([]store.Metadata, int, error) {
+	return x.records.List(ctx, q, offset, limit)
+}
+
+func (x indexed) Stats(ctx context.Context) (store.Stats, error) {
+	return x.records.Stats(ctx)
+}
+
+func (x indexed) Usage(ctx context.Context, since time.Time, top int) (store.Usage, error) {
+	return x.records.Usage(ctx, since, top)
+}
+
+// Adopt only assigns the records, leaving sidecars without an owner until
+// they are next rewritten; records rebuilt from them are adopted again.
+func (x indexed) Adopt(ctx context.Context, owner string) (int, error) {
+	return x.records.Adopt(ctx, owner)
+}
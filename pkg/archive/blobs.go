@@ -0,0 +1,281 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/store"
+)
+
+// Blobs is an ImageStore keeping images in a BlobStore: <hash>.<ext> for the
+// image, shared by identical images, and <id>.json for a sidecar copy of its
+// metadata, from which the records can be rebuilt.
+type Blobs struct {
+	indexed
+	blobs BlobStore
+
+	mu sync.Mutex // serializes metadata updates and counting references
+}
+
+// Open returns a Blobs archiving into blobs with its metadata kept in
+// records, or in memory if records is nil. If records is empty, the
+// sidecars of the images already in blobs are indexed into it.
+func Open(ctx context.Context, blobs BlobStore, records store.Store) (*Blobs, error) {
+	if records == nil {
+		records = store.NewMemory()
+	}
+	b := &Blobs{indexed: indexed{records}, blobs: blobs}
+	stats, err := records.Stats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read archive records: %w", err)
+	}
+	if stats.Images == 0 {
+		if err := b.load(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// OpenDir returns a Blobs archiving into the directory at path, creating it
+// if needed. See Open.
+func OpenDir(ctx context.Context, path string, records store.Store) (*Blobs, error) {
+	files, err := NewFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return Open(ctx, files, records)
+}
+
+// load indexes the sidecars in the blob store. Sidecars that cannot be
+// parsed are skipped.
+func (b *Blobs) load(ctx context.Context) error {
+	names, err := b.blobs.List(ctx, "")
+	if err != nil {
+		return fmt.Errorf("list archive: %w", err)
+	}
+	var all []store.Metadata
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		data, err := readBlob(ctx, b.blobs, name)
+		if err != nil {
+			return fmt.Errorf("read metadata of %s: %w", id, err)
+		}
+		var meta store.Metadata
+		if err := json.Unmarshal(data, &meta); err != nil || meta.ID != id {
+			continue
+		}
+		if meta.Size == 0 {
+			// Sidecars written before sizes were recorded.
+			if r, size, err := b.blobs.Open(ctx, imageBlob(meta)); err == nil {
+				r.Close()
+				meta.Size = size
+			}
+		}
+		all = append(all, meta)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].CreatedAt.Before(all[j].CreatedAt) })
+	for _, meta := range all {
+		if err := b.records.Put(ctx, meta); err != nil {
+			return fmt.Errorf("index %s: %w", meta.ID, err)
+		}
+	}
+	return nil
+}
+
+// imageBlob is the name of the blob holding an image. It is taken from the
+// indexed metadata, never from a requested ID directly. Images archived
+// before their hash was recorded are named after their ID.
+func imageBlob(meta store.Metadata) string {
+	name := meta.Hash
+	if name == "" {
+		name = meta.ID
+	}
+	return name + "." + path.Base(meta.Format)
+}
+
+// Put writes an image and its metadata, unless an identical image is stored
+// already. The image is written before its sidecar, so a sidecar always
+// refers to a complete image.
+func (b *Blobs) Put(ctx context.Context, id string, data []byte, meta store.Metadata) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("invalid image ID %q", id)
+	}
+	meta.ID = id
+	meta.Size = int64(len(data))
+	meta.Hash = contentHash(data)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	refs, err := references(ctx, b.records, meta.Hash)
+	if err != nil {
+		return fmt.Errorf("count references of %s: %w", id, err)
+	}
+	if refs == 0 {
+		if err := b.blobs.Put(ctx, imageBlob(meta), data); err != nil {
+			return err
+		}
+	}
+	old, err := b.records.Get(ctx, id)
+	replaced := err == nil && imageBlob(old) != imageBlob(meta)
+	if err := b.writeMetadata(ctx, meta); err != nil {
+		return err
+	}
+	if err := b.records.Put(ctx, meta); err != nil {
+		return err
+	}
+	if replaced {
+		// The image took the place of one with other content.
+		return b.release(ctx, old)
+	}
+	return nil
+}
+
+// release removes the blob of an image once no other image refers to it.
+// The caller must hold b.mu.
+func (b *Blobs) release(ctx context.Context, meta store.Metadata) error {
+	if meta.Hash != "" {
+		refs, err := references(ctx, b.records, meta.Hash)
+		if err != nil {
+			return fmt.Errorf("count references of %s: %w", meta.ID, err)
+		}
+		if refs > 0 {
+			return nil
+		}
+	}
+	name := imageBlob(meta)
+	if err := b.blobs.Delete(ctx, name); err != nil {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetFavorite marks an image as a favorite or not, rewriting its sidecar.
+func (b *Blobs) SetFavorite(ctx context.Context, id string, favorite bool) (store.Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	meta, err := b.records.Get(ctx, id)
+	if err != nil {
+		return store.Metadata{}, err
+	}
+	meta.Favorite = favorite
+	if err := b.writeMetadata(ctx, meta); err != nil {
+		return store.Metadata{}, err
+	}
+	if err := b.records.Put(ctx, meta); err != nil {
+		return store.Metadata{}, err
+	}
+	return meta, nil
+}
+
+// writeMetadata replaces the sidecar of an image.
+func (b *Blobs) writeMetadata(ctx context.Context, meta store.Metadata) error {
+	sidecar, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	return b.blobs.Put(ctx, meta.ID+".json", sidecar)
+}
+
+// Get returns an image and its metadata.
+func (b *Blobs) Get(ctx context.Context, id string) ([]byte, store.Metadata, error) {
+	r, meta, err := b.OpenImage(ctx, id)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	return data, meta, nil
+}
+
+// OpenImage returns a reader of an image and its metadata, for streaming
+// the image without holding it in memory.
+func (b *Blobs) OpenImage(ctx context.Context, id string) (io.ReadSeekCloser, store.Metadata, error) {
+	meta, err := b.records.Get(ctx, id)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	r, _, err := b.blobs.Open(ctx, imageBlob(meta))
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	return r, meta, nil
+}
+
+// ImageURL returns a URL clients can fetch an image from directly for
+// expiry, or "" if the blob store does not serve clients.
+func (b *Blobs) ImageURL(ctx context.Context, id string, expiry time.Duration) (string, error) {
+	meta, err := b.records.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return b.blobs.URL(ctx, imageBlob(meta), expiry)
+}
+
+// Delete removes an image along with its metadata and thumbnails, and its
+// blob unless other images share it. It leaves the records first and loses
+// its sidecar next, so an interrupted deletion never leaves a listed image
+// without its blob.
+func (b *Blobs) Delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	meta, err := b.records.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := b.records.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	if err := b.blobs.Delete(ctx, meta.ID+".json"); err != nil {
+		return fmt.Errorf("remove metadata of %s: %w", id, err)
+	}
+	thumbs, err := b.blobs.List(ctx, thumbnailName(meta.ID, ""))
+	if err != nil {
+		return fmt.Errorf("list thumbnails of %s: %w", id, err)
+	}
+	for _, name := range thumbs {
+		if err := b.blobs.Delete(ctx, name); err != nil {
+			return fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+	return b.release(ctx, meta)
+}
+
+// Thumbnail returns a thumbnail stored by SaveThumbnail.
+func (b *Blobs) Thumbnail(ctx context.Context, id, variant string) ([]byte, error) {
+	if _, err := b.records.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	return readBlob(ctx, b.blobs, thumbnailName(id, variant))
+}
+
+// SaveThumbnail stores a thumbnail of an image next to it.
+func (b *Blobs) SaveThumbnail(ctx context.Context, id, variant string, data []byte) error {
+	if _, err := b.records.Get(ctx, id); err != nil {
+		return err
+	}
+	return b.blobs.Put(ctx, thumbnailName(id, variant), data)
+}
+
+// thumbnailName is the name of the blob holding a thumbnail, or with an
+// empty variant the prefix of the thumbnails of an image.
+func thumbnailName(id, variant string) string {
+	if variant == "" {
+		return id + ".thumb-"
+	}
+	return id + ".thumb-" + path.Base(variant)
+}
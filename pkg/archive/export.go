@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/store"
+)
+
+// recordsName is the name of the JSON lines file of metadata records in an
+// export, and imagesDir the directory holding the images.
+const (
+	recordsName = "records.jsonl"
+	imagesDir   = "images/"
+)
+
+// maxImportErrors is the number of failures listed in an ImportSummary.
+const maxImportErrors = 20
+
+// Export writes a zip archive of the records of every stored image, oldest
+// first, as JSON lines, followed by the images themselves if withImages is
+// set. The archive is streamed to w one image at a time. Images deleted
+// while exporting are left out.
+func Export(ctx context.Context, w io.Writer, images ImageStore, withImages bool) error {
+	all, _, err := images.List(ctx, store.Query{}, 0, math.MaxInt)
+	if err != nil {
+		return fmt.Errorf("list images: %w", err)
+	}
+	slices.Reverse(all)
+
+	zw := zip.NewWriter(w)
+	records, err := zw.CreateHeader(&zip.FileHeader{Name: recordsName, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(records)
+	for _, meta := range all {
+		if err := enc.Encode(meta); err != nil {
+			return err
+		}
+	}
+
+	if withImages {
+		for _, meta := range all {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data, _, err := images.Get(ctx, meta.ID)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("read image %s: %w", meta.ID, err)
+			}
+			// Images are compressed already.
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: imageName(meta), Method: zip.Store, Modified: meta.CreatedAt})
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// imageName is the name of an image in an export.
+func imageName(meta store.Metadata) string {
+	return imagesDir + meta.ID + "." + meta.Format
+}
+
+// ImportSummary counts the outcome of an import.
+type ImportSummary struct {
+	Imported int `json:"imported"`
+	// Skipped counts records whose ID is already stored.
+	Skipped int `json:"skipped"`
+	Errored int `json:"errored"`
+	// Errors describes the first failures.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (s *ImportSummary) fail(format string, args ...any) {
+	s.Errored++
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// Import stores the images of a zip archive written by Export, in the order
+// of its records, skipping those whose ID is already stored. Records whose
+// image is not in the archive cannot be imported and count as errors. It
+// fails only if the archive itself cannot be read.
+func Import(ctx context.Context, r io.ReaderAt, size int64, images ImageStore) (ImportSummary, error) {
+	var summary ImportSummary
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return summary, fmt.Errorf("read archive: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	records, ok := files[recordsName]
+	if !ok {
+		return summary, fmt.Errorf("read archive: %s is missing", recordsName)
+	}
+	rc, err := records.Open()
+	if err != nil {
+		return summary, fmt.Errorf("read archive: %w", err)
+	}
+	defer rc.Close()
+
+	scanner := bufio.NewScanner(rc)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		var meta store.Metadata
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			summary.fail("record %d: %v", line, err)
+			continue
+		}
+		if !idPattern.MatchString(meta.ID) {
+			summary.fail("record %d: invalid ID %q", line, meta.ID)
+			continue
+		}
+		if format, err := imaging.ParseFormat(meta.Format); err != nil || string(format) != meta.Format {
+			summary.fail("%s: unknown format %q", meta.ID, meta.Format)
+			continue
+		}
+		if _, err := images.Metadata(ctx, meta.ID); err == nil {
+			summary.Skipped++
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			summary.fail("%s: %v", meta.ID, err)
+			continue
+		}
+
+		f, ok := files[imageName(meta)]
+		if !ok {
+			summary.fail("%s: image is not in the archive", meta.ID)
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			summary.fail("%s: %v", meta.ID, err)
+			continue
+		}
+		if err := images.Put(ctx, meta.ID, data, meta); err != nil {
+			summary.fail("%s: %v", meta.ID, err)
+			continue
+		}
+		summary.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, fmt.Errorf("read %s: %w", recordsName, err)
+	}
+	return summary, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"flue-frontend/pkg/store"
+)
+
+// openTestStore returns an empty image store in a temporary directory, with
+// its records in a SQLite database.
+func openTestStore(t *testing.T) *Blobs {
+	t.Helper()
+	dir := t.TempDir()
+	records, err := store.OpenSQLite(filepath.Join(dir, "flue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { records.Close() })
+	images, err := OpenDir(context.Background(), filepath.Join(dir, "images"), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return images
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := openTestStore(t)
+	seed := 42
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	want := map[string][]byte{
+		"aaaa": []byte("first image"),
+		"bbbb": []byte("second image"),
+		"cccc": []byte("first image"),
+	}
+	for i, id := range []string{"aaaa", "bbbb", "cccc"} {
+		meta := store.Metadata{
+			Prompt: "image " + id, Seed: &seed, Width: 64, Height: 64, Steps: 4, Guidance: 3.5,
+			Format: "png", CreatedAt: created.Add(time.Duration(i) * time.Minute), Owner: "alice",
+			Favorite: id == "bbbb",
+		}
+		if err := src.Put(ctx, id, want[id], meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Export(ctx, &buf, src, true); err != nil {
+		t.Fatal(err)
+	}
+	dst := openTestStore(t)
+	summary, err := Import(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Imported != 3 || summary.Skipped != 0 || summary.Errored != 0 {
+		t.Errorf("Import = %+v, want 3 imported", summary)
+	}
+
+	for id, data := range want {
+		got, meta, err := dst.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", id, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("image %s = %q, want %q", id, got, data)
+		}
+		orig, _ := src.Metadata(ctx, id)
+		if !meta.CreatedAt.Equal(orig.CreatedAt) {
+			t.Errorf("image %s created at %v, want %v", id, meta.CreatedAt, orig.CreatedAt)
+		}
+		meta.CreatedAt, orig.CreatedAt = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(meta, orig) {
+			t.Errorf("metadata of %s = %+v, want %+v", id, meta, orig)
+		}
+	}
+	srcStats, _ := src.Stats(ctx)
+	dstStats, _ := dst.Stats(ctx)
+	if srcStats != dstStats {
+		t.Errorf("Stats after import = %+v, want %+v", dstStats, srcStats)
+	}
+
+	// Importing again skips what is stored already.
+	summary, err = Import(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Imported != 0 || summary.Skipped != 3 || summary.Errored != 0 {
+		t.Errorf("second Import = %+v, want 3 skipped", summary)
+	}
+}
+
+func TestImportWithoutImages(t *testing.T) {
+	ctx := context.Background()
+	src := openTestStore(t)
+	if err := src.Put(ctx, "aaaa", []byte("image"), store.Metadata{Prompt: "a", Format: "png", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Export(ctx, &buf, src, false); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := Import(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), NewMemory(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Imported != 0 || summary.Errored != 1 || len(summary.Errors) != 1 {
+		t.Errorf("Import of records only = %+v, want 1 error", summary)
+	}
+}
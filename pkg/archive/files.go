@@ -0,0 +1,137 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps named blobs of data, such as the files of an archive. Names
+// are flat, without directories.
+type BlobStore interface {
+	// Put stores data under name, replacing any blob of that name at once,
+	// so readers see either the old or the new data.
+	Put(ctx context.Context, name string, data []byte) error
+	// Open returns a reader of the blob stored under name and its size, or
+	// ErrNotFound.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, int64, error)
+	// Delete removes the blob stored under name. Removing a missing blob is
+	// not an error.
+	Delete(ctx context.Context, name string) error
+	// List returns the names of the stored blobs starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// URL returns a URL clients can fetch the blob stored under name from
+	// directly for expiry, or "" if the store does not serve clients.
+	URL(ctx context.Context, name string, expiry time.Duration) (string, error)
+}
+
+// readBlob returns the whole blob stored under name.
+func readBlob(ctx context.Context, blobs BlobStore, name string) ([]byte, error) {
+	r, _, err := blobs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Files is a BlobStore keeping blobs as files in a directory.
+type Files struct {
+	path string
+}
+
+// NewFiles returns a Files storing into the directory at path, creating it
+// if needed.
+func NewFiles(path string) (*Files, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("create archive directory: %w", err)
+	}
+	return &Files{path: path}, nil
+}
+
+// file returns the path of the named blob. Names never leave the
+// directory.
+func (f *Files) file(name string) string {
+	return filepath.Join(f.path, filepath.Base(name))
+}
+
+// Put atomically replaces the named file with data, by writing a temporary
+// file and renaming it into place.
+func (f *Files) Put(ctx context.Context, name string, data []byte) error {
+	name = filepath.Base(name)
+	tmp, err := os.CreateTemp(f.path, "."+name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod %s: %w", name, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), f.file(name)); err != nil {
+		return fmt.Errorf("rename %s: %w", name, err)
+	}
+	return nil
+}
+
+func (f *Files) Open(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	file, err := os.Open(f.file(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (f *Files) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(f.file(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the names of the files starting with prefix, leaving out
+// directories and temporary files.
+func (f *Files) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("read archive directory: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// URL returns "", since files are served through the server.
+func (f *Files) URL(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	return "", nil
+}
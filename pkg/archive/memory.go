@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"context"
+	"sync"
+
+	"flue-frontend/pkg/store"
+)
+
+// Memory is an ImageStore keeping images in memory, so they do not survive a
+// restart.
+type Memory struct {
+	indexed
+
+	mu     sync.Mutex
+	images map[string][]byte            // by hash, shared by identical images
+	thumbs map[string]map[string][]byte // by ID and variant
+}
+
+// NewMemory returns an empty Memory with its metadata kept in records, or
+// in memory too if records is nil.
+func NewMemory(records store.Store) *Memory {
+	if records == nil {
+		records = store.NewMemory()
+	}
+	return &Memory{
+		indexed: indexed{records},
+		images:  make(map[string][]byte),
+		thumbs:  make(map[string]map[string][]byte),
+	}
+}
+
+func (m *Memory) Put(ctx context.Context, id string, data []byte, meta store.Metadata) error {
+	meta.ID = id
+	meta.Size = int64(len(data))
+	meta.Hash = contentHash(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.images[meta.Hash]; !ok {
+		m.images[meta.Hash] = data
+	}
+	old, err := m.records.Get(ctx, id)
+	if err := m.records.Put(ctx, meta); err != nil {
+		return err
+	}
+	if err == nil && old.Hash != meta.Hash {
+		return m.release(ctx, old.Hash)
+	}
+	return nil
+}
+
+// release drops the image with the given hash once no image refers to it.
+// The caller must hold m.mu.
+func (m *Memory) release(ctx context.Context, hash string) error {
+	refs, err := references(ctx, m.records, hash)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		delete(m.images, hash)
+	}
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, id string) ([]byte, store.Metadata, error) {
+	meta, err := m.records.Get(ctx, id)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.images[meta.Hash]
+	if !ok {
+		return nil, store.Metadata{}, ErrNotFound
+	}
+	return data, meta, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err := m.records.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := m.records.Delete(ctx, id); err != nil {
+		return err
+	}
+	delete(m.thumbs, id)
+	return m.release(ctx, meta.Hash)
+}
+
+func (m *Memory) SetFavorite(ctx context.Context, id string, favorite bool) (store.Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err := m.records.Get(ctx, id)
+	if err != nil {
+		return store.Metadata{}, err
+	}
+	meta.Favorite = favorite
+	if err := m.records.Put(ctx, meta); err != nil {
+		return store.Metadata{}, err
+	}
+	return meta, nil
+}
+
+func (m *Memory) Thumbnail(ctx context.Context, id, variant string) ([]byte, error) {
+	if _, err := m.records.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.thumbs[id][variant]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *Memory) SaveThumbnail(ctx context.Context, id, variant string, data []byte) error {
+	if _, err := m.records.Get(ctx, id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.thumbs[id] == nil {
+		m.thumbs[id] = make(map[string][]byte)
+	}
+	m.thumbs[id][variant] = data
+	return nil
+}
@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config locates an S3 compatible bucket, such as one on AWS or MinIO.
+type S3Config struct {
+	// Endpoint is the URL of the service, such as https://s3.amazonaws.com
+	// or http://minio:9000.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the name of every object, to share a bucket.
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 is a BlobStore keeping blobs as objects in an S3 compatible bucket.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 returns an S3 storing into the configured bucket, after checking
+// that the bucket exists.
+func NewS3(ctx context.Context, cfg S3Config) (*S3, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("S3 endpoint %q is not an absolute HTTP URL", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("no S3 bucket configured")
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: u.Scheme == "https",
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create S3 client: %w", err)
+	}
+	ok, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("reach S3 bucket %s: %w", cfg.Bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("S3 bucket %s does not exist", cfg.Bucket)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+// key returns the object key of the named blob.
+func (s *S3) key(name string) string {
+	return s.prefix + path.Base(name)
+}
+
+// Put uploads data as the named object, which S3 replaces at once.
+func (s *S3) Put(ctx context.Context, name string, data []byte) error {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("download %s: %w", name, err)
+	}
+	// The object is only requested once read or examined.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, fmt.Errorf("download %s: %w", name, err)
+	}
+	return obj, info.Size, nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	// Removing a missing object succeeds.
+	if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("list S3 bucket %s: %w", s.bucket, obj.Err)
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return names, nil
+}
+
+// URL returns a presigned URL of the named object valid for expiry.
+func (s *S3) URL(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.key(name), expiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("presign %s: %w", name, err)
+	}
+	return u.String(), nil
+}
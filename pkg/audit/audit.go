@@ -0,0 +1,84 @@
+// Package audit appends a durable record of generations to a file, one JSON
+// object per line, separately from the operational log.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/params"
+)
+
+// Entry is the record of one generation.
+type Entry struct {
+	Time    time.Time     `json:"time"`
+	Client  string        `json:"client"`
+	Params  params.Params `json:"params"`
+	Outcome string        `json:"outcome"`
+	Error   string        `json:"error,omitempty"`
+	// GenTime is the generation time in seconds, for successful outcomes.
+	GenTime float64 `json:"gen_time,omitempty"`
+	// ImageID is the ID the image was archived under, if any.
+	ImageID      string `json:"image_id,omitempty"`
+	NSFW         bool   `json:"nsfw,omitempty"`
+	SafetyAction string `json:"safety_action,omitempty"`
+}
+
+// Log appends entries to a file. It is safe for concurrent use.
+type Log struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open opens the audit log at path for appending, creating it if needed.
+func Open(path string) (*Log, error) {
+	l := &Log{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen closes and reopens the file, so an external tool can rotate it by
+// renaming it first.
+func (l *Log) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// Record appends an entry as a single line and syncs it to disk.
+func (l *Log) Record(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(line); err != nil {
+		return fmt.Errorf("write audit entry: %w", err)
+	}
+	return l.f.Sync()
+}
+
+// Close closes the file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
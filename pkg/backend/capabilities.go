@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+)
+
+// capabilitiesPath is the Flue endpoint reporting supported parameter ranges.
+const capabilitiesPath = "/v1/capabilities"
+
+// ErrNoCapabilities is returned when no backend reports its capabilities.
+var ErrNoCapabilities = errors.New("backends do not report capabilities")
+
+// ErrCapabilitiesUnavailable is returned when every backend failed to answer
+// for its capabilities, so they are unknown for now.
+var ErrCapabilitiesUnavailable = errors.New("backend capabilities unavailable")
+
+// errNotReported is returned by capabilities when a backend answers but does
+// not implement the capabilities endpoint.
+var errNotReported = errors.New("backend does not report capabilities")
+
+// capabilities is the capabilities document of a backend. Ranges it omits
+// are nil.
+type capabilities struct {
+	Width    *params.Range[int]     `json:"width"`
+	Height   *params.Range[int]     `json:"height"`
+	Steps    *params.Range[int]     `json:"steps"`
+	Guidance *params.Range[float64] `json:"guidance"`
+
+	// backend is the URL of the backend reporting them.
+	backend string
+}
+
+// Capabilities queries every backend for its supported parameter ranges and
+// returns the ranges all reporting backends support. Ranges no backend
+// reports, or whose reports do not overlap, keep their fallback values.
+// Reported ranges that are empty or, for sizes and steps, not positive are
+// logged and ignored. If every backend failed to answer, it returns fallback
+// and ErrCapabilitiesUnavailable.
+func (c *Client) Capabilities(ctx context.Context, fallback params.Limits) (params.Limits, error) {
+	var reports []*capabilities
+	unavailable := 0
+	for _, b := range c.backends {
+		caps, err := c.capabilities(ctx, b)
+		if errors.Is(err, errNotReported) {
+			continue
+		} else if err != nil {
+			log.Warn("Failed to query backend capabilities", "backend", b.URL, "error", err)
+			unavailable++
+			continue
+		}
+		reports = append(reports, caps)
+	}
+	if len(reports) == 0 && unavailable > 0 && unavailable == len(c.backends) {
+		return fallback, ErrCapabilitiesUnavailable
+	}
+	if len(reports) == 0 {
+		return fallback, ErrNoCapabilities
+	}
+
+	return params.Limits{
+		Width:    intersect("width", fallback.Width, true, reports, func(c *capabilities) *params.Range[int] { return c.Width }),
+		Height:   intersect("height", fallback.Height, true, reports, func(c *capabilities) *params.Range[int] { return c.Height }),
+		Steps:    intersect("steps", fallback.Steps, true, reports, func(c *capabilities) *params.Range[int] { return c.Steps }),
+		Guidance: intersect("guidance", fallback.Guidance, false, reports, func(c *capabilities) *params.Range[float64] { return c.Guidance }),
+	}, nil
+}
+
+// intersect returns the intersection of the valid ranges field selects from
+// each report, or fallback if none of them reports one or the intersection
+// is empty. A range is valid if it is not empty and, if positive is set,
+// starts above zero.
+func intersect[T int | float64](name string, fallback params.Range[T], positive bool, reports []*capabilities, field func(*capabilities) *params.Range[T]) params.Range[T] {
+	var out *params.Range[T]
+	for _, caps := range reports {
+		r := field(caps)
+		if r == nil {
+			continue
+		}
+		if r.Empty() || positive && r.Min <= 0 {
+			log.Warn("Ignoring invalid backend capability", "backend", caps.backend, "param", name, "min", r.Min, "max", r.Max)
+			continue
+		}
+		if out == nil {
+			out = r
+			continue
+		}
+		narrowed := out.Intersect(*r)
+		out = &narrowed
+	}
+	if out == nil {
+		return fallback
+	}
+	if out.Empty() {
+		log.Warn("Backend capabilities do not overlap, keeping the configured range", "param", name, "min", fallback.Min, "max", fallback.Max)
+		return fallback
+	}
+	return *out
+}
+
+func (c *Client) capabilities(ctx context.Context, b *Backend) (*capabilities, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+capabilitiesPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req, nil)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("backend returned status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errNotReported
+	}
+
+	caps := capabilities{backend: b.URL}
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		return nil, fmt.Errorf("parse capabilities: %w", err)
+	}
+	return &caps, nil
+}
+
+// Ping checks that b answers HTTP requests. It requests the capabilities
+// endpoint, but any response below 500 counts since backends need not
+// implement it. Ping does not affect the breaker of b.
+func (c *Client) Ping(ctx context.Context, b *Backend) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+capabilitiesPath, nil)
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req, nil)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("backend returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// identity is the part of the capabilities document naming the running
+// backend instance.
+type identity struct {
+	Version  string `json:"version"`
+	Instance string `json:"instance"`
+}
+
+// Identity returns a string identifying the process serving b, built from
+// the version and instance it reports in its capabilities and its Server
+// header. It changes when the backend is redeployed or restarted, as far as
+// the backend reports it, and is empty if it reports nothing.
+func (c *Client) Identity(ctx context.Context, b *Backend) (string, error) {
+	id, server, err := c.identify(ctx, b)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{id.Version, id.Instance, server}
+	if strings.Join(parts, "") == "" {
+		return "", nil
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Version returns the version b reports in its capabilities, or an empty
+// string if it reports none.
+func (c *Client) Version(ctx context.Context, b *Backend) (string, error) {
+	id, _, err := c.identify(ctx, b)
+	return id.Version, err
+}
+
+// identify returns the identity b reports in its capabilities along with
+// the Server header of the response.
+func (c *Client) identify(ctx context.Context, b *Backend) (identity, string, error) {
+	var id identity
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+capabilitiesPath, nil)
+	if err != nil {
+		return id, "", err
+	}
+	c.setHeaders(req, nil)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return id, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return id, "", fmt.Errorf("backend returned status %d", resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Backends need not report an identity.
+		json.NewDecoder(resp.Body).Decode(&id)
+	}
+	return id, resp.Header.Get("Server"), nil
+}
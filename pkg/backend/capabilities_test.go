@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"flue-frontend/pkg/params"
+)
+
+func capabilitiesServer(t *testing.T, status int, body string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestCapabilitiesIgnoreInvalidRanges(t *testing.T) {
+	c := NewClient([]string{
+		capabilitiesServer(t, http.StatusOK, `{"width": {"min": 0, "max": 1024}, "height": {"min": 512, "max": 256}, "steps": {"min": 1, "max": 50}}`),
+		capabilitiesServer(t, http.StatusOK, `{"width": {"min": 128, "max": 768}, "steps": {"min": 60, "max": 80}}`),
+	}, 0, 0)
+	fallback := params.DefaultLimits()
+
+	limits, err := c.Capabilities(context.Background(), fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (params.Range[int]{Min: 128, Max: 768}); limits.Width != want {
+		t.Errorf("width = %v, want the valid report %v", limits.Width, want)
+	}
+	if limits.Height != fallback.Height {
+		t.Errorf("height = %v, want the fallback %v", limits.Height, fallback.Height)
+	}
+	if limits.Steps != fallback.Steps {
+		t.Errorf("steps = %v, want the fallback %v for disjoint reports", limits.Steps, fallback.Steps)
+	}
+}
+
+func TestCapabilitiesUnavailable(t *testing.T) {
+	c := NewClient([]string{capabilitiesServer(t, http.StatusServiceUnavailable, "")}, 0, 0)
+	if _, err := c.Capabilities(context.Background(), params.DefaultLimits()); !errors.Is(err, ErrCapabilitiesUnavailable) {
+		t.Errorf("failing backend: error %v, want %v", err, ErrCapabilitiesUnavailable)
+	}
+	c = NewClient([]string{capabilitiesServer(t, http.StatusNotFound, "")}, 0, 0)
+	if _, err := c.Capabilities(context.Background(), params.DefaultLimits()); !errors.Is(err, ErrNoCapabilities) {
+		t.Errorf("backend without capabilities: error %v, want %v", err, ErrNoCapabilities)
+	}
+}
@@ -0,0 +1,399 @@
+// Package backend implements the HTTP client used to talk to one or more
+// Flue generation servers.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"flue-frontend/pkg/metrics"
+	"flue-frontend/pkg/tracing"
+
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("flue-frontend/pkg/backend")
+
+// generationsPath is the Flue endpoint used for image generation.
+const generationsPath = "/v1/images/generations"
+
+// ErrNoBackends is returned when every configured backend has its circuit
+// breaker open.
+var ErrNoBackends = errors.New("no healthy backends available")
+
+// ErrResponseTooLarge is returned when a backend response exceeds the
+// client's size limit.
+var ErrResponseTooLarge = errors.New("backend response too large")
+
+// ErrTimeout is returned when a backend does not deliver its complete
+// response within the client's timeout.
+var ErrTimeout = errors.New("backend timed out")
+
+// Backend is a single Flue server along with its load and health state.
+type Backend struct {
+	URL     string
+	Breaker *Breaker
+
+	inFlight atomic.Int64
+}
+
+// InFlight returns the number of requests currently outstanding against b.
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
+}
+
+// record feeds the outcome of a request into the breaker of b.
+func (b *Backend) record(ctx context.Context, err error) {
+	switch {
+	case err == nil, isRejection(err):
+		b.Breaker.Success()
+	case ctx.Err() != nil:
+		b.Breaker.Abandon()
+	default:
+		b.Breaker.Failure(time.Now())
+	}
+	metrics.BackendCircuitState.WithLabelValues(b.URL).Set(float64(b.Breaker.State()))
+}
+
+// Client distributes generation requests across backends in round-robin
+// order, skipping backends whose circuit breaker is open.
+type Client struct {
+	HTTP *http.Client
+	// Timeout bounds each generation request including reading the whole
+	// response body, so a backend stalling mid-body cannot hold it forever.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// MaxResponseSize is the maximum number of bytes read from a response,
+	// or from each message of a streamed response. Zero means no limit.
+	MaxResponseSize int64
+	// Header holds static headers added to every backend request.
+	Header http.Header
+	// Signer, if set, signs every backend request.
+	Signer *Signer
+	// PayloadKeys renames the keys of generation payloads.
+	PayloadKeys PayloadKeys
+	// OnExchange, if set, is called after every generation request with
+	// the payload sent and the response received, for diagnosing requests
+	// a backend rejects. The payload includes the prompt.
+	OnExchange func(ctx context.Context, e Exchange)
+
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+// Exchange is a generation request sent to a backend and the response it
+// got.
+type Exchange struct {
+	Backend string
+	// Payload is the JSON body of the request.
+	Payload []byte
+	// Status is the status of the response, or zero without one, and
+	// Length the number of bytes of its body that were read.
+	Status   int
+	Length   int64
+	Duration time.Duration
+	Err      error
+}
+
+// NewClient returns a Client for the given backend base URLs. Each backend's
+// breaker opens after threshold consecutive failures and probes again after
+// cooldown.
+func NewClient(urls []string, threshold int, cooldown time.Duration) *Client {
+	backends := make([]*Backend, len(urls))
+	for i, u := range urls {
+		backends[i] = &Backend{
+			URL:     strings.TrimRight(u, "/"),
+			Breaker: &Breaker{Threshold: threshold, Cooldown: cooldown},
+		}
+	}
+	return &Client{
+		HTTP:     &http.Client{},
+		backends: backends,
+	}
+}
+
+// Backends returns the configured backends.
+func (c *Client) Backends() []*Backend {
+	return c.backends
+}
+
+// pick selects the next available backend in round-robin order.
+func (c *Client) pick() (*Backend, error) {
+	n := len(c.backends)
+	if n == 0 {
+		return nil, ErrNoBackends
+	}
+	now := time.Now()
+	start := c.next.Add(1) - 1
+	for i := 0; i < n; i++ {
+		b := c.backends[(start+uint64(i))%uint64(n)]
+		if b.Breaker.Allow(now) {
+			return b, nil
+		}
+	}
+	return nil, ErrNoBackends
+}
+
+// Progress is an intermediate update streamed by the backend, optionally
+// carrying a low-resolution base64 preview of the image so far.
+type Progress struct {
+	Step    int    `json:"step"`
+	Total   int    `json:"total"`
+	Preview string `json:"preview,omitempty"`
+}
+
+// ProgressFunc receives intermediate updates during a generation.
+type ProgressFunc func(Progress)
+
+// Generate sends payload to the next available backend and decodes its JSON
+// response. If the backend streams newline-delimited JSON, objects without
+// an image are reported to progress (which may be nil) and the object
+// carrying the image is returned.
+func (c *Client) Generate(ctx context.Context, payload any, progress ProgressFunc) (map[string]any, error) {
+	b, err := c.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	b.inFlight.Add(1)
+	metrics.BackendInFlight.WithLabelValues(b.URL).Inc()
+	defer func() {
+		b.inFlight.Add(-1)
+		metrics.BackendInFlight.WithLabelValues(b.URL).Dec()
+	}()
+
+	ctx, span := tracer.Start(ctx, "backend.generate", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("flue.backend", b.URL)))
+	reqCtx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	result, err := c.do(reqCtx, b, payload, progress)
+	err = timeoutError(ctx, reqCtx, err)
+	b.record(ctx, err)
+	if err != nil {
+		log.Warn("Backend request failed", "backend", b.URL, "error", err)
+	}
+	tracing.End(span, err)
+	return result, err
+}
+
+// withTimeout derives the context of a single backend request from ctx.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+// timeoutError reports err as ErrTimeout if the request context expired
+// while the caller's context did not.
+func timeoutError(ctx, reqCtx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+func (c *Client) do(ctx context.Context, b *Backend, payload any, progress ProgressFunc) (result map[string]any, err error) {
+	jsonData, err := json.Marshal(c.PayloadKeys.rename(payload))
+	if err != nil {
+		return nil, fmt.Errorf("encode payload: %w", err)
+	}
+	var resp *http.Response
+	var body *limitReader
+	if c.OnExchange != nil {
+		defer c.exchanged(ctx, b, jsonData, time.Now(), &resp, &body, &err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.URL+generationsPath, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	c.setHeaders(req, jsonData)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body = &limitReader{r: resp.Body, max: c.MaxResponseSize}
+	if resp.StatusCode < http.StatusInternalServerError && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		result, err := readStream(body, progress)
+		if err != nil {
+			return nil, err
+		}
+		return checkResult(resp.StatusCode, result)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	// Error responses need not be JSON; they still carry their status.
+	if err := json.Unmarshal(data, &result); err != nil {
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, &Error{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+	return checkResult(resp.StatusCode, result)
+}
+
+// readStream reads a stream of JSON objects, reporting progress updates until
+// the object carrying the images arrives. The size limit of r applies to each
+// object.
+func readStream(r *limitReader, progress ProgressFunc) (map[string]any, error) {
+	dec := json.NewDecoder(r)
+	for {
+		var msg map[string]any
+		r.reset()
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, ErrResponseTooLarge) {
+				return nil, err
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("stream ended without a result")
+			}
+			return nil, fmt.Errorf("parse stream: %w", err)
+		}
+		_, hasImage := msg["image"]
+		_, hasImages := msg["images"]
+		if hasImage || hasImages {
+			return msg, nil
+		}
+		if errorMessage(msg) != "" {
+			return msg, nil
+		}
+		if progress != nil {
+			step, _ := msg["step"].(float64)
+			total, _ := msg["total"].(float64)
+			preview, _ := msg["preview"].(string)
+			progress(Progress{Step: int(step), Total: int(total), Preview: preview})
+		}
+	}
+}
+
+// RawResponse is a backend response exactly as it was received.
+type RawResponse struct {
+	Backend string
+	Status  int
+	Body    []byte
+}
+
+// GenerateRaw sends payload to the next available backend and returns its
+// response without interpreting it. Only transport failures and server
+// errors count against the backend's breaker.
+func (c *Client) GenerateRaw(ctx context.Context, payload any) (*RawResponse, error) {
+	b, err := c.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	b.inFlight.Add(1)
+	metrics.BackendInFlight.WithLabelValues(b.URL).Inc()
+	defer func() {
+		b.inFlight.Add(-1)
+		metrics.BackendInFlight.WithLabelValues(b.URL).Dec()
+	}()
+
+	reqCtx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	raw, err := c.doRaw(reqCtx, b, payload)
+	err = timeoutError(ctx, reqCtx, err)
+	if err == nil && raw.Status >= http.StatusInternalServerError {
+		b.record(ctx, fmt.Errorf("backend returned status %d", raw.Status))
+	} else {
+		b.record(ctx, err)
+	}
+	return raw, err
+}
+
+func (c *Client) doRaw(ctx context.Context, b *Backend, payload any) (raw *RawResponse, err error) {
+	jsonData, err := json.Marshal(c.PayloadKeys.rename(payload))
+	if err != nil {
+		return nil, fmt.Errorf("encode payload: %w", err)
+	}
+	var resp *http.Response
+	var body *limitReader
+	if c.OnExchange != nil {
+		defer c.exchanged(ctx, b, jsonData, time.Now(), &resp, &body, &err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.URL+generationsPath, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	c.setHeaders(req, jsonData)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body = &limitReader{r: resp.Body, max: c.MaxResponseSize}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	return &RawResponse{Backend: b.URL, Status: resp.StatusCode, Body: data}, nil
+}
+
+// exchanged passes a finished request to OnExchange. It is deferred before
+// the response and the reader of its body exist, so it takes pointers to
+// them and to the request's error.
+func (c *Client) exchanged(ctx context.Context, b *Backend, payload []byte, start time.Time, resp **http.Response, body **limitReader, err *error) {
+	e := Exchange{Backend: b.URL, Payload: payload, Duration: time.Since(start), Err: *err}
+	if *resp != nil {
+		e.Status = (*resp).StatusCode
+	}
+	if *body != nil {
+		e.Length = (*body).total
+	}
+	c.OnExchange(ctx, e)
+}
+
+// limitReader fails with ErrResponseTooLarge once more than max bytes were
+// read since the last reset. A max of zero or less means no limit. It
+// counts all bytes read in total.
+type limitReader struct {
+	r     io.Reader
+	max   int64
+	n     int64
+	total int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.max <= 0 {
+		n, err := l.r.Read(p)
+		l.total += int64(n)
+		return n, err
+	}
+	if l.n > l.max {
+		return 0, ErrResponseTooLarge
+	}
+	if left := l.max - l.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	l.total += int64(n)
+	return n, err
+}
+
+func (l *limitReader) reset() {
+	l.n = 0
+}
@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoImage is returned when a backend response carries neither an image
+// nor an error.
+var ErrNoImage = errors.New("backend response has no image")
+
+// Error is an error a backend reports in its response.
+type Error struct {
+	// Status is the HTTP status of the response.
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("backend returned status %d: %s", e.Status, e.Message)
+}
+
+// Rejected reports whether the backend refused the request itself, such as
+// for an invalid parameter, rather than failing to serve it.
+func (e *Error) Rejected() bool {
+	return e.Status >= http.StatusBadRequest && e.Status < http.StatusInternalServerError
+}
+
+// isRejection reports whether err is a backend refusing a request, which
+// says nothing about the backend's health.
+func isRejection(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Rejected()
+}
+
+// checkResult returns the decoded response body of a generation, or the
+// error the backend reports in it.
+func checkResult(status int, result map[string]any) (map[string]any, error) {
+	if msg := errorMessage(result); msg != "" {
+		return nil, &Error{Status: status, Message: msg}
+	}
+	if status >= http.StatusBadRequest {
+		return nil, &Error{Status: status, Message: http.StatusText(status)}
+	}
+	if len(Images(result)) == 0 {
+		return nil, ErrNoImage
+	}
+	return result, nil
+}
+
+// Images returns the base64 encoded images of a generation response, taken
+// from its images array if it has one, or else its single image.
+func Images(result map[string]any) []string {
+	var images []string
+	if list, ok := result["images"].([]any); ok {
+		for _, v := range list {
+			if image, ok := v.(string); ok {
+				images = append(images, image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		if image, ok := result["image"].(string); ok {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// errorMessage returns the message of the error or detail field of a
+// response body, if any. FastAPI style validation details are joined into
+// one message naming each invalid field.
+func errorMessage(result map[string]any) string {
+	for _, key := range []string{"error", "detail"} {
+		switch v := result[key].(type) {
+		case string:
+			return v
+		case map[string]any:
+			if msg, ok := v["message"].(string); ok {
+				return msg
+			}
+		case []any:
+			var msgs []string
+			for _, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					msgs = append(msgs, validationMessage(m))
+				}
+			}
+			if len(msgs) > 0 {
+				return strings.Join(msgs, "; ")
+			}
+		}
+	}
+	return ""
+}
+
+// validationMessage formats one FastAPI validation error as "field: msg".
+func validationMessage(m map[string]any) string {
+	msg, _ := m["msg"].(string)
+	loc, _ := m["loc"].([]any)
+	if len(loc) == 0 {
+		return msg
+	}
+	return fmt.Sprint(loc[len(loc)-1]) + ": " + msg
+}
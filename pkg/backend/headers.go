@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// hopByHop lists the headers that apply to a single connection and must
+// never be passed on to a backend.
+var hopByHop = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+}
+
+// IsHopByHop reports whether the named header must not be forwarded.
+func IsHopByHop(name string) bool {
+	return hopByHop[http.CanonicalHeaderKey(name)]
+}
+
+type headersKey struct{}
+
+// WithHeaders returns a context carrying headers to add to the backend
+// requests made with it, such as ones forwarded from the client.
+func WithHeaders(ctx context.Context, h http.Header) context.Context {
+	if len(h) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+// setHeaders adds the headers carried by the request context and the
+// client's static headers to req, skipping hop-by-hop headers and any named
+// by the Connection header, and the trace context of the request. Static
+// headers come last and so replace forwarded ones of the same name, which a
+// client could otherwise use to pose as another tenant. With a Signer, the
+// request, whose body is body, is signed last.
+func (c *Client) setHeaders(req *http.Request, body []byte) {
+	ctxHeader, _ := req.Context().Value(headersKey{}).(http.Header)
+	for _, h := range []http.Header{ctxHeader, c.Header} {
+		connection := make(map[string]bool)
+		for _, v := range h.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				connection[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+			}
+		}
+		for name, values := range h {
+			if IsHopByHop(name) || connection[http.CanonicalHeaderKey(name)] {
+				continue
+			}
+			req.Header.Del(name)
+			for _, v := range values {
+				req.Header.Add(name, v)
+			}
+		}
+	}
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	if c.Signer != nil {
+		c.Signer.Sign(req, body)
+	}
+}
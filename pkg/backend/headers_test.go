@@ -0,0 +1,28 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestStaticHeadersReplaceForwarded(t *testing.T) {
+	c := NewClient([]string{"http://backend"}, 0, 0)
+	c.Header = http.Header{"X-Tenant": {"operator"}}
+	forwarded := http.Header{
+		"X-Tenant":     {"spoofed"},
+		"X-Request-Id": {"abc"},
+	}
+	req, err := http.NewRequestWithContext(WithHeaders(context.Background(), forwarded), http.MethodPost, "http://backend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setHeaders(req, nil)
+
+	if got := req.Header.Values("X-Tenant"); len(got) != 1 || got[0] != "operator" {
+		t.Errorf("X-Tenant = %q, want only %q", got, "operator")
+	}
+	if got := req.Header.Get("X-Request-Id"); got != "abc" {
+		t.Errorf("X-Request-Id = %q, want %q", got, "abc")
+	}
+}
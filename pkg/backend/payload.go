@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"fmt"
+	"slices"
+)
+
+// PayloadKeys renames the keys of generation payloads for backend versions
+// expecting other names, such as num_inference_steps for steps. Keys it does
+// not name are sent unchanged.
+type PayloadKeys map[string]string
+
+// NewPayloadKeys returns the renaming of keys to names, checking that every
+// key is one of known, so a misspelled key is not silently ignored, that no
+// name is empty and that no two keys share a name.
+func NewPayloadKeys(names map[string]string, known []string) (PayloadKeys, error) {
+	seen := make(map[string]string, len(names))
+	for key, name := range names {
+		if !slices.Contains(known, key) {
+			return nil, fmt.Errorf("unknown payload key %s, expected one of %v", key, known)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("payload key %s is renamed to an empty name", key)
+		}
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("payload keys %s and %s are both renamed to %s", other, key, name)
+		}
+		seen[name] = key
+	}
+	return PayloadKeys(names), nil
+}
+
+// rename returns payload with its keys renamed. Payloads other than JSON
+// objects are returned unchanged.
+func (k PayloadKeys) rename(payload any) any {
+	fields, ok := payload.(map[string]any)
+	if !ok || len(k) == 0 {
+		return payload
+	}
+	renamed := make(map[string]any, len(fields))
+	for key, v := range fields {
+		if name, ok := k[key]; ok {
+			key = name
+		}
+		renamed[key] = v
+	}
+	return renamed
+}
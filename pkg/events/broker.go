@@ -0,0 +1,112 @@
+// Package events fans out server-sent events to subscribers by topic.
+package events
+
+import "sync"
+
+// Event is a single server-sent event.
+type Event struct {
+	Name string
+	Data string
+}
+
+// topic holds the subscribers of one topic and the last event published to
+// it, which is replayed to late subscribers.
+type topic struct {
+	subs map[chan Event]struct{}
+	last *Event
+}
+
+// Broker delivers published events to every subscriber of a topic. Slow
+// subscribers drop events rather than blocking publishers.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]*topic
+}
+
+// NewBroker returns an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{topics: make(map[string]*topic)}
+}
+
+func (b *Broker) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{subs: make(map[chan Event]struct{})}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Subscribe returns a channel receiving events published to name, starting
+// with the most recent one if any, so subscribers racing the publisher do not
+// miss its state. The channel is closed when the topic is closed. The
+// returned function unsubscribes and must be called.
+func (b *Broker) Subscribe(name string) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, 16)
+	t := b.topic(name)
+	if t.last != nil {
+		ch <- *t.last
+	}
+	t.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := t.subs[ch]; !ok {
+			return
+		}
+		delete(t.subs, ch)
+		close(ch)
+		if len(t.subs) == 0 && t.last == nil && b.topics[name] == t {
+			delete(b.topics, name)
+		}
+	}
+}
+
+// Publish sends ev to every current subscriber of name.
+func (b *Broker) Publish(name string, ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(name)
+	t.last = &ev
+	for ch := range t.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Close publishes a final event, if non-nil, closes all subscriptions to name
+// and forgets the topic.
+func (b *Broker) Close(name string, final *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		return
+	}
+	for ch := range t.subs {
+		if final != nil {
+			// Make room for the final event by dropping the oldest
+			// undelivered one if the subscriber is behind.
+			select {
+			case ch <- *final:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- *final
+			}
+		}
+		close(ch)
+	}
+	t.subs = nil
+	delete(b.topics, name)
+}
@@ -0,0 +1,173 @@
+// Package i18n translates user-facing strings. Messages have stable IDs,
+// such as width_is_invalid: the English catalog maps each ID to its text and
+// the other catalogs map IDs to translations. Code and templates pass the
+// English text, which finds the ID through the English catalog, so rewording
+// a message there and at its uses keeps its translations. The English text
+// doubles as the fallback when a locale lacks a translation.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// Default is the locale of the English source text of messages.
+const Default = "en"
+
+//go:embed locales/*.json
+var files embed.FS
+
+// Catalog holds the translations of every supported locale.
+type Catalog struct {
+	// messages maps each locale, the default included, to its messages by
+	// ID.
+	messages map[string]map[string]string
+	// ids maps the English text of each message to its ID.
+	ids     map[string]string
+	locales []string
+
+	// missing records the messages found lacking a translation, keyed by
+	// locale and message, so each is logged once.
+	missing sync.Map
+}
+
+// Load reads the embedded message catalogs, one JSON object per locale
+// mapping message IDs to their text. Every ID must be in the English
+// catalog, and each English text may have only one ID.
+func Load() (*Catalog, error) {
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{
+		messages: make(map[string]map[string]string),
+		locales:  []string{Default},
+	}
+	for _, e := range entries {
+		data, err := files.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", e.Name(), err)
+		}
+		locale := strings.TrimSuffix(e.Name(), path.Ext(e.Name()))
+		c.messages[locale] = messages
+		if locale != Default {
+			c.locales = append(c.locales, locale)
+		}
+	}
+
+	english, ok := c.messages[Default]
+	if !ok {
+		return nil, fmt.Errorf("no catalog for %s", Default)
+	}
+	c.ids = make(map[string]string, len(english))
+	for id, text := range english {
+		if other, ok := c.ids[text]; ok {
+			return nil, fmt.Errorf("%s.json: messages %s and %s have the same text %q", Default, min(id, other), max(id, other), text)
+		}
+		c.ids[text] = id
+	}
+	for locale, messages := range c.messages {
+		for id := range messages {
+			if _, ok := english[id]; !ok {
+				return nil, fmt.Errorf("%s.json: unknown message ID %s", locale, id)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Locales returns the supported locales, the default first.
+func (c *Catalog) Locales() []string {
+	return c.locales
+}
+
+// Supports reports whether locale has a catalog.
+func (c *Catalog) Supports(locale string) bool {
+	return slices.Contains(c.locales, locale)
+}
+
+// Translate returns the translation of a message in locale, formatted with
+// args like fmt.Sprintf if any are given. The message is named by its
+// English text or its ID. Messages a supported locale lacks fall back to
+// English, and unknown messages are used as they are; the first use of each
+// is logged.
+func (c *Catalog) Translate(locale, message string, args ...any) string {
+	id, known := c.ids[message]
+	if !known {
+		_, known = c.messages[Default][message]
+		id = message
+	}
+	msg := message
+	switch {
+	case !known:
+		c.logMissing("Unknown message", Default, message)
+	case locale == Default:
+		msg = c.messages[Default][id]
+	default:
+		msg = c.messages[locale][id]
+		if msg == "" {
+			if _, supported := c.messages[locale]; supported {
+				c.logMissing("Missing translation", locale, id)
+			}
+			msg = c.messages[Default][id]
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// logMissing logs msg about the message key of locale, once per key.
+func (c *Catalog) logMissing(msg, locale, key string) {
+	if _, logged := c.missing.LoadOrStore(locale+"\x00"+key, true); !logged {
+		log.Warn(msg, "locale", locale, "key", key)
+	}
+}
+
+// Match picks the supported locale best matching an Accept-Language header,
+// falling back to Default.
+func (c *Catalog) Match(acceptLanguage string) string {
+	type candidate struct {
+		tag string
+		q   float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag != "" && q > 0 {
+			candidates = append(candidates, candidate{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, cand := range candidates {
+		base, _, _ := strings.Cut(cand.tag, "-")
+		if c.Supports(cand.tag) {
+			return cand.tag
+		}
+		if c.Supports(base) {
+			return base
+		}
+	}
+	return Default
+}
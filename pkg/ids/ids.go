@@ -0,0 +1,19 @@
+// Package ids generates short random identifiers.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// New returns a short random identifier safe for use in URLs and file names.
+func New() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.ToLower(encoding.EncodeToString(b))
+}
@@ -0,0 +1,99 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Blur returns a blurred copy of img approximating a Gaussian blur with
+// standard deviation sigma, using three successive box blurs.
+func Blur(img image.Image, sigma float64) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	if sigma <= 0 {
+		return dst
+	}
+
+	tmp := make([]uint8, len(dst.Pix))
+	for _, r := range boxRadii(sigma, 3) {
+		boxBlurH(dst.Pix, tmp, dst.Stride, b.Dx(), b.Dy(), r)
+		boxBlurV(tmp, dst.Pix, dst.Stride, b.Dx(), b.Dy(), r)
+	}
+	return dst
+}
+
+// boxRadii returns the radii of n box blurs whose combination approximates a
+// Gaussian with the given sigma.
+func boxRadii(sigma float64, n int) []int {
+	// Ideal box width for n passes, rounded down to the nearest odd width.
+	ideal := int(math.Sqrt(12*sigma*sigma/float64(n) + 1))
+	lower := ideal
+	if lower%2 == 0 {
+		lower--
+	}
+	upper := lower + 2
+
+	m := int((12*sigma*sigma-float64(n*lower*lower)-float64(4*n*lower)-float64(3*n))/float64(-4*lower-4) + 0.5)
+	radii := make([]int, n)
+	for i := range radii {
+		w := upper
+		if i < m {
+			w = lower
+		}
+		radii[i] = (w - 1) / 2
+	}
+	return radii
+}
+
+// boxBlurH blurs each row of src into dst with a box of the given radius.
+func boxBlurH(src, dst []uint8, stride, w, h, r int) {
+	if r < 1 {
+		copy(dst, src)
+		return
+	}
+	div := 2*r + 1
+	for y := 0; y < h; y++ {
+		row := y * stride
+		for c := 0; c < 4; c++ {
+			at := func(x int) int {
+				x = min(max(x, 0), w-1)
+				return int(src[row+x*4+c])
+			}
+			sum := 0
+			for x := -r; x <= r; x++ {
+				sum += at(x)
+			}
+			for x := 0; x < w; x++ {
+				dst[row+x*4+c] = uint8(sum / div)
+				sum += at(x+r+1) - at(x-r)
+			}
+		}
+	}
+}
+
+// boxBlurV blurs each column of src into dst with a box of the given radius.
+func boxBlurV(src, dst []uint8, stride, w, h, r int) {
+	if r < 1 {
+		copy(dst, src)
+		return
+	}
+	div := 2*r + 1
+	for x := 0; x < w; x++ {
+		for c := 0; c < 4; c++ {
+			at := func(y int) int {
+				y = min(max(y, 0), h-1)
+				return int(src[y*stride+x*4+c])
+			}
+			sum := 0
+			for y := -r; y <= r; y++ {
+				sum += at(y)
+			}
+			for y := 0; y < h; y++ {
+				dst[y*stride+x*4+c] = uint8(sum / div)
+				sum += at(y+r+1) - at(y-r)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package imaging converts generated images between output formats.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	_ "golang.org/x/image/webp" // register the WebP decoder
+)
+
+// Format is an output image format.
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+	WebP Format = "webp"
+)
+
+// ErrUnsupportedFormat is returned when an encoder for a format is not
+// available in this build.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ParseFormat parses a format name, accepting "jpg" as an alias for JPEG.
+// An empty name selects PNG.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "png":
+		return PNG, nil
+	case "jpeg", "jpg":
+		return JPEG, nil
+	case "webp":
+		return WebP, nil
+	}
+	return "", fmt.Errorf("unknown format: %s", name)
+}
+
+// Supported reports whether this build can encode images in f. WebP needs
+// cgo and the "webp" build tag.
+func (f Format) Supported() bool {
+	return f != WebP || webpEncoder
+}
+
+// SupportedFormats returns the formats this build can encode images in.
+func SupportedFormats() []Format {
+	var formats []Format
+	for _, f := range []Format{PNG, JPEG, WebP} {
+		if f.Supported() {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// MIMEType returns the media type of images encoded in f.
+func (f Format) MIMEType() string {
+	switch f {
+	case JPEG:
+		return "image/jpeg"
+	case WebP:
+		return "image/webp"
+	}
+	return "image/png"
+}
+
+// Transcode re-encodes the PNG image in src to the format f at the given
+// quality (1-100, ignored for PNG). PNG output is returned unchanged so any
+// metadata chunks in src are preserved; the lossy formats carry pixel data
+// only.
+func Transcode(src []byte, f Format, quality int) ([]byte, error) {
+	if f == PNG {
+		return src, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("decode png: %w", err)
+	}
+	return Encode(img, f, quality)
+}
+
+// Lossy reports whether f discards image data and honors a quality setting.
+func (f Format) Lossy() bool {
+	return f == JPEG || f == WebP
+}
+
+// Decode decodes an image in any of the supported formats.
+func Decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Encode encodes img in the format f. The quality (1-100) applies to lossy
+// formats only.
+func Encode(img image.Image, f Format, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	switch f {
+	case PNG:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("encode png: %w", err)
+		}
+	case JPEG:
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("encode jpeg: %w", err)
+		}
+	case WebP:
+		if err := encodeWebP(&buf, img, quality); err != nil {
+			return nil, fmt.Errorf("encode webp: %w", err)
+		}
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	return buf.Bytes(), nil
+}
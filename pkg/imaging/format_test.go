@@ -0,0 +1,48 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testImage returns a detailed image, whose encoded size depends on the
+// quality of lossy formats.
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 13), uint8((x ^ y) * 5), 255})
+		}
+	}
+	return img
+}
+
+func TestEncodeQuality(t *testing.T) {
+	img := testImage(128, 128)
+	for _, f := range []Format{JPEG, WebP} {
+		t.Run(string(f), func(t *testing.T) {
+			if !f.Supported() {
+				if _, err := Encode(img, f, 50); !errors.Is(err, ErrUnsupportedFormat) {
+					t.Errorf("Encode in a build without %s = %v, want %v", f, err, ErrUnsupportedFormat)
+				}
+				t.Skipf("this build cannot encode %s", f)
+			}
+			prev := 0
+			for _, quality := range []int{1, 25, 50, 75, 100} {
+				data, err := Encode(img, f, quality)
+				if err != nil {
+					t.Fatalf("quality %d: %v", quality, err)
+				}
+				if _, err := Decode(data); err != nil {
+					t.Errorf("quality %d: output does not decode: %v", quality, err)
+				}
+				if len(data) <= prev {
+					t.Errorf("quality %d gave %d bytes, no more than %d at the quality before", quality, len(data), prev)
+				}
+				prev = len(data)
+			}
+		})
+	}
+}
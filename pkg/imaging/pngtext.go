@@ -0,0 +1,176 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf8"
+)
+
+// pngSignature starts every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// TextChunk is a keyword and text pair stored in a PNG text chunk.
+type TextChunk struct {
+	Key  string
+	Text string
+}
+
+// AddPNGText inserts text chunks right after the IHDR chunk of the PNG image
+// in src, leaving the image data untouched. ASCII text is stored in tEXt
+// chunks and other text in uncompressed iTXt chunks. Keys must be 1 to 79
+// printable ASCII characters.
+func AddPNGText(src []byte, chunks []TextChunk) ([]byte, error) {
+	if !bytes.HasPrefix(src, pngSignature) {
+		return nil, errors.New("not a PNG image")
+	}
+	// IHDR is always the first chunk and 13 bytes long, so it ends after
+	// its length, type, data and CRC.
+	ihdrEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if len(src) < ihdrEnd || string(src[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, errors.New("PNG image does not start with IHDR")
+	}
+
+	var extra bytes.Buffer
+	for _, c := range chunks {
+		if len(c.Key) == 0 || len(c.Key) > 79 {
+			return nil, fmt.Errorf("PNG text key %q must be 1 to 79 characters", c.Key)
+		}
+		for i := 0; i < len(c.Key); i++ {
+			if c.Key[i] < 0x20 || c.Key[i] > 0x7e {
+				return nil, fmt.Errorf("PNG text key %q has a character other than printable ASCII", c.Key)
+			}
+		}
+		if isASCII(c.Text) {
+			writeChunk(&extra, "tEXt", []byte(c.Key+"\x00"+c.Text))
+			continue
+		}
+		if !utf8.ValidString(c.Text) {
+			return nil, fmt.Errorf("PNG text %q is not valid UTF-8", c.Key)
+		}
+		// Keyword, then no compression, no language and no translated
+		// keyword.
+		writeChunk(&extra, "iTXt", []byte(c.Key+"\x00\x00\x00\x00\x00"+c.Text))
+	}
+
+	out := make([]byte, 0, len(src)+extra.Len())
+	out = append(out, src[:ihdrEnd]...)
+	out = append(out, extra.Bytes()...)
+	return append(out, src[ihdrEnd:]...), nil
+}
+
+// maxPNGText is the largest decompressed text read from a compressed chunk.
+const maxPNGText = 1 << 20
+
+// PNGText returns the tEXt, zTXt and iTXt chunks of the PNG image in src, in
+// file order, with their text converted to UTF-8. Malformed text chunks are
+// skipped; only a malformed image is an error.
+func PNGText(src []byte) ([]TextChunk, error) {
+	if !bytes.HasPrefix(src, pngSignature) {
+		return nil, errors.New("not a PNG image")
+	}
+	var chunks []TextChunk
+	for rest := src[len(pngSignature):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(n) > uint64(len(rest)-12) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		typ, data := string(rest[4:8]), rest[8:8+n]
+		rest = rest[12+n:]
+		if typ == "IEND" {
+			break
+		}
+		key, body, ok := bytes.Cut(data, []byte{0})
+		if !ok || len(key) == 0 {
+			continue
+		}
+		switch typ {
+		case "tEXt":
+			chunks = append(chunks, TextChunk{Key: latin1(key), Text: latin1(body)})
+		case "zTXt":
+			// A compression method byte, always zlib, precedes the text.
+			if len(body) == 0 {
+				continue
+			}
+			if text, err := inflate(body[1:]); err == nil {
+				chunks = append(chunks, TextChunk{Key: latin1(key), Text: latin1(text)})
+			}
+		case "iTXt":
+			// Compression flag and method, then language tag and translated
+			// keyword, each ending in a zero byte.
+			if len(body) < 2 {
+				continue
+			}
+			compressed := body[0] == 1
+			parts := bytes.SplitN(body[2:], []byte{0}, 3)
+			if len(parts) < 3 {
+				continue
+			}
+			text := parts[2]
+			if compressed {
+				var err error
+				if text, err = inflate(text); err != nil {
+					continue
+				}
+			}
+			if utf8.Valid(text) {
+				chunks = append(chunks, TextChunk{Key: latin1(key), Text: string(text)})
+			}
+		}
+	}
+	return chunks, nil
+}
+
+// inflate decompresses zlib data of up to maxPNGText bytes.
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	text, err := io.ReadAll(io.LimitReader(r, maxPNGText+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(text) > maxPNGText {
+		return nil, errors.New("PNG text is too large")
+	}
+	return text, nil
+}
+
+// latin1 converts ISO 8859-1 text, which tEXt and zTXt chunks hold, to
+// UTF-8.
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// writeChunk appends a PNG chunk of the given type and data to buf.
+func writeChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package imaging
+
+import (
+	"bytes"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPNGTextRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(16, 16)); err != nil {
+		t.Fatal(err)
+	}
+	chunks := []TextChunk{
+		{Key: "parameters", Text: "a lighthouse at dusk\nSteps: 4, CFG scale: 3.5, Seed: 42, Size: 16x16"},
+		{Key: "Software", Text: "Flue Frontend"},
+		// Text beyond ASCII goes in an iTXt chunk.
+		{Key: "Comment", Text: "ein Leuchtturm in der Dämmerung, 灯台"},
+	}
+	out, err := AddPNGText(buf.Bytes(), chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("tEXtparameters\x00")) {
+		t.Error("ASCII recipe is not stored in a tEXt chunk")
+	}
+	if !bytes.Contains(out, []byte("iTXtComment\x00")) {
+		t.Error("non-ASCII text is not stored in an iTXt chunk")
+	}
+
+	got, err := PNGText(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, chunks) {
+		t.Errorf("PNGText = %q, want %q", got, chunks)
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("image with text chunks does not decode: %v", err)
+	}
+}
+
+func TestAddPNGTextRejects(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]TextChunk{
+		"empty key":         {Key: "", Text: "x"},
+		"long key":          {Key: strings.Repeat("k", 80), Text: "x"},
+		"non-printable key": {Key: "a\nb", Text: "x"},
+		"invalid UTF-8":     {Key: "Comment", Text: "\xff\xfe"},
+	} {
+		if _, err := AddPNGText(buf.Bytes(), []TextChunk{c}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := AddPNGText([]byte("GIF89a"), nil); err == nil {
+		t.Error("no error for an image other than PNG")
+	}
+}
@@ -0,0 +1,20 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Tile returns img repeated cols times horizontally and rows times
+// vertically, for judging how well a texture's edges line up.
+func Tile(img image.Image, cols, rows int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx()*cols, b.Dy()*rows))
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r := image.Rect(x*b.Dx(), y*b.Dy(), (x+1)*b.Dx(), (y+1)*b.Dy())
+			draw.Draw(dst, r, img, b.Min, draw.Src)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,19 @@
+//go:build webp && cgo
+
+package imaging
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// webpEncoder reports whether this build can encode WebP.
+const webpEncoder = true
+
+// encodeWebP encodes img as WebP using libwebp. It is only available when
+// building with cgo and the "webp" build tag.
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+}
@@ -0,0 +1,17 @@
+//go:build !(webp && cgo)
+
+package imaging
+
+import (
+	"image"
+	"io"
+)
+
+// webpEncoder reports whether this build can encode WebP.
+const webpEncoder = false
+
+// encodeWebP reports that WebP output is unavailable. Build with cgo and the
+// "webp" build tag to enable it.
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return ErrUnsupportedFormat
+}
@@ -0,0 +1,392 @@
+// Package jobs tracks asynchronous generation jobs.
+package jobs
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/ids"
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+)
+
+// Status is the lifecycle state of a job.
+type Status string
+
+const (
+	Scheduled Status = "scheduled"
+	Queued    Status = "queued"
+	Running   Status = "running"
+	Done      Status = "done"
+	Failed    Status = "failed"
+	Canceled  Status = "canceled"
+)
+
+// Finished reports whether s is a terminal state.
+func (s Status) Finished() bool {
+	return s == Done || s == Failed || s == Canceled
+}
+
+// Job is a snapshot of an asynchronous generation.
+type Job struct {
+	ID       string        `json:"id"`
+	Status   Status        `json:"status"`
+	Position int           `json:"position,omitempty"`
+	Params   params.Params `json:"params"`
+
+	// ETA is the approximate number of seconds until a queued job starts,
+	// predicted from recent generations, or zero if unknown.
+	ETA float64 `json:"eta_seconds,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Client is the IP of the client that submitted the job, and Usage its
+	// current generation counts, filled in when the job is reported.
+	Client string `json:"-"`
+	Usage  *Usage `json:"client_usage,omitempty"`
+	// Owner is the session that submitted the job, if sessions are in use.
+	Owner string `json:"-"`
+
+	// Batch is the ID of the batch the job was submitted in, if any.
+	Batch string `json:"batch,omitempty"`
+	// RunAt is when a scheduled job moves to the queue.
+	RunAt *time.Time `json:"run_at,omitempty"`
+
+	CanceledBy string     `json:"canceled_by,omitempty"`
+	CanceledAt *time.Time `json:"canceled_at,omitempty"`
+
+	Error  string `json:"error,omitempty"`
+	Result any    `json:"result,omitempty"`
+}
+
+// Usage is how many generations a client has running and queued, along with
+// its limits. Zero limits are unlimited.
+type Usage struct {
+	Running    int `json:"running"`
+	Queued     int `json:"queued"`
+	MaxRunning int `json:"max_running"`
+	MaxQueued  int `json:"max_queued"`
+}
+
+// Manager holds jobs in memory and writes every change through to its
+// store. Finished jobs can be retrieved until they are older than TTL, and
+// are listed until they are older than History, after which they are
+// forgotten.
+type Manager struct {
+	TTL time.Duration
+	// History is how long finished jobs are kept for listings. Jobs are
+	// always kept for at least TTL.
+	History time.Duration
+
+	store   Store
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+}
+
+// NewManager returns an empty Manager keeping finished jobs for ttl and
+// persisting them to store, which may be nil to keep jobs in memory only.
+func NewManager(ttl time.Duration, store Store) *Manager {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Manager{
+		TTL:     ttl,
+		store:   store,
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// restartError is recorded on jobs that were running when the server
+// stopped.
+const restartError = "Interrupted by a server restart, please resubmit"
+
+// Restore loads the jobs of a previous run from the store. Jobs that were
+// running are marked as failed, since their generation was lost. Scheduled
+// and queued jobs are returned oldest first, each with the context governing
+// it, so the caller can schedule or enqueue them again.
+func (m *Manager) Restore() ([]Job, []context.Context, error) {
+	stored, err := m.store.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.SortFunc(stored, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var pending []Job
+	var ctxs []context.Context
+	for i := range stored {
+		j := &stored[i]
+		switch j.Status {
+		case Running:
+			j.Status = Failed
+			j.Error = restartError
+			j.FinishedAt = &now
+			m.save(j)
+		case Scheduled, Queued:
+			ctx, cancel := context.WithCancel(context.Background())
+			m.cancels[j.ID] = cancel
+			pending = append(pending, *j)
+			ctxs = append(ctxs, ctx)
+		}
+		m.jobs[j.ID] = j
+	}
+	m.prune(now)
+	return pending, ctxs, nil
+}
+
+// save writes a job to the store. It must be called with m.mu held.
+func (m *Manager) save(j *Job) {
+	if err := m.store.Save(*j); err != nil {
+		log.Error("Failed to persist job", "job", j.ID, "error", err)
+	}
+}
+
+// forget removes a job from memory and the store. It must be called with
+// m.mu held.
+func (m *Manager) forget(id string) {
+	delete(m.jobs, id)
+	if err := m.store.Delete(id); err != nil {
+		log.Error("Failed to delete persisted job", "job", id, "error", err)
+	}
+}
+
+// Add registers a new job with the parameters, client, batch and run time
+// of j. It is scheduled if j has a run time and queued otherwise. The
+// returned context is canceled when the job is canceled or finishes, and
+// should govern all work on it.
+func (m *Manager) Add(j Job) (Job, context.Context) {
+	now := time.Now()
+	j.ID = ids.New()
+	j.Status = Queued
+	if j.RunAt != nil {
+		j.Status = Scheduled
+	}
+	j.CreatedAt = now
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+	m.jobs[j.ID] = &j
+	m.cancels[j.ID] = cancel
+	m.save(&j)
+	return j, ctx
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.prune(now)
+	j, ok := m.jobs[id]
+	if !ok || m.expired(j, now) {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Batch returns the jobs of a batch in submission order.
+func (m *Manager) Batch(id string) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.prune(now)
+	var batch []Job
+	for _, j := range m.jobs {
+		if j.Batch == id && !m.expired(j, now) {
+			batch = append(batch, *j)
+		}
+	}
+	slices.SortFunc(batch, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return batch
+}
+
+// Update applies fn to the job with the given ID, persists it and returns
+// the result.
+func (m *Manager) Update(id string, fn func(*Job)) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	fn(j)
+	m.save(j)
+	return *j, true
+}
+
+// SetPosition records the queue position and estimated wait of a queued job.
+// Being transient, they are not persisted.
+func (m *Manager) SetPosition(id string, position int, eta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok && j.Status == Queued {
+		j.Position = position
+		j.ETA = eta
+	}
+}
+
+// Activate moves a scheduled job to the queue. It reports whether the job
+// was still scheduled.
+func (m *Manager) Activate(id string) bool {
+	activated := false
+	m.Update(id, func(j *Job) {
+		if j.Status == Scheduled {
+			j.Status = Queued
+			activated = true
+		}
+	})
+	return activated
+}
+
+// Start marks a queued job as running.
+func (m *Manager) Start(id string) (Job, bool) {
+	return m.Update(id, func(j *Job) {
+		if j.Status != Queued {
+			return
+		}
+		now := time.Now()
+		j.Status = Running
+		j.Position = 0
+		j.ETA = 0
+		j.StartedAt = &now
+	})
+}
+
+// Finish marks a job as done with result, or failed if err is non-nil. A
+// canceled job keeps its state.
+func (m *Manager) Finish(id string, result any, err error) (Job, bool) {
+	m.mu.Lock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.mu.Unlock()
+
+	return m.Update(id, func(j *Job) {
+		if j.Status.Finished() {
+			return
+		}
+		now := time.Now()
+		j.FinishedAt = &now
+		j.Position = 0
+		j.ETA = 0
+		if err != nil {
+			j.Status = Failed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = Done
+		j.Result = result
+	})
+}
+
+// Remove forgets a job, canceling its context.
+func (m *Manager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.forget(id)
+}
+
+// Cancel marks an unfinished job as canceled by the given actor and cancels
+// its context. Canceling a finished job changes nothing. It returns the
+// resulting job state.
+func (m *Manager) Cancel(id, by string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	if j.Status.Finished() {
+		return *j, true
+	}
+
+	now := time.Now()
+	j.Status = Canceled
+	j.Position = 0
+	j.ETA = 0
+	j.CanceledBy = by
+	j.CanceledAt = &now
+	j.FinishedAt = &now
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.save(j)
+	return *j, true
+}
+
+// Abort fails an unfinished job with the given reason and cancels its
+// context, as when an operator force-cancels it. Aborting a finished job
+// changes nothing. It returns the resulting job state.
+func (m *Manager) Abort(id, reason string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	if j.Status.Finished() {
+		return *j, true
+	}
+
+	now := time.Now()
+	j.Status = Failed
+	j.Error = reason
+	j.Position = 0
+	j.ETA = 0
+	j.FinishedAt = &now
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.save(j)
+	return *j, true
+}
+
+// Active returns the running and queued jobs, oldest first.
+func (m *Manager) Active() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var active []Job
+	for _, j := range m.jobs {
+		if j.Status == Running || j.Status == Queued {
+			active = append(active, *j)
+		}
+	}
+	slices.SortFunc(active, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return active
+}
+
+// expired reports whether j finished longer than the TTL ago, so it is
+// only kept for listings.
+func (m *Manager) expired(j *Job, now time.Time) bool {
+	return j.FinishedAt != nil && now.Sub(*j.FinishedAt) > m.TTL
+}
+
+// prune forgets finished jobs older than both the TTL and History. It must
+// be called with m.mu held.
+func (m *Manager) prune(now time.Time) {
+	keep := max(m.TTL, m.History)
+	for id, j := range m.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > keep {
+			m.forget(id)
+		}
+	}
+}
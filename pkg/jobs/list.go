@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"flue-frontend/pkg/params"
+)
+
+// ErrInvalidCursor is returned when a listing cursor cannot be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filter selects jobs for a listing. Zero fields match everything.
+type Filter struct {
+	Status Status
+	Client string
+	Owner  string
+	Since  time.Time
+	Until  time.Time
+	// Prompt matches jobs whose prompt contains it, ignoring case.
+	Prompt string
+	Seed   *int
+	Model  string
+	// Limit is the maximum number of jobs returned.
+	Limit int
+	// Cursor continues a previous listing after its last job.
+	Cursor string
+}
+
+// Summary is the listing form of a job.
+type Summary struct {
+	ID         string        `json:"id"`
+	Status     Status        `json:"status"`
+	Prompt     string        `json:"prompt"`
+	Params     params.Params `json:"params"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	RunAt      *time.Time    `json:"run_at,omitempty"`
+	// Duration is the number of seconds the job took to run, once finished.
+	Duration float64 `json:"duration,omitempty"`
+	// Thumbnail is the URL of a thumbnail of the result, if it was
+	// archived. It is filled in by the caller, who knows the result.
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// snippetLength is the number of characters of the prompt kept in a
+// summary.
+const snippetLength = 80
+
+// Summary returns the listing form of j.
+func (j Job) Summary() Summary {
+	s := Summary{
+		ID:         j.ID,
+		Status:     j.Status,
+		Prompt:     j.Params.Prompt,
+		Params:     j.Params,
+		CreatedAt:  j.CreatedAt,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+		RunAt:      j.RunAt,
+	}
+	if utf8.RuneCountInString(s.Prompt) > snippetLength {
+		s.Prompt = string([]rune(s.Prompt)[:snippetLength]) + "…"
+	}
+	if j.StartedAt != nil && j.FinishedAt != nil {
+		s.Duration = j.FinishedAt.Sub(*j.StartedAt).Seconds()
+	}
+	return s
+}
+
+// List returns the jobs matching f, newest first, along with the cursor of
+// the next page, which is empty on the last page. It includes finished jobs
+// kept for History after their TTL. Paging is keyed on the
+// creation time and ID, so it stays stable while new jobs are added.
+func (m *Manager) List(f Filter) ([]Job, string, error) {
+	var after *Job
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &c
+	}
+
+	m.mu.Lock()
+	m.prune(time.Now())
+	var matched []Job
+	for _, j := range m.jobs {
+		if f.matches(j) && (after == nil || newer(*after, *j)) {
+			matched = append(matched, *j)
+		}
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(matched, func(a, b Job) int {
+		if newer(a, b) {
+			return -1
+		}
+		return 1
+	})
+	if f.Limit <= 0 || len(matched) <= f.Limit {
+		return matched, "", nil
+	}
+	matched = matched[:f.Limit]
+	return matched, encodeCursor(matched[len(matched)-1]), nil
+}
+
+func (f Filter) matches(j *Job) bool {
+	return (f.Status == "" || j.Status == f.Status) &&
+		(f.Client == "" || j.Client == f.Client) &&
+		(f.Owner == "" || j.Owner == f.Owner) &&
+		(f.Since.IsZero() || !j.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || j.CreatedAt.Before(f.Until)) &&
+		(f.Prompt == "" || params.PromptContains(j.Params.Prompt, f.Prompt)) &&
+		(f.Seed == nil || (j.Params.Seed != nil && *j.Params.Seed == *f.Seed)) &&
+		(f.Model == "" || j.Params.Model == f.Model)
+}
+
+// newer reports whether a sorts before b in a listing.
+func newer(a, b Job) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+func encodeCursor(j Job) string {
+	raw := strconv.FormatInt(j.CreatedAt.UnixNano(), 10) + ":" + j.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (Job, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Job{}, ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return Job{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Job{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return Job{ID: id, CreatedAt: time.Unix(0, n)}, nil
+}
@@ -0,0 +1,163 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists job records so they survive restarts.
+type Store interface {
+	// Save creates or replaces a job.
+	Save(j Job) error
+	// Delete removes a job. Deleting an unknown job is not an error.
+	Delete(id string) error
+	// Load returns every stored job.
+	Load() ([]Job, error)
+	// Close releases the store's resources.
+	Close() error
+}
+
+// MetaStore is implemented by stores that can also keep small named blobs
+// of server state, such as generation statistics.
+type MetaStore interface {
+	SaveMeta(key string, data []byte) error
+	// LoadMeta returns nil if nothing was saved under key.
+	LoadMeta(key string) ([]byte, error)
+}
+
+// record is the stored form of a job, keeping the fields hidden from
+// clients.
+type record struct {
+	Job    Job    `json:"job"`
+	Client string `json:"client"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+// MemoryStore keeps jobs in memory, so nothing survives a restart.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]Job)}
+}
+
+func (s *MemoryStore) Save(j Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = j
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// jobsBucket is the bbolt bucket holding job records keyed by ID, and
+// metaBucket the one holding other server state.
+var (
+	jobsBucket = []byte("jobs")
+	metaBucket = []byte("meta")
+)
+
+// BoltStore keeps jobs in a bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open job store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create job bucket: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Save(j Job) error {
+	data, err := json.Marshal(record{Job: j, Client: j.Client, Owner: j.Owner})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), data)
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Load() ([]Job, error) {
+	var jobs []Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var r record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("decode job %s: %w", k, err)
+			}
+			r.Job.Client = r.Client
+			r.Job.Owner = r.Owner
+			jobs = append(jobs, r.Job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+func (s *BoltStore) SaveMeta(key string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) LoadMeta(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get([]byte(key)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,40 @@
+// Package metrics defines the Prometheus collectors exported by the frontend.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BackendInFlight tracks the number of generation requests currently
+// outstanding against each backend.
+var BackendInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "flue_backend_in_flight",
+	Help: "Number of in-flight generation requests per backend.",
+}, []string{"backend"})
+
+// BackendCircuitState reports the circuit breaker state of each backend:
+// 0 closed, 1 open, 2 half-open.
+var BackendCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "flue_backend_circuit_state",
+	Help: "Circuit breaker state per backend (0 closed, 1 open, 2 half-open).",
+}, []string{"backend"})
+
+// SlowGenerations counts the generations the backend took longer than the
+// slow generation threshold for, per model.
+var SlowGenerations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "flue_slow_generations_total",
+	Help: "Number of generations slower than the slow generation threshold per model.",
+}, []string{"model"})
+
+// QueueRunning is the number of generations currently holding a slot.
+var QueueRunning = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "flue_queue_running",
+	Help: "Number of generations currently running.",
+})
+
+// QueueDepth is the number of generations waiting for a slot.
+var QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "flue_queue_depth",
+	Help: "Number of generations waiting in the queue.",
+})
@@ -0,0 +1,75 @@
+package params
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ModelLimits narrows the limits for a model. Nil ranges keep the general
+// limits.
+type ModelLimits struct {
+	Width    *Range[int]     `json:"width,omitempty"`
+	Height   *Range[int]     `json:"height,omitempty"`
+	Steps    *Range[int]     `json:"steps,omitempty"`
+	Guidance *Range[float64] `json:"guidance,omitempty"`
+}
+
+// Apply returns l narrowed to the ranges set in m. The result never exceeds
+// l, so a model cannot allow more than the backends accept.
+func (m ModelLimits) Apply(l Limits) Limits {
+	if m.Width != nil {
+		l.Width = l.Width.Intersect(*m.Width)
+	}
+	if m.Height != nil {
+		l.Height = l.Height.Intersect(*m.Height)
+	}
+	if m.Steps != nil {
+		l.Steps = l.Steps.Intersect(*m.Steps)
+	}
+	if m.Guidance != nil {
+		l.Guidance = l.Guidance.Intersect(*m.Guidance)
+	}
+	return l
+}
+
+// ModelDefaults are the suggested settings and limits of a model.
+type ModelDefaults struct {
+	Steps    int         `json:"steps,omitempty"`
+	Guidance *float64    `json:"guidance,omitempty"`
+	Limits   ModelLimits `json:"limits"`
+}
+
+// LoadModelDefaults reads the defaults of each model from a JSON file
+// mapping model names to ModelDefaults.
+func LoadModelDefaults(path string) (map[string]ModelDefaults, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read model config: %w", err)
+	}
+	var models map[string]ModelDefaults
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("parse model config %s: %w", path, err)
+	}
+	for name, m := range models {
+		if err := m.Limits.validate(); err != nil {
+			return nil, fmt.Errorf("model %s: %w", name, err)
+		}
+	}
+	return models, nil
+}
+
+// validate checks that every range set in m is non-empty.
+func (m ModelLimits) validate() error {
+	switch {
+	case m.Width != nil && m.Width.Min > m.Width.Max:
+		return fmt.Errorf("width range %d-%d is empty", m.Width.Min, m.Width.Max)
+	case m.Height != nil && m.Height.Min > m.Height.Max:
+		return fmt.Errorf("height range %d-%d is empty", m.Height.Min, m.Height.Max)
+	case m.Steps != nil && m.Steps.Min > m.Steps.Max:
+		return fmt.Errorf("steps range %d-%d is empty", m.Steps.Min, m.Steps.Max)
+	case m.Guidance != nil && m.Guidance.Min > m.Guidance.Max:
+		return fmt.Errorf("guidance range %g-%g is empty", m.Guidance.Min, m.Guidance.Max)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package params defines the validated parameters of a generation request.
+package params
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"flue-frontend/pkg/imaging"
+)
+
+// Params are the validated parameters of a single generation.
+type Params struct {
+	Prompt   string         `json:"prompt"`
+	Width    int            `json:"width"`
+	Height   int            `json:"height"`
+	Steps    int            `json:"steps"`
+	Guidance float64        `json:"guidance"`
+	Seed     *int           `json:"seed,omitempty"`
+	Model    string         `json:"model,omitempty"`
+	Tiling   bool           `json:"tiling,omitempty"`
+	Format   imaging.Format `json:"format"`
+	Quality  int            `json:"quality,omitempty"`
+}
+
+// PayloadKeys are the keys of the payloads Payload returns.
+var PayloadKeys = []string{"prompt", "width", "height", "steps", "guidance", "model", "tiling", "seed"}
+
+// Payload returns the JSON payload sent to the backend for p.
+func (p Params) Payload() map[string]any {
+	payload := map[string]any{
+		"prompt":   p.Prompt,
+		"width":    p.Width,
+		"height":   p.Height,
+		"steps":    p.Steps,
+		"guidance": p.Guidance,
+	}
+	if p.Model != "" {
+		payload["model"] = p.Model
+	}
+	if p.Tiling {
+		payload["tiling"] = true
+	}
+	if p.Seed != nil {
+		payload["seed"] = *p.Seed
+	}
+	return payload
+}
+
+// Normalize returns p in canonical form, so that requests differing only in
+// details the backend ignores compare and hash the same: surrounding
+// whitespace is trimmed and the quality of lossless formats dropped.
+func (p Params) Normalize() Params {
+	p.Prompt = strings.TrimSpace(p.Prompt)
+	p.Model = strings.TrimSpace(p.Model)
+	if !p.Format.Lossy() {
+		p.Quality = 0
+	}
+	return p
+}
+
+// Hash returns a stable digest of the canonical form of p, identifying
+// identical requests across caching, deduplication and logs. Fields are
+// encoded in their declared order, so the digest does not depend on how the
+// request spelled or ordered them.
+func (p Params) Hash() string {
+	data, _ := json.Marshal(p.Normalize())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Range is an inclusive range of values.
+type Range[T int | float64] struct {
+	Min T `json:"min"`
+	Max T `json:"max"`
+}
+
+// Contains reports whether v lies within r.
+func (r Range[T]) Contains(v T) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+// Clamp returns the value of r closest to v.
+func (r Range[T]) Clamp(v T) T {
+	return min(max(v, r.Min), r.Max)
+}
+
+// Empty reports whether r contains no values.
+func (r Range[T]) Empty() bool {
+	return r.Min > r.Max
+}
+
+// Intersect returns the values lying in both r and o. It is empty if they do
+// not overlap.
+func (r Range[T]) Intersect(o Range[T]) Range[T] {
+	return Range[T]{Min: max(r.Min, o.Min), Max: min(r.Max, o.Max)}
+}
+
+// Limits are the accepted ranges of the numeric parameters.
+type Limits struct {
+	Width    Range[int]     `json:"width"`
+	Height   Range[int]     `json:"height"`
+	Steps    Range[int]     `json:"steps"`
+	Guidance Range[float64] `json:"guidance"`
+}
+
+// DefaultLimits returns the limits used when the backend does not report its
+// own.
+func DefaultLimits() Limits {
+	return Limits{
+		Width:    Range[int]{Min: 64, Max: 2048},
+		Height:   Range[int]{Min: 64, Max: 2048},
+		Steps:    Range[int]{Min: 1, Max: 100},
+		Guidance: Range[float64]{Min: 0, Max: 10},
+	}
+}
+
+// PromptContains reports whether prompt contains query, ignoring case. It is
+// how prompts are searched everywhere.
+func PromptContains(prompt, query string) bool {
+	return strings.Contains(strings.ToLower(prompt), strings.ToLower(query))
+}
@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Estimator predicts how long a generation takes from rolling windows of
+// recent durations, bucketed by approximate pixel count and step count.
+// Sizes without samples of their own are predicted from the average time
+// per pixel and step across all generations.
+type Estimator struct {
+	// OnChange, if set, is called after each observation, outside the
+	// estimator's lock.
+	OnChange func()
+
+	size int
+
+	mu      sync.Mutex
+	buckets map[string][]float64 // seconds per generation
+	rates   []float64            // seconds per megapixel-step
+}
+
+// NewEstimator returns an Estimator keeping the last size durations per
+// bucket.
+func NewEstimator(size int) *Estimator {
+	return &Estimator{size: max(size, 1), buckets: make(map[string][]float64)}
+}
+
+// bucket returns the key of the bucket for a generation, rounding both
+// dimensions to the nearest power of two.
+func bucket(pixels, steps int) string {
+	log2 := func(n int) int { return int(math.Round(math.Log2(float64(max(n, 1))))) }
+	return fmt.Sprintf("%d/%d", log2(pixels), log2(steps))
+}
+
+// work is the size of a generation in megapixel-steps.
+func work(pixels, steps int) float64 {
+	return float64(max(pixels, 1)) * float64(max(steps, 1)) / 1e6
+}
+
+// Observe records the duration of a completed generation.
+func (e *Estimator) Observe(pixels, steps int, d time.Duration) {
+	e.mu.Lock()
+	key := bucket(pixels, steps)
+	e.buckets[key] = e.push(e.buckets[key], d.Seconds())
+	e.rates = e.push(e.rates, d.Seconds()/work(pixels, steps))
+	e.mu.Unlock()
+
+	if e.OnChange != nil {
+		e.OnChange()
+	}
+}
+
+func (e *Estimator) push(window []float64, v float64) []float64 {
+	window = append(window, v)
+	if len(window) > e.size {
+		window = window[len(window)-e.size:]
+	}
+	return window
+}
+
+// Predict returns the expected duration of a generation, or false if there
+// is no data yet.
+func (e *Estimator) Predict(pixels, steps int) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if samples := e.buckets[bucket(pixels, steps)]; len(samples) > 0 {
+		return seconds(mean(samples)), true
+	}
+	if len(e.rates) > 0 {
+		return seconds(mean(e.rates) * work(pixels, steps)), true
+	}
+	return 0, false
+}
+
+// Mean returns the average of the most recent durations across all
+// buckets, or false if there is no data yet.
+func (e *Estimator) Mean() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var all []float64
+	for _, samples := range e.buckets {
+		all = append(all, samples...)
+	}
+	if len(all) == 0 {
+		return 0, false
+	}
+	return seconds(mean(all)), true
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// estimatorState is the serialized form of an Estimator.
+type estimatorState struct {
+	Buckets map[string][]float64 `json:"buckets"`
+	Rates   []float64            `json:"rates"`
+}
+
+// MarshalJSON encodes the recorded durations.
+func (e *Estimator) MarshalJSON() ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.Marshal(estimatorState{Buckets: e.buckets, Rates: e.rates})
+}
+
+// UnmarshalJSON restores durations recorded by MarshalJSON.
+func (e *Estimator) UnmarshalJSON(data []byte) error {
+	var st estimatorState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buckets = make(map[string][]float64, len(st.Buckets))
+	for key, samples := range st.Buckets {
+		for _, v := range samples {
+			e.buckets[key] = e.push(e.buckets[key], v)
+		}
+	}
+	e.rates = nil
+	for _, v := range st.Rates {
+		e.rates = e.push(e.rates, v)
+	}
+	return nil
+}
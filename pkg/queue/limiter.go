@@ -0,0 +1,235 @@
+// Package queue limits concurrent generations and queues the excess in FIFO
+// order.
+package queue
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when a caller would have to wait but the queue
+// already holds the maximum number of waiters.
+var ErrQueueFull = errors.New("queue is full")
+
+// PositionFunc is called with a waiter's 1-based position in the queue and
+// the total number of queued requests whenever either changes.
+type PositionFunc func(position, total int)
+
+type waiter struct {
+	ready  chan struct{}
+	notify PositionFunc
+}
+
+// Limiter admits up to a fixed number of concurrent holders. Further callers
+// wait in FIFO order and are told their queue position as it changes.
+type Limiter struct {
+	// Observe, if set, is called with the running and queued counts
+	// whenever either changes, while the limiter's lock is held.
+	Observe func(running, queued int)
+
+	mu        sync.Mutex
+	max       int
+	maxQueued int
+	running   int
+	paused    bool
+	waiters   *list.List
+}
+
+// NewLimiter returns a Limiter admitting max concurrent holders and queueing
+// up to maxQueued more. A max of zero or less means unlimited concurrency,
+// a maxQueued of zero or less an unbounded queue.
+func NewLimiter(max, maxQueued int) *Limiter {
+	return &Limiter{max: max, maxQueued: maxQueued, waiters: list.New()}
+}
+
+// Max returns the maximum number of concurrent holders, or zero if
+// unlimited.
+func (l *Limiter) Max() int {
+	return max(l.max, 0)
+}
+
+// MaxQueued returns the maximum number of waiting callers, or zero if
+// unbounded.
+func (l *Limiter) MaxQueued() int {
+	return max(l.maxQueued, 0)
+}
+
+// Running returns the number of current holders.
+func (l *Limiter) Running() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running
+}
+
+// Queued returns the number of waiting callers.
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiters.Len()
+}
+
+// Pause stops admitting callers, so they queue while current holders
+// finish.
+func (l *Limiter) Pause() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = true
+}
+
+// Resume admits callers again, starting with those queued while paused.
+func (l *Limiter) Resume() {
+	l.mu.Lock()
+	l.paused = false
+	for front := l.waiters.Front(); front != nil && (l.max <= 0 || l.running < l.max); front = l.waiters.Front() {
+		l.waiters.Remove(front)
+		l.running++
+		close(front.Value.(*waiter).ready)
+	}
+	updates := l.positions()
+	l.mu.Unlock()
+	updates()
+}
+
+// Paused reports whether the limiter is paused.
+func (l *Limiter) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// Acquire blocks until a slot is free or ctx is done. While queued, notify
+// (which may be nil) receives position updates. On success the returned
+// release function must be called exactly once to free the slot. It fails
+// with ErrQueueFull if the queue is full.
+func (l *Limiter) Acquire(ctx context.Context, notify PositionFunc) (func(), error) {
+	t, err := l.Join(notify)
+	if err != nil {
+		return nil, err
+	}
+	return t.Wait(ctx)
+}
+
+// Ticket is a place in a Limiter's queue, or an admitted slot.
+type Ticket struct {
+	l  *Limiter
+	w  *waiter
+	el *list.Element
+}
+
+// Join takes a place in the queue without waiting, so the caller learns its
+// initial position before Join returns. The ticket must be resolved with
+// either Wait or Cancel. It fails with ErrQueueFull if the caller would
+// have to wait and the queue is full.
+func (l *Limiter) Join(notify PositionFunc) (*Ticket, error) {
+	w := &waiter{ready: make(chan struct{}), notify: notify}
+	t := &Ticket{l: l, w: w}
+
+	l.mu.Lock()
+	if !l.paused && (l.max <= 0 || (l.running < l.max && l.waiters.Len() == 0)) {
+		l.running++
+		close(w.ready)
+		l.observe()
+		l.mu.Unlock()
+		return t, nil
+	}
+	if l.maxQueued > 0 && l.waiters.Len() >= l.maxQueued {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	t.el = l.waiters.PushBack(w)
+	updates := l.positions()
+	l.mu.Unlock()
+	updates()
+	return t, nil
+}
+
+// Ready reports whether the ticket has been admitted.
+func (t *Ticket) Ready() bool {
+	select {
+	case <-t.w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the ticket is admitted or ctx is done. On success the
+// returned release function must be called exactly once to free the slot.
+func (t *Ticket) Wait(ctx context.Context) (func(), error) {
+	select {
+	case <-t.w.ready:
+		return t.l.releaseFunc(), nil
+	case <-ctx.Done():
+		t.Cancel()
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel gives up the ticket, leaving the queue or handing back the slot if
+// it was admitted concurrently. It must not be called after a successful
+// Wait.
+func (t *Ticket) Cancel() {
+	l := t.l
+	l.mu.Lock()
+	select {
+	case <-t.w.ready:
+		l.mu.Unlock()
+		l.release()
+		return
+	default:
+	}
+	l.waiters.Remove(t.el)
+	updates := l.positions()
+	l.mu.Unlock()
+	updates()
+}
+
+// releaseFunc returns a function freeing one slot, safe to call only once.
+func (l *Limiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(l.release)
+	}
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	l.running--
+	if front := l.waiters.Front(); front != nil && !l.paused && (l.max <= 0 || l.running < l.max) {
+		l.waiters.Remove(front)
+		l.running++
+		close(front.Value.(*waiter).ready)
+	}
+	updates := l.positions()
+	l.mu.Unlock()
+	updates()
+}
+
+// observe reports the running and queued counts to Observe. It must be
+// called with l.mu held.
+func (l *Limiter) observe() {
+	if l.Observe != nil {
+		l.Observe(l.running, l.waiters.Len())
+	}
+}
+
+// positions snapshots the queue and returns a function that notifies every
+// waiter of its position. It must be called with l.mu held; the returned
+// function must be called without it.
+func (l *Limiter) positions() func() {
+	l.observe()
+	total := l.waiters.Len()
+	notifies := make([]PositionFunc, 0, total)
+	for el := l.waiters.Front(); el != nil; el = el.Next() {
+		notifies = append(notifies, el.Value.(*waiter).notify)
+	}
+	return func() {
+		for i, notify := range notifies {
+			if notify != nil {
+				notify(i+1, total)
+			}
+		}
+	}
+}
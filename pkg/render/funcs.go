@@ -0,0 +1,123 @@
+package render
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"time"
+)
+
+// Funcs returns the formatting helpers available to every template, to be
+// passed to ParseDir:
+//
+//   - humanizeDuration formats a time.Duration, or a number of seconds such
+//     as a generation time, as 850ms, 3.2s, 2m 5s or 1h 3m.
+//   - humanizeBytes formats a size in bytes with a binary unit, as 1.5 MiB.
+//   - formatTime formats a time.Time or *time.Time in loc with layout. A nil
+//     or zero time is empty.
+//   - truncate shortens text to at most n characters, as in
+//     {{ .Prompt | truncate 40 }}.
+//   - safeAttr marks a trusted string as an attribute name and value, so it
+//     is not escaped. Never pass it user input.
+func Funcs(loc *time.Location, layout string) template.FuncMap {
+	return template.FuncMap{
+		"humanizeDuration": humanizeDuration,
+		"humanizeBytes":    humanizeBytes,
+		"formatTime": func(v any) (string, error) {
+			return formatTime(v, loc, layout)
+		},
+		"truncate": func(n int, text string) string { return Truncate(text, n) },
+		"safeAttr": func(s string) template.HTMLAttr { return template.HTMLAttr(s) },
+	}
+}
+
+// HumanizeDuration formats d for people, with a precision that fits its
+// length: milliseconds below a second, tenths of a second below a minute,
+// and whole seconds or minutes above.
+func HumanizeDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d < time.Minute:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Hour:
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%dm %ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// HumanizeBytes formats a size in bytes with a binary unit, such as 1.5 MiB.
+func HumanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Truncate shortens text to at most n characters, marking a cut with an
+// ellipsis.
+func Truncate(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// humanizeDuration is HumanizeDuration for templates, which also pass
+// numbers of seconds.
+func humanizeDuration(v any) (string, error) {
+	switch v := v.(type) {
+	case time.Duration:
+		return HumanizeDuration(v), nil
+	case float64:
+		return HumanizeDuration(time.Duration(math.Round(v * float64(time.Second)))), nil
+	case int:
+		return HumanizeDuration(time.Duration(v) * time.Second), nil
+	case int64:
+		return HumanizeDuration(time.Duration(v) * time.Second), nil
+	}
+	return "", fmt.Errorf("humanizeDuration: unsupported type %T", v)
+}
+
+// humanizeBytes is HumanizeBytes for templates, which pass sizes of any
+// integer type.
+func humanizeBytes(v any) (string, error) {
+	switch v := v.(type) {
+	case int:
+		return HumanizeBytes(int64(v)), nil
+	case int64:
+		return HumanizeBytes(v), nil
+	case uint64:
+		return HumanizeBytes(int64(v)), nil
+	}
+	return "", fmt.Errorf("humanizeBytes: unsupported type %T", v)
+}
+
+// formatTime does the work of the formatTime template function.
+func formatTime(v any, loc *time.Location, layout string) (string, error) {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return "", nil
+		}
+		t = *v
+	default:
+		return "", fmt.Errorf("formatTime: unsupported type %T", v)
+	}
+	if t.IsZero() {
+		return "", nil
+	}
+	return t.In(loc).Format(layout), nil
+}
@@ -0,0 +1,70 @@
+package render
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execute runs the inline template text with the helpers of Funcs on data.
+func execute(t *testing.T, text string, data any) (string, error) {
+	t.Helper()
+	tmpl, err := template.New("test").Funcs(Funcs(time.UTC, "2006-01-02 15:04")).Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	err = tmpl.Execute(&out, data)
+	return out.String(), err
+}
+
+func TestFuncs(t *testing.T) {
+	when := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	var never *time.Time
+	tests := []struct {
+		name, text string
+		data       any
+		want       string
+	}{
+		{"duration milliseconds", `{{ humanizeDuration . }}`, 850 * time.Millisecond, "850ms"},
+		{"duration seconds", `{{ humanizeDuration . }}`, 3200 * time.Millisecond, "3.2s"},
+		{"duration minutes", `{{ humanizeDuration . }}`, 125 * time.Second, "2m 5s"},
+		{"duration hours", `{{ humanizeDuration . }}`, 63 * time.Minute, "1h 3m"},
+		{"duration float seconds", `{{ humanizeDuration . }}`, 0.25, "250ms"},
+		{"duration int seconds", `{{ humanizeDuration . }}`, 90, "1m 30s"},
+		{"duration int64 seconds", `{{ humanizeDuration . }}`, int64(5), "5.0s"},
+		{"bytes", `{{ humanizeBytes . }}`, 512, "512 B"},
+		{"kibibytes", `{{ humanizeBytes . }}`, int64(1536), "1.5 KiB"},
+		{"mebibytes", `{{ humanizeBytes . }}`, uint64(3 << 20), "3.0 MiB"},
+		{"time", `{{ formatTime . }}`, when, "2026-03-01 11:30"},
+		{"time pointer", `{{ formatTime . }}`, &when, "2026-03-01 11:30"},
+		{"nil time", `{{ formatTime . }}`, never, ""},
+		{"zero time", `{{ formatTime . }}`, time.Time{}, ""},
+		{"truncate short", `{{ . | truncate 10 }}`, "a cat", "a cat"},
+		{"truncate exact", `{{ . | truncate 5 }}`, "a cat", "a cat"},
+		{"truncate long", `{{ . | truncate 8 }}`, "a lighthouse at dusk", "a light…"},
+		{"truncate runes", `{{ . | truncate 4 }}`, "Straßencafé", "Str…"},
+		{"truncate escapes", `{{ . | truncate 20 }}`, "<b>bold</b>", "&lt;b&gt;bold&lt;/b&gt;"},
+		{"safeAttr", `<img {{ safeAttr . }}>`, `loading="lazy"`, `<img loading="lazy">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := execute(t, tt.text, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%s on %v = %q, want %q", tt.text, tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFuncsUnsupportedTypes(t *testing.T) {
+	for _, text := range []string{`{{ humanizeDuration . }}`, `{{ humanizeBytes . }}`, `{{ formatTime . }}`} {
+		if _, err := execute(t, text, "soon"); err == nil {
+			t.Errorf("%s on a string: no error", text)
+		}
+	}
+}
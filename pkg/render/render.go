@@ -1,18 +1,202 @@
 package render
 
 import (
+	"bytes"
+	"fmt"
 	"html/template"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 )
 
 // TemplateRenderer is a custom html/template renderer for Echo.
+//
+// Templates are rendered by file name, such as "stats.html". A name of the
+// form page#block, such as "gallery.html#items", renders only that block of
+// the page, without its layout, for HTMX requests updating part of a page.
 type TemplateRenderer struct {
-	Templates *template.Template
+	Templates *Set
+	// Locale, if set, returns the locale of a request, and LocaleFuncs the
+	// template functions of a locale, such as a translating t, that replace
+	// the placeholders the templates were parsed with. The templates are
+	// copied once per locale.
+	Locale      func(c echo.Context) string
+	LocaleFuncs func(locale string) template.FuncMap
+
+	// localized holds the copies of the templates by localizedKey.
+	localized sync.Map
+}
+
+// localizedKey identifies the copy of a template set for a locale.
+type localizedKey struct {
+	tmpl   *template.Template
+	locale string
 }
 
-// Render renders a template document.
+// buffers holds the buffers templates are rendered into.
+var buffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBuffer is the capacity above which a buffer is dropped rather
+// than pooled, so one huge page does not pin its memory.
+const maxPooledBuffer = 1 << 20
+
+// Render renders a template document. The document is rendered into a
+// buffer and written to w only once complete, so a template failing halfway
+// through writes nothing and its error can still be reported properly.
 func (t *TemplateRenderer) Render(w io.Writer, name string, data any, c echo.Context) error {
-	return t.Templates.ExecuteTemplate(w, name, data)
+	tmpl, entry, err := t.Templates.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if t.Locale != nil {
+		if tmpl, err = t.localize(tmpl, t.Locale(c)); err != nil {
+			return err
+		}
+	}
+
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buffers.Put(buf)
+		}
+	}()
+	if err := tmpl.ExecuteTemplate(buf, entry, data); err != nil {
+		return fmt.Errorf("render template %s: %w", name, err)
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// localize returns the copy of tmpl with the functions of locale. Copies are
+// made on first use and kept, so templates are escaped once per locale
+// rather than on every render.
+func (t *TemplateRenderer) localize(tmpl *template.Template, locale string) (*template.Template, error) {
+	key := localizedKey{tmpl, locale}
+	if cached, ok := t.localized.Load(key); ok {
+		return cached.(*template.Template), nil
+	}
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	clone.Funcs(t.LocaleFuncs(locale))
+	cached, _ := t.localized.LoadOrStore(key, clone)
+	return cached.(*template.Template), nil
+}
+
+// Set is the templates of a directory. The layouts in its layouts
+// subdirectory and the partials directly in it, such as fragments rendered
+// on their own or included by other templates, share one namespace. Each
+// page in its pages subdirectory is parsed into its own copy of that
+// namespace, so pages can fill in the blocks of a layout, such as "content",
+// without colliding with each other.
+type Set struct {
+	shared *template.Template
+	pages  map[string]*template.Template
+}
+
+// Lookup returns the template set name is rendered from and the template to
+// execute in it, which is the block for a page#block name.
+func (s *Set) Lookup(name string) (*template.Template, string, error) {
+	file, block, hasBlock := strings.Cut(name, "#")
+	tmpl, ok := s.pages[file]
+	if !ok {
+		if s.shared.Lookup(file) == nil {
+			return nil, "", fmt.Errorf("no template named %s", file)
+		}
+		tmpl = s.shared
+	}
+	if !hasBlock {
+		return tmpl, file, nil
+	}
+	if block == "" || tmpl.Lookup(block) == nil {
+		return nil, "", fmt.Errorf("template %s has no block %q", file, block)
+	}
+	return tmpl, block, nil
+}
+
+// ParseDir parses the layouts, partials and pages in dir, with funcs
+// available to them, such as the helpers of Funcs. Pages render a layout and
+// define the blocks it leaves open; they may not redefine a layout or
+// partial. Errors name the directory and, for syntax errors and name
+// collisions, the offending files.
+func ParseDir(dir string, funcs template.FuncMap) (*Set, error) {
+	var files [3][]string
+	for i, pattern := range []string{"layouts/*.html", "*.html", "pages/*.html"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("list templates in %s: %w", dir, err)
+		}
+		files[i] = matches
+	}
+	layouts, partials, pages := files[0], files[1], files[2]
+	if len(layouts)+len(partials)+len(pages) == 0 {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		return nil, fmt.Errorf("no templates (*.html) found in %s", dir)
+	}
+
+	// defined maps the name of each layout and partial to its file.
+	defined := make(map[string]string)
+	shared := template.New("").Funcs(funcs)
+	for _, file := range append(layouts, partials...) {
+		name := filepath.Base(file)
+		if other, ok := defined[name]; ok {
+			return nil, fmt.Errorf("template %s is defined by both %s and %s", name, other, file)
+		}
+		defined[name] = file
+		text, err := readTemplate(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := shared.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", file, err)
+		}
+	}
+
+	set := &Set{shared: shared, pages: make(map[string]*template.Template, len(pages))}
+	for _, file := range pages {
+		name := filepath.Base(file)
+		if other, ok := defined[name]; ok {
+			return nil, fmt.Errorf("template %s is defined by both %s and %s", name, other, file)
+		}
+		text, err := readTemplate(file)
+		if err != nil {
+			return nil, err
+		}
+		// Parse the page on its own first to learn what it defines.
+		own, err := template.New(name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", file, err)
+		}
+		for _, t := range own.Templates() {
+			if other, ok := defined[t.Name()]; ok {
+				return nil, fmt.Errorf("page %s redefines %s from %s; pages may only define blocks", file, t.Name(), other)
+			}
+		}
+		tmpl, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tmpl.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", file, err)
+		}
+		set.pages[name] = tmpl
+	}
+	return set, nil
+}
+
+// readTemplate returns the text of a template file.
+func readTemplate(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("read template %s: %w", file, err)
+	}
+	return string(data), nil
 }
@@ -0,0 +1,83 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRenderer returns a renderer for a layout, a partial and a page that
+// fails halfway through unless its Took is a duration.
+func testRenderer(t *testing.T) *TemplateRenderer {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"layouts/base.html": `{{ define "base" }}<main>{{ block "content" . }}{{ end }}</main>{{ end }}`,
+		"item.html":         `<li>{{ . }}</li>`,
+		"pages/job.html":    `{{ template "base" . }}{{ define "content" }}<h1>{{ .Prompt }}</h1><p>{{ humanizeDuration .Took }}</p>{{ end }}`,
+	}
+	for name, text := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := ParseDir(dir, Funcs(time.UTC, time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TemplateRenderer{Templates: set}
+}
+
+func TestRender(t *testing.T) {
+	r := testRenderer(t)
+	job := map[string]any{"Prompt": "a cat", "Took": 3 * time.Second}
+	tests := []struct {
+		name string
+		data any
+		want string
+	}{
+		{"job.html", job, "<main><h1>a cat</h1><p>3.0s</p></main>"},
+		{"job.html#content", job, "<h1>a cat</h1><p>3.0s</p>"},
+		{"item.html", "<b>", "<li>&lt;b&gt;</li>"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := r.Render(&out, tt.name, tt.data, nil); err != nil {
+			t.Errorf("Render(%s): %v", tt.name, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("Render(%s) = %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	r := testRenderer(t)
+	tests := []struct {
+		name string
+		data any
+	}{
+		{"missing.html", nil},
+		{"job.html#missing", nil},
+		{"job.html#", nil},
+		// The heading is executed before humanizeDuration fails.
+		{"job.html", map[string]any{"Prompt": "a cat", "Took": "soon"}},
+		{"job.html#content", map[string]any{"Prompt": "a cat", "Took": "soon"}},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := r.Render(&out, tt.name, tt.data, nil); err == nil {
+			t.Errorf("Render(%s): no error", tt.name)
+		}
+		if out.Len() != 0 {
+			t.Errorf("Render(%s) failed but wrote %q", tt.name, out.String())
+		}
+	}
+}
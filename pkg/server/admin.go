@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// adminCancelReason is recorded on jobs force-canceled by an administrator.
+const adminCancelReason = "Canceled by an administrator"
+
+// adminAuth returns middleware admitting requests with the HTTP basic auth
+// credentials of one of AdminUsers, recording the user name as the admin
+// identity.
+func (s *Server) adminAuth() echo.MiddlewareFunc {
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: "Flue Frontend admin",
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			if !s.validAdmin(user, password) {
+				log.Warn("Admin authentication failed", "user", user, "client", c.RealIP())
+				return false, nil
+			}
+			c.Set("admin", user)
+			return true, nil
+		},
+	})
+}
+
+// validAdmin reports whether password is that of the administrator user.
+func (s *Server) validAdmin(user, password string) bool {
+	want, ok := s.AdminUsers[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// optionalAdmin returns the administrator whose basic auth credentials the
+// request carries outside the /admin endpoints, if any.
+func (s *Server) optionalAdmin(c echo.Context) (string, bool) {
+	user, password, ok := c.Request().BasicAuth()
+	if !ok || !s.validAdmin(user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// adminIdentity returns the name of the authenticated administrator.
+func adminIdentity(c echo.Context) string {
+	user, _ := c.Get("admin").(string)
+	return user
+}
+
+// activeJob is a running or queued job as shown to administrators.
+type activeJob struct {
+	jobs.Summary
+	Client string `json:"client"`
+	// Elapsed is the number of seconds the job has been running, or waiting
+	// if it is queued.
+	Elapsed float64 `json:"elapsed"`
+}
+
+// adminJobs lists the running and queued jobs as JSON, or as an HTML page
+// for browsers.
+func (s *Server) adminJobs(c echo.Context) error {
+	now := time.Now()
+	var active []activeJob
+	for _, j := range s.jobs.Active() {
+		since := j.CreatedAt
+		if j.StartedAt != nil {
+			since = *j.StartedAt
+		}
+		active = append(active, activeJob{Summary: j.Summary(), Client: j.Client, Elapsed: roundFloat(now.Sub(since).Seconds(), 1)})
+	}
+
+	if s.acceptsHTML(c) {
+		return c.Render(http.StatusOK, "admin_jobs.html", map[string]any{
+			"jobs":        active,
+			"paused":      s.limiter.Paused(),
+			"maintenance": s.maintenance.Load(),
+			"lang":        locale(c),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"jobs":        active,
+		"paused":      s.limiter.Paused(),
+		"maintenance": s.maintenance.Load(),
+	})
+}
+
+// adminCancelJob fails a job with a reason shown to its submitter, aborting
+// its backend request if it is running.
+func (s *Server) adminCancelJob(c echo.Context) error {
+	job, ok := s.jobs.Abort(c.Param("id"), adminCancelReason)
+	if !ok {
+		return s.jobError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+	log.Info("Admin force-canceled job", "admin", adminIdentity(c), "job", job.ID, "client", job.Client)
+	return s.adminDone(c, job)
+}
+
+// adminDrain stops starting queued generations, letting running ones finish,
+// until adminResume is called.
+func (s *Server) adminDrain(c echo.Context) error {
+	s.limiter.Pause()
+	log.Info("Admin started draining the queue", "admin", adminIdentity(c))
+	return s.adminDone(c, map[string]bool{"paused": true})
+}
+
+// adminResume starts queued generations again after adminDrain.
+func (s *Server) adminResume(c echo.Context) error {
+	s.limiter.Resume()
+	log.Info("Admin resumed the queue", "admin", adminIdentity(c))
+	return s.adminDone(c, map[string]bool{"paused": false})
+}
+
+// adminDone answers an admin action by sending browsers back to the job
+// list, and other clients v as JSON.
+func (s *Server) adminDone(c echo.Context, v any) error {
+	if s.acceptsHTML(c) {
+		return c.Redirect(http.StatusSeeOther, "/admin/jobs")
+	}
+	return c.JSON(http.StatusOK, v)
+}
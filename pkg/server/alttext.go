@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/render"
+
+	"github.com/charmbracelet/log"
+)
+
+// DefaultAltText is the default template of the alt text of result images.
+const DefaultAltText = "{{ .Prompt }}"
+
+// altTextPromptLength is the number of characters of a prompt available to
+// the alt text template, which screen readers read in full.
+const altTextPromptLength = 150
+
+// altTextData is what the alt text template is executed with.
+type altTextData struct {
+	// Prompt is shortened to altTextPromptLength characters.
+	Prompt string
+	Seed   *int
+	Width  int
+	Height int
+	Steps  int
+	Model  string
+}
+
+// parseAltText parses an alt text template.
+func parseAltText(text string) (*template.Template, error) {
+	tmpl, err := template.New("alt").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse alt text template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// altText returns the alt text of an image generated with p and seed, or
+// "" if the template fails, leaving the generic text in place.
+func (s *Server) altText(p params.Params, seed *int) string {
+	if s.altTemplate == nil {
+		return ""
+	}
+	var b strings.Builder
+	err := s.altTemplate.Execute(&b, altTextData{
+		Prompt: render.Truncate(p.Prompt, altTextPromptLength),
+		Seed:   seed,
+		Width:  p.Width,
+		Height: p.Height,
+		Steps:  p.Steps,
+		Model:  p.Model,
+	})
+	if err != nil {
+		log.Warn("Failed to execute alt text template", "error", err)
+		return ""
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"flue-frontend/pkg/audit"
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+)
+
+// recordAudit appends the outcome of a generation to the audit log. Failing
+// to record it is logged but does not fail the generation.
+func (s *Server) recordAudit(ctx context.Context, client string, p params.Params, data *ResultView, err error) {
+	e := audit.Entry{Time: time.Now(), Client: client, Params: p, Outcome: "done"}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		e.Outcome = "canceled"
+	case err != nil:
+		e.Outcome = "failed"
+		var se *statusError
+		if errors.As(err, &se) {
+			e.Error = se.Message
+		} else {
+			e.Error = err.Error()
+		}
+	default:
+		e.GenTime = data.GenTime
+		e.ImageID = data.ID
+		e.NSFW = data.NSFW
+		e.SafetyAction = data.SafetyAction
+	}
+	if err := s.audit.Record(e); err != nil {
+		log.Error("Failed to write audit log", "error", err)
+	}
+}
+
+// reopenAuditOnHangup reopens the audit log whenever the process receives
+// SIGHUP, so it can be rotated, until ctx is done.
+func (s *Server) reopenAuditOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := s.audit.Reopen(); err != nil {
+				log.Error("Failed to reopen audit log", "error", err)
+				continue
+			}
+			log.Info("Reopened audit log", "path", s.AuditLog)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"flue-frontend/pkg/ids"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// batchStatus is the aggregate progress of a batch.
+type batchStatus struct {
+	ID        string     `json:"id"`
+	Total     int        `json:"total"`
+	Done      int        `json:"done"`
+	Failed    int        `json:"failed"`
+	Canceled  int        `json:"canceled"`
+	Remaining int        `json:"remaining"`
+	Jobs      []batchJob `json:"jobs"`
+	// DownloadURL serves the finished images as a zip archive, if they are
+	// archived.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// batchJob is a job of a batch along with where to retrieve it.
+type batchJob struct {
+	jobs.Summary
+	URL string `json:"url"`
+}
+
+// newBatchStatus aggregates the jobs of a batch, linking a zip download of
+// its images once any is done if archived is set.
+func newBatchStatus(id string, list []jobs.Job, archived bool) batchStatus {
+	b := batchStatus{ID: id, Total: len(list), Jobs: make([]batchJob, len(list))}
+	for i, j := range list {
+		switch j.Status {
+		case jobs.Done:
+			b.Done++
+		case jobs.Failed:
+			b.Failed++
+		case jobs.Canceled:
+			b.Canceled++
+		default:
+			b.Remaining++
+		}
+		b.Jobs[i] = batchJob{Summary: j.Summary(), URL: "/jobs/" + j.ID}
+	}
+	if archived && b.Done > 0 {
+		b.DownloadURL = "/batches/" + id + "/download.zip"
+	}
+	return b
+}
+
+// batchPrompts splits a batch's prompts field into its non-empty lines,
+// dropping repeated lines if dedupe is set.
+func batchPrompts(text string, dedupe bool) []string {
+	seen := make(map[string]bool)
+	var prompts []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (dedupe && seen[line]) {
+			continue
+		}
+		seen[line] = true
+		prompts = append(prompts, line)
+	}
+	return prompts
+}
+
+// submitBatch queues one job per line of the prompts field, sharing the
+// remaining parameters. The batch is rejected as a whole if any prompt is
+// invalid or the client lacks room for all of its jobs.
+func (s *Server) submitBatch(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	dedupe, _ := strconv.ParseBool(values("dedupe"))
+	if values("dedupe") == "on" {
+		dedupe = true
+	}
+	prompts := batchPrompts(values("prompts"), dedupe)
+	if len(prompts) == 0 {
+		return s.jobError(c, errorf(http.StatusBadRequest, "The batch has no prompts"))
+	}
+	if s.MaxBatchSize > 0 && len(prompts) > s.MaxBatchSize {
+		return s.jobError(c, errorf(http.StatusBadRequest, "The batch has %d prompts, more than the limit of %d", len(prompts), s.MaxBatchSize))
+	}
+
+	// Validate every prompt before queueing any of them.
+	all := make([]params.Params, len(prompts))
+	warnings := make([][]string, len(prompts))
+	for i, prompt := range prompts {
+		line := func(name string) string {
+			if name == "prompt" {
+				return prompt
+			}
+			return values(name)
+		}
+		all[i], warnings[i], err = s.parseParams(c, line)
+		if err != nil {
+			// The prompt of a line is not the one of the form.
+			return s.jobError(c, withValues(err, nil))
+		}
+	}
+
+	client := c.RealIP()
+	if err := s.clients.fits(client, len(prompts)); err != nil {
+		return s.jobError(c, err)
+	}
+	id, origin := ids.New(), s.origin(c)
+	for i, p := range all {
+		if _, err := s.enqueueJob(origin, jobs.Job{Params: p, Client: client, Owner: s.owner(c), Batch: id}, warnings[i]); err != nil {
+			for _, job := range s.jobs.Batch(id) {
+				s.jobs.Cancel(job.ID, client)
+			}
+			if errors.Is(err, errQueueFull) {
+				err = s.queueFull(c)
+			}
+			return s.jobError(c, err)
+		}
+	}
+	log.Info("Batch queued", "batch", id, "jobs", len(prompts), "client", client)
+
+	status := newBatchStatus(id, s.jobs.Batch(id), s.archive != nil)
+	switch {
+	case s.isHTMX(c):
+		return c.Render(http.StatusAccepted, "batch_status.html", status)
+	case strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON):
+		return c.JSON(http.StatusAccepted, status)
+	default:
+		return c.Redirect(http.StatusSeeOther, "/batches/"+id)
+	}
+}
+
+// visibleBatch returns the jobs of a batch that the client may see, as
+// visibleJob decides for each.
+func (s *Server) visibleBatch(c echo.Context, id string) []jobs.Job {
+	list := s.jobs.Batch(id)
+	if _, admin := s.optionalAdmin(c); admin {
+		return list
+	}
+	return slices.DeleteFunc(list, func(j jobs.Job) bool { return !s.owns(c, j.Owner) })
+}
+
+// getBatch reports the aggregate progress of a batch as JSON, as a fragment
+// for HTMX, or as an HTML page for browsers. Batches without a job the
+// client may see are not found.
+func (s *Server) getBatch(c echo.Context) error {
+	list := s.visibleBatch(c, c.Param("id"))
+	if len(list) == 0 {
+		return s.jobError(c, errorf(http.StatusNotFound, "Batch not found"))
+	}
+	status := newBatchStatus(c.Param("id"), list, s.archive != nil)
+	if s.isHTMX(c) {
+		return c.Render(http.StatusOK, "batch_status.html", status)
+	}
+	if s.acceptsHTML(c) {
+		return c.Render(http.StatusOK, "batch.html", map[string]any{
+			"batch": status,
+			"lang":  locale(c),
+		})
+	}
+	return c.JSON(http.StatusOK, status)
+}
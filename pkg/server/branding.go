@@ -0,0 +1,20 @@
+package server
+
+import "html/template"
+
+// Branding customizes the site for white-labeling without editing templates.
+// Templates reach it as .Branding.
+type Branding struct {
+	// Title replaces the site title.
+	Title string
+	// LogoURL is the URL of a logo shown next to the title.
+	LogoURL string
+	// FooterHTML is shown at the bottom of every page. It is trusted and
+	// rendered unescaped.
+	FooterHTML template.HTML
+	// BusyMessage replaces the default message shown when a submission is
+	// rejected because the server is busy.
+	BusyMessage string
+	// BusyImageURL is the URL of an image shown with the busy message.
+	BusyImageURL string
+}
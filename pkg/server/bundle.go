@@ -0,0 +1,181 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// maxBundleImages is the number of images a gallery selection may download
+// at once.
+const maxBundleImages = 500
+
+// bundleMember is an image to include in a zip download.
+type bundleMember struct {
+	// ID is the archived image.
+	ID string
+	// Job is the job that generated the image, if known.
+	Job string
+	// Missing, if set, explains why the member has no image.
+	Missing string
+}
+
+// bundleManifest lists the recipes of the images in a zip download, along
+// with the members left out.
+type bundleManifest struct {
+	CreatedAt time.Time     `json:"created_at"`
+	Batch     string        `json:"batch,omitempty"`
+	Images    []bundleImage `json:"images"`
+	Skipped   []bundleSkip  `json:"skipped,omitempty"`
+}
+
+type bundleImage struct {
+	File   string         `json:"file"`
+	Job    string         `json:"job,omitempty"`
+	Recipe store.Metadata `json:"recipe"`
+}
+
+type bundleSkip struct {
+	ID     string `json:"id,omitempty"`
+	Job    string `json:"job,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// writeBundle streams a zip archive of the images of members to w, one
+// image at a time, followed by a manifest.json of their recipes. Members
+// that are missing or deleted meanwhile are listed in the manifest instead.
+func (s *Server) writeBundle(ctx context.Context, w *zip.Writer, manifest bundleManifest, members []bundleMember) error {
+	manifest.Images = []bundleImage{}
+	for i, m := range members {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if m.Missing != "" {
+			manifest.Skipped = append(manifest.Skipped, bundleSkip{ID: m.ID, Job: m.Job, Reason: m.Missing})
+			continue
+		}
+		meta, err := s.archive.Metadata(ctx, m.ID)
+		var data []byte
+		if err == nil {
+			data, _, err = s.archive.Get(ctx, m.ID)
+		}
+		if errors.Is(err, archive.ErrNotFound) {
+			manifest.Skipped = append(manifest.Skipped, bundleSkip{ID: m.ID, Job: m.Job, Reason: "image not found"})
+			continue
+		}
+		if err != nil {
+			log.Warn("Failed to read image for download", "id", m.ID, "error", err)
+			manifest.Skipped = append(manifest.Skipped, bundleSkip{ID: m.ID, Job: m.Job, Reason: "image could not be read"})
+			continue
+		}
+
+		// Number the files so equal recipes do not clash and the selection
+		// order is kept.
+		name, _ := downloadName(meta)
+		name = fmt.Sprintf("%03d_%s", i+1, name)
+		// Images are compressed already.
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: meta.CreatedAt})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		// Downloads are open to everyone, so leave out who generated it.
+		meta.Client = ""
+		meta.Owner = ""
+		manifest.Images = append(manifest.Images, bundleImage{File: name, Job: m.Job, Recipe: meta})
+	}
+
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.CreatedAt})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// serveBundle streams a zip download of members under the given file name.
+func (s *Server) serveBundle(c echo.Context, filename string, manifest bundleManifest, members []bundleMember) error {
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "application/zip")
+	h.Set(echo.HeaderContentDisposition, contentDisposition(filename, filename))
+	c.Response().WriteHeader(http.StatusOK)
+	if err := s.writeBundle(c.Request().Context(), zip.NewWriter(c.Response()), manifest, members); err != nil {
+		// The response has started, so the client only sees a truncated
+		// archive.
+		log.Error("Failed to write zip download", "file", filename, "error", err)
+	}
+	return nil
+}
+
+// batchDownload streams a zip archive of the archived images of a batch,
+// noting in its manifest the jobs without one. Only the jobs the client may
+// see are included.
+func (s *Server) batchDownload(c echo.Context) error {
+	id := c.Param("id")
+	list := s.visibleBatch(c, id)
+	if len(list) == 0 {
+		return s.jobError(c, errorf(http.StatusNotFound, "Batch not found"))
+	}
+	members := make([]bundleMember, len(list))
+	for i, j := range list {
+		members[i] = bundleMember{Job: j.ID}
+		switch result, ok := jobResult(j); {
+		case j.Status != jobs.Done:
+			members[i].Missing = "job is " + string(j.Status)
+		case !ok || result.ID == "":
+			members[i].Missing = "image was not archived"
+		default:
+			members[i].ID = result.ID
+		}
+	}
+	manifest := bundleManifest{CreatedAt: time.Now(), Batch: id}
+	return s.serveBundle(c, "flue-batch-"+id+".zip", manifest, members)
+}
+
+// selectionDownload streams a zip archive of the archived images whose IDs
+// are posted as id fields, in the order given. Images of other sessions are
+// listed as not found.
+func (s *Server) selectionDownload(c echo.Context) error {
+	form, err := c.FormParams()
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "Invalid form"))
+	}
+	ids := form["id"]
+	if len(ids) == 0 {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No images selected"))
+	}
+	if len(ids) > maxBundleImages {
+		return s.jobError(c, errorf(http.StatusBadRequest, "At most %d images can be downloaded at once", maxBundleImages))
+	}
+	_, admin := s.optionalAdmin(c)
+	members := make([]bundleMember, len(ids))
+	for i, id := range ids {
+		members[i] = bundleMember{ID: id}
+		if admin || !s.PerUserGalleries {
+			continue
+		}
+		meta, err := s.archive.Metadata(c.Request().Context(), id)
+		if err == nil && !s.owns(c, meta.Owner) {
+			members[i].Missing = "image not found"
+		}
+	}
+	now := time.Now()
+	return s.serveBundle(c, "flue-images-"+now.Format("20060102-150405")+".zip", bundleManifest{CreatedAt: now}, members)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBatchDownload(t *testing.T) {
+	flue := newFakeBackend(t, 0)
+	ts := startServer(t, flue.URL, func(s *Server) { s.ImageStore = StoreMemory })
+
+	form := generationForm("")
+	form.Set("prompts", "a lighthouse\na harbor")
+	resp := ts.post(t, "/batches", form, http.Header{"Accept": {"application/json"}})
+	var batch struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&batch)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/batches/"+batch.ID, nil)
+	req.Header.Set("Accept", "application/json")
+	var status struct{ Jobs []struct{ ID string } }
+	do(t, http.DefaultClient, req, &status)
+	for _, job := range status.Jobs {
+		waitForJob(t, ts, job.ID)
+	}
+
+	for _, path := range []string{"/batches/" + batch.ID + "/download.zip", "/batch/" + batch.ID + "/download"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+			t.Fatalf("GET %s: status %d, Content-Type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		// Both images and the manifest.
+		if len(zr.File) != 3 {
+			t.Errorf("GET %s: %d files, want 3", path, len(zr.File))
+		}
+	}
+}
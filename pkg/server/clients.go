@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/queue"
+
+	"github.com/labstack/echo/v4"
+)
+
+// clientLimiters gives each client its own limiter, admitting at most
+// maxRunning of its generations and queueing up to maxQueued more ahead of
+// the shared queue. Zero limits are unlimited. Idle clients are forgotten.
+type clientLimiters struct {
+	maxRunning int
+	maxQueued  int
+
+	mu      sync.Mutex
+	clients map[string]*queue.Limiter
+}
+
+func newClientLimiters(maxRunning, maxQueued int) *clientLimiters {
+	return &clientLimiters{
+		maxRunning: maxRunning,
+		maxQueued:  maxQueued,
+		clients:    make(map[string]*queue.Limiter),
+	}
+}
+
+// join takes a place in the client's queue. It fails with a 429 naming the
+// limit and the client's usage if the client already has too many
+// generations in flight.
+func (cl *clientLimiters) join(client string) (*queue.Ticket, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for key, l := range cl.clients {
+		if key != client && l.Running() == 0 && l.Queued() == 0 {
+			delete(cl.clients, key)
+		}
+	}
+	l, ok := cl.clients[client]
+	if !ok {
+		l = queue.NewLimiter(cl.maxRunning, cl.maxQueued)
+		cl.clients[client] = l
+	}
+
+	t, err := l.Join(nil)
+	if errors.Is(err, queue.ErrQueueFull) {
+		return nil, tooManyGenerations(&jobs.Usage{
+			Running: l.Running(), Queued: l.Queued(), MaxRunning: cl.maxRunning, MaxQueued: cl.maxQueued,
+		})
+	}
+	return t, err
+}
+
+// tooManyGenerations returns the 429 rejecting a generation of a client
+// with usage u, naming its limits and usage.
+func tooManyGenerations(u *jobs.Usage) error {
+	return errorf(http.StatusTooManyRequests,
+		"Too many generations in progress: you have %d running (limit %s) and %d queued (limit %s)",
+		u.Running, formatLimit(u.MaxRunning), u.Queued, formatLimit(u.MaxQueued))
+}
+
+// fits checks that n more generations of the client would be admitted. It
+// fails with a 429 naming how many more fit if they would not.
+func (cl *clientLimiters) fits(client string, n int) error {
+	if cl.maxRunning <= 0 || cl.maxQueued <= 0 {
+		return nil
+	}
+	u := cl.usage(client)
+	room := max(0, u.MaxRunning-u.Running) + max(0, u.MaxQueued-u.Queued)
+	if n > room {
+		return errorf(http.StatusTooManyRequests,
+			"The batch of %d generations does not fit: you have room for %d more (%d running, limit %d; %d queued, limit %d)",
+			n, room, u.Running, u.MaxRunning, u.Queued, u.MaxQueued)
+	}
+	return nil
+}
+
+// usage returns the current counts and limits of a client.
+func (cl *clientLimiters) usage(client string) *jobs.Usage {
+	cl.mu.Lock()
+	l, ok := cl.clients[client]
+	cl.mu.Unlock()
+	u := &jobs.Usage{MaxRunning: cl.maxRunning, MaxQueued: cl.maxQueued}
+	if ok {
+		u.Running = l.Running()
+		u.Queued = l.Queued()
+	}
+	return u
+}
+
+// formatLimit renders a per-client limit, where zero means none.
+func formatLimit(n int) string {
+	if n <= 0 {
+		return "none"
+	}
+	return fmt.Sprint(n)
+}
+
+// ipExtractor returns how client IPs are determined. Forwarding headers are
+// only honored from the given trusted proxy ranges; without any, the peer
+// address is used so clients cannot spoof their IP.
+func ipExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range trustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// uncompressedPrefixes are the path prefixes of images, which are
+// compressed already.
+var uncompressedPrefixes = []string{"/generated/", "/raw/", "/thumbs/", "/tiled/"}
+
+// uncompressedSuffixes are the path suffixes of zip archives, such as the
+// export, which are compressed already, and of event streams and
+// WebSockets, whose messages gzip would hold back until its buffer fills.
+var uncompressedSuffixes = []string{".zip", "/download", "/export", "/events", "/ws"}
+
+// skipCompression reports whether the response to a request is sent
+// without gzip: images, archives, event streams and WebSockets, and the
+// Prometheus metrics, which compress themselves.
+func skipCompression(c echo.Context) bool {
+	path := c.Request().URL.Path
+	if path == "/metrics" || strings.HasPrefix(path, "/progress/") {
+		return true
+	}
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/event-stream") {
+		return true
+	}
+	for _, prefix := range uncompressedPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, suffix := range uncompressedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
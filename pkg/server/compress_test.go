@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gzipClient asks for gzipped responses and leaves them compressed, so
+// their Content-Encoding can be checked.
+var gzipClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+// getEncoding sends req with gzip accepted and returns the
+// Content-Encoding of the response.
+func getEncoding(t *testing.T, req *http.Request) string {
+	t.Helper()
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := gzipClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", req.URL.Path, resp.StatusCode)
+	}
+	return resp.Header.Get("Content-Encoding")
+}
+
+func TestCompressionSkipsCompressedContent(t *testing.T) {
+	flue := newFakeBackend(t, 0)
+	ts := startServer(t, flue.URL, func(s *Server) {
+		withAdmin(s)
+		// Compress whatever is not skipped, however small.
+		s.CompressionMinBytes = 1
+	})
+	t.Cleanup(gzipClient.CloseIdleConnections)
+
+	resp := ts.post(t, "/", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}})
+	var result struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "gzip"},
+		{"/generated/" + result.ID, ""},
+		{"/generated/" + result.ID + "/download", ""},
+		{"/thumbs/" + result.ID, ""},
+		{"/export", ""},
+	}
+	for _, tt := range tests {
+		req := adminRequest(t, http.MethodGet, ts.URL+tt.path, nil)
+		if got := getEncoding(t, req); got != tt.want {
+			t.Errorf("GET %s: Content-Encoding %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionFlushesEvents(t *testing.T) {
+	flue := newFakeBackend(t, 1500*time.Millisecond)
+	ts := startServer(t, flue.URL, func(s *Server) {
+		s.StreamProgress = true
+	})
+	t.Cleanup(gzipClient.CloseIdleConnections)
+
+	resp := ts.post(t, "/jobs", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}})
+	var job struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+job.ID+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = gzipClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("event stream has Content-Encoding %q", ce)
+	}
+
+	// The first progress event must arrive while the job still runs,
+	// rather than being held back in a compression buffer.
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event: progress") {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-flue.finished:
+		t.Error("first progress event arrived after the generation finished")
+	default:
+	}
+}
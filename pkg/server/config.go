@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// redacted replaces secrets in the reported configuration.
+const redacted = "[redacted]"
+
+// adminConfig reports the effective configuration as JSON, once flags,
+// environment variables and defaults have been resolved, along with the
+// limits currently in force. Secrets are redacted.
+func (s *Server) adminConfig(c echo.Context) error {
+	log.Info("Admin read the configuration", "admin", adminIdentity(c))
+	return c.JSON(http.StatusOK, s.effectiveConfig())
+}
+
+// effectiveConfig returns the settings of s keyed by their snake case names,
+// redacting credentials. Settings are listed one by one, so a new one, which
+// may well be a secret, is left out until it is added here.
+func (s *Server) effectiveConfig() map[string]any {
+	backends := make([]string, len(s.Backends))
+	for i, b := range s.Backends {
+		backends[i] = redactURL(b)
+	}
+	return map[string]any{
+		"host":                  s.Host,
+		"port":                  s.Port,
+		"backends":              backends,
+		"breaker_threshold":     s.BreakerThreshold,
+		"breaker_cooldown":      s.BreakerCooldown.String(),
+		"backend_timeout":       s.BackendTimeout.String(),
+		"slow_threshold":        s.SlowThreshold.String(),
+		"backend_headers":       redactValues(s.BackendHeaders),
+		"forward_headers":       s.ForwardHeaders,
+		"signing_secret":        redactString(s.SigningSecret),
+		"signing_algorithm":     s.SigningAlgorithm,
+		"signature_header":      s.SignatureHeader,
+		"payload_keys":          s.PayloadKeys,
+		"probe_backend_version": s.ProbeBackendVersion,
+		"max_backend_response":  s.MaxBackendResponse,
+		"default_quality":       s.DefaultQuality,
+		"default_model":         s.DefaultModel,
+		"available_models":      s.AvailableModels,
+		"model_config":          s.ModelConfig,
+		"model_defaults":        s.ModelDefaults,
+		"example_prompts":       s.ExamplePrompts,
+		"examples":              s.Examples,
+		"png_metadata":          s.PNGMetadata,
+		"version":               s.Version,
+		"safety_mode":           s.SafetyMode,
+		"audit_log":             s.AuditLog,
+		"image_store":           s.ImageStore,
+		"output_dir":            s.OutputDir,
+		"s3": map[string]any{
+			"endpoint":   redactURL(s.S3.Endpoint),
+			"bucket":     s.S3.Bucket,
+			"prefix":     s.S3.Prefix,
+			"region":     s.S3.Region,
+			"access_key": redactString(s.S3.AccessKey),
+			"secret_key": redactString(s.S3.SecretKey),
+		},
+		"presign_expiry":            s.PresignExpiry.String(),
+		"share_expiry":              s.ShareExpiry.String(),
+		"base_url":                  redactURL(s.BaseURL),
+		"feed_size":                 s.FeedSize,
+		"feed_scope":                s.FeedScope,
+		"retention_max_age":         s.RetentionMaxAge.String(),
+		"retention_max_bytes":       s.RetentionMaxBytes,
+		"retention_max_count":       s.RetentionMaxCount,
+		"retention_interval":        s.RetentionInterval.String(),
+		"retention_dry_run":         s.RetentionDryRun,
+		"thumbnail_size":            s.ThumbnailSize,
+		"thumbnail_format":          s.ThumbnailFormat,
+		"gallery_page_size":         s.GalleryPageSize,
+		"per_user_galleries":        s.PerUserGalleries,
+		"legacy_owner":              redactString(s.LegacyOwner),
+		"image_cache_size":          s.ImageCacheSize,
+		"inline_max_bytes":          s.InlineMaxBytes,
+		"preview_max_dimension":     s.PreviewMaxDimension,
+		"alt_text":                  s.AltText,
+		"blocking_submit":           s.BlockingSubmit,
+		"max_concurrent":            s.MaxConcurrent,
+		"max_queued":                s.MaxQueued,
+		"max_queue_wait":            s.MaxQueueWait.String(),
+		"max_running_per_client":    s.MaxRunningPerClient,
+		"max_queued_per_client":     s.MaxQueuedPerClient,
+		"trusted_proxies":           s.TrustedProxies,
+		"prompt_filter":             s.PromptFilter != nil,
+		"blocked_patterns":          s.BlockedPatterns,
+		"redact_filtered_prompts":   s.RedactFilteredPrompts,
+		"dedup_window":              s.DedupWindow.String(),
+		"max_batch_size":            s.MaxBatchSize,
+		"max_schedule_horizon":      s.MaxScheduleHorizon.String(),
+		"job_ttl":                   s.JobTTL.String(),
+		"job_history":               s.JobHistory.String(),
+		"database":                  redactURL(s.Database),
+		"job_store":                 redactURL(s.JobStore),
+		"limits":                    s.Limits,
+		"health_poll_interval":      s.HealthPollInterval.String(),
+		"connection_check_interval": s.ConnectionCheckInterval.String(),
+		"capabilities_refresh":      s.CapabilitiesRefresh.String(),
+		"stream_progress":           s.StreamProgress,
+		"warmup_on_start":           s.WarmupOnStart,
+		"warmup_params":             s.WarmupParams,
+		"drain_delay":               s.DrainDelay.String(),
+		"drain_timeout":             s.DrainTimeout.String(),
+		"no_compression":            s.NoCompression,
+		"compression_min_bytes":     s.CompressionMinBytes,
+		"admin_users":               redactValues(s.AdminUsers),
+		"branding": map[string]any{
+			"title":          s.Branding.Title,
+			"logo_url":       s.Branding.LogoURL,
+			"footer_html":    s.Branding.FooterHTML,
+			"busy_message":   s.Branding.BusyMessage,
+			"busy_image_url": s.Branding.BusyImageURL,
+		},
+		"time_format":      s.TimeFormat,
+		"time_zone":        s.TimeZone,
+		"prefs_secret":     redactString(s.PrefsSecret),
+		"api_only":         s.APIOnly,
+		"maintenance_mode": s.MaintenanceMode,
+		"otlp_endpoint":    redactURL(s.OTLPEndpoint),
+		"debug":            s.Debug,
+		"pprof":            s.Pprof,
+		"effective_limits": s.currentLimits(),
+	}
+}
+
+// redactURL drops the user info and query of a URL, either of which may
+// carry credentials, keeping where it points.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactString(raw)
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return u.String()
+}
+
+// redactValues keeps the keys of m, such as header or user names, and hides
+// their values.
+func redactValues(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k := range m {
+		out[k] = redacted
+	}
+	return out
+}
+
+// redactString hides a secret, showing only whether it is set.
+func redactString(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// csrfField is the form field plain forms carry the CSRF token in, while
+// HTMX sends it in the X-CSRF-Token header set on the page body.
+const csrfField = "_csrf"
+
+// csrf returns the middleware rejecting requests that change state unless
+// they carry the token of the CSRF cookie, which pages put in .Globals.CSRF.
+func (s *Server) csrf() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        skipCSRF,
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken + ",form:" + csrfField,
+		CookieName:     csrfField,
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
+		ErrorHandler: func(err error, c echo.Context) error {
+			return errorf(http.StatusForbidden, "This form has expired, reload the page and try again")
+		},
+	})
+}
+
+// skipCSRF reports whether a request goes without the CSRF check. Browsers
+// without Sec-Fetch-Site, which older ones and some webviews lack, still
+// name the page a request comes from by Origin or Referer, so only those
+// naming this site, or none at all like API clients and scripts, skip it.
+// Of browser requests that change nothing, only page loads get a token,
+// which leaves images and fragments cacheable without Vary: Cookie.
+func skipCSRF(c echo.Context) bool {
+	h := c.Request().Header
+	if h.Get("Sec-Fetch-Site") == "" {
+		return !crossOrigin(c.Request())
+	}
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return h.Get("Sec-Fetch-Dest") != "document"
+	}
+	return false
+}
+
+// crossOrigin reports whether the Origin header of r, or else its Referer,
+// names a host other than the one r was sent to. Requests naming neither
+// are not cross-origin, while an opaque "null" origin is.
+func crossOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	if from == "" {
+		return false
+	}
+	u, err := url.Parse(from)
+	return err != nil || u.Host != r.Host
+}
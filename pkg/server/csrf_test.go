@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// pageToken matches the CSRF token a page sends HTMX requests with.
+var pageToken = regexp.MustCompile(`hx-headers='{"X-CSRF-Token": "(\w+)"}'`)
+
+func TestCSRF(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, nil)
+	client := sessionClient(t)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	// browser returns a request as a browser sends it from a page of the
+	// site, or of another site with crossSite.
+	browser := func(method, path string, body io.Reader, crossSite bool) *http.Request {
+		req, err := http.NewRequest(method, ts.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		if crossSite {
+			req.Header.Set("Sec-Fetch-Site", "cross-site")
+		}
+		if method == http.MethodGet {
+			req.Header.Set("Sec-Fetch-Dest", "document")
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		return req
+	}
+
+	resp, err := client.Do(browser(http.MethodGet, "/", nil, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pageToken.FindSubmatch(page)
+	if m == nil {
+		t.Fatalf("page lacks the CSRF token:\n%s", page)
+	}
+	token := string(m[1])
+	if !strings.Contains(string(page), `name="_csrf" value="`+token+`"`) {
+		t.Errorf("theme form lacks the CSRF token")
+	}
+
+	theme := func(token string) string { return url.Values{"theme": {"dark"}, "_csrf": {token}}.Encode() }
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"forged form", browser(http.MethodPost, "/prefs/theme", strings.NewReader(theme("")), true), http.StatusForbidden},
+		{"wrong token", browser(http.MethodPost, "/prefs/theme", strings.NewReader(theme("guessed")), true), http.StatusForbidden},
+		{"form", browser(http.MethodPost, "/prefs/theme", strings.NewReader(theme(token)), false), http.StatusSeeOther},
+		{"htmx", func() *http.Request {
+			req := browser(http.MethodPost, "/prefs/theme", strings.NewReader("theme=light"), false)
+			req.Header.Set("HX-Request", "true")
+			req.Header.Set("X-CSRF-Token", token)
+			return req
+		}(), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(t, client, tt.req, nil); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Browsers without Sec-Fetch-Site are told apart by the page they post
+	// from.
+	legacy := func(header, from, token string) *http.Request {
+		req := browser(http.MethodPost, "/prefs/theme", strings.NewReader(theme(token)), false)
+		req.Header.Del("Sec-Fetch-Site")
+		req.Header.Set(header, from)
+		return req
+	}
+	for _, tt := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"legacy forged form", legacy("Origin", "https://evil.example", ""), http.StatusForbidden},
+		{"legacy forged referer", legacy("Referer", "https://evil.example/page", ""), http.StatusForbidden},
+		{"legacy opaque origin", legacy("Origin", "null", ""), http.StatusForbidden},
+		{"legacy cross-origin form", legacy("Origin", "https://evil.example", token), http.StatusSeeOther},
+		{"legacy same-origin form", legacy("Origin", ts.URL, ""), http.StatusSeeOther},
+	} {
+		if got := do(t, client, tt.req, nil); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Clients other than browsers have no cookies to forge requests with.
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/prefs/theme", strings.NewReader(theme("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := do(t, http.DefaultClient, req, nil); got == http.StatusForbidden {
+		t.Errorf("API client: status %d", got)
+	}
+}
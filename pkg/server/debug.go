@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"flue-frontend/pkg/backend"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// rawGenerate forwards a generation to the backend and returns its JSON
+// response verbatim, plus a "_meta" object with timing and the request ID.
+// It is only registered in debug mode.
+func (s *Server) rawGenerate(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jsonError(c, err)
+	}
+	p, _, err := s.parseParams(c, values)
+	if err != nil {
+		return s.jsonError(c, err)
+	}
+
+	ctx := withRequestID(backend.WithHeaders(c.Request().Context(), s.forwardedHeaders(c)), c)
+	release, err := s.acquireSlot(ctx, c.RealIP(), nil)
+	if errors.Is(err, errQueueFull) {
+		err = s.queueFull(c)
+	}
+	if err != nil {
+		return s.jsonError(c, err)
+	}
+	defer release()
+
+	start := time.Now()
+	raw, err := s.client.GenerateRaw(ctx, p.Payload())
+	if err != nil {
+		log.Error("Raw backend request failed", "error", err)
+		if errors.Is(err, backend.ErrNoBackends) {
+			return s.jsonError(c, errorf(http.StatusServiceUnavailable, "No Flue server is currently available"))
+		}
+		if errors.Is(err, backend.ErrTimeout) {
+			return s.jsonError(c, errorf(http.StatusGatewayTimeout, "The Flue server did not respond in time"))
+		}
+		if errors.Is(err, backend.ErrResponseTooLarge) {
+			return s.jsonError(c, errorf(http.StatusBadGateway, "The Flue server sent an oversized response"))
+		}
+		return s.jsonError(c, errorf(http.StatusBadGateway, "Failed to call Flue server: %v", err))
+	}
+
+	// Keep the backend's fields byte for byte; a body that is not a JSON
+	// object is returned as a string.
+	body := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw.Body, &body); err != nil {
+		body = map[string]json.RawMessage{}
+		body["_body"], _ = json.Marshal(string(raw.Body))
+	}
+	body["_meta"], _ = json.Marshal(map[string]any{
+		"gen_time":       roundFloat(time.Since(start).Seconds(), 3),
+		"backend":        raw.Backend,
+		"backend_status": raw.Status,
+		"request_id":     c.Response().Header().Get(echo.HeaderXRequestID),
+	})
+	return c.JSON(http.StatusOK, body)
+}
+
+// requestIDKey is the context key carrying the ID of the client request a
+// generation is made for.
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the ID of the request of c, so the
+// backend requests made for it can be correlated with it.
+func withRequestID(ctx context.Context, c echo.Context) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, c.Response().Header().Get(echo.HeaderXRequestID))
+}
+
+// logExchange logs the payload of a backend request and the status and
+// length of its response. It is only used in debug mode, as payloads
+// include prompts.
+func logExchange(ctx context.Context, e backend.Exchange) {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	keyvals := []any{"request_id", requestID, "backend", e.Backend, "payload", string(e.Payload),
+		"status", e.Status, "length", e.Length, "duration", e.Duration.Round(time.Millisecond)}
+	if e.Err != nil {
+		keyvals = append(keyvals, "error", e.Err)
+	}
+	log.Info("Backend exchange", keyvals...)
+}
+
+// registerPprof serves the runtime profiles of net/http/pprof under
+// /debug/pprof behind the admin authentication.
+func (s *Server) registerPprof() {
+	g := s.Echo.Group("/debug/pprof", s.adminAuth())
+	g.GET("/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	g.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// Named profiles such as heap and goroutine.
+	g.GET("/:profile", func(c echo.Context) error {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+}
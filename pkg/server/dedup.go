@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// dedupCall is an operation that identical requests within the window share.
+type dedupCall[T any] struct {
+	done    chan struct{}
+	started time.Time
+	value   T
+	err     error
+
+	// waiters is the number of requests waiting for the outcome, and cancel
+	// cancels the operation once none is left.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// deduper collapses identical requests arriving within a short window, such
+// as an accidental double submit, into a single operation.
+type deduper[T any] struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*dedupCall[T]
+}
+
+func newDeduper[T any](window time.Duration) *deduper[T] {
+	return &deduper[T]{window: window, calls: make(map[string]*dedupCall[T])}
+}
+
+// do runs fn, unless an operation with the same key started within the
+// window, in which case it waits for that operation and returns its outcome
+// with shared set. The operation runs on a context detached from that of
+// the request starting it, keeping its values, so every request waits only
+// as long as its own ctx allows without failing the operation for the
+// others. It is canceled once all of them have given up.
+func (d *deduper[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (value T, err error, shared bool) {
+	if d.window <= 0 {
+		value, err = fn(ctx)
+		return value, err, false
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	for k, call := range d.calls {
+		if now.Sub(call.started) > d.window && isClosed(call.done) {
+			delete(d.calls, k)
+		}
+	}
+	call, shared := d.calls[key]
+	if !shared || now.Sub(call.started) > d.window {
+		shared = false
+		opCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &dedupCall[T]{done: make(chan struct{}), started: now, cancel: cancel}
+		d.calls[key] = call
+		go func() {
+			defer close(call.done)
+			defer cancel()
+			call.value, call.err = fn(opCtx)
+		}()
+	}
+	call.waiters++
+	d.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err, shared
+	case <-ctx.Done():
+		d.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			// Later requests start over rather than share the cancellation.
+			if d.calls[key] == call {
+				delete(d.calls, key)
+			}
+		}
+		d.mu.Unlock()
+		return value, ctx.Err(), shared
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// dedupKey identifies a request by its client, its session with
+// PerUserGalleries, which may be one of several behind the same address,
+// and its contents, such as its generation parameters.
+func dedupKey(client, owner string, v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(append([]byte(client+"\x00"+owner+"\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
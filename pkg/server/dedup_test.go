@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeduperOutlivesFirstCaller(t *testing.T) {
+	d := newDeduper[string](time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	op := func(ctx context.Context) (string, error) {
+		close(started)
+		select {
+		case <-release:
+			return "done", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err, _ := d.do(first, "key", op)
+		firstErr <- err
+	}()
+	<-started
+
+	second := make(chan string, 1)
+	go func() {
+		value, err, shared := d.do(context.Background(), "key", op)
+		if err != nil || !shared {
+			t.Errorf("second caller got %v, shared %v", err, shared)
+		}
+		second <- value
+	}()
+	// Let the second caller join before the first one gives up.
+	time.Sleep(50 * time.Millisecond)
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("first caller got %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if value := <-second; value != "done" {
+		t.Errorf("second caller got %q, want %q", value, "done")
+	}
+}
+
+func TestDeduperCancelsAbandonedOperation(t *testing.T) {
+	d := newDeduper[string](time.Minute)
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err, _ := d.do(ctx, "key", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "", ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation was not canceled once its only caller gave up")
+	}
+
+	// A later identical call starts over.
+	value, err, shared := d.do(context.Background(), "key", func(context.Context) (string, error) { return "again", nil })
+	if value != "again" || err != nil || shared {
+		t.Errorf("later call got %q, %v, shared %v", value, err, shared)
+	}
+}
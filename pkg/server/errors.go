@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// retryForms are the forms of the UI whose failed submissions the error
+// fragment fills in again, highlighting invalid input, or offers to submit
+// again.
+var retryForms = map[string]bool{"promptForm": true, "batchForm": true}
+
+// errorView is an error as shown to clients, by the error.html fragment or
+// as a JSON error object.
+type errorView struct {
+	Status    int    `json:"-"`
+	Message   string `json:"error"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Field is the form field holding the invalid input, if any.
+	Field string `json:"field,omitempty"`
+	// Form is the ID of the form whose submission failed, if any, and
+	// Values the fields it was submitted with, to fill it in again.
+	Form   string            `json:"-"`
+	Values map[string]string `json:"-"`
+	// Retry is the ID of the form to submit again, if the error may pass.
+	Retry string `json:"-"`
+	// Busy is whether the form was rejected for load, by rate or
+	// concurrency limits, rather than for its input.
+	Busy bool `json:"-"`
+}
+
+// errorView returns how err is shown to the client of c.
+func (s *Server) errorView(c echo.Context, err error) errorView {
+	status, msg := s.errorStatus(c, err)
+	v := errorView{
+		Status:    status,
+		Message:   msg,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		v.Detail = se.Detail
+		v.Field = se.Field
+		v.Values = se.Values
+	}
+	form := c.Request().Header.Get("HX-Trigger")
+	if retryForms[form] {
+		v.Form = form
+	}
+	if retryForms[form] && (status >= http.StatusInternalServerError || status == http.StatusTooManyRequests) {
+		v.Retry = form
+	}
+	v.Busy = v.Form != "" && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable)
+	return v
+}
+
+// jobError writes err in the format the client asked for: the error
+// fragment for HTMX requests and a JSON error object otherwise.
+func (s *Server) jobError(c echo.Context, err error) error {
+	if s.isHTMX(c) {
+		return s.errorFragment(c, err)
+	}
+	return s.jsonError(c, err)
+}
+
+// pageError writes err as the error fragment for HTMX requests and as the
+// error page for pages loaded by the browser.
+func (s *Server) pageError(c echo.Context, err error) error {
+	if s.isHTMX(c) {
+		return s.errorFragment(c, err)
+	}
+	return s.errorPage(c, err)
+}
+
+// errorPage writes err as a whole page: the not found page for 404 errors
+// and the error page otherwise.
+func (s *Server) errorPage(c echo.Context, err error) error {
+	v := s.errorView(c, err)
+	page := "error_page.html"
+	if v.Status == http.StatusNotFound {
+		page = "404.html"
+	}
+	return c.Render(v.Status, page, map[string]any{"error": v, "lang": locale(c)})
+}
+
+// errorFragment writes err as the error fragment, or as the busy fragment
+// for form submissions rejected for load, which keeps the result area
+// friendly during load spikes.
+func (s *Server) errorFragment(c echo.Context, err error) error {
+	v := s.errorView(c, err)
+	if v.Busy {
+		return c.Render(v.Status, "busy.html", map[string]any{"error": v})
+	}
+	return c.Render(v.Status, "error.html", v)
+}
+
+// jsonError writes err as a JSON error object with its HTTP status.
+func (s *Server) jsonError(c echo.Context, err error) error {
+	v := s.errorView(c, err)
+	return c.JSON(v.Status, v)
+}
+
+// routeErrors are the messages of the errors Echo itself returns, such as
+// for unknown paths, by status.
+var routeErrors = map[int]string{
+	http.StatusNotFound:              "Page not found",
+	http.StatusMethodNotAllowed:      "Method not allowed",
+	http.StatusRequestEntityTooLarge: "Request body too large",
+}
+
+// handleError is the Echo error handler, writing the errors handlers return
+// rather than write themselves, Echo's own errors such as for unknown paths,
+// and panics recovered by the Recover middleware. Browsers get an error page,
+// HTMX requests the error fragment and everyone else a JSON error object.
+// Errors in responses already under way are only logged, since their
+// status has been sent.
+func (s *Server) handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		log.Debug("Error after response was written", "uri", c.Request().RequestURI, "error", err)
+		return
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		err = httpError(he)
+	}
+	if c.Request().Method == http.MethodHead {
+		status, _ := s.errorStatus(c, err)
+		err = c.NoContent(status)
+	} else if s.isHTMX(c) || !s.acceptsHTML(c) {
+		err = s.jobError(c, err)
+	} else {
+		err = s.errorPage(c, err)
+	}
+	if err != nil {
+		log.Error("Failed to write error response", "uri", c.Request().RequestURI, "error", err)
+	}
+}
+
+// httpError converts an error returned by Echo or its middleware into a
+// statusError, keeping the status but not messages meant for developers.
+func httpError(he *echo.HTTPError) error {
+	if msg, ok := routeErrors[he.Code]; ok {
+		return errorf(he.Code, msg)
+	}
+	if he.Code >= http.StatusInternalServerError {
+		return errorf(he.Code, "Internal server error")
+	}
+	if msg, ok := he.Message.(string); ok {
+		return errorf(he.Code, "%s", msg)
+	}
+	return errorf(he.Code, "%s", http.StatusText(he.Code))
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// submittedValues matches the submitted values the error fragment carries.
+var submittedValues = regexp.MustCompile(`(?s)<script type="application/json" class="submitted-values">(.*?)</script>`)
+
+func TestInvalidFieldErrorFragment(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	for name, blocking := range map[string]bool{"queued": false, "blocking": true} {
+		t.Run(name, func(t *testing.T) {
+			ts := startServer(t, backend.URL, func(s *Server) { s.BlockingSubmit = blocking })
+			form := generationForm("a lighthouse")
+			form.Set("width", "abc")
+			form.Set("seed", "7")
+			resp := ts.post(t, "/", form, http.Header{"Hx-Request": {"true"}, "Hx-Trigger": {"promptForm"}})
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			html := string(body)
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			for _, want := range []string{`data-invalid-field="width"`, `data-form="promptForm"`, "Width must be a whole number"} {
+				if !strings.Contains(html, want) {
+					t.Errorf("fragment lacks %s:\n%s", want, html)
+				}
+			}
+			m := submittedValues.FindStringSubmatch(html)
+			if m == nil {
+				t.Fatalf("fragment lacks the submitted values:\n%s", html)
+			}
+			var values map[string]string
+			if err := json.Unmarshal([]byte(m[1]), &values); err != nil {
+				t.Fatalf("submitted values %s: %v", m[1], err)
+			}
+			for name := range form {
+				if values[name] != form.Get(name) {
+					t.Errorf("submitted %s = %q, want %q", name, values[name], form.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestStreamErrorsAreNotPlainText(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, nil)
+	tests := []struct {
+		path    string
+		status  int
+		message string
+	}{
+		{"/progress/not.valid", http.StatusBadRequest, "Invalid progress ID"},
+		{"/jobs/missing/events", http.StatusNotFound, "Job not found"},
+		{"/jobs/missing/ws", http.StatusNotFound, "Job not found"},
+	}
+	for _, tt := range tests {
+		for client, header := range map[string]http.Header{
+			"htmx": {"Hx-Request": {"true"}},
+			"json": {"Accept": {"application/json"}},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			req.Header = header
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("GET %s as %s: status %d, want %d", tt.path, client, resp.StatusCode, tt.status)
+			}
+			want := `"error":"` + tt.message
+			if client == "htmx" {
+				want = `<div class="alert alert-danger" role="alert">`
+			}
+			if !strings.Contains(string(body), want) || !strings.Contains(string(body), tt.message) {
+				t.Errorf("GET %s as %s: body %q lacks %s", tt.path, client, body, want)
+			}
+		}
+	}
+}
+
+func TestNumberErrorsAreTranslated(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, nil)
+	tests := []struct {
+		width, want string
+	}{
+		{"abc", "Die Breite muss eine ganze Zahl sein"},
+		{"99999999999999999999", "Die Breite muss zwischen"},
+		{"100000", "Die Breite muss zwischen"},
+	}
+	for _, tt := range tests {
+		form := generationForm("a lighthouse")
+		form.Set("width", tt.width)
+		resp := ts.post(t, "/", form, http.Header{"Accept": {"application/json"}, "Accept-Language": {"de"}})
+		var body struct{ Error string }
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || !strings.HasPrefix(body.Error, tt.want) {
+			t.Errorf("width %s: status %d, error %q, want %q", tt.width, resp.StatusCode, body.Error, tt.want)
+		}
+	}
+}
+
+func TestMissingImageErrors(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, withAdmin)
+	for _, path := range []string{"/raw/missing", "/tiled/missing", "/generated/missing", "/generated/missing/download"} {
+		for client, tt := range map[string]struct {
+			header http.Header
+			want   string
+		}{
+			"browser": {http.Header{"Accept": {"text/html"}}, "<h1 class=\"mb-3\">Page not found</h1>"},
+			"json":    {http.Header{"Accept": {"application/json"}}, `"error":"Image not found"`},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			req.Header = tt.header
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET %s as %s: status %d, want %d", path, client, resp.StatusCode, http.StatusNotFound)
+			}
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("GET %s as %s: body %q lacks %s", path, client, body, tt.want)
+			}
+		}
+	}
+}
+
+func TestPageErrorsRenderPages(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, withAdmin)
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/s/unknown", http.StatusNotFound, "<h1 class=\"mb-3\">Page not found</h1>"},
+		{"/gallery?page=abc", http.StatusBadRequest, "Invalid page"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		req.Header.Set("Accept", "text/html")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), tt.want) {
+			t.Errorf("GET %s: %s body %q lacks %s", tt.path, resp.Header.Get("Content-Type"), body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"flue-frontend/pkg/render"
+)
+
+// exampleLabelLength is the number of characters of the prompt an example
+// without a label is shown with.
+const exampleLabelLength = 40
+
+// ExamplePrompt is an example offered on the index page that fills in the
+// form when chosen. Settings it leaves out keep their value in the form.
+type ExamplePrompt struct {
+	// Label is shown on the example instead of the start of its prompt.
+	Label    string   `json:"label,omitempty"`
+	Prompt   string   `json:"prompt"`
+	Model    string   `json:"model,omitempty"`
+	Width    int      `json:"width,omitempty"`
+	Height   int      `json:"height,omitempty"`
+	Steps    int      `json:"steps,omitempty"`
+	Guidance *float64 `json:"guidance,omitempty"`
+	Seed     *int64   `json:"seed,omitempty"`
+}
+
+// form returns the form fields e fills in.
+func (e ExamplePrompt) form() map[string]string {
+	form := map[string]string{"prompt": e.Prompt}
+	if e.Model != "" {
+		form["model"] = e.Model
+	}
+	if e.Width > 0 {
+		form["width"] = strconv.Itoa(e.Width)
+	}
+	if e.Height > 0 {
+		form["height"] = strconv.Itoa(e.Height)
+	}
+	if e.Steps > 0 {
+		form["num_steps"] = strconv.Itoa(e.Steps)
+	}
+	if e.Guidance != nil {
+		form["guidance_scale"] = strconv.FormatFloat(*e.Guidance, 'f', -1, 64)
+	}
+	if e.Seed != nil {
+		form["seed"] = strconv.FormatInt(*e.Seed, 10)
+	}
+	return form
+}
+
+// loadExamples reads example prompts from a JSON file holding a list of
+// ExamplePrompt, checking them against the selectable models.
+func loadExamples(path string, models []string) ([]ExamplePrompt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read example prompts: %w", err)
+	}
+	var examples []ExamplePrompt
+	if err := json.Unmarshal(data, &examples); err != nil {
+		return nil, fmt.Errorf("parse example prompts %s: %w", path, err)
+	}
+	for i, e := range examples {
+		switch {
+		case e.Prompt == "":
+			return nil, fmt.Errorf("example prompt %d: prompt is empty", i+1)
+		case e.Width < 0 || e.Height < 0 || e.Steps < 0:
+			return nil, fmt.Errorf("example prompt %d: size and steps must not be negative", i+1)
+		case e.Model != "" && len(models) > 0 && !slices.Contains(models, e.Model):
+			return nil, fmt.Errorf("example prompt %d: model %s is not available", i+1, e.Model)
+		}
+	}
+	return examples, nil
+}
+
+// exampleChip is an example prompt as shown on the index page.
+type exampleChip struct {
+	Label  string
+	Prompt string
+	// Form is the JSON object of the form fields the example fills in.
+	Form string
+}
+
+// exampleChips returns the example prompts to show on the index page.
+func (s *Server) exampleChips() []exampleChip {
+	chips := make([]exampleChip, 0, len(s.Examples))
+	for _, e := range s.Examples {
+		form, _ := json.Marshal(e.form())
+		label := e.Label
+		if label == "" {
+			label = render.Truncate(e.Prompt, exampleLabelLength)
+		}
+		chips = append(chips, exampleChip{Label: label, Prompt: e.Prompt, Form: string(form)})
+	}
+	return chips
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"flue-frontend/pkg/archive"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// exportArchive streams a zip archive of the records of the archived images
+// and, unless images is false, the images themselves.
+func (s *Server) exportArchive(c echo.Context) error {
+	withImages := true
+	if v := c.QueryParam("images"); v != "" {
+		var err error
+		if withImages, err = strconv.ParseBool(v); err != nil {
+			return s.jobError(c, errorf(http.StatusBadRequest, "Invalid value for images: %q", v))
+		}
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "application/zip")
+	h.Set(echo.HeaderContentDisposition, `attachment; filename="flue-export-`+time.Now().Format("20060102")+`.zip"`)
+	c.Response().WriteHeader(http.StatusOK)
+	if err := archive.Export(c.Request().Context(), c.Response(), s.archive, withImages); err != nil {
+		// The response has started, so the client only sees a truncated
+		// archive.
+		log.Error("Failed to export archive", "admin", adminIdentity(c), "error", err)
+		return nil
+	}
+	log.Info("Archive exported", "admin", adminIdentity(c), "images", withImages)
+	return nil
+}
+
+// adminImport stores the images of an uploaded archive written by
+// exportArchive, skipping those already archived, and reports how many were
+// imported, skipped and failed. The archive must be posted in the archive
+// field of a multipart/form-data body.
+func (s *Server) adminImport(c echo.Context) error {
+	upload, err := c.FormFile("archive")
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No archive was uploaded"))
+	}
+	f, err := upload.Open()
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No archive was uploaded"))
+	}
+	defer f.Close()
+
+	summary, err := archive.Import(c.Request().Context(), f, upload.Size, s.archive)
+	if err != nil {
+		log.Warn("Failed to import archive", "admin", adminIdentity(c), "error", err)
+		return s.jobError(c, errorf(http.StatusBadRequest, "Invalid archive: %v", err))
+	}
+	log.Info("Archive imported", "admin", adminIdentity(c), "imported", summary.Imported, "skipped", summary.Skipped, "errored", summary.Errored)
+	return c.JSON(http.StatusOK, summary)
+}
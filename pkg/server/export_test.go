@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+// adminRequest returns a request authenticated as the administrator
+// configured by withAdmin.
+func adminRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	return req
+}
+
+// withAdmin configures a server with an administrator and images kept in
+// memory.
+func withAdmin(s *Server) {
+	s.AdminUsers = map[string]string{"admin": "secret"}
+	s.ImageStore = StoreMemory
+}
+
+// getBody sends req and returns the response body, failing unless the status
+// is 200.
+func getBody(t *testing.T, req *http.Request) []byte {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+	}
+	return body
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	src := startServer(t, backend.URL, withAdmin)
+	var ids []string
+	for _, prompt := range []string{"a lighthouse", "a harbor"} {
+		resp := src.post(t, "/", generationForm(prompt), http.Header{"Accept": {"application/json"}})
+		var result struct{ ID string }
+		err := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, result.ID)
+	}
+	export := getBody(t, adminRequest(t, http.MethodGet, src.URL+"/export", nil))
+
+	dst := startServer(t, backend.URL, withAdmin)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("archive", "export.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(export)
+	mw.Close()
+	req := adminRequest(t, http.MethodPost, dst.URL+"/admin/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	var summary struct{ Imported, Skipped, Errored int }
+	if err := json.Unmarshal(getBody(t, req), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Imported != len(ids) || summary.Skipped != 0 || summary.Errored != 0 {
+		t.Errorf("import summary = %+v, want %d imported", summary, len(ids))
+	}
+
+	for _, id := range ids {
+		want := getBody(t, adminRequest(t, http.MethodGet, src.URL+"/generated/"+id, nil))
+		got := getBody(t, adminRequest(t, http.MethodGet, dst.URL+"/generated/"+id, nil))
+		if !bytes.Equal(got, want) {
+			t.Errorf("imported image %s differs from the exported one", id)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/render"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// Generations the feed lists.
+const (
+	// FeedPublic lists only images with a public link.
+	FeedPublic = "public"
+	// FeedAll lists every archived image.
+	FeedAll = "all"
+)
+
+// parseFeedScope validates a feed scope name.
+func parseFeedScope(scope string) (string, error) {
+	switch scope {
+	case "", FeedPublic:
+		return FeedPublic, nil
+	case FeedAll:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown feed scope: %s", scope)
+}
+
+// atomFeed is an Atom feed as defined by RFC 4287.
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Generator string      `xml:"generator"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedItem is an archived image listed in the feed, with the page it is
+// linked to and the time it was last changed, such as made public.
+type feedItem struct {
+	meta    store.Metadata
+	page    string
+	updated time.Time
+}
+
+// feed serves an Atom feed of the latest FeedSize generations, either those
+// with a public link or, if FeedScope is FeedAll, every archived image. The
+// feed carries Last-Modified and ETag headers, so feed readers can poll it
+// with conditional requests.
+func (s *Server) feed(c echo.Context) error {
+	items, err := s.feedItems(c)
+	if err != nil {
+		log.Error("Failed to list feed entries", "error", err)
+		return s.pageError(c, errorf(http.StatusInternalServerError, "Failed to list images"))
+	}
+
+	base := s.baseURL(c)
+	title := s.Branding.Title
+	if title == "" {
+		title = s.t(c, "Flue Image Generator")
+	}
+	generator := "Flue Frontend"
+	if s.Version != "" {
+		generator += " " + s.Version
+	}
+	// An empty feed has not changed since the server started.
+	modified := s.started
+	if len(items) > 0 {
+		modified = items[0].updated
+	}
+	feed := atomFeed{
+		ID:        base + "/feed.atom",
+		Title:     title,
+		Updated:   modified.UTC().Format(time.RFC3339),
+		Author:    atomAuthor{Name: title},
+		Generator: generator,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + "/feed.atom"},
+			{Rel: "alternate", Type: "text/html", Href: base + "/"},
+		},
+	}
+	for _, item := range items {
+		meta := item.meta
+		imageURL := base + "/generated/" + meta.ID
+		var content bytes.Buffer
+		err := c.Echo().Renderer.Render(&content, "feed_entry.html", map[string]any{
+			"image":     meta,
+			"image_url": imageURL,
+		}, c)
+		if err != nil {
+			return err
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        imageURL,
+			Title:     render.Truncate(meta.Prompt, gallerySnippetLength),
+			Published: meta.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   item.updated.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: item.page},
+				{Rel: "enclosure", Type: imaging.Format(meta.Format).MIMEType(), Length: meta.Size, Href: imageURL},
+			},
+			Content: atomContent{Type: "html", Body: content.String()},
+		})
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	sum := sha256.Sum256(data)
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "application/atom+xml; charset=utf-8")
+	h.Set("ETag", strconv.Quote(hex.EncodeToString(sum[:16])))
+	h.Set("Cache-Control", "public, no-cache")
+	http.ServeContent(c.Response(), c.Request(), "", modified, bytes.NewReader(data))
+	return nil
+}
+
+// feedItems returns the images listed in the feed, most recently changed
+// first.
+func (s *Server) feedItems(c echo.Context) ([]feedItem, error) {
+	ctx := c.Request().Context()
+	base := s.baseURL(c)
+	if s.FeedScope == FeedAll {
+		records, _, err := s.archive.List(ctx, store.Query{}, 0, s.FeedSize)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]feedItem, len(records))
+		for i, meta := range records {
+			items[i] = feedItem{meta: meta, page: base + "/gallery/" + meta.ID, updated: meta.CreatedAt}
+		}
+		return items, nil
+	}
+
+	// List each shared image once, under its most recent link.
+	latest := make(map[string]publicLink)
+	for _, l := range s.links.list() {
+		if other, ok := latest[l.ImageID]; !ok || l.CreatedAt.After(other.CreatedAt) {
+			latest[l.ImageID] = l
+		}
+	}
+	links := make([]publicLink, 0, len(latest))
+	for _, l := range latest {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+
+	var items []feedItem
+	for _, l := range links {
+		if len(items) == s.FeedSize {
+			break
+		}
+		meta, err := s.archive.Metadata(ctx, l.ImageID)
+		if errors.Is(err, archive.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, feedItem{meta: meta, page: s.linkURL(c, l.Token), updated: l.CreatedAt})
+	}
+	return items, nil
+}
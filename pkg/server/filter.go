@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PromptFilter decides whether a prompt may be sent to the backend.
+type PromptFilter interface {
+	// Match reports whether prompt is disallowed and, if so, the rule that
+	// matched it.
+	Match(prompt string) (rule string, blocked bool)
+}
+
+// PatternFilter blocks prompts matching any of a list of case-insensitive
+// regular expressions. Plain words act as substring matches.
+type PatternFilter struct {
+	patterns []*regexp.Regexp
+}
+
+// NewPatternFilter compiles patterns into a PatternFilter.
+func NewPatternFilter(patterns []string) (*PatternFilter, error) {
+	f := &PatternFilter{}
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocked pattern %q: %w", p, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+// Match implements PromptFilter.
+func (f *PatternFilter) Match(prompt string) (string, bool) {
+	for _, re := range f.patterns {
+		if re.MatchString(prompt) {
+			return re.String()[len("(?i)"):], true
+		}
+	}
+	return "", false
+}
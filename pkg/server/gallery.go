@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/render"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// gallerySnippetLength is the number of characters of a prompt shown under
+// its gallery thumbnail.
+const gallerySnippetLength = 100
+
+// galleryItem is an archived image as listed in the gallery.
+type galleryItem struct {
+	store.Metadata
+	Snippet string
+}
+
+// gallery lists the archived images newest first, a page at a time,
+// optionally narrowed by a search. With PerUserGalleries only the images of
+// the request's session are listed, except to administrators, who may narrow
+// theirs by owner instead. HTMX requests get only the page's items, for
+// infinite scrolling, and clients not accepting HTML the page as JSON.
+func (s *Server) gallery(c echo.Context) error {
+	page := 1
+	if v := c.QueryParam("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return s.pageError(c, errorf(http.StatusBadRequest, "Invalid page"))
+		}
+		page = n
+	}
+	q, err := s.parseSearch(c)
+	if err != nil {
+		return s.pageError(c, err)
+	}
+	size := max(s.GalleryPageSize, 1)
+	if perPage := s.prefs(c).PerPage; perPage > 0 {
+		size = perPage
+	}
+	query := q.archiveQuery()
+	query.Favorites = c.QueryParam("favorites") != ""
+	searching := query != (store.Query{})
+	if adminIdentity(c) != "" {
+		query.Owner = s.sessionOwner(c.QueryParam("owner"))
+	} else {
+		query.Owner = s.owner(c)
+	}
+	list, total, err := s.archive.List(c.Request().Context(), query, (page-1)*size, size)
+	if err != nil {
+		log.Error("Failed to list archived images", "error", err)
+		return s.pageError(c, errorf(http.StatusInternalServerError, "Failed to list images"))
+	}
+	if len(list) == 0 && page > 1 {
+		return s.pageError(c, errorf(http.StatusNotFound, "Page not found"))
+	}
+
+	items := make([]galleryItem, len(list))
+	for i, meta := range list {
+		items[i] = galleryItem{Metadata: meta, Snippet: render.Truncate(meta.Prompt, gallerySnippetLength)}
+	}
+	values := c.QueryParams()
+	data := map[string]any{
+		"items":     items,
+		"total":     total,
+		"query":     values,
+		"searching": searching,
+		"lang":      locale(c),
+	}
+	if page*size < total {
+		data["next_url"] = galleryURL(c.Path(), values, page+1)
+	}
+	if page > 1 {
+		data["prev_url"] = galleryURL(c.Path(), values, page-1)
+	}
+	return s.respond(c, http.StatusOK, "gallery.html", "gallery.html#items", data)
+}
+
+// galleryURL returns the URL of a page of the gallery at path, keeping the
+// search of query.
+func galleryURL(path string, query url.Values, page int) string {
+	q := url.Values{}
+	for name, v := range query {
+		q[name] = v
+	}
+	q.Set("page", strconv.Itoa(page))
+	return path + "?" + q.Encode()
+}
+
+// galleryImage shows an archived image at full size with its complete recipe.
+// Images of other sessions are not found, except by administrators.
+func (s *Server) galleryImage(c echo.Context) error {
+	meta, err := s.archivedMetadata(c, c.Param("id"))
+	if err != nil {
+		return s.pageError(c, err)
+	}
+	if _, admin := s.optionalAdmin(c); !admin && !s.owns(c, meta.Owner) {
+		return s.pageError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	return c.Render(http.StatusOK, "gallery_image.html", map[string]any{
+		"image":     meta,
+		"share_url": shareURL(recipeParams(meta)),
+		"lang":      locale(c),
+	})
+}
+
+// toggleFavorite marks an archived image as a favorite, or unmarks it, as
+// given by the favorite value or else the opposite of its current state.
+// HTMX requests get the updated star button.
+func (s *Server) toggleFavorite(c echo.Context) error {
+	if s.archive == nil {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	meta, err := s.archivedMetadata(c, c.Param("id"))
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	if !s.owns(c, meta.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its owner may change this image"))
+	}
+	favorite := !meta.Favorite
+	if v := c.FormValue("favorite"); v != "" {
+		if favorite, err = strconv.ParseBool(v); err != nil {
+			return s.jobError(c, errorf(http.StatusBadRequest, "Invalid value for favorite: %q", v))
+		}
+	}
+	meta, err = s.archive.SetFavorite(c.Request().Context(), meta.ID, favorite)
+	if errors.Is(err, archive.ErrNotFound) {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	if err != nil {
+		log.Error("Failed to update archived image", "id", meta.ID, "error", err)
+		return s.jobError(c, errorf(http.StatusInternalServerError, "Failed to update image"))
+	}
+
+	if s.isHTMX(c) {
+		return c.Render(http.StatusOK, "favorite.html", meta)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"id": meta.ID, "favorite": meta.Favorite})
+}
+
+// recipeParams returns the generation parameters recorded for an archived
+// image.
+func recipeParams(meta store.Metadata) params.Params {
+	return params.Params{
+		Prompt:   meta.Prompt,
+		Model:    meta.Model,
+		Width:    meta.Width,
+		Height:   meta.Height,
+		Steps:    meta.Steps,
+		Guidance: meta.Guidance,
+		Seed:     meta.Seed,
+		Tiling:   meta.Tiling,
+		Format:   imaging.Format(meta.Format),
+		Quality:  meta.Quality,
+	}
+}
@@ -0,0 +1,616 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/events"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/metrics"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/store"
+	"flue-frontend/pkg/tracing"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusError is a client-facing error message along with its HTTP status.
+// The format and arguments are kept so the message can be translated.
+type statusError struct {
+	Status  int
+	Message string
+	// Detail optionally explains the error further, untranslated.
+	Detail string
+	// Field is the form field holding the invalid input, if any.
+	Field string
+	// Values are the submitted form fields, so the form can be filled in
+	// again when showing the error.
+	Values map[string]string
+
+	format string
+	args   []any
+}
+
+func (e *statusError) Error() string {
+	return e.Message
+}
+
+// errorf returns a statusError with a formatted message.
+func errorf(status int, format string, args ...any) error {
+	return &statusError{Status: status, Message: fmt.Sprintf(format, args...), format: format, args: args}
+}
+
+// withDetail returns err, a statusError, with further detail.
+func withDetail(err error, detail string) error {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return err
+	}
+	detailed := *se
+	detailed.Detail = detail
+	return &detailed
+}
+
+// withField returns err, a statusError, blaming the input of a form field.
+func withField(err error, field string) error {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return err
+	}
+	blamed := *se
+	blamed.Field = field
+	return &blamed
+}
+
+// withValues returns err, a statusError, with the submitted form fields.
+func withValues(err error, values map[string]string) error {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return err
+	}
+	submitted := *se
+	submitted.Values = values
+	return &submitted
+}
+
+// errorStatus returns the HTTP status and client-facing message for err,
+// translated into the locale of the request.
+func (s *Server) errorStatus(c echo.Context, err error) (int, string) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Status, s.t(c, se.format, se.args...)
+	}
+	return http.StatusInternalServerError, s.t(c, "Internal server error")
+}
+
+// maxFormMemory is how much of a multipart form is held in memory. Larger
+// file parts are spooled to temporary files.
+const maxFormMemory = 32 << 20
+
+// valuesKey is the context key caching the lookup requestValues returns,
+// since the body it is read from can only be read once.
+const valuesKey = "values"
+
+// requestValues returns a lookup for request parameters, read from either
+// form fields or a JSON object body using the same names. JSON arrays are
+// joined with newlines. Forms may be URL-encoded or multipart, as sent by
+// forms with a file input; files in a multipart form are ignored. A body
+// that cannot be parsed is an error rather than a form missing its fields.
+func requestValues(c echo.Context) (func(string) string, error) {
+	if values, ok := c.Get(valuesKey).(func(string) string); ok {
+		return values, nil
+	}
+	values, err := readValues(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(valuesKey, values)
+	return values, nil
+}
+
+// readValues does the work of requestValues.
+func readValues(c echo.Context) (func(string) string, error) {
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	if strings.HasPrefix(contentType, echo.MIMEMultipartForm) {
+		if err := c.Request().ParseMultipartForm(maxFormMemory); err != nil {
+			return nil, errorf(http.StatusBadRequest, "Invalid form body: %v", err)
+		}
+		return c.FormValue, nil
+	}
+	if !strings.HasPrefix(contentType, echo.MIMEApplicationJSON) {
+		if err := c.Request().ParseForm(); err != nil {
+			return nil, errorf(http.StatusBadRequest, "Invalid form body: %v", err)
+		}
+		return c.FormValue, nil
+	}
+
+	var body map[string]any
+	dec := json.NewDecoder(c.Request().Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, errorf(http.StatusBadRequest, "Invalid JSON body: %v", err)
+	}
+	return func(name string) string {
+		v, ok := body[name]
+		if !ok || v == nil {
+			return ""
+		}
+		if list, ok := v.([]any); ok {
+			lines := make([]string, len(list))
+			for i, item := range list {
+				lines[i] = fmt.Sprint(item)
+			}
+			return strings.Join(lines, "\n")
+		}
+		return fmt.Sprint(v)
+	}, nil
+}
+
+// generate handles a form submission. Unless BlockingSubmit is set, HTMX
+// requests queue a job and get a fragment polling its status; otherwise the
+// request waits for the generation and gets the result, as the result
+// fragment or, for clients not accepting HTML, as JSON. Scheduled
+// submissions always become jobs.
+func (s *Server) generate(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	if s.isHTMX(c) && (!s.BlockingSubmit || values("run_at") != "") {
+		return s.submitJob(c)
+	}
+	p, warnings, err := s.parseParams(c, values)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+
+	progressID := values("progress_id")
+	if !progressIDPattern.MatchString(progressID) {
+		progressID = ""
+	}
+
+	// Wait for a generation slot, reporting the queue position meanwhile.
+	// An identical request shortly after shares the outcome instead.
+	ctx := withRequestID(withOwner(backend.WithHeaders(c.Request().Context(), s.forwardedHeaders(c)), s.owner(c)), c)
+	client := c.RealIP()
+	if progressID != "" {
+		defer s.progress.Close(progressID, &events.Event{Name: "done"})
+		defer s.waiting.remove(progressID)
+	}
+	data, err, shared := s.generateDedup.do(ctx, dedupKey(client, s.owner(c), p.Hash()), func(ctx context.Context) (*ResultView, error) {
+		release, err := s.acquireSlot(ctx, client, func(position, total int) {
+			wait, known := s.estimateWait(position, p)
+			s.waiting.set(progressID, queueStatus{Position: position, Total: total, Wait: wait, WaitKnown: known})
+			s.publishProgress(progressID, "queue", fmt.Sprintf("position %d of %d", position, total))
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		s.waiting.set(progressID, queueStatus{})
+		s.publishProgress(progressID, "progress", "started")
+
+		return s.execute(ctx, client, p, warnings, func(pr backend.Progress) {
+			s.publishProgress(progressID, "progress", fmt.Sprintf("step %d of %d", pr.Step, pr.Total))
+		})
+	})
+	if shared {
+		log.Info("Duplicate generation request", "client", client, "params", p.Hash())
+	}
+	if errors.Is(err, errQueueFull) {
+		err = s.queueFull(c)
+	}
+	if err != nil {
+		return s.jobError(c, err)
+	}
+
+	// Render the fragment template, or the result as JSON for scripts.
+	setGenerationHeaders(c.Response().Header(), data.GenTime, data.Seed, data.Model)
+	_, span := tracer.Start(c.Request().Context(), "render")
+	err = s.respond(c, http.StatusOK, "", "result.html", data)
+	tracing.End(span, err)
+	return err
+}
+
+// parseParams validates the generation parameters of a request. It returns
+// the parameters along with warnings about inputs that were ignored. Errors
+// carry the submitted fields and, for invalid input, the field at fault.
+func (s *Server) parseParams(c echo.Context, values func(string) string) (params.Params, []string, error) {
+	_, span := tracer.Start(c.Request().Context(), "validate")
+	p, warnings, err := s.validateParams(c, values)
+	if err == nil {
+		span.SetAttributes(paramAttributes(p)...)
+		log.Info("Generation request", "client", c.RealIP(), "params", p.Hash())
+	} else {
+		submitted := make(map[string]string, len(formFields))
+		for _, name := range formFields {
+			if v := values(name); v != "" {
+				submitted[name] = v
+			}
+		}
+		err = withValues(err, submitted)
+	}
+	tracing.End(span, err)
+	return p, warnings, err
+}
+
+// validateParams does the work of parseParams.
+func (s *Server) validateParams(c echo.Context, values func(string) string) (params.Params, []string, error) {
+	// Extract request fields.
+	prompt := strings.TrimSpace(values("prompt"))
+	widthStr := values("width")
+	heightStr := values("height")
+	numStepsStr := values("num_steps")
+	guidanceScaleStr := values("guidance_scale")
+	seedStr := values("seed")
+	formatStr := values("format")
+	qualityStr := values("quality")
+	modelStr := values("model")
+	tiling := values("tiling") != ""
+
+	// Validate required fields against the limits of the selected model,
+	// falling back to its defaults for omitted steps and guidance.
+	if prompt == "" {
+		return params.Params{}, nil, withField(errorf(http.StatusBadRequest, "Prompt is required"), "prompt")
+	}
+	// JSON would replace invalid bytes, so the backend would get another
+	// prompt than the one recorded.
+	if !utf8.ValidString(prompt) {
+		return params.Params{}, nil, withField(errorf(http.StatusBadRequest, "Prompt is not valid UTF-8 text"), "prompt")
+	}
+	model, err := s.resolveModel(modelStr)
+	if err != nil {
+		return params.Params{}, nil, withField(errorf(http.StatusBadRequest, "Model is not available: %s", strings.TrimSpace(modelStr)), "model")
+	}
+	limits := s.modelLimits(model)
+	if m, ok := s.ModelDefaults[model]; ok {
+		if numStepsStr == "" && m.Steps > 0 {
+			numStepsStr = strconv.Itoa(m.Steps)
+		}
+		if guidanceScaleStr == "" && m.Guidance != nil {
+			guidanceScaleStr = strconv.FormatFloat(*m.Guidance, 'f', -1, 64)
+		}
+	}
+	width, err := parseFormInt(widthStr, limits.Width.Min, limits.Width.Max)
+	if err != nil {
+		return params.Params{}, nil, withField(numberError(err, "Width must be a whole number", "Width must be between %v and %v"), "width")
+	}
+	height, err := parseFormInt(heightStr, limits.Height.Min, limits.Height.Max)
+	if err != nil {
+		return params.Params{}, nil, withField(numberError(err, "Height must be a whole number", "Height must be between %v and %v"), "height")
+	}
+	numSteps, err := parseFormInt(numStepsStr, limits.Steps.Min, limits.Steps.Max)
+	if err != nil {
+		return params.Params{}, nil, withField(numberError(err, "Number of steps must be a whole number", "Number of steps must be between %v and %v"), "num_steps")
+	}
+	guidanceScale, err := parseFormFloat(guidanceScaleStr, limits.Guidance.Min, limits.Guidance.Max)
+	if err != nil {
+		return params.Params{}, nil, withField(numberError(err, "Guidance scale must be a number", "Guidance scale must be between %v and %v"), "guidance_scale")
+	}
+	format, err := imaging.ParseFormat(formatStr)
+	if err == nil && !format.Supported() {
+		err = fmt.Errorf("%w: %s", imaging.ErrUnsupportedFormat, format)
+	}
+	if err != nil {
+		return params.Params{}, nil, withField(errorf(http.StatusBadRequest, "Format is not supported: %s", formatStr), "format")
+	}
+
+	// Reject disallowed prompts without saying which rule matched.
+	if s.PromptFilter != nil {
+		if rule, blocked := s.PromptFilter.Match(prompt); blocked {
+			if s.RedactFilteredPrompts {
+				log.Warn("Prompt rejected by filter", "client", c.RealIP(), "rule", rule)
+			} else {
+				log.Warn("Prompt rejected by filter", "client", c.RealIP(), "rule", rule, "prompt", prompt)
+			}
+			return params.Params{}, nil, withField(errorf(http.StatusUnprocessableEntity, "This prompt is not allowed"), "prompt")
+		}
+	}
+
+	// Quality only applies to lossy formats; it is noted and ignored otherwise.
+	var warnings []string
+	quality := s.DefaultQuality
+	if qualityStr != "" {
+		if format.Lossy() {
+			quality, err = parseFormInt(qualityStr, 1, 100)
+			if err != nil {
+				return params.Params{}, nil, withField(numberError(err, "Quality must be a whole number", "Quality must be between %v and %v"), "quality")
+			}
+		} else {
+			warnings = append(warnings, s.t(c, "Quality is ignored for %s output", format))
+		}
+	}
+
+	p := params.Params{
+		Prompt:   prompt,
+		Width:    width,
+		Height:   height,
+		Steps:    numSteps,
+		Guidance: guidanceScale,
+		Model:    model,
+		Tiling:   tiling,
+		Format:   format,
+		Quality:  quality,
+	}
+
+	// Handle optional seed parameter.
+	if seedStr != "" {
+		seed, err := parseFormInt(seedStr, math.MinInt, math.MaxInt)
+		if err != nil {
+			return params.Params{}, nil, withField(numberError(err, "Seed must be a whole number", "Seed must be between %v and %v"), "seed")
+		}
+		p.Seed = &seed
+	}
+
+	return p.Normalize(), warnings, nil
+}
+
+// execute sends a validated generation on behalf of client to the backends
+// and prepares the result for rendering. The caller must hold a generation
+// slot. Backend progress updates are passed to progress, which may be nil.
+func (s *Server) execute(ctx context.Context, client string, p params.Params, warnings []string, progress backend.ProgressFunc) (data *ResultView, err error) {
+	ctx, span := tracer.Start(ctx, "execute", trace.WithAttributes(paramAttributes(p)...))
+	defer func() { tracing.End(span, err) }()
+	if s.audit != nil {
+		defer func() { s.recordAudit(ctx, client, p, data, err) }()
+	}
+
+	// Measure the time taken for the generation call.
+	predicted, _ := s.predict(p)
+	defer s.running.begin(predicted)()
+	start := time.Now()
+
+	// Call the Flue backends.
+	payload := p.Payload()
+	if s.StreamProgress {
+		payload["stream"] = true
+	}
+	result, err := s.client.Generate(ctx, payload, progress)
+	s.outcomes.record(err)
+	if errors.Is(err, backend.ErrNoBackends) {
+		return nil, errorf(http.StatusServiceUnavailable, "No Flue server is currently available")
+	}
+	if errors.Is(err, backend.ErrTimeout) {
+		return nil, errorf(http.StatusGatewayTimeout, "The Flue server did not respond in time")
+	}
+	if errors.Is(err, backend.ErrResponseTooLarge) {
+		return nil, errorf(http.StatusBadGateway, "The Flue server sent an oversized response")
+	}
+	var backendErr *backend.Error
+	if errors.As(err, &backendErr) {
+		if backendErr.Rejected() {
+			return nil, errorf(http.StatusUnprocessableEntity, "The Flue server rejected the request: %s", backendErr.Message)
+		}
+		return nil, errorf(http.StatusBadGateway, "The Flue server reported an error: %s", backendErr.Message)
+	}
+	if errors.Is(err, backend.ErrNoImage) {
+		return nil, errorf(http.StatusBadGateway, "The Flue server returned no image")
+	}
+	if err != nil {
+		failed := errorf(http.StatusInternalServerError, "Failed to call Flue server")
+		if s.Debug {
+			failed = withDetail(failed, err.Error())
+		}
+		return nil, failed
+	}
+
+	// Compute generation time as fallback if response doesn't provide it
+	elapsed := time.Since(start)
+	s.durations.Observe(p.Width*p.Height, p.Steps, elapsed)
+	genTime := elapsed.Seconds()
+	if respGenTime, ok := result["gen_time"].(float64); ok {
+		genTime = respGenTime
+	}
+	if s.SlowThreshold > 0 && genTime > s.SlowThreshold.Seconds() {
+		log.Warn("Slow generation", "gen_time", roundFloat(genTime, 2), "threshold", s.SlowThreshold,
+			"params", p.Hash(), "model", p.Model, "width", p.Width, "height", p.Height, "steps", p.Steps, "guidance", p.Guidance)
+		metrics.SlowGenerations.WithLabelValues(p.Model).Inc()
+	}
+
+	// Prepare every image of the response, the first one shown as the
+	// result and any others after it.
+	meta := store.Metadata{
+		Prompt:    p.Prompt,
+		Width:     p.Width,
+		Height:    p.Height,
+		Steps:     p.Steps,
+		Guidance:  p.Guidance,
+		Model:     p.Model,
+		Tiling:    p.Tiling,
+		GenTime:   roundFloat(genTime, 2),
+		Elapsed:   roundFloat(elapsed.Seconds(), 2),
+		CreatedAt: start,
+		Client:    client,
+		Owner:     ownerFrom(ctx),
+	}
+	images := backend.Images(result)
+	if len(images) == 0 {
+		return nil, errorf(http.StatusBadGateway, "The Flue server returned no image")
+	}
+	var extra []ImageView
+	for i := 1; i < len(images); i++ {
+		meta.Seed = resultSeed(result, p, i)
+		extra = append(extra, s.prepareImage(ctx, p, images[i], resultNSFW(result, i), meta))
+	}
+	meta.Seed = resultSeed(result, p, 0)
+	recipe := formValues(p)
+	if meta.Seed != nil {
+		recipe["seed"] = strconv.Itoa(*meta.Seed)
+	}
+
+	return &ResultView{
+		ImageView:   s.prepareImage(ctx, p, images[0], resultNSFW(result, 0), meta),
+		Params:      p,
+		Model:       p.Model,
+		GenTime:     roundFloat(genTime, 2),
+		Warnings:    warnings,
+		Tiling:      p.Tiling,
+		ShareURL:    shareURL(p),
+		Recipe:      recipe,
+		ExtraImages: extra,
+	}, nil
+}
+
+// prepareImage re-encodes one generated image in the requested output
+// format, applies the safety mode and archives it, returning how it is
+// shown in the result. meta is the image's archive metadata.
+func (s *Server) prepareImage(ctx context.Context, p params.Params, image string, nsfw bool, meta store.Metadata) ImageView {
+	out := encodeOutput(image, p.Format, p.Quality)
+	out = s.embedParameters(out, p, meta.Seed)
+
+	// Apply the safety mode to images the backend flagged.
+	out, safetyAction, rawID := s.applySafety(out, nsfw)
+	log.Info("Generated image", "nsfw", nsfw, "safety_action", safetyAction)
+
+	// Keep tileable textures around for the lazily rendered tiled preview.
+	var tiledID string
+	if p.Tiling && safetyAction == safetyNone && out.Bytes != nil {
+		tiledID = s.images.Add(cachedImage{Data: out.Bytes, Format: out.Format, Quality: out.Quality})
+	}
+
+	// Archive the full resolution image unless it was blocked. If the image
+	// store cannot be reached, the image is embedded in the page instead.
+	var id string
+	archiveFailed := false
+	if s.archive != nil && safetyAction != safetyBlocked && out.Bytes != nil {
+		id = s.archiveImage(ctx, out, meta)
+		archiveFailed = id == ""
+	}
+
+	// Serve a smaller preview, keeping the full resolution image available
+	// for download.
+	var fullID string
+	if s.PreviewMaxDimension > 0 && safetyAction != safetyBlocked && out.Bytes != nil {
+		preview, scaled, err := downscaleOutput(out, s.PreviewMaxDimension)
+		if err != nil {
+			log.Warn("Failed to downscale image", "error", err)
+		} else if scaled {
+			fullID = s.images.Add(cachedImage{Data: out.Bytes, Format: out.Format, Quality: out.Quality})
+			out = preview
+		}
+	}
+
+	// Link images above the inline threshold instead of embedding them in
+	// the page, from the archive if the shown image is the archived one.
+	var imageURL string
+	switch {
+	case safetyAction == safetyBlocked || out.Bytes == nil || out.Size <= s.InlineMaxBytes:
+	case archiveFailed:
+		log.Warn("Image store unavailable, embedding the image in the page", "size", out.Size)
+	case id != "" && fullID == "":
+		imageURL = "/generated/" + id
+	default:
+		imageURL = "/raw/" + s.images.Add(cachedImage{Data: out.Bytes, Format: out.Format, Quality: out.Quality})
+	}
+
+	return ImageView{
+		ID:       id,
+		Image:    out.Data,
+		ImageURL: imageURL,
+		Alt:      s.altText(p, meta.Seed),
+		MIME:     out.Format.MIMEType(),
+		Format:   out.Format,
+		Size:     out.Size,
+		Quality:  out.Quality,
+		Seed:     meta.Seed,
+
+		NSFW:         nsfw,
+		SafetyAction: safetyAction,
+		RawID:        rawID,
+
+		TiledID: tiledID,
+		FullID:  fullID,
+	}
+}
+
+// resolveModel returns the model to use for a request, falling back to the
+// default and checking it against the available models when configured.
+// Available models match regardless of case and are returned as listed, so
+// every spelling of a model resolves to the same name.
+func (s *Server) resolveModel(model string) (string, error) {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return s.DefaultModel, nil
+	}
+	if len(s.AvailableModels) > 0 {
+		i := slices.IndexFunc(s.AvailableModels, func(m string) bool { return strings.EqualFold(m, model) })
+		if i < 0 {
+			return "", fmt.Errorf("unknown model: %s", model)
+		}
+		return s.AvailableModels[i], nil
+	}
+	return model, nil
+}
+
+// roundFloat rounds a float64 to a specified number of decimal places.
+func roundFloat(val float64, precision int) float64 {
+	ratio := math.Pow(10, float64(precision))
+	return math.Round(val*ratio) / ratio
+}
+
+// errNotANumber is returned by parseFormInt and parseFormFloat for values
+// that are not a finite number.
+var errNotANumber = errors.New("not a number")
+
+// rangeError is returned by parseFormInt and parseFormFloat for numbers
+// outside the range from Min to Max.
+type rangeError struct {
+	Min, Max any
+}
+
+func (e rangeError) Error() string {
+	return fmt.Sprintf("value out of range (expected between %v and %v)", e.Min, e.Max)
+}
+
+func parseFormInt(field string, min, max int) (int, error) {
+	// Helper function to parse form values as integers with min/max constraints
+	val, err := strconv.Atoi(field)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, rangeError{min, max}
+	}
+	if err != nil {
+		return 0, errNotANumber
+	}
+	if val < min || val > max {
+		return 0, rangeError{min, max}
+	}
+	return val, nil
+}
+
+func parseFormFloat(field string, min, max float64) (float64, error) {
+	// Helper function to parse form values as floats with min/max constraints
+	val, err := strconv.ParseFloat(field, 64)
+	// NaN compares false against both bounds and would pass the range check,
+	// and neither NaN nor infinity can be encoded in the backend payload.
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, errNotANumber
+	}
+	if val < min || val > max {
+		return 0, rangeError{min, max}
+	}
+	return val, nil
+}
+
+// numberError returns the error for a number field that failed to parse,
+// with the message for values out of range given the bounds as arguments
+// and the one for values that are not numbers none, so that both are
+// translated whole.
+func numberError(err error, notANumber, outOfRange string) error {
+	var re rangeError
+	if errors.As(err, &re) {
+		return errorf(http.StatusBadRequest, outOfRange, re.Min, re.Max)
+	}
+	return errorf(http.StatusBadRequest, notANumber)
+}
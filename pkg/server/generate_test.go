@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+
+	"github.com/labstack/echo/v4"
+)
+
+func FuzzParseFormInt(f *testing.F) {
+	f.Add("512", 64, 2048)
+	f.Add("-1", 0, 100)
+	f.Add(" 64", 64, 2048)
+	f.Add("0x40", 0, 100)
+	f.Add(strconv.Itoa(math.MinInt), math.MinInt, math.MaxInt)
+	f.Add(strconv.Itoa(math.MaxInt), math.MinInt, math.MaxInt)
+	f.Add("9223372036854775808", math.MinInt, math.MaxInt)
+	f.Fuzz(func(t *testing.T, field string, min, max int) {
+		v, err := parseFormInt(field, min, max)
+		if err == nil && (v < min || v > max) {
+			t.Errorf("parseFormInt(%q, %d, %d) = %d, outside the range", field, min, max, v)
+		}
+	})
+}
+
+func FuzzParseFormFloat(f *testing.F) {
+	f.Add("3.5", 0.0, 10.0)
+	f.Add("NaN", 0.0, 10.0)
+	f.Add("Inf", 0.0, math.Inf(1))
+	f.Add("-Inf", math.Inf(-1), 0.0)
+	f.Add("1e309", 0.0, math.MaxFloat64)
+	f.Add("-0", 0.0, 1.0)
+	f.Add("0x1p-2", 0.0, 1.0)
+	f.Fuzz(func(t *testing.T, field string, min, max float64) {
+		v, err := parseFormFloat(field, min, max)
+		if err != nil {
+			return
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("parseFormFloat(%q, %v, %v) = %v, not a finite number", field, min, max, v)
+		}
+		if v < min || v > max {
+			t.Errorf("parseFormFloat(%q, %v, %v) = %v, outside the range", field, min, max, v)
+		}
+	})
+}
+
+// roundTripFunc sends requests with a function rather than the network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// FuzzGenerateParams feeds form values through validateParams and sends the
+// payload of those it accepts through the backend client, with steps and
+// guidance renamed as for older backends, checking that the JSON the
+// backend gets holds the accepted values unchanged.
+func FuzzGenerateParams(f *testing.F) {
+	f.Add("a cat", "512", "384", "4", "0.0", "", "png", "")
+	f.Add("a cat", "64", "64", "1", "10", "-1", "jpeg", "100")
+	f.Add(" ", "512", "384", "4", "0", "", "", "")
+	f.Add("a cat", "4096", "384", "4", "0", "", "png", "")
+	f.Add("a cat", "512", "384", "4", "NaN", "", "webp", "0")
+	f.Add("a cat", "512", "384", "4", "1", strconv.Itoa(math.MinInt), "jpeg", "50")
+	f.Add("a cat", "512", "384", "4", "1", "9223372036854775808", "png", "")
+	f.Add("a \xdc cat", "512", "384", "4", "1", "", "png", "")
+
+	s, err := New("127.0.0.1", 8080, []string{"http://localhost:8000"})
+	if err != nil {
+		f.Fatal(err)
+	}
+	e := echo.New()
+	keys, err := backend.NewPayloadKeys(map[string]string{"steps": "num_inference_steps", "guidance": "guidance_scale"}, params.PayloadKeys)
+	if err != nil {
+		f.Fatal(err)
+	}
+	client := backend.NewClient([]string{"http://flue.invalid"}, math.MaxInt, 0)
+	client.PayloadKeys = keys
+	var sent []byte
+	client.HTTP.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent, _ = io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusUnprocessableEntity,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error": "fuzzing"}`)),
+			Request:    req,
+		}, nil
+	})
+
+	f.Fuzz(func(t *testing.T, prompt, width, height, steps, guidance, seed, format, quality string) {
+		form := map[string]string{
+			"prompt": prompt, "width": width, "height": height, "num_steps": steps,
+			"guidance_scale": guidance, "seed": seed, "format": format, "quality": quality,
+		}
+		c := e.NewContext(httptest.NewRequest("POST", "/", nil), httptest.NewRecorder())
+		p, _, err := s.validateParams(c, func(name string) string { return form[name] })
+		if err != nil {
+			return
+		}
+
+		limits := s.modelLimits(p.Model)
+		if p.Prompt == "" {
+			t.Error("accepted an empty prompt")
+		}
+		if p.Width < limits.Width.Min || p.Width > limits.Width.Max {
+			t.Errorf("width %d is outside %+v", p.Width, limits.Width)
+		}
+		if p.Height < limits.Height.Min || p.Height > limits.Height.Max {
+			t.Errorf("height %d is outside %+v", p.Height, limits.Height)
+		}
+		if p.Steps < limits.Steps.Min || p.Steps > limits.Steps.Max {
+			t.Errorf("steps %d are outside %+v", p.Steps, limits.Steps)
+		}
+		if !(p.Guidance >= limits.Guidance.Min && p.Guidance <= limits.Guidance.Max) {
+			t.Errorf("guidance %v is outside %+v", p.Guidance, limits.Guidance)
+		}
+		if f, err := imaging.ParseFormat(string(p.Format)); err != nil || !f.Supported() {
+			t.Errorf("accepted format %q, which this build cannot encode", p.Format)
+		}
+		if p.Format.Lossy() && (p.Quality < 1 || p.Quality > 100) {
+			t.Errorf("quality %d is outside 1-100", p.Quality)
+		}
+
+		sent = nil
+		client.Generate(context.Background(), p.Payload(), nil)
+		dec := json.NewDecoder(bytes.NewReader(sent))
+		dec.UseNumber()
+		var payload map[string]any
+		if err := dec.Decode(&payload); err != nil {
+			t.Fatalf("payload %q of accepted parameters is not JSON: %v", sent, err)
+		}
+		want := map[string]string{
+			"width":               strconv.Itoa(p.Width),
+			"height":              strconv.Itoa(p.Height),
+			"num_inference_steps": strconv.Itoa(p.Steps),
+		}
+		if p.Seed != nil {
+			want["seed"] = strconv.Itoa(*p.Seed)
+		}
+		for key, v := range want {
+			if n, _ := payload[key].(json.Number); n.String() != v {
+				t.Errorf("payload %s = %v, want %s", key, payload[key], v)
+			}
+		}
+		if g, _ := payload["guidance_scale"].(json.Number); g.String() == "" {
+			t.Errorf("payload guidance_scale = %v, want %v", payload["guidance_scale"], p.Guidance)
+		} else if v, err := g.Float64(); err != nil || v != p.Guidance {
+			t.Errorf("payload guidance_scale = %s, want %v", g, p.Guidance)
+		}
+		if payload["prompt"] != p.Prompt {
+			t.Errorf("payload prompt = %q, want %q", payload["prompt"], p.Prompt)
+		}
+		for _, key := range []string{"steps", "guidance"} {
+			if _, ok := payload[key]; ok {
+				t.Errorf("payload has %s, which is renamed", key)
+			}
+		}
+	})
+}
+
+func TestValidateParamsFormat(t *testing.T) {
+	s, err := New("127.0.0.1", 8080, []string{"http://localhost:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	for _, format := range []string{"png", "jpg", "webp", "gif"} {
+		t.Run(format, func(t *testing.T) {
+			form := map[string]string{"prompt": "a cat", "width": "512", "height": "512", "num_steps": "4", "guidance_scale": "1", "format": format}
+			c := e.NewContext(httptest.NewRequest("POST", "/", nil), httptest.NewRecorder())
+			_, _, err := s.validateParams(c, func(name string) string { return form[name] })
+			f, parseErr := imaging.ParseFormat(format)
+			if want := parseErr == nil && f.Supported(); (err == nil) != want {
+				t.Errorf("validateParams error = %v, want accepted %v", err, want)
+			}
+		})
+	}
+}
+
+func TestRequestValuesEncodings(t *testing.T) {
+	form := generationForm("a lighthouse\nat dusk")
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	for name, values := range form {
+		mw.WriteField(name, values[0])
+	}
+	// Files, such as an image to load settings from, are ignored.
+	fw, _ := mw.CreateFormFile("width", "width.txt")
+	fw.Write([]byte("1024"))
+	mw.Close()
+
+	jsonBody, _ := json.Marshal(map[string]any{
+		"prompt": []string{"a lighthouse", "at dusk"}, "width": 64, "height": 64, "num_steps": 4, "guidance_scale": 1,
+	})
+
+	tests := []struct {
+		name, contentType, body string
+	}{
+		{"urlencoded", "application/x-www-form-urlencoded", form.Encode()},
+		{"urlencoded with charset", "application/x-www-form-urlencoded; charset=UTF-8", form.Encode()},
+		{"multipart", mw.FormDataContentType(), multipartBody.String()},
+		{"json", "application/json", string(jsonBody)},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			values, err := requestValues(e.NewContext(req, httptest.NewRecorder()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name := range form {
+				if got, want := values(name), form.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	for name, contentType := range map[string]string{
+		"multipart":  "multipart/form-data; boundary=missing",
+		"urlencoded": "application/x-www-form-urlencoded",
+		"json":       "application/json",
+	} {
+		t.Run("malformed "+name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("%zz{"))
+			req.Header.Set("Content-Type", contentType)
+			if _, err := requestValues(e.NewContext(req, httptest.NewRecorder())); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestGenerateFormEncodings(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, nil)
+	form := generationForm("a lighthouse")
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	for name, values := range form {
+		mw.WriteField(name, values[0])
+	}
+	mw.Close()
+
+	for _, tt := range []struct {
+		name, contentType, body string
+	}{
+		{"urlencoded", "application/x-www-form-urlencoded", form.Encode()},
+		{"multipart", mw.FormDataContentType(), multipartBody.String()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var result struct {
+				Params struct{ Prompt string }
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || result.Params.Prompt != "a lighthouse" {
+				t.Errorf("status %d, prompt %q, want 200 for %q", resp.StatusCode, result.Params.Prompt, "a lighthouse")
+			}
+		})
+	}
+}
+
+func TestAPIOnlyGenerate(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, func(s *Server) { s.APIOnly = true })
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET / status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp = ts.post(t, "/", generationForm("a lighthouse"), http.Header{"Accept": {"text/html"}})
+	defer resp.Body.Close()
+	var result struct {
+		Params struct{ Prompt string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Params.Prompt != "a lighthouse" {
+		t.Errorf("POST / status %d, prompt %q, want 200 for %q", resp.StatusCode, result.Params.Prompt, "a lighthouse")
+	}
+}
+
+func TestLimitsSurviveUnavailableBackends(t *testing.T) {
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"steps": {"min": 1, "max": 30}}`))
+	}))
+	defer ts.Close()
+	s, err := New("127.0.0.1", 1, []string{ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = backend.NewClient([]string{ts.URL}, 0, 0)
+	want := params.Range[int]{Min: 1, Max: 30}
+
+	s.updateCapabilities(context.Background())
+	if got := s.currentLimits().Steps; got != want {
+		t.Fatalf("steps = %v, want the reported %v", got, want)
+	}
+	down.Store(true)
+	s.updateCapabilities(context.Background())
+	if got := s.currentLimits().Steps; got != want {
+		t.Errorf("steps while the backend is down = %v, want the last reported %v", got, want)
+	}
+}
+
+func TestClientLimitRejectsWithoutWaiting(t *testing.T) {
+	flue := newFakeBackend(t, time.Second)
+	ts := startServer(t, flue.URL, func(s *Server) {
+		s.MaxQueueWait = 0
+		s.MaxRunningPerClient = 1
+		s.MaxQueuedPerClient = 1
+	})
+	accept := http.Header{"Accept": {"application/json"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp := ts.post(t, "/", generationForm("a lighthouse"), accept)
+		resp.Body.Close()
+	}()
+	<-flue.received
+	defer func() { <-done }()
+
+	resp := ts.post(t, "/", generationForm("a harbor"), accept)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second generation: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if !strings.Contains(string(body), "1 running (limit 1)") {
+		t.Errorf("second generation: body %s, want the client's usage", body)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"maps"
+	"net/url"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Globals is the per-request data every page can reach as .Globals, without
+// handlers passing it along.
+type Globals struct {
+	// CSRF is the token forms send back to pass the CSRF check, or "" for
+	// requests the check skips.
+	CSRF      string
+	RequestID string
+	// BasePath is the path of BaseURL, such as /flue, or "" at the root.
+	BasePath string
+	// SiteTitle is the branded title of the site, or the default one.
+	SiteTitle string
+	// User is the administrator the request authenticated as, if any.
+	User    string
+	Version string
+	// Theme is the color theme pages are rendered in, and Prefs the
+	// browser's preferences it comes from.
+	Theme string
+	Prefs Prefs
+}
+
+// globals returns the Globals of a request.
+func (s *Server) globals(c echo.Context) Globals {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	g := Globals{
+		CSRF:      csrf,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		SiteTitle: s.Branding.Title,
+		User:      adminIdentity(c),
+		Version:   s.Version,
+		Theme:     defaultTheme,
+		Prefs:     s.prefs(c),
+	}
+	if g.Prefs.Theme != "" {
+		g.Theme = g.Prefs.Theme
+	}
+	if u, err := url.Parse(s.BaseURL); err == nil {
+		g.BasePath = u.Path
+	}
+	if g.SiteTitle == "" {
+		g.SiteTitle = s.t(c, "Flue Image Generator")
+	}
+	return g
+}
+
+// View is the data templates are rendered with when handlers pass a struct
+// or other non-map payload: the payload as .Data next to the branding and
+// the request's globals, which map payloads get merged in instead. Map
+// payloads also get a View under "View", so pages can include partials
+// rendered from a struct.
+type View struct {
+	Data     any
+	Branding Branding
+	Globals  Globals
+}
+
+// With returns v for rendering data, such as a partial included with part
+// of a page's data, as in {{ template "favorite.html" (.View.With .image) }}.
+func (v View) With(data any) View {
+	v.Data = data
+	return v
+}
+
+// pageRenderer renders templates with the data every page needs: the
+// branding under "Branding", the request's globals under "Globals" and a
+// View under "View" added to map data, with data the handler passes under
+// those keys taking precedence, and other data wrapped in a View.
+type pageRenderer struct {
+	echo.Renderer
+	branding Branding
+	globals  func(c echo.Context) Globals
+}
+
+func (r pageRenderer) Render(w io.Writer, name string, data any, c echo.Context) error {
+	view := View{Branding: r.branding, Globals: r.globals(c)}
+	m, ok := data.(map[string]any)
+	if !ok {
+		view.Data = data
+		return r.Renderer.Render(w, name, view, c)
+	}
+	merged := map[string]any{"Branding": view.Branding, "Globals": view.Globals, "View": view}
+	for key := range merged {
+		if _, ok := m[key]; ok {
+			log.Warn("Template data overrides a reserved key", "template", name, "key", key)
+		}
+	}
+	maps.Copy(merged, m)
+	return r.Renderer.Render(w, name, merged, c)
+}
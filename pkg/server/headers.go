@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"flue-frontend/pkg/backend"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// backendHeader returns the static backend headers, warning about
+// configured headers that are hop-by-hop and so never sent.
+func backendHeader(static map[string]string, forward []string) http.Header {
+	h := make(http.Header, len(static))
+	for name, value := range static {
+		if backend.IsHopByHop(name) {
+			log.Warn("Ignoring hop-by-hop backend header", "header", name)
+			continue
+		}
+		h.Set(name, value)
+	}
+	for _, name := range forward {
+		if backend.IsHopByHop(name) {
+			log.Warn("Ignoring hop-by-hop forwarded header", "header", name)
+		}
+	}
+	return h
+}
+
+// forwardedHeaders returns the headers of the request named by
+// ForwardHeaders.
+func (s *Server) forwardedHeaders(c echo.Context) http.Header {
+	h := make(http.Header)
+	for _, name := range s.ForwardHeaders {
+		if values := c.Request().Header.Values(name); len(values) > 0 && !backend.IsHopByHop(name) {
+			h[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return h
+}
+
+// Headers describing a generation, so scripted clients, such as ones
+// downloading the image itself, need not parse the body. The request ID is
+// sent with every response.
+const (
+	headerGenerationTime = "X-Generation-Time"
+	headerSeedUsed       = "X-Seed-Used"
+	headerModel          = "X-Model"
+)
+
+// setGenerationHeaders sets the headers describing a generation that took
+// genTime seconds with seed and model, leaving out the ones not known.
+func setGenerationHeaders(h http.Header, genTime float64, seed *int, model string) {
+	h.Set(headerGenerationTime, strconv.FormatFloat(genTime, 'f', -1, 64))
+	if seed != nil {
+		h.Set(headerSeedUsed, strconv.Itoa(*seed))
+	}
+	if model != "" {
+		h.Set(headerModel, model)
+	}
+}
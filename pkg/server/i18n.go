@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"flue-frontend/pkg/i18n"
+
+	"github.com/labstack/echo/v4"
+)
+
+// localeKey is the context key holding the request's locale.
+const localeKey = "locale"
+
+// langCookie remembers a locale chosen with the lang query parameter.
+const langCookie = "lang"
+
+// localize selects the locale of a request from the lang query parameter,
+// the lang cookie or the Accept-Language header, in that order. An explicit
+// choice is remembered in the cookie.
+func (s *Server) localize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		locale := ""
+		if lang := c.QueryParam("lang"); s.catalog.Supports(lang) {
+			locale = lang
+			c.SetCookie(&http.Cookie{
+				Name:     langCookie,
+				Value:    lang,
+				Path:     "/",
+				MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+				SameSite: http.SameSiteLaxMode,
+			})
+		} else if cookie, err := c.Cookie(langCookie); err == nil && s.catalog.Supports(cookie.Value) {
+			locale = cookie.Value
+		} else {
+			locale = s.catalog.Match(c.Request().Header.Get("Accept-Language"))
+		}
+		c.Set(localeKey, locale)
+		return next(c)
+	}
+}
+
+// locale returns the locale of a request.
+func locale(c echo.Context) string {
+	if l, ok := c.Get(localeKey).(string); ok {
+		return l
+	}
+	return i18n.Default
+}
+
+// t translates a message into the locale of a request.
+func (s *Server) t(c echo.Context, key string, args ...any) string {
+	if s.catalog == nil {
+		if len(args) == 0 {
+			return key
+		}
+		return fmt.Sprintf(key, args...)
+	}
+	return s.catalog.Translate(locale(c), key, args...)
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/ids"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// cachedImage is an encoded image held for later retrieval by ID.
+type cachedImage struct {
+	Data    []byte
+	Format  imaging.Format
+	Quality int
+}
+
+// imageCache is a bounded, least-recently-used store of recently generated
+// images that are served separately from the result fragment.
+type imageCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	id  string
+	img cachedImage
+}
+
+func newImageCache(size int) *imageCache {
+	return &imageCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Add stores img under a new random ID and returns the ID.
+func (c *imageCache) Add(img cachedImage) string {
+	id := ids.New()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = c.order.PushFront(&cacheEntry{id: id, img: img})
+	for c.order.Len() > max(c.size, 1) {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).id)
+	}
+	return id
+}
+
+// Get returns the image stored under id.
+func (c *imageCache) Get(id string) (cachedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return cachedImage{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).img, true
+}
+
+// rawImage serves an unfiltered image from the cache, such as the original
+// behind a blurred safety preview.
+func (s *Server) rawImage(c echo.Context) error {
+	img, ok := s.images.Get(c.Param("id"))
+	if !ok {
+		return errorf(http.StatusNotFound, "Image not found")
+	}
+	c.Response().Header().Set("Cache-Control", "private, max-age=3600")
+	return c.Blob(http.StatusOK, img.Format.MIMEType(), img.Data)
+}
+
+// generatedImage serves an image from the image store, redirecting to a
+// presigned URL of the store if PresignExpiry is set and the store serves
+// clients directly. Archived images never change, so they may be cached
+// indefinitely.
+func (s *Server) generatedImage(c echo.Context) error {
+	if s.archive == nil {
+		return errorf(http.StatusNotFound, "Image not found")
+	}
+	if linker, ok := s.archive.(archive.Linker); ok && s.PresignExpiry > 0 {
+		u, err := linker.ImageURL(c.Request().Context(), c.Param("id"), s.PresignExpiry)
+		switch {
+		case errors.Is(err, archive.ErrNotFound):
+			return errorf(http.StatusNotFound, "Image not found")
+		case err != nil:
+			log.Warn("Failed to presign archived image, serving it directly", "id", c.Param("id"), "error", err)
+		case u != "":
+			// Let browsers reuse the URL for part of its lifetime only.
+			c.Response().Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(s.PresignExpiry.Seconds()/2)))
+			return c.Redirect(http.StatusFound, u)
+		}
+	}
+	return s.serveArchived(c, false)
+}
+
+// downloadGeneratedImage serves an archived image as an attachment named
+// after its prompt, seed and dimensions.
+func (s *Server) downloadGeneratedImage(c echo.Context) error {
+	if s.archive == nil {
+		return errorf(http.StatusNotFound, "Image not found")
+	}
+	return s.serveArchived(c, true)
+}
+
+// serveArchived streams the archived image named by the id parameter, as an
+// attachment if attach is set, with headers describing its generation.
+// Requests with a matching If-None-Match or If-Modified-Since header get 304
+// Not Modified.
+func (s *Server) serveArchived(c echo.Context, attach bool) error {
+	r, meta, err := s.openArchived(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, archive.ErrNotFound) {
+		return errorf(http.StatusNotFound, "Image not found")
+	}
+	if err != nil {
+		log.Error("Failed to read archived image", "id", c.Param("id"), "error", err)
+		return errorf(http.StatusInternalServerError, "Failed to read image")
+	}
+	defer r.Close()
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, imaging.Format(meta.Format).MIMEType())
+	if attach {
+		h.Set(echo.HeaderContentDisposition, contentDisposition(downloadName(meta)))
+	}
+	setGenerationHeaders(h, meta.GenTime, meta.Seed, meta.Model)
+	h.Set("ETag", imageETag(meta))
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(c.Response(), c.Request(), "", meta.CreatedAt, r)
+	return nil
+}
+
+// imageETag returns the strong ETag of an archived image, the hash of its
+// bytes, or its ID if it was archived before hashes were recorded.
+func imageETag(meta store.Metadata) string {
+	if meta.Hash != "" {
+		return `"` + meta.Hash + `"`
+	}
+	return `"` + meta.ID + `"`
+}
+
+// openArchived returns a reader of an archived image and its metadata,
+// streaming it from the image store if the store supports that.
+func (s *Server) openArchived(ctx context.Context, id string) (io.ReadSeekCloser, store.Metadata, error) {
+	if opener, ok := s.archive.(archive.Opener); ok {
+		return opener.OpenImage(ctx, id)
+	}
+	data, meta, err := s.archive.Get(ctx, id)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	return nopCloser{bytes.NewReader(data)}, meta, nil
+}
+
+// nopCloser adds a Close method doing nothing to a ReadSeeker.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// maxSlugLength is the maximum number of characters of a prompt in a
+// download file name.
+const maxSlugLength = 60
+
+// downloadName returns the file name of an archived image, such as
+// lighthouse-at-dusk_s42_768x768.png, along with an ASCII-only variant for
+// clients that do not understand others.
+func downloadName(meta store.Metadata) (string, string) {
+	suffix := fmt.Sprintf("_%dx%d.%s", meta.Width, meta.Height, meta.Format)
+	if meta.Seed != nil {
+		suffix = fmt.Sprintf("_s%d", *meta.Seed) + suffix
+	}
+	ascii := strings.Map(func(r rune) rune {
+		if r >= utf8.RuneSelf {
+			return -1
+		}
+		return r
+	}, meta.Prompt)
+	return slug(meta.Prompt) + suffix, slug(ascii) + suffix
+}
+
+// slug lowercases text and joins its runs of letters and digits with
+// hyphens, cut to maxSlugLength characters. It returns "image" if text has
+// no letters or digits.
+func slug(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "image"
+	}
+	s := []rune(strings.Join(words, "-"))
+	if len(s) > maxSlugLength {
+		s = s[:maxSlugLength]
+	}
+	return strings.TrimSuffix(string(s), "-")
+}
+
+// contentDisposition returns an attachment header for a file name, given in
+// RFC 5987 encoding if it differs from its ASCII variant.
+func contentDisposition(name, ascii string) string {
+	if name == ascii {
+		return `attachment; filename="` + name + `"`
+	}
+	return `attachment; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(name)
+}
+
+// archivedMetadata returns the metadata of an archived image, or a 404
+// error if there is none.
+func (s *Server) archivedMetadata(c echo.Context, id string) (store.Metadata, error) {
+	meta, err := s.archive.Metadata(c.Request().Context(), id)
+	if errors.Is(err, archive.ErrNotFound) {
+		return store.Metadata{}, errorf(http.StatusNotFound, "Image not found")
+	}
+	if err != nil {
+		log.Error("Failed to read archived image metadata", "id", id, "error", err)
+		return store.Metadata{}, errorf(http.StatusInternalServerError, "Failed to read image")
+	}
+	return meta, nil
+}
+
+// deleteGeneratedImage removes an image from the image store along with the
+// finished jobs whose result it is. Only its submitter, or with
+// PerUserGalleries its session, or an administrator may delete it. HTMX
+// requests targeting the image's gallery item get an empty response for
+// removing it, and others are sent back to the gallery.
+func (s *Server) deleteGeneratedImage(c echo.Context) error {
+	if s.archive == nil {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	id := c.Param("id")
+	meta, err := s.archivedMetadata(c, id)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	actor := c.RealIP()
+	if admin, ok := s.optionalAdmin(c); ok {
+		actor = admin
+	} else if !s.submitted(c, meta.Client, meta.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its submitter or an administrator may delete this image"))
+	}
+
+	if err := s.archive.Delete(c.Request().Context(), id); errors.Is(err, archive.ErrNotFound) {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	} else if err != nil {
+		log.Error("Failed to delete archived image", "id", id, "error", err)
+		return s.jobError(c, errorf(http.StatusInternalServerError, "Failed to delete image"))
+	}
+	s.forgetImageJobs(id)
+	s.links.revoke(id)
+	log.Info("Archived image deleted", "id", id, "by", actor)
+
+	if s.isHTMX(c) && c.Request().Header.Get("HX-Target") == "image-"+id {
+		return c.NoContent(http.StatusOK)
+	}
+	if s.isHTMX(c) {
+		c.Response().Header().Set("HX-Redirect", "/gallery")
+		return c.NoContent(http.StatusOK)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// forgetImageJobs removes the finished jobs whose result is the archived
+// image id, so its history goes along with it.
+func (s *Server) forgetImageJobs(id string) {
+	done, _, _ := s.jobs.List(jobs.Filter{Status: jobs.Done})
+	for _, j := range done {
+		if result, ok := jobResult(j); ok && result.ID == id {
+			s.jobs.Remove(j.ID)
+		}
+	}
+}
+
+// redirectImage sends requests for /images/:id on to /generated/:id, the
+// canonical URL of archived images. Deletions are served directly since not
+// every client follows redirects for them.
+func (s *Server) redirectImage(c echo.Context) error {
+	return c.Redirect(http.StatusPermanentRedirect, "/generated/"+url.PathEscape(c.Param("id")))
+}
+
+// tiledImage serves a 2x2 tiling of a cached image so seams in textures are
+// easy to spot. It is composited on request to keep result fragments small.
+func (s *Server) tiledImage(c echo.Context) error {
+	cached, ok := s.images.Get(c.Param("id"))
+	if !ok {
+		return errorf(http.StatusNotFound, "Image not found")
+	}
+	img, err := imaging.Decode(cached.Data)
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "Failed to decode image")
+	}
+	tiled, err := imaging.Encode(imaging.Tile(img, 2, 2), cached.Format, cached.Quality)
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "Failed to encode tiled image")
+	}
+	c.Response().Header().Set("Cache-Control", "private, max-age=3600")
+	return c.Blob(http.StatusOK, cached.Format.MIMEType(), tiled)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// retentionRun is the outcome of the latest retention cleanup.
+type retentionRun struct {
+	mu         sync.Mutex
+	at         time.Time
+	removed    int
+	bytesFreed int64
+}
+
+func (r *retentionRun) set(removed int, bytesFreed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.at = time.Now()
+	r.removed = removed
+	r.bytesFreed = bytesFreed
+}
+
+func (r *retentionRun) get() (time.Time, int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.at, r.removed, r.bytesFreed
+}
+
+// retentionEnabled reports whether any retention limit is configured.
+func (s *Server) retentionEnabled() bool {
+	return s.RetentionMaxAge > 0 || s.RetentionMaxBytes > 0 || s.RetentionMaxCount > 0
+}
+
+// enforceRetention removes archived images beyond the retention limits on
+// startup and then every RetentionInterval until ctx is done.
+func (s *Server) enforceRetention(ctx context.Context) {
+	if s.archive == nil || !s.retentionEnabled() {
+		return
+	}
+	s.cleanArchive(ctx)
+	if s.RetentionInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cleanArchive(ctx)
+		}
+	}
+}
+
+// cleanArchive deletes the oldest images that are not favorites until the
+// archive is within RetentionMaxBytes and RetentionMaxCount, along with every
+// such image older than RetentionMaxAge. In dry run mode it only logs what
+// it would delete. Deleting drops an image from the index before its files,
+// so no new download of it starts while it is removed.
+func (s *Server) cleanArchive(ctx context.Context) {
+	all, count, err := s.archive.List(ctx, store.Query{}, 0, math.MaxInt)
+	if err != nil {
+		log.Error("Failed to list archived images for retention", "error", err)
+		return
+	}
+	var usage int64
+	for _, meta := range all {
+		usage += meta.Size
+	}
+
+	now := time.Now()
+	removed := 0
+	var freed int64
+	for i := len(all) - 1; i >= 0 && ctx.Err() == nil; i-- {
+		meta := all[i]
+		expired := s.RetentionMaxAge > 0 && now.Sub(meta.CreatedAt) > s.RetentionMaxAge
+		tooLarge := s.RetentionMaxBytes > 0 && usage > s.RetentionMaxBytes
+		tooMany := s.RetentionMaxCount > 0 && count > s.RetentionMaxCount
+		if !expired && !tooLarge && !tooMany {
+			// Newer images are not expired either.
+			break
+		}
+		if meta.Favorite {
+			continue
+		}
+
+		if s.RetentionDryRun {
+			log.Info("Retention would remove image", "id", meta.ID, "created_at", meta.CreatedAt, "size", meta.Size)
+		} else if err := s.archive.Delete(ctx, meta.ID); err != nil {
+			log.Error("Failed to remove image for retention", "id", meta.ID, "error", err)
+			continue
+		}
+		usage -= meta.Size
+		count--
+		removed++
+		freed += meta.Size
+	}
+
+	s.retention.set(removed, freed)
+	if removed > 0 || s.RetentionDryRun {
+		log.Info("Retention cleanup finished", "removed", removed, "bytes_freed", freed, "usage", usage, "images", count, "dry_run", s.RetentionDryRun)
+	}
+}
+
+// storageStats is the archive's usage and the outcome of the latest
+// retention cleanup, as shown to administrators.
+type storageStats struct {
+	Images     int   `json:"images"`
+	Favorites  int   `json:"favorites"`
+	UsageBytes int64 `json:"usage_bytes"`
+	// DedupSavedBytes is the part of UsageBytes not actually stored, as
+	// identical images share one copy.
+	DedupSavedBytes int64 `json:"dedup_saved_bytes"`
+
+	RetentionEnabled bool       `json:"retention_enabled"`
+	DryRun           bool       `json:"dry_run"`
+	LastRun          *time.Time `json:"last_run"`
+	// LastRemoved and LastBytesFreed count what the latest cleanup removed,
+	// or would have removed in dry run mode.
+	LastRemoved    int   `json:"last_removed"`
+	LastBytesFreed int64 `json:"last_bytes_freed"`
+}
+
+// adminStorage reports the archive's current usage and the outcome of the
+// latest retention cleanup as JSON.
+func (s *Server) adminStorage(c echo.Context) error {
+	usage, err := s.archive.Stats(c.Request().Context())
+	if err != nil {
+		log.Error("Failed to read archive stats", "error", err)
+		return s.jobError(c, errorf(http.StatusInternalServerError, "Failed to list images"))
+	}
+	stats := storageStats{
+		Images:           usage.Images,
+		Favorites:        usage.Favorites,
+		UsageBytes:       usage.Bytes,
+		DedupSavedBytes:  usage.SavedBytes,
+		RetentionEnabled: s.retentionEnabled(),
+		DryRun:           s.RetentionDryRun,
+	}
+	if at, removed, freed := s.retention.get(); !at.IsZero() {
+		stats.LastRun = &at
+		stats.LastRemoved = removed
+		stats.LastBytesFreed = freed
+	}
+	return c.JSON(http.StatusOK, stats)
+}
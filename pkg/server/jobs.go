@@ -0,0 +1,576 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/events"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/queue"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// isHTMX reports whether the request was issued by HTMX and should get an
+// HTML fragment, which is never the case without the HTML UI.
+func (s *Server) isHTMX(c echo.Context) bool {
+	return !s.APIOnly && c.Request().Header.Get("HX-Request") == "true"
+}
+
+// acceptsHTML reports whether the client asked for an HTML page rather than
+// JSON, which is never the case without the HTML UI.
+func (s *Server) acceptsHTML(c echo.Context) bool {
+	return !s.APIOnly && strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// submitJob validates a generation request and queues it, returning the job
+// immediately. HTMX requests get a fragment that polls for the result.
+func (s *Server) submitJob(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	p, warnings, err := s.parseParams(c, values)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+
+	runAt, err := s.parseRunAt(values("run_at"))
+	if err != nil {
+		return s.jobError(c, err)
+	}
+
+	// An identical submission shortly after returns the same job.
+	client, origin := c.RealIP(), s.origin(c)
+	req := jobs.Job{Params: p, Client: client, Owner: s.owner(c), RunAt: runAt}
+	job, err, shared := s.jobDedup.do(c.Request().Context(), dedupKey(client, req.Owner, []any{p.Hash(), runAt}), func(context.Context) (jobs.Job, error) {
+		return s.enqueueJob(origin, req, warnings)
+	})
+	if errors.Is(err, errQueueFull) {
+		err = s.queueFull(c)
+	}
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	if shared {
+		log.Info("Duplicate job submission", "job", job.ID, "client", client)
+	}
+
+	job, _ = s.jobs.Get(job.ID)
+	job.Usage = s.clients.usage(client)
+	if s.isHTMX(c) {
+		return c.Render(http.StatusAccepted, "job.html", withResultView(job))
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// parseRunAt parses the time a job is scheduled for, given in RFC 3339 or
+// relative to now like "+2h". It returns nil if v is empty.
+func (s *Server) parseRunAt(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	var t time.Time
+	if rel, ok := strings.CutPrefix(v, "+"); ok {
+		d, err := time.ParseDuration(rel)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "Run time is invalid: %s", v)
+		}
+		t = now.Add(d)
+	} else {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "Run time is invalid: %s", v)
+		}
+		t = parsed
+	}
+	if !t.After(now) {
+		return nil, errorf(http.StatusBadRequest, "Run time must be in the future")
+	}
+	if s.MaxScheduleHorizon > 0 && t.Sub(now) > s.MaxScheduleHorizon {
+		return nil, errorf(http.StatusBadRequest, "Run time is more than %s ahead", s.MaxScheduleHorizon)
+	}
+	return &t, nil
+}
+
+// requestOrigin is what a job needs from the request submitting it: the
+// headers forwarded to the backends and the request ID. It is taken out of
+// the echo.Context up front, as Echo reuses the context once the request
+// ends while the job may still be queued.
+type requestOrigin struct {
+	header    http.Header
+	requestID string
+}
+
+// origin returns the requestOrigin of the request of c.
+func (s *Server) origin(c echo.Context) requestOrigin {
+	return requestOrigin{header: s.forwardedHeaders(c), requestID: c.Response().Header().Get(echo.HeaderXRequestID)}
+}
+
+// context returns ctx carrying the forwarded headers and request ID of o.
+func (o requestOrigin) context(ctx context.Context) context.Context {
+	return context.WithValue(backend.WithHeaders(ctx, o.header), requestIDKey{}, o.requestID)
+}
+
+// enqueueJob creates a job with the parameters, client, batch and run time
+// of req, submitted by a request from origin. A scheduled job waits for its
+// run time; any other takes a place in the client's own queue, and in the
+// shared queue right away if the client is within its running limit,
+// failing with errQueueFull if that is full.
+func (s *Server) enqueueJob(origin requestOrigin, req jobs.Job, warnings []string) (jobs.Job, error) {
+	if req.RunAt != nil {
+		job, ctx := s.jobs.Add(req)
+		s.goJob(func() { s.runScheduled(origin.context(ctx), job, warnings) })
+		log.Info("Job scheduled", "job", job.ID, "client", job.Client, "params", job.Params.Hash(), "run_at", job.RunAt)
+		return job, nil
+	}
+
+	clientTicket, err := s.clients.join(req.Client)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	job, ctx := s.jobs.Add(req)
+	var ticket *queue.Ticket
+	if clientTicket.Ready() {
+		ticket, err = s.limiter.Join(s.jobPosition(job.ID, job.Params))
+		if err != nil {
+			clientTicket.Cancel()
+			s.jobs.Remove(job.ID)
+			return jobs.Job{}, errQueueFull
+		}
+	}
+	s.goJob(func() { s.runJob(origin.context(ctx), job.ID, clientTicket, ticket, job.Params, warnings) })
+	log.Info("Job queued", "job", job.ID, "client", job.Client, "params", job.Params.Hash())
+	return job, nil
+}
+
+// resumeJobs schedules and enqueues the jobs that were still pending when
+// the server last stopped.
+func (s *Server) resumeJobs() error {
+	pending, ctxs, err := s.jobs.Restore()
+	if err != nil {
+		return err
+	}
+	for i, job := range pending {
+		if job.Status == jobs.Scheduled {
+			s.goJob(func() { s.runScheduled(ctxs[i], job, nil) })
+			continue
+		}
+		clientTicket, err := s.clients.join(job.Client)
+		if err != nil {
+			s.finishJob(job.ID, nil, err)
+			continue
+		}
+		s.goJob(func() { s.runJob(ctxs[i], job.ID, clientTicket, nil, job.Params, nil) })
+	}
+	if len(pending) > 0 {
+		log.Info("Resumed pending jobs", "count", len(pending))
+	}
+	return nil
+}
+
+// goJob runs fn, which works on a job, in a goroutine shutdown waits for.
+func (s *Server) goJob(fn func()) {
+	s.jobWork.Add(1)
+	go func() {
+		defer s.jobWork.Done()
+		fn()
+	}()
+}
+
+// untilStopping returns a context canceled along with ctx or once shutdown
+// starts, for jobs to stop waiting on, and the function releasing it.
+func (s *Server) untilStopping(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runScheduled waits until the run time of a scheduled job, then moves it to
+// the queue and runs it like any other. Canceling ctx before then drops it,
+// while shutdown leaves it scheduled for the next start.
+func (s *Server) runScheduled(ctx context.Context, job jobs.Job, warnings []string) {
+	timer := time.NewTimer(time.Until(*job.RunAt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		s.finishJob(job.ID, nil, ctx.Err())
+		return
+	case <-s.stopping:
+		return
+	case <-timer.C:
+	}
+
+	if !s.jobs.Activate(job.ID) {
+		return
+	}
+	s.publishJob(job.ID, "queued", map[string]any{"status": jobs.Queued})
+	log.Info("Scheduled job queued", "job", job.ID)
+	clientTicket, err := s.clients.join(job.Client)
+	if err != nil {
+		s.finishJob(job.ID, nil, err)
+		return
+	}
+	s.runJob(ctx, job.ID, clientTicket, nil, job.Params, warnings)
+}
+
+// runJob waits for a slot among the client's generations and then for a
+// shared generation slot, joining the shared queue if ticket is nil, and
+// executes the job. Canceling ctx removes a queued job from the queues or
+// aborts the backend request of a running one, freeing its slots either way.
+// Shutdown takes a job still waiting off the queues but leaves it queued,
+// for the next start to resume, while a running one carries on.
+func (s *Server) runJob(ctx context.Context, id string, clientTicket, ticket *queue.Ticket, p params.Params, warnings []string) {
+	waitCtx, stopWaiting := s.untilStopping(ctx)
+	defer stopWaiting()
+	releaseClient, err := clientTicket.Wait(waitCtx)
+	if err != nil {
+		if ticket != nil {
+			ticket.Cancel()
+		}
+		if ctx.Err() == nil {
+			return
+		}
+		s.finishJob(id, nil, err)
+		return
+	}
+	defer releaseClient()
+
+	if ticket == nil {
+		ticket, err = s.limiter.Join(s.jobPosition(id, p))
+		if err != nil {
+			s.finishJob(id, nil, errorf(http.StatusServiceUnavailable, "The generation queue is full, please try again later"))
+			return
+		}
+	}
+	release, err := ticket.Wait(waitCtx)
+	if err != nil {
+		if ctx.Err() == nil {
+			return
+		}
+		s.finishJob(id, nil, err)
+		return
+	}
+	defer release()
+
+	job, _ := s.jobs.Start(id)
+	s.publishJob(id, "running", map[string]any{"status": jobs.Running})
+	data, err := s.execute(withOwner(ctx, job.Owner), job.Client, p, warnings, func(pr backend.Progress) {
+		s.publishJob(id, "progress", backend.Progress{Step: pr.Step, Total: pr.Total})
+		if pr.Preview != "" {
+			s.publishJob(id, "preview", pr)
+		}
+	})
+	if ctx.Err() != nil {
+		log.Info("Job canceled", "job", id)
+	} else if err != nil {
+		log.Warn("Job failed", "job", id, "error", err)
+	} else {
+		log.Info("Job done", "job", id)
+	}
+	s.finishJob(id, data, err)
+}
+
+// jobPosition returns a callback recording a job's position in the shared
+// queue and its approximate wait, and notifying its listeners.
+func (s *Server) jobPosition(id string, p params.Params) queue.PositionFunc {
+	return func(position, _ int) {
+		var eta float64
+		if wait, ok := s.estimateWait(position, p); ok {
+			eta = roundFloat(wait.Seconds(), 1)
+		}
+		s.jobs.SetPosition(id, position, eta)
+		s.publishJob(id, "queued", map[string]any{"status": jobs.Queued, "position": position, "eta_seconds": eta})
+	}
+}
+
+// finishJob records the outcome of a job and sends the final event to its
+// listeners.
+func (s *Server) finishJob(id string, result any, err error) {
+	job, _ := s.jobs.Finish(id, result, err)
+	final := finalJobEvent(job)
+	s.progress.Close(jobTopic(id), &final)
+}
+
+// jobTopic is the event broker topic of a job.
+func jobTopic(id string) string {
+	return "job/" + id
+}
+
+// publishJob sends a JSON-encoded event to the listeners of a job.
+func (s *Server) publishJob(id, name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Failed to encode job event", "job", id, "error", err)
+		return
+	}
+	s.progress.Publish(jobTopic(id), events.Event{Name: name, Data: string(data)})
+}
+
+// finalJobEvent returns the done or error event for a finished job. The
+// result itself is referenced by URL rather than inlined.
+func finalJobEvent(job jobs.Job) events.Event {
+	if job.Status == jobs.Canceled {
+		data, _ := json.Marshal(map[string]any{"id": job.ID, "status": job.Status, "error": "Job was canceled"})
+		return events.Event{Name: "error", Data: string(data)}
+	}
+	if job.Status == jobs.Failed {
+		data, _ := json.Marshal(map[string]any{"id": job.ID, "status": job.Status, "error": job.Error})
+		return events.Event{Name: "error", Data: string(data)}
+	}
+	data, _ := json.Marshal(map[string]any{"id": job.ID, "status": job.Status, "url": "/jobs/" + job.ID})
+	return events.Event{Name: "done", Data: string(data)}
+}
+
+// jobEvents streams a job's state transitions and progress as server-sent
+// events, ending with a done or error event. With cancel_on_close=true the
+// job is canceled as soon as the client closes the stream before the job
+// finished, such as when a browser tab is closed, so the backends stop
+// working on a generation no one waits for. Like canceling it outright, that
+// is only allowed to its submitter or an administrator. Scheduled jobs are
+// left alone.
+func (s *Server) jobEvents(c echo.Context) error {
+	id := c.Param("id")
+	cancelOnClose := false
+	if v := c.QueryParam("cancel_on_close"); v != "" {
+		var err error
+		if cancelOnClose, err = strconv.ParseBool(v); err != nil {
+			return s.jobError(c, errorf(http.StatusBadRequest, "Invalid value for cancel_on_close: %q", v))
+		}
+	}
+	ch, unsubscribe := s.progress.Subscribe(jobTopic(id))
+	defer unsubscribe()
+
+	// Check the job only after subscribing so a concurrent finish is either
+	// seen here or delivered on the channel.
+	job, ok := s.visibleJob(c, id)
+	if !ok {
+		return s.jobError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+	if _, admin := s.optionalAdmin(c); cancelOnClose && !admin && !s.submitted(c, job.Client, job.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its submitter or an administrator may cancel this job"))
+	}
+	if job.Status.Finished() {
+		closed := make(chan events.Event, 1)
+		closed <- finalJobEvent(job)
+		close(closed)
+		ch = closed
+	}
+	ctx := c.Request().Context()
+	err := s.streamEvents(c, withoutPreviews(ctx, ch))
+	if cancelOnClose && ctx.Err() != nil {
+		s.cancelAbandoned(c, id)
+	}
+	return err
+}
+
+// cancelAbandoned cancels a queued or running job whose client went away.
+func (s *Server) cancelAbandoned(c echo.Context, id string) {
+	job, ok := s.jobs.Get(id)
+	if !ok || job.Status.Finished() || job.Status == jobs.Scheduled {
+		return
+	}
+	if job, ok = s.jobs.Cancel(id, c.RealIP()); ok && job.Status == jobs.Canceled {
+		log.Info("Job canceled, client closed its event stream", "job", job.ID, "by", job.CanceledBy)
+	}
+}
+
+// withoutPreviews filters preview images out of a job's event stream, which
+// are only sent over the WebSocket channel.
+func withoutPreviews(ctx context.Context, in <-chan events.Event) <-chan events.Event {
+	out := make(chan events.Event)
+	go func() {
+		defer close(out)
+		for ev := range in {
+			if ev.Name == "preview" {
+				continue
+			}
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// listJobs returns recent jobs, newest first, as JSON or as an HTML page for
+// browsers. With PerUserGalleries only the jobs of the request's session are
+// listed, except to administrators, who may narrow theirs by owner instead.
+// It accepts the filters status, submitter, since and until (RFC 3339), a
+// limit, and the cursor of the previous page.
+func (s *Server) listJobs(c echo.Context) error {
+	f := jobs.Filter{
+		Status: jobs.Status(c.QueryParam("status")),
+		Client: c.QueryParam("submitter"),
+		Limit:  50,
+		Cursor: c.QueryParam("cursor"),
+	}
+	if adminIdentity(c) != "" {
+		f.Owner = s.sessionOwner(c.QueryParam("owner"))
+	} else {
+		f.Owner = s.owner(c)
+	}
+	switch f.Status {
+	case "", jobs.Scheduled, jobs.Queued, jobs.Running, jobs.Done, jobs.Failed, jobs.Canceled:
+	default:
+		return s.jobError(c, errorf(http.StatusBadRequest, "Status is invalid: %s", f.Status))
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := parseFormInt(v, 1, 200)
+		if err != nil {
+			return s.jobError(c, numberError(err, "Limit must be a whole number", "Limit must be between %v and %v"))
+		}
+		f.Limit = limit
+	}
+	q, err := s.parseSearch(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	q.apply(&f)
+
+	list, next, err := s.jobs.List(f)
+	if errors.Is(err, jobs.ErrInvalidCursor) {
+		return s.jobError(c, errorf(http.StatusBadRequest, "Cursor is invalid"))
+	}
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	summaries := make([]jobs.Summary, len(list))
+	for i, j := range list {
+		summaries[i] = j.Summary()
+		if result, ok := jobResult(j); ok && j.Status == jobs.Done && result.ID != "" {
+			summaries[i].Thumbnail = "/thumbs/" + url.PathEscape(result.ID)
+		}
+	}
+
+	var nextURL string
+	if next != "" {
+		q := c.QueryParams()
+		q.Set("cursor", next)
+		nextURL = c.Path() + "?" + q.Encode()
+	}
+	if s.acceptsHTML(c) {
+		return c.Render(http.StatusOK, "jobs.html", map[string]any{
+			"jobs":     summaries,
+			"path":     c.Path(),
+			"next_url": nextURL,
+			"filter":   f,
+			"statuses": []jobs.Status{jobs.Scheduled, jobs.Queued, jobs.Running, jobs.Done, jobs.Failed, jobs.Canceled},
+			"lang":     locale(c),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"jobs":        summaries,
+		"next_cursor": next,
+	})
+}
+
+// visibleJob returns the job with the given ID unless it is hidden from the
+// request: with PerUserGalleries, jobs of other sessions are only visible
+// to administrators.
+func (s *Server) visibleJob(c echo.Context, id string) (jobs.Job, bool) {
+	job, ok := s.jobs.Get(id)
+	if !ok {
+		return jobs.Job{}, false
+	}
+	if _, admin := s.optionalAdmin(c); !admin && !s.owns(c, job.Owner) {
+		return jobs.Job{}, false
+	}
+	return job, true
+}
+
+// getJob returns the status of a job as JSON, as a fragment for HTMX or as
+// a page for browsers, which keeps polling until the job finishes.
+func (s *Server) getJob(c echo.Context) error {
+	representation := s.negotiate(c)
+	if representation == asFragment {
+		return s.jobFragment(c)
+	}
+	job, ok := s.visibleJob(c, c.Param("id"))
+	if !ok {
+		if representation == asPage {
+			return errorf(http.StatusNotFound, "Job not found")
+		}
+		return c.JSON(http.StatusNotFound, map[string]string{"error": s.t(c, "Job not found")})
+	}
+	job.Usage = s.clients.usage(job.Client)
+	if result, ok := jobResult(job); ok {
+		setGenerationHeaders(c.Response().Header(), result.GenTime, result.Seed, result.Model)
+	}
+	if representation == asPage {
+		return c.Render(http.StatusOK, "job_status.html", map[string]any{"job": withResultView(job), "lang": locale(c)})
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// cancelJob cancels a queued or running job, if the request comes from its
+// submitter or an administrator. Jobs the client may not see are not found.
+// Canceling a finished job is a no-op that returns its final state.
+func (s *Server) cancelJob(c echo.Context) error {
+	job, ok := s.visibleJob(c, c.Param("id"))
+	if !ok {
+		return s.jobError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+	if _, admin := s.optionalAdmin(c); !admin && !s.submitted(c, job.Client, job.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its submitter or an administrator may cancel this job"))
+	}
+	job, ok = s.jobs.Cancel(job.ID, c.RealIP())
+	if !ok {
+		return s.jobError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+	if job.Status == jobs.Canceled {
+		log.Info("Job cancel requested", "job", job.ID, "by", job.CanceledBy)
+	}
+	if s.isHTMX(c) {
+		return c.Render(http.StatusOK, "job.html", withResultView(job))
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// jobFragment renders the status of a job, polling until it finishes. Once
+// it has, the polling element is replaced by the result, error or
+// cancellation fragment, which ends the polling.
+func (s *Server) jobFragment(c echo.Context) error {
+	job, ok := s.visibleJob(c, c.Param("id"))
+	if !ok {
+		return s.pageError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+	if !job.Status.Finished() {
+		return c.Render(http.StatusOK, "job.html", withResultView(job))
+	}
+
+	h := c.Response().Header()
+	h.Set("HX-Retarget", "#job-"+job.ID)
+	h.Set("HX-Reswap", "outerHTML")
+	switch job.Status {
+	case jobs.Done:
+		result, ok := jobResult(job)
+		if !ok {
+			return s.pageError(c, errorf(http.StatusInternalServerError, "Job result is unavailable"))
+		}
+		setGenerationHeaders(h, result.GenTime, result.Seed, result.Model)
+		return c.Render(http.StatusOK, "result.html", result)
+	case jobs.Canceled:
+		return c.Render(http.StatusOK, "job_canceled.html", job)
+	default:
+		return c.Render(http.StatusOK, "job_failed.html", job)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"flue-frontend/pkg/backend"
+)
+
+// sseEvent is a server-sent event as read by a client.
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// readEvents reads the events of an event stream until it ends.
+func readEvents(t *testing.T, resp *http.Response) []sseEvent {
+	t.Helper()
+	var evs []sseEvent
+	var ev sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if ev.Data != "" {
+				evs = append(evs, ev)
+			}
+			ev = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			ev.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return evs
+}
+
+func TestJobEventsStreamProgress(t *testing.T) {
+	flue := newFakeBackend(t, 600*time.Millisecond)
+	ts := startServer(t, flue.URL, func(s *Server) {
+		s.StreamProgress = true
+	})
+
+	resp := ts.post(t, "/jobs", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}})
+	var job struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(ts.URL + "/jobs/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var steps []int
+	var last sseEvent
+	for _, ev := range readEvents(t, resp) {
+		if ev.Name == "progress" {
+			var pr backend.Progress
+			if err := json.Unmarshal([]byte(ev.Data), &pr); err != nil {
+				t.Fatalf("progress event %q: %v", ev.Data, err)
+			}
+			if pr.Total != flue.Steps {
+				t.Errorf("progress total = %d, want %d", pr.Total, flue.Steps)
+			}
+			steps = append(steps, pr.Step)
+		}
+		last = ev
+	}
+	if want := []int{1, 2, 3}; !slices.Equal(steps, want) {
+		t.Errorf("progress steps = %v, want %v", steps, want)
+	}
+	var final struct{ ID, Status, URL string }
+	if err := json.Unmarshal([]byte(last.Data), &final); err != nil {
+		t.Fatalf("final event %q: %v", last.Data, err)
+	}
+	if last.Name != "done" || final.ID != job.ID || final.Status != "done" || final.URL != "/jobs/"+job.ID {
+		t.Errorf("final event = %s %s, want done for job %s", last.Name, last.Data, job.ID)
+	}
+}
+
+func TestJobEventsCancelOnClose(t *testing.T) {
+	flue := newFakeBackend(t, 2*time.Second)
+	ts := startServer(t, flue.URL, func(s *Server) {
+		// Tell clients apart by the address a trusted proxy forwards.
+		s.TrustedProxies = []string{"127.0.0.1"}
+	})
+	from := func(ip string) http.Header {
+		return http.Header{"Accept": {"application/json"}, "X-Forwarded-For": {ip}}
+	}
+
+	resp := ts.post(t, "/jobs", generationForm("a lighthouse"), from("192.0.2.1"))
+	var job struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := func(ip string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+job.ID+"/events?cancel_on_close=true", nil)
+		req.Header = from(ip)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp = events("192.0.2.2")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("another client got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp = events("192.0.2.1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("submitter got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp.Body.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var status struct{ Status string }
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+job.ID, nil)
+		req.Header = from("192.0.2.1")
+		do(t, http.DefaultClient, req, &status)
+		if status.Status == "canceled" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job status = %s after its submitter closed the stream, want canceled", status.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobHistoryOutlivesTTL(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, func(s *Server) {
+		withAdmin(s)
+		s.JobTTL = 300 * time.Millisecond
+	})
+	accept := http.Header{"Accept": {"application/json"}}
+	var job struct{ ID string }
+	if status := do(t, http.DefaultClient, ts.postRequest("/jobs", generationForm("a lighthouse"), accept), &job); status != http.StatusAccepted {
+		t.Fatalf("submit status = %d", status)
+	}
+	waitForJob(t, ts, job.ID)
+	time.Sleep(400 * time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+job.ID, nil)
+	req.Header = accept
+	if status := do(t, http.DefaultClient, req, nil); status != http.StatusNotFound {
+		t.Errorf("job after its TTL: status %d, want %d", status, http.StatusNotFound)
+	}
+	var list struct {
+		Jobs []struct{ ID, Thumbnail string }
+	}
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/jobs?status=done", nil)
+	req.Header = accept
+	do(t, http.DefaultClient, req, &list)
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != job.ID {
+		t.Fatalf("history = %+v, want job %s", list.Jobs, job.ID)
+	}
+	if !strings.HasPrefix(list.Jobs[0].Thumbnail, "/thumbs/") {
+		t.Errorf("thumbnail = %q, want a /thumbs/ URL", list.Jobs[0].Thumbnail)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+)
+
+// currentLimits returns the parameter limits in effect, as reported by the
+// backends or the static configuration.
+func (s *Server) currentLimits() params.Limits {
+	if l := s.limits.Load(); l != nil {
+		return *l
+	}
+	return s.Limits
+}
+
+// modelLimits returns the parameter limits in effect for model, narrowed by
+// its ModelDefaults.
+func (s *Server) modelLimits(model string) params.Limits {
+	limits := s.currentLimits()
+	if m, ok := s.ModelDefaults[model]; ok {
+		limits = m.Limits.Apply(limits)
+	}
+	return limits
+}
+
+// modelSettings are the defaults and limits of a model as read by the index
+// page when the user switches models.
+type modelSettings struct {
+	Steps    int           `json:"steps,omitempty"`
+	Guidance *float64      `json:"guidance,omitempty"`
+	Limits   params.Limits `json:"limits"`
+}
+
+// modelSettings returns the settings of every model with ModelDefaults.
+func (s *Server) modelSettings() map[string]modelSettings {
+	settings := make(map[string]modelSettings, len(s.ModelDefaults))
+	for name, m := range s.ModelDefaults {
+		settings[name] = modelSettings{Steps: m.Steps, Guidance: m.Guidance, Limits: s.modelLimits(name)}
+	}
+	return settings
+}
+
+// refreshCapabilities queries the backends for their parameter ranges now
+// and then every CapabilitiesRefresh until ctx is done.
+func (s *Server) refreshCapabilities(ctx context.Context) {
+	s.updateCapabilities(ctx)
+	if s.CapabilitiesRefresh <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.CapabilitiesRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.updateCapabilities(ctx)
+		}
+	}
+}
+
+func (s *Server) updateCapabilities(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	limits, err := s.client.Capabilities(ctx, s.Limits)
+	if errors.Is(err, backend.ErrCapabilitiesUnavailable) && s.limits.Load() != nil {
+		// Keep the last known limits until a backend answers again.
+		log.Warn("Backend capabilities unavailable, keeping current limits")
+		return
+	}
+	if errors.Is(err, backend.ErrNoCapabilities) {
+		log.Debug("Backends do not report capabilities, using static limits")
+	}
+	if prev := s.limits.Swap(&limits); prev == nil || *prev != limits {
+		log.Info("Parameter limits updated", "width", limits.Width, "height", limits.Height, "steps", limits.Steps, "guidance", limits.Guidance)
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/render"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// linksKey is the key under which public links are persisted.
+const linksKey = "public_links"
+
+// publicLink makes one archived image viewable by anyone holding its token.
+type publicLink struct {
+	Token     string     `json:"token"`
+	ImageID   string     `json:"image_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (l publicLink) expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// publicLinks holds the public links by token. OnChange, if set, is called
+// with a copy of the links after every change, for persisting them.
+type publicLinks struct {
+	mu      sync.Mutex
+	byToken map[string]publicLink
+
+	OnChange func(map[string]publicLink)
+}
+
+func newPublicLinks() *publicLinks {
+	return &publicLinks{byToken: make(map[string]publicLink)}
+}
+
+// add mints a link to an image, expiring after ttl if it is positive.
+func (p *publicLinks) add(imageID string, ttl time.Duration) publicLink {
+	now := time.Now()
+	l := publicLink{Token: newToken(), ImageID: imageID, CreatedAt: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		l.ExpiresAt = &expires
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for token, other := range p.byToken {
+		if other.expired(now) {
+			delete(p.byToken, token)
+		}
+	}
+	p.byToken[l.Token] = l
+	p.changed()
+	return l
+}
+
+// get returns the link with the given token unless it expired.
+func (p *publicLinks) get(token string) (publicLink, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.byToken[token]
+	if !ok || l.expired(time.Now()) {
+		return publicLink{}, false
+	}
+	return l, true
+}
+
+// list returns the links that have not expired.
+func (p *publicLinks) list() []publicLink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	links := make([]publicLink, 0, len(p.byToken))
+	for _, l := range p.byToken {
+		if !l.expired(now) {
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+// revoke removes the links to an image, returning how many there were.
+func (p *publicLinks) revoke(imageID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for token, l := range p.byToken {
+		if l.ImageID == imageID {
+			delete(p.byToken, token)
+			n++
+		}
+	}
+	if n > 0 {
+		p.changed()
+	}
+	return n
+}
+
+// changed passes the links to OnChange. The caller must hold p.mu.
+func (p *publicLinks) changed() {
+	if p.OnChange == nil {
+		return
+	}
+	links := make(map[string]publicLink, len(p.byToken))
+	for token, l := range p.byToken {
+		links[token] = l
+	}
+	p.OnChange(links)
+}
+
+// loadLinks restores the public links from the store, if it can keep them,
+// and saves them there after every change.
+func (s *Server) loadLinks(store jobs.Store) {
+	s.links = newPublicLinks()
+	meta, ok := store.(jobs.MetaStore)
+	if !ok {
+		return
+	}
+	data, err := meta.LoadMeta(linksKey)
+	if err != nil {
+		log.Warn("Failed to load public links", "error", err)
+	} else if data != nil {
+		if err := json.Unmarshal(data, &s.links.byToken); err != nil {
+			log.Warn("Failed to decode public links", "error", err)
+		}
+	}
+	s.links.OnChange = func(links map[string]publicLink) {
+		data, err := json.Marshal(links)
+		if err == nil {
+			err = meta.SaveMeta(linksKey, data)
+		}
+		if err != nil {
+			log.Warn("Failed to save public links", "error", err)
+		}
+	}
+}
+
+// baseURL returns the external URL of the server, BaseURL if it is set or
+// else the one the request was made to.
+func (s *Server) baseURL(c echo.Context) string {
+	if s.BaseURL != "" {
+		return s.BaseURL
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// linkURL returns the absolute URL of the public page of a link.
+func (s *Server) linkURL(c echo.Context, token string) string {
+	return s.baseURL(c) + "/s/" + token
+}
+
+// sharePublicLink mints a public link to an archived image, valid for
+// ShareExpiry if it is positive. Only its submitter, or with
+// PerUserGalleries its session, or an administrator may share it. HTMX
+// requests get a fragment showing the link.
+func (s *Server) sharePublicLink(c echo.Context) error {
+	if s.archive == nil {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	meta, err := s.archivedMetadata(c, c.Param("id"))
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	if _, ok := s.optionalAdmin(c); !ok && !s.submitted(c, meta.Client, meta.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its submitter or an administrator may share this image"))
+	}
+	l := s.links.add(meta.ID, s.ShareExpiry)
+	log.Info("Public link created", "id", meta.ID, "expires_at", l.ExpiresAt)
+
+	data := map[string]any{"id": meta.ID, "token": l.Token, "url": s.linkURL(c, l.Token), "expires_at": l.ExpiresAt}
+	if s.isHTMX(c) {
+		return c.Render(http.StatusOK, "public_link.html", data)
+	}
+	return c.JSON(http.StatusCreated, data)
+}
+
+// revokePublicLinks removes every public link to an archived image, which
+// only those who may share it may do.
+func (s *Server) revokePublicLinks(c echo.Context) error {
+	if s.archive == nil {
+		return s.jobError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	meta, err := s.archivedMetadata(c, c.Param("id"))
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	if _, ok := s.optionalAdmin(c); !ok && !s.submitted(c, meta.Client, meta.Owner) {
+		return s.jobError(c, errorf(http.StatusForbidden, "Only its submitter or an administrator may share this image"))
+	}
+	n := s.links.revoke(meta.ID)
+	log.Info("Public links revoked", "id", meta.ID, "count", n)
+	if s.isHTMX(c) {
+		return c.NoContent(http.StatusOK)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// publicImage shows the image of a public link with its recipe, on a page
+// linking nowhere else, with Open Graph tags for link previews.
+func (s *Server) publicImage(c echo.Context) error {
+	l, ok := s.links.get(c.Param("token"))
+	if !ok {
+		return s.pageError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	meta, err := s.archive.Metadata(c.Request().Context(), l.ImageID)
+	if errors.Is(err, archive.ErrNotFound) {
+		s.links.revoke(l.ImageID)
+		return s.pageError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	if err != nil {
+		log.Error("Failed to read archived image metadata", "id", l.ImageID, "error", err)
+		return s.pageError(c, errorf(http.StatusInternalServerError, "Failed to read image"))
+	}
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	return c.Render(http.StatusOK, "public_image.html", map[string]any{
+		"image":     meta,
+		"title":     render.Truncate(meta.Prompt, gallerySnippetLength),
+		"url":       s.linkURL(c, l.Token),
+		"image_url": s.baseURL(c) + "/generated/" + meta.ID,
+		"lang":      locale(c),
+	})
+}
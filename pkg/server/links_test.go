@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestOnlySubmitterOrAdminShares(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, func(s *Server) {
+		withAdmin(s)
+		// Tell clients apart by the address a trusted proxy forwards.
+		s.TrustedProxies = []string{"127.0.0.1"}
+	})
+	from := func(ip string) http.Header {
+		return http.Header{"Accept": {"application/json"}, "X-Forwarded-For": {ip}}
+	}
+
+	resp := ts.post(t, "/", generationForm("a lighthouse"), from("192.0.2.1"))
+	var result struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := func(method string, header http.Header) int {
+		req, _ := http.NewRequest(method, ts.URL+"/generated/"+result.ID+"/share", nil)
+		req.Header = header
+		return do(t, http.DefaultClient, req, nil)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		if status := links(method, from("192.0.2.2")); status != http.StatusForbidden {
+			t.Errorf("%s by another client: status %d, want %d", method, status, http.StatusForbidden)
+		}
+	}
+	if status := links(http.MethodPost, from("192.0.2.1")); status != http.StatusCreated {
+		t.Errorf("POST by the submitter: status %d, want %d", status, http.StatusCreated)
+	}
+	admin := adminRequest(t, http.MethodDelete, ts.URL+"/generated/"+result.ID+"/share", nil)
+	admin.Header.Set("X-Forwarded-For", "192.0.2.2")
+	if status := do(t, http.DefaultClient, admin, nil); status != http.StatusNoContent {
+		t.Errorf("DELETE by an administrator: status %d, want %d", status, http.StatusNoContent)
+	}
+}
+
+func TestDeleteImageByAlias(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, withAdmin)
+	resp := ts.post(t, "/", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}})
+	var result struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Do not follow redirects so the deletion has to be served directly.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req := adminRequest(t, http.MethodDelete, ts.URL+"/images/"+result.ID, nil)
+		req.Header.Set("Accept", "application/json")
+		if status := do(t, client, req, nil); status != want {
+			t.Errorf("DELETE /images/%s: status %d, want %d", result.ID, status, want)
+		}
+	}
+}
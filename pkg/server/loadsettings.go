@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxSettingsImageBytes is the largest image read for its settings.
+const maxSettingsImageBytes = 32 << 20
+
+// loadedSettings are the form values read from an uploaded image, along
+// with notes on the ones that were changed or ignored.
+type loadedSettings struct {
+	Settings map[string]string `json:"settings"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// settingsFromImage reads the generation settings embedded in an uploaded
+// PNG image, as embedded by embedParameters or the A1111 web UI, to prefill
+// the form with. Values outside the limits of the model are clamped and
+// others that are unusable dropped, with a warning for each. HTMX requests
+// get a fragment that applies the settings to the form. The image must be
+// posted in the image field of a multipart/form-data body.
+func (s *Server) settingsFromImage(c echo.Context) error {
+	upload, err := c.FormFile("image")
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No image was uploaded"))
+	}
+	if upload.Size > maxSettingsImageBytes {
+		return s.jobError(c, errorf(http.StatusRequestEntityTooLarge, "The image is too large"))
+	}
+	f, err := upload.Open()
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No image was uploaded"))
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSettingsImageBytes))
+	if err != nil {
+		return s.jobError(c, errorf(http.StatusBadRequest, "No image was uploaded"))
+	}
+
+	var form map[string]string
+	var ignored []string
+	if chunks, err := imaging.PNGText(data); err == nil {
+		form, ignored = settingsFromPNGText(chunks)
+	}
+	if len(form) == 0 {
+		if s.isHTMX(c) {
+			return c.Render(http.StatusOK, "loaded_settings.html", map[string]any{})
+		}
+		return s.jobError(c, errorf(http.StatusUnprocessableEntity, "No settings found in this image"))
+	}
+
+	loaded := loadedSettings{Settings: form, Warnings: s.clampSettings(c, form)}
+	if len(ignored) > 0 {
+		loaded.Warnings = append(loaded.Warnings, s.t(c, "Settings not supported here were ignored: %s", strings.Join(ignored, ", ")))
+	}
+	if _, ok := form["prompt"]; ok {
+		// Run the settings past the same checks as a generation, filling
+		// in those the image lacks from the form or its defaults.
+		defaults := s.formDefaults(c)
+		values := func(name string) string {
+			if v, ok := form[name]; ok {
+				return v
+			}
+			if v := c.FormValue(name); v != "" {
+				return v
+			}
+			return defaults[name]
+		}
+		if _, _, err := s.validateParams(c, values); err != nil {
+			return s.jobError(c, err)
+		}
+	}
+
+	if s.isHTMX(c) {
+		return c.Render(http.StatusOK, "loaded_settings.html", map[string]any{
+			"settings": loaded.Settings,
+			"warnings": loaded.Warnings,
+		})
+	}
+	return c.JSON(http.StatusOK, loaded)
+}
+
+// clampSettings brings the numeric values of form within the limits of its
+// model, or the default model, dropping an unavailable model and values that
+// are not numbers. It returns a warning for each change.
+func (s *Server) clampSettings(c echo.Context, form map[string]string) []string {
+	var warnings []string
+	if model, ok := form["model"]; ok {
+		if _, err := s.resolveModel(model); err != nil {
+			warnings = append(warnings, s.t(c, "Model %s is not available, so it was not applied", model))
+			delete(form, "model")
+		}
+	}
+	model, _ := s.resolveModel(form["model"])
+	limits := s.modelLimits(model)
+
+	clampInt := func(name, label string, r params.Range[int]) {
+		v, ok := form[name]
+		if !ok {
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			warnings = append(warnings, s.t(c, "%s %q is invalid, so it was not applied", s.t(c, label), v))
+			delete(form, name)
+			return
+		}
+		if clamped := r.Clamp(n); clamped != n {
+			warnings = append(warnings, s.t(c, "%s %v is outside the allowed range and was changed to %v", s.t(c, label), n, clamped))
+			form[name] = strconv.Itoa(clamped)
+		}
+	}
+	clampInt("width", "Width", limits.Width)
+	clampInt("height", "Height", limits.Height)
+	clampInt("num_steps", "Number of Steps", limits.Steps)
+
+	if v, ok := form["guidance_scale"]; ok {
+		g, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			warnings = append(warnings, s.t(c, "%s %q is invalid, so it was not applied", s.t(c, "Guidance Scale"), v))
+			delete(form, "guidance_scale")
+		} else if clamped := limits.Guidance.Clamp(g); clamped != g {
+			warnings = append(warnings, s.t(c, "%s %v is outside the allowed range and was changed to %v", s.t(c, "Guidance Scale"), g, clamped))
+			form["guidance_scale"] = strconv.FormatFloat(clamped, 'f', -1, 64)
+		}
+	}
+	if v, ok := form["seed"]; ok {
+		if _, err := strconv.Atoi(v); err != nil {
+			warnings = append(warnings, s.t(c, "%s %q is invalid, so it was not applied", s.t(c, "Seed"), v))
+			delete(form, "seed")
+		}
+	}
+	return warnings
+}
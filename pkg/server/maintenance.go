@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// refuseInMaintenance is middleware rejecting new generations with 503 while
+// maintenance mode is on. The rest of the site stays up.
+func (s *Server) refuseInMaintenance(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !s.maintenance.Load() {
+			return next(c)
+		}
+		return s.jobError(c, errorf(http.StatusServiceUnavailable, "Generation is paused for maintenance, please try again later"))
+	}
+}
+
+// adminMaintenance turns maintenance mode on or off, as given by the enabled
+// value, defaulting to on.
+func (s *Server) adminMaintenance(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	enabled := true
+	if v := values("enabled"); v != "" {
+		enabled, err = strconv.ParseBool(v)
+		if err != nil {
+			return s.jobError(c, errorf(http.StatusBadRequest, "Invalid value for enabled: %q", v))
+		}
+	}
+	s.maintenance.Store(enabled)
+	log.Info("Admin set maintenance mode", "admin", adminIdentity(c), "enabled", enabled)
+	return s.adminDone(c, map[string]bool{"maintenance": enabled})
+}
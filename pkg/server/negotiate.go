@@ -0,0 +1,54 @@
+package server
+
+import "github.com/labstack/echo/v4"
+
+// representation is the form a response takes for its client.
+type representation int
+
+const (
+	// asPage is a full HTML page, for browsers.
+	asPage representation = iota
+	// asFragment is the part of a page HTMX swaps in.
+	asFragment
+	// asJSON is the data itself, for scripts.
+	asJSON
+)
+
+// pageTarget is the ID of the body of every page, which HTMX requests
+// target to replace the whole page.
+const pageTarget = "page"
+
+// negotiate picks the representation a request asks for. HTMX requests get
+// a fragment, except those replacing the whole page, which get the page:
+// boosted navigation, history restoration and requests targeting the page
+// body. Other clients accepting HTML get the page, and everyone else JSON.
+func (s *Server) negotiate(c echo.Context) representation {
+	h := c.Request().Header
+	wholePage := h.Get("HX-Boosted") == "true" || h.Get("HX-History-Restore-Request") == "true" || h.Get("HX-Target") == pageTarget
+	switch {
+	case s.isHTMX(c) && wholePage:
+		return asPage
+	case s.isHTMX(c):
+		return asFragment
+	case s.acceptsHTML(c):
+		return asPage
+	}
+	return asJSON
+}
+
+// respond writes data in the representation negotiate picks: rendered with
+// the page template, rendered with the fragment template, such as a partial
+// or a page#block, or encoded as JSON. Handlers without a page of their own
+// pass an empty page, so browsers get the fragment too.
+func (s *Server) respond(c echo.Context, status int, page, fragment string, data any) error {
+	switch s.negotiate(c) {
+	case asPage:
+		if page != "" {
+			return c.Render(status, page, data)
+		}
+		return c.Render(status, fragment, data)
+	case asFragment:
+		return c.Render(status, fragment, data)
+	}
+	return c.JSON(status, data)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// waitForJob polls a job until it finishes, failing after a few seconds.
+func waitForJob(t *testing.T, ts *testServer, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var job struct{ Status string }
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+id, nil)
+		req.Header.Set("Accept", "application/json")
+		do(t, http.DefaultClient, req, &job)
+		if job.Status == "done" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+}
+
+func TestNegotiation(t *testing.T) {
+	flue := newFakeBackend(t, 0)
+	ts := startServer(t, flue.URL, withAdmin)
+
+	resp := ts.post(t, "/jobs", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}})
+	var job struct{ ID string }
+	err := json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, ts, job.ID)
+
+	clients := map[string]http.Header{
+		"page": {"Accept": {"text/html,application/xhtml+xml"}},
+		"htmx": {"Accept": {"*/*"}, "HX-Request": {"true"}},
+		// Boosted links replace the whole page.
+		"boosted":   {"Accept": {"*/*"}, "HX-Request": {"true"}, "HX-Boosted": {"true"}, "HX-Target": {pageTarget}},
+		"htmx page": {"Accept": {"*/*"}, "HX-Request": {"true"}, "HX-Target": {pageTarget}},
+		"json":      {"Accept": {"application/json"}},
+	}
+	// want is the status and content type of the response to a client,
+	// whether it is a whole page rather than a fragment, and text it
+	// contains.
+	type want struct {
+		status      int
+		contentType string
+		page        bool
+		contains    string
+	}
+	tests := []struct {
+		name, method, path string
+		want               map[string]want
+	}{
+		{"gallery", http.MethodGet, "/gallery", map[string]want{
+			"page":      {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"htmx":      {http.StatusOK, echo.MIMETextHTML, false, "a lighthouse"},
+			"boosted":   {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"htmx page": {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"json":      {http.StatusOK, echo.MIMEApplicationJSON, false, "a lighthouse"},
+		}},
+		// HTMX queues a job and gets its fragment, while browsers without
+		// HTMX wait for the result fragment, as generate has no page.
+		{"generate", http.MethodPost, "/", map[string]want{
+			"page":      {http.StatusOK, echo.MIMETextHTML, false, "a harbor"},
+			"htmx":      {http.StatusAccepted, echo.MIMETextHTML, false, `id="job-`},
+			"boosted":   {http.StatusAccepted, echo.MIMETextHTML, false, `id="job-`},
+			"htmx page": {http.StatusAccepted, echo.MIMETextHTML, false, `id="job-`},
+			"json":      {http.StatusOK, echo.MIMEApplicationJSON, false, "a harbor"},
+		}},
+		{"job status", http.MethodGet, "/jobs/" + job.ID, map[string]want{
+			"page":      {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"htmx":      {http.StatusOK, echo.MIMETextHTML, false, "a lighthouse"},
+			"boosted":   {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"htmx page": {http.StatusOK, echo.MIMETextHTML, true, "a lighthouse"},
+			"json":      {http.StatusOK, echo.MIMEApplicationJSON, false, "a lighthouse"},
+		}},
+	}
+	for _, tt := range tests {
+		for client, header := range clients {
+			t.Run(tt.name+"/"+client, func(t *testing.T) {
+				var resp *http.Response
+				if tt.method == http.MethodPost {
+					resp = ts.post(t, tt.path, generationForm("a harbor"), header)
+				} else {
+					req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					req.Header = header.Clone()
+					if resp, err = http.DefaultClient.Do(req); err != nil {
+						t.Fatal(err)
+					}
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := tt.want[client]
+				if resp.StatusCode != w.status {
+					t.Fatalf("status %d, want %d: %s", resp.StatusCode, w.status, body)
+				}
+				if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, w.contentType) {
+					t.Errorf("Content-Type = %q, want %s", ct, w.contentType)
+				}
+				if page := strings.Contains(string(body), "<!DOCTYPE html>"); page != w.page {
+					t.Errorf("whole page = %v, want %v", page, w.page)
+				}
+				if w.contentType == echo.MIMEApplicationJSON && !json.Valid(body) {
+					t.Errorf("invalid JSON: %s", body)
+				}
+				if !strings.Contains(string(body), w.contains) {
+					t.Errorf("body does not contain %q: %s", w.contains, body)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"flue-frontend/pkg/ids"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+)
+
+// output is a generated image encoded for delivery to the client.
+type output struct {
+	Bytes   []byte // encoded image bytes, nil if the backend image was invalid
+	Data    string // base64-encoded image bytes
+	Format  imaging.Format
+	Size    int // encoded size in bytes
+	Quality int // encoder quality, zero for lossless formats
+}
+
+// encodeOutput converts the base64 PNG returned by the backend to format at
+// the given quality. Transcoding failures are logged and fall back to the
+// original PNG.
+func encodeOutput(b64 string, format imaging.Format, quality int) output {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		log.Warn("Failed to decode backend image", "error", err)
+		return output{Data: b64, Format: imaging.PNG, Size: base64.StdEncoding.DecodedLen(len(b64))}
+	}
+
+	encoded, err := imaging.Transcode(raw, format, quality)
+	if err != nil {
+		log.Warn("Failed to transcode image, falling back to PNG", "format", format, "error", err)
+		return output{Bytes: raw, Data: b64, Format: imaging.PNG, Size: len(raw)}
+	}
+	if format == imaging.PNG {
+		return output{Bytes: raw, Data: b64, Format: imaging.PNG, Size: len(raw)}
+	}
+	return newOutput(encoded, format, quality)
+}
+
+// newOutput wraps already-encoded image bytes.
+func newOutput(data []byte, format imaging.Format, quality int) output {
+	if !format.Lossy() {
+		quality = 0
+	}
+	return output{
+		Bytes:   data,
+		Data:    base64.StdEncoding.EncodeToString(data),
+		Format:  format,
+		Size:    len(data),
+		Quality: quality,
+	}
+}
+
+// blurOutput returns a blurred preview of out encoded in the same format.
+func blurOutput(out output) (output, error) {
+	img, err := imaging.Decode(out.Bytes)
+	if err != nil {
+		return output{}, err
+	}
+	b := img.Bounds()
+	sigma := float64(max(b.Dx(), b.Dy())) / 40
+	blurred, err := imaging.Encode(imaging.Blur(img, sigma), out.Format, out.Quality)
+	if err != nil {
+		return output{}, err
+	}
+	return newOutput(blurred, out.Format, out.Quality), nil
+}
+
+// downscaleOutput returns a copy of out scaled down to fit within maxDim,
+// encoded in the same format. It returns false if out already fits.
+func downscaleOutput(out output, maxDim int) (output, bool, error) {
+	img, err := imaging.Decode(out.Bytes)
+	if err != nil {
+		return output{}, false, err
+	}
+	scaled, ok := imaging.Fit(img, maxDim)
+	if !ok {
+		return out, false, nil
+	}
+	encoded, err := imaging.Encode(scaled, out.Format, out.Quality)
+	if err != nil {
+		return output{}, false, err
+	}
+	return newOutput(encoded, out.Format, out.Quality), true, nil
+}
+
+// archiveTimeout bounds storing an image, so an unreachable image store
+// delays a generation only so long.
+const archiveTimeout = 30 * time.Second
+
+// archiveImage stores out with its metadata under a new ID and returns the
+// ID. Failures are logged rather than failing the generation, returning an
+// empty ID. The image is stored even if the client has gone away.
+func (s *Server) archiveImage(ctx context.Context, out output, meta store.Metadata) string {
+	id := ids.New()
+	meta.Format = string(out.Format)
+	meta.Quality = out.Quality
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), archiveTimeout)
+	defer cancel()
+	if err := s.archive.Put(ctx, id, out.Bytes, meta); err != nil {
+		log.Error("Failed to archive image", "id", id, "error", err)
+		return ""
+	}
+	return id
+}
+
+// resultSeed returns the seed the backend reports having used for the i-th
+// image of its response, or for the first image the requested one if it
+// does not. The seeds of further images are only known from a seeds array.
+func resultSeed(result map[string]any, p params.Params, i int) *int {
+	if seeds, ok := result["seeds"].([]any); ok && i < len(seeds) {
+		if seed, ok := seeds[i].(float64); ok {
+			n := int(seed)
+			return &n
+		}
+	}
+	if i > 0 {
+		return nil
+	}
+	if seed, ok := result["seed"].(float64); ok {
+		n := int(seed)
+		return &n
+	}
+	return p.Seed
+}
+
+// resultNSFW reports whether the backend flagged the i-th image of its
+// response, from either one flag for all images or an array of flags.
+func resultNSFW(result map[string]any, i int) bool {
+	switch v := result["nsfw"].(type) {
+	case bool:
+		return v
+	case []any:
+		if i < len(v) {
+			nsfw, _ := v[i].(bool)
+			return nsfw
+		}
+	}
+	return false
+}
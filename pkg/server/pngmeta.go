@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+
+	"github.com/charmbracelet/log"
+)
+
+// Conventions for embedding the generation parameters in PNG images.
+const (
+	// PNGMetadataParameters writes a single "parameters" text chunk in the
+	// format of the AUTOMATIC1111 web UI, which most image tools read.
+	PNGMetadataParameters = "parameters"
+	// PNGMetadataFields writes a text chunk per parameter, keyed by the
+	// parameter name.
+	PNGMetadataFields = "fields"
+	// PNGMetadataNone embeds nothing.
+	PNGMetadataNone = "none"
+)
+
+// parsePNGMetadata validates a PNG metadata convention name.
+func parsePNGMetadata(mode string) (string, error) {
+	switch mode {
+	case "", PNGMetadataNone:
+		return PNGMetadataNone, nil
+	case PNGMetadataParameters, PNGMetadataFields:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown PNG metadata convention: %s", mode)
+}
+
+// embedParameters returns out with the parameters p and seed it was
+// generated with spliced into its text chunks, if it is a PNG image and
+// PNGMetadata asks for it. The image data is not re-encoded. Failures are
+// logged and leave out as it is.
+func (s *Server) embedParameters(out output, p params.Params, seed *int) output {
+	if out.Format != imaging.PNG || out.Bytes == nil || s.PNGMetadata == PNGMetadataNone {
+		return out
+	}
+	data, err := imaging.AddPNGText(out.Bytes, s.pngText(p, seed))
+	if err != nil {
+		log.Warn("Failed to embed parameters in image", "error", err)
+		return out
+	}
+	return newOutput(data, out.Format, out.Quality)
+}
+
+// pngText returns the text chunks describing a generation in the
+// configured convention.
+func (s *Server) pngText(p params.Params, seed *int) []imaging.TextChunk {
+	software := "Flue Frontend"
+	if s.Version != "" {
+		software += " " + s.Version
+	}
+	fields := []imaging.TextChunk{
+		{Key: "Steps", Text: strconv.Itoa(p.Steps)},
+		{Key: "CFG scale", Text: strconv.FormatFloat(p.Guidance, 'g', -1, 64)},
+	}
+	if seed != nil {
+		fields = append(fields, imaging.TextChunk{Key: "Seed", Text: strconv.Itoa(*seed)})
+	}
+	fields = append(fields, imaging.TextChunk{Key: "Size", Text: fmt.Sprintf("%dx%d", p.Width, p.Height)})
+	if p.Model != "" {
+		fields = append(fields, imaging.TextChunk{Key: "Model", Text: p.Model})
+	}
+	if p.Tiling {
+		fields = append(fields, imaging.TextChunk{Key: "Tiling", Text: "True"})
+	}
+	fields = append(fields, imaging.TextChunk{Key: "Version", Text: software})
+
+	if s.PNGMetadata == PNGMetadataFields {
+		chunks := []imaging.TextChunk{{Key: "prompt", Text: p.Prompt}}
+		for _, f := range fields {
+			key := strings.ToLower(strings.ReplaceAll(f.Key, " ", "_"))
+			chunks = append(chunks, imaging.TextChunk{Key: key, Text: f.Text})
+		}
+		return append(chunks, imaging.TextChunk{Key: "Software", Text: software})
+	}
+
+	// The prompt on the first line, then the settings as "Key: value"
+	// pairs on the last.
+	settings := make([]string, len(fields))
+	for i, f := range fields {
+		settings[i] = f.Key + ": " + f.Text
+	}
+	return []imaging.TextChunk{
+		{Key: "parameters", Text: p.Prompt + "\n" + strings.Join(settings, ", ")},
+		{Key: "Software", Text: software},
+	}
+}
+
+// a1111Setting matches a "Key: value" pair of the settings line of an A1111
+// parameters chunk. Values containing commas are quoted.
+var a1111Setting = regexp.MustCompile(`\s*(\w[\w \-/]*):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+// pngSettingFields are the form fields of the settings embedded in PNG
+// images, by their key in PNGMetadataFields form. Size is split into width
+// and height.
+var pngSettingFields = map[string]string{
+	"prompt":    "prompt",
+	"steps":     "num_steps",
+	"cfg_scale": "guidance_scale",
+	"seed":      "seed",
+	"model":     "model",
+	"tiling":    "tiling",
+}
+
+// settingsFromPNGText returns the form values described by the text chunks
+// of a PNG image, embedded in either convention or by the A1111 web UI,
+// along with the names of the settings found but not supported here.
+func settingsFromPNGText(chunks []imaging.TextChunk) (map[string]string, []string) {
+	var pairs []imaging.TextChunk
+	for _, c := range chunks {
+		if c.Key == "parameters" {
+			pairs = parseA1111Parameters(c.Text)
+			break
+		}
+		pairs = append(pairs, c)
+	}
+
+	form := make(map[string]string)
+	var ignored []string
+	for _, pair := range pairs {
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pair.Key), " ", "_"))
+		value := strings.TrimSpace(pair.Text)
+		switch field, ok := pngSettingFields[key]; {
+		case key == "size":
+			w, h, ok := strings.Cut(value, "x")
+			if !ok {
+				ignored = append(ignored, pair.Key)
+				continue
+			}
+			form["width"], form["height"] = strings.TrimSpace(w), strings.TrimSpace(h)
+		case key == "tiling":
+			if b, _ := strconv.ParseBool(value); b {
+				form[field] = "1"
+			} else {
+				form[field] = ""
+			}
+		case ok:
+			form[field] = value
+		case key == "version" || key == "software":
+			// Provenance only.
+		default:
+			ignored = append(ignored, pair.Key)
+		}
+	}
+	if form["prompt"] == "" {
+		delete(form, "prompt")
+	}
+	return form, ignored
+}
+
+// parseA1111Parameters splits the parameters text written by the A1111 web
+// UI, or in PNGMetadataParameters form, into key and value pairs. The prompt
+// is on the lines before the negative prompt, if any, and the other
+// settings on the last line.
+func parseA1111Parameters(text string) []imaging.TextChunk {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	var settings []imaging.TextChunk
+	if last := lines[len(lines)-1]; len(a1111Setting.FindAllString(last, -1)) >= 3 {
+		for _, m := range a1111Setting.FindAllStringSubmatch(last, -1) {
+			value := m[2]
+			if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+				value = unquoted
+			}
+			settings = append(settings, imaging.TextChunk{Key: m[1], Text: value})
+		}
+		lines = lines[:len(lines)-1]
+	}
+
+	var prompt, negative []string
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "Negative prompt:"); ok || negative != nil {
+			if !ok {
+				rest = line
+			}
+			negative = append(negative, rest)
+			continue
+		}
+		prompt = append(prompt, line)
+	}
+	pairs := []imaging.TextChunk{{Key: "prompt", Text: strings.Join(prompt, "\n")}}
+	if strings.TrimSpace(strings.Join(negative, "")) != "" {
+		pairs = append(pairs, imaging.TextChunk{Key: "Negative prompt", Text: strings.Join(negative, "\n")})
+	}
+	return append(pairs, settings...)
+}
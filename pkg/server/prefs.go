@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// prefsCookie holds the preferences of a browser.
+const prefsCookie = "prefs"
+
+// prefsMaxAge is how long preferences are kept without being changed.
+const prefsMaxAge = 400 * 24 * time.Hour
+
+// maxPrefsCookie is the size in bytes above which a preferences cookie is
+// ignored.
+const maxPrefsCookie = 512
+
+// maxGalleryPageSize is the most images per gallery page a browser may
+// prefer.
+const maxGalleryPageSize = 100
+
+// defaultTheme is the color theme of browsers that have not chosen one.
+const defaultTheme = "dark"
+
+// themes are the color themes of the HTML UI.
+var themes = map[string]bool{"light": true, "dark": true}
+
+// Prefs are the preferences of a browser, kept in a signed cookie so pages
+// are rendered with them from the first byte. Zero fields keep the server's
+// defaults.
+type Prefs struct {
+	Theme string `json:"theme,omitempty"`
+	// Width and Height are the image size the index form starts with.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// PerPage is the number of images per gallery page.
+	PerPage int `json:"per_page,omitempty"`
+}
+
+// prefs returns the preferences of a request. A missing, oversized,
+// tampered or otherwise invalid cookie yields the defaults.
+func (s *Server) prefs(c echo.Context) Prefs {
+	cookie, err := c.Cookie(prefsCookie)
+	if err != nil || len(cookie.Value) > maxPrefsCookie {
+		return Prefs{}
+	}
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.signPrefs(payload))) {
+		return Prefs{}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Prefs{}
+	}
+	var p Prefs
+	if err := json.Unmarshal(data, &p); err != nil || s.checkPrefs(p) != nil {
+		return Prefs{}
+	}
+	return p
+}
+
+// checkPrefs validates preferences against the server's limits.
+func (s *Server) checkPrefs(p Prefs) error {
+	limits := s.currentLimits()
+	if p.Theme != "" && !themes[p.Theme] {
+		return withField(errorf(http.StatusBadRequest, "Theme is invalid: %s", p.Theme), "theme")
+	}
+	if p.Width != 0 && (p.Width < limits.Width.Min || p.Width > limits.Width.Max) {
+		return withField(errorf(http.StatusBadRequest, "Width is invalid: %v", p.Width), "width")
+	}
+	if p.Height != 0 && (p.Height < limits.Height.Min || p.Height > limits.Height.Max) {
+		return withField(errorf(http.StatusBadRequest, "Height is invalid: %v", p.Height), "height")
+	}
+	if p.PerPage < 0 || p.PerPage > maxGalleryPageSize {
+		return withField(errorf(http.StatusBadRequest, "Results per page is invalid: %v", p.PerPage), "per_page")
+	}
+	return nil
+}
+
+// signPrefs returns the signature of an encoded preferences cookie.
+func (s *Server) signPrefs(payload string) string {
+	mac := hmac.New(sha256.New, s.prefsKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setPrefs stores p in the preferences cookie of the response.
+func (s *Server) setPrefs(c echo.Context, p Prefs) {
+	data, _ := json.Marshal(p)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	c.SetCookie(&http.Cookie{
+		Name:     prefsCookie,
+		Value:    payload + "." + s.signPrefs(payload),
+		Path:     "/",
+		MaxAge:   int(prefsMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// updatePrefs changes the preferences given as the theme, width, height and
+// per_page form fields, keeping the others. Browsers are sent back to the
+// page they came from, which is then rendered with the new preferences;
+// other clients get the preferences as JSON.
+func (s *Server) updatePrefs(c echo.Context) error {
+	values, err := requestValues(c)
+	if err != nil {
+		return s.jobError(c, err)
+	}
+	p := s.prefs(c)
+	if v := values("theme"); v != "" {
+		p.Theme = v
+	}
+	for name, field := range map[string]*int{"width": &p.Width, "height": &p.Height, "per_page": &p.PerPage} {
+		v := values(name)
+		if v == "" {
+			continue
+		}
+		n, err := parseFormInt(v, 0, math.MaxInt32)
+		if err != nil {
+			return s.jobError(c, withField(numberError(err, "Preferences must be whole numbers", "Preferences must be between %v and %v"), name))
+		}
+		*field = n
+	}
+	if err := s.checkPrefs(p); err != nil {
+		return s.jobError(c, err)
+	}
+	s.setPrefs(c, p)
+
+	if s.acceptsHTML(c) && !s.isHTMX(c) {
+		return c.Redirect(http.StatusSeeOther, s.referringPage(c))
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// referringPage returns the path of the page of this site a request came
+// from, or the index page.
+func (s *Server) referringPage(c echo.Context) string {
+	u, err := url.Parse(c.Request().Referer())
+	if err != nil || u.Host != c.Request().Host || !strings.HasPrefix(u.Path, "/") {
+		return "/"
+	}
+	return u.RequestURI()
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"flue-frontend/pkg/events"
+
+	"github.com/labstack/echo/v4"
+)
+
+// progressIDPattern restricts client-chosen progress IDs.
+var progressIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// progressEvents streams queue position and progress updates for a
+// generation as server-sent events. The client picks the ID and submits it
+// with the generation request as progress_id.
+func (s *Server) progressEvents(c echo.Context) error {
+	id := c.Param("id")
+	if !progressIDPattern.MatchString(id) {
+		return s.jobError(c, errorf(http.StatusBadRequest, "Invalid progress ID"))
+	}
+
+	ch, unsubscribe := s.progress.Subscribe(id)
+	defer unsubscribe()
+	return s.streamEvents(c, ch)
+}
+
+// heartbeatInterval is how often idle event streams send a comment to keep
+// proxies from timing out the connection.
+const heartbeatInterval = 15 * time.Second
+
+// streamEvents writes events from ch to the client until ch is closed, the
+// client goes away or the server shuts down, sending heartbeat comments
+// while idle.
+func (s *Server) streamEvents(c echo.Context, ch <-chan events.Event) error {
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.stopping:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// writeEvent writes a single server-sent event and flushes it.
+func writeEvent(w *echo.Response, ev events.Event) error {
+	if ev.Name != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", ev.Name); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", ev.Data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// publishProgress sends an event to the progress stream with the given ID,
+// if the client asked for one.
+func (s *Server) publishProgress(id, name, data string) {
+	if id == "" {
+		return
+	}
+	s.progress.Publish(id, events.Event{Name: name, Data: data})
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/queue"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// queueStatus is the place of a synchronous generation in the queue. A zero
+// Position means it is running. Wait is the estimated time until it starts,
+// if known.
+type queueStatus struct {
+	Position  int
+	Total     int
+	Wait      time.Duration
+	WaitKnown bool
+}
+
+// waitingRequests tracks synchronous generations by progress ID so their
+// queue position can be polled.
+type waitingRequests struct {
+	mu       sync.Mutex
+	requests map[string]queueStatus
+}
+
+func (w *waitingRequests) set(id string, st queueStatus) {
+	if id == "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.requests == nil {
+		w.requests = make(map[string]queueStatus)
+	}
+	w.requests[id] = st
+}
+
+func (w *waitingRequests) get(id string) (queueStatus, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st, ok := w.requests[id]
+	return st, ok
+}
+
+func (w *waitingRequests) remove(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.requests, id)
+}
+
+// runningGenerations tracks when the generations holding a slot started and
+// how long they were predicted to take.
+type runningGenerations struct {
+	mu   sync.Mutex
+	next int
+	gens map[int]runningGeneration
+}
+
+type runningGeneration struct {
+	started   time.Time
+	predicted time.Duration
+}
+
+// begin records a generation as running and returns a function to call when
+// it finishes.
+func (r *runningGenerations) begin(predicted time.Duration) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gens == nil {
+		r.gens = make(map[int]runningGeneration)
+	}
+	id := r.next
+	r.next++
+	r.gens[id] = runningGeneration{started: time.Now(), predicted: predicted}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.gens, id)
+	}
+}
+
+// remaining returns the predicted time until the first running generation
+// finishes, or zero if none is running.
+func (r *runningGenerations) remaining() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var soonest time.Duration
+	first := true
+	for _, g := range r.gens {
+		left := max(g.predicted-time.Since(g.started), 0)
+		if first || left < soonest {
+			soonest, first = left, false
+		}
+	}
+	return soonest
+}
+
+// predict returns the expected duration of a generation, or false if there
+// is no data yet.
+func (s *Server) predict(p params.Params) (time.Duration, bool) {
+	return s.durations.Predict(p.Width*p.Height, p.Steps)
+}
+
+// estimateWait returns the approximate time until the generation with the
+// given parameters and 1-based queue position starts: the remaining time of
+// the running generation plus the predicted duration of each round of jobs
+// ahead. It returns false if there is no data yet.
+func (s *Server) estimateWait(position int, p params.Params) (time.Duration, bool) {
+	predicted, ok := s.predict(p)
+	if !ok {
+		return 0, false
+	}
+	slots := max(s.limiter.Max(), 1)
+	ahead := max(position-1, 0)
+	return s.running.remaining() + predicted*time.Duration(ahead/slots), true
+}
+
+// statsKey is the key under which generation statistics are persisted.
+const statsKey = "generation_stats"
+
+// loadStats restores the generation statistics from the store, if it can
+// keep them, and saves them there after every generation.
+func (s *Server) loadStats(store jobs.Store) {
+	meta, ok := store.(jobs.MetaStore)
+	if !ok {
+		return
+	}
+	data, err := meta.LoadMeta(statsKey)
+	if err != nil {
+		log.Warn("Failed to load generation statistics", "error", err)
+	} else if data != nil {
+		if err := json.Unmarshal(data, s.durations); err != nil {
+			log.Warn("Failed to decode generation statistics", "error", err)
+		}
+	}
+	s.durations.OnChange = func() {
+		data, err := json.Marshal(s.durations)
+		if err == nil {
+			err = meta.SaveMeta(statsKey, data)
+		}
+		if err != nil {
+			log.Warn("Failed to save generation statistics", "error", err)
+		}
+	}
+}
+
+// retryAfter sets the Retry-After header of a response rejected because the
+// queue is full, based on how long the queue takes to drain.
+func (s *Server) retryAfter(c echo.Context) {
+	wait, ok := s.durations.Mean()
+	if !ok {
+		wait = 10 * time.Second
+	}
+	wait = s.running.remaining() + wait*time.Duration(s.limiter.Queued()/max(s.limiter.Max(), 1))
+	seconds := max(int(wait.Round(time.Second)/time.Second), 1)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// errQueueFull is returned by acquireSlot when a request may not wait for a
+// generation slot any longer; queueFull turns it into the response.
+var errQueueFull = errors.New("generation queue is full")
+
+// acquireSlot waits for a slot among the generations of client and then for
+// a shared generation slot on behalf of a synchronous request, giving up
+// after MaxQueueWait. If MaxQueueWait is zero the request is rejected as
+// soon as it would have to wait. Giving up on the client's slot fails with
+// the 429 of its limits, and on the shared slot with errQueueFull. On
+// success the returned function frees both slots.
+func (s *Server) acquireSlot(parent context.Context, client string, notify queue.PositionFunc) (func(), error) {
+	ctx := parent
+	if s.MaxQueueWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, s.MaxQueueWait)
+		defer cancel()
+	}
+	// wait waits for the slot of t, failing with full() if it may not.
+	wait := func(t *queue.Ticket, full func() error) (func(), error) {
+		if s.MaxQueueWait <= 0 && !t.Ready() {
+			t.Cancel()
+			return nil, full()
+		}
+		release, err := t.Wait(ctx)
+		if err != nil && parent.Err() == nil {
+			return nil, full()
+		}
+		return release, err
+	}
+
+	t, err := s.clients.join(client)
+	if err != nil {
+		return nil, err
+	}
+	releaseClient, err := wait(t, func() error { return tooManyGenerations(s.clients.usage(client)) })
+	if err != nil {
+		return nil, err
+	}
+	var release func()
+	t, err = s.limiter.Join(notify)
+	switch {
+	case errors.Is(err, queue.ErrQueueFull):
+		err = errQueueFull
+	case err == nil:
+		release, err = wait(t, func() error { return errQueueFull })
+	}
+	if err != nil {
+		releaseClient()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseClient()
+	}, nil
+}
+
+// queueFull returns the error for a generation rejected by a full queue.
+func (s *Server) queueFull(c echo.Context) error {
+	s.retryAfter(c)
+	return errorf(http.StatusServiceUnavailable, "The generation queue is full, please try again later")
+}
+
+// formatWait renders an estimated wait for display.
+func (s *Server) formatWait(c echo.Context, d time.Duration) string {
+	if d < time.Second {
+		return s.t(c, "less than a second")
+	}
+	return s.t(c, "about %s", d.Round(time.Second))
+}
+
+// queuePosition renders the queue position of a synchronous generation as a
+// fragment that keeps polling while the generation is in progress.
+func (s *Server) queuePosition(c echo.Context) error {
+	id := c.Param("id")
+	st, ok := s.waiting.get(id)
+	data := map[string]any{
+		"id":     id,
+		"active": ok,
+	}
+	if ok {
+		data["position"] = st.Position
+		data["total"] = st.Total
+		if st.WaitKnown {
+			data["eta"] = s.formatWait(c, st.Wait)
+		}
+	}
+	return c.Render(http.StatusOK, "queue.html", data)
+}
+
+// health reports the queue and backend state.
+func (s *Server) health(c echo.Context) error {
+	status, backends := s.backendHealth()
+	if s.draining.Load() {
+		status = "draining"
+	}
+	code := http.StatusOK
+	if status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, map[string]any{
+		"status": status,
+		"queue": map[string]int{
+			"running":        s.limiter.Running(),
+			"queued":         s.limiter.Queued(),
+			"max_concurrent": s.limiter.Max(),
+			"max_queued":     s.limiter.MaxQueued(),
+		},
+		"paused":      s.limiter.Paused(),
+		"maintenance": s.maintenance.Load(),
+		"backends":    backends,
+	})
+}
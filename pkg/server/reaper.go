@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// reapIdleConnections checks every ConnectionCheckInterval whether a backend
+// was redeployed or restarted, and if so closes the idle connections to the
+// backends so no request goes out on a connection to the old process. A
+// backend counts as restarted when the identity it reports changes, or when
+// it answers again after failing to.
+func (s *Server) reapIdleConnections(ctx context.Context) {
+	if s.ConnectionCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ConnectionCheckInterval)
+	defer ticker.Stop()
+
+	identities := make(map[string]string)
+	down := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reset := false
+		for _, b := range s.client.Backends() {
+			probeCtx, cancel := context.WithTimeout(ctx, s.ConnectionCheckInterval)
+			id, err := s.client.Identity(probeCtx, b)
+			cancel()
+			if err != nil {
+				down[b.URL] = true
+				continue
+			}
+			prev, known := identities[b.URL]
+			identities[b.URL] = id
+			switch {
+			case down[b.URL]:
+				log.Info("Backend answers again, closing idle connections", "backend", b.URL)
+				reset = true
+			case known && id != prev:
+				log.Info("Backend identity changed, closing idle connections", "backend", b.URL, "previous", prev, "identity", id)
+				reset = true
+			}
+			down[b.URL] = false
+		}
+		if reset {
+			s.client.HTTP.CloseIdleConnections()
+		}
+	}
+}
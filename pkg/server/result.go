@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/params"
+)
+
+// ImageView is one generated image as shown in a result.
+type ImageView struct {
+	// ID is the image's ID in the archive, if it was archived.
+	ID string `json:"id"`
+	// Image is the base64-encoded image, unless it is linked by ImageURL.
+	Image    string         `json:"image"`
+	ImageURL string         `json:"image_url"`
+	Alt      string         `json:"alt"`
+	MIME     string         `json:"mime"`
+	Format   imaging.Format `json:"format"`
+	Size     int            `json:"size"`
+	Quality  int            `json:"quality"`
+	Seed     *int           `json:"seed,omitempty"`
+
+	NSFW         bool   `json:"nsfw"`
+	SafetyAction string `json:"safety_action"`
+	// RawID is the cached unblurred image of a blurred one.
+	RawID string `json:"raw_id"`
+
+	// TiledID is the cached image the tiled preview is rendered from.
+	TiledID string `json:"tiled_id"`
+	// FullID is the cached full resolution image of a downscaled one.
+	FullID string `json:"full_id"`
+}
+
+// ResultView is the outcome of a generation, rendered by the result.html
+// fragment and returned as the result of jobs. Its first image is the one
+// shown as the result; backends returning several images add ExtraImages.
+type ResultView struct {
+	ImageView
+	Params   params.Params `json:"params"`
+	Model    string        `json:"model"`
+	GenTime  float64       `json:"gen_time"`
+	Warnings []string      `json:"warnings"`
+	Tiling   bool          `json:"tiling"`
+	ShareURL string        `json:"share_url"`
+	// Recipe is the form values of the effective parameters, after
+	// defaults and clamping, with the seed the backend used, to generate
+	// the image again or tweak it.
+	Recipe      map[string]string `json:"recipe,omitempty"`
+	ExtraImages []ImageView       `json:"extra_images,omitempty"`
+}
+
+// RecipeURL returns an index page URL that prefills the form with the
+// recipe.
+func (r *ResultView) RecipeURL() string {
+	return formURL(r.Recipe)
+}
+
+// jobResult returns the result of a done job. Jobs restored from the store
+// hold their result as decoded JSON, which is converted back.
+func jobResult(job jobs.Job) (*ResultView, bool) {
+	switch result := job.Result.(type) {
+	case *ResultView:
+		return result, result != nil
+	case nil:
+		return nil, false
+	}
+	data, err := json.Marshal(job.Result)
+	if err != nil {
+		return nil, false
+	}
+	var result ResultView
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false
+	}
+	return &result, true
+}
+
+// withResultView returns job with its result as a *ResultView, for
+// templates rendering it.
+func withResultView(job jobs.Job) jobs.Job {
+	if result, ok := jobResult(job); ok {
+		job.Result = result
+	}
+	return job
+}
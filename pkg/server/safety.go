@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/log"
+)
+
+// Safety modes controlling how images flagged as NSFW by the backend are
+// presented.
+const (
+	// SafetyOff ignores the backend's NSFW flag.
+	SafetyOff = "off"
+	// SafetyBlur serves a blurred preview with the original available on
+	// request.
+	SafetyBlur = "blur"
+	// SafetyBlock replaces flagged images with a notice.
+	SafetyBlock = "block"
+)
+
+// Actions recorded for a generation after applying the safety mode.
+const (
+	safetyNone    = "none"
+	safetyBlurred = "blurred"
+	safetyBlocked = "blocked"
+)
+
+// parseSafetyMode validates a safety mode name.
+func parseSafetyMode(mode string) (string, error) {
+	switch mode {
+	case "", SafetyOff:
+		return SafetyOff, nil
+	case SafetyBlur, SafetyBlock:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown safety mode: %s", mode)
+}
+
+// applySafety applies the configured safety mode to a flagged image. It
+// returns the image to show, the action taken, and the ID under which the
+// original is cached when it was blurred.
+func (s *Server) applySafety(out output, nsfw bool) (output, string, string) {
+	if !nsfw || s.SafetyMode == SafetyOff {
+		return out, safetyNone, ""
+	}
+
+	if s.SafetyMode == SafetyBlur {
+		preview, err := blurOutput(out)
+		if err == nil {
+			id := s.images.Add(cachedImage{Data: out.Bytes, Format: out.Format, Quality: out.Quality})
+			log.Info("Safety filter blurred image", "raw_id", id)
+			return preview, safetyBlurred, id
+		}
+		log.Warn("Failed to blur flagged image, blocking instead", "error", err)
+	}
+
+	log.Info("Safety filter blocked image")
+	return output{}, safetyBlocked, ""
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// search is a search of past generations by their recipe, shared by the
+// gallery and the job listing so both select the same way.
+type search struct {
+	Prompt string
+	Seed   *int
+	Model  string
+	Since  time.Time
+	Until  time.Time
+}
+
+// parseSearch reads a search from the q, seed, model, since and until query
+// parameters. Times are RFC 3339 or dates, where until includes the whole
+// day.
+func (s *Server) parseSearch(c echo.Context) (search, error) {
+	q := search{
+		Prompt: strings.TrimSpace(c.QueryParam("q")),
+		Model:  strings.TrimSpace(c.QueryParam("model")),
+	}
+	if v := c.QueryParam("seed"); v != "" {
+		seed, err := parseFormInt(v, math.MinInt, math.MaxInt)
+		if err != nil {
+			return search{}, numberError(err, "Seed must be a whole number", "Seed must be between %v and %v")
+		}
+		q.Seed = &seed
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		v := c.QueryParam(name)
+		if v == "" {
+			continue
+		}
+		if parsed, err := time.Parse(time.RFC3339, v); err == nil {
+			*t = parsed
+			continue
+		}
+		day, err := time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil {
+			return search{}, errorf(http.StatusBadRequest, "Time is invalid: %s", v)
+		}
+		if name == "until" {
+			day = day.AddDate(0, 0, 1)
+		}
+		*t = day
+	}
+	return q, nil
+}
+
+// archiveQuery returns the search as a query of the image archive.
+func (q search) archiveQuery() store.Query {
+	return store.Query{Prompt: q.Prompt, Seed: q.Seed, Model: q.Model, Since: q.Since, Until: q.Until}
+}
+
+// apply narrows a job listing filter to the search.
+func (q search) apply(f *jobs.Filter) {
+	f.Prompt, f.Seed, f.Model, f.Since, f.Until = q.Prompt, q.Seed, q.Model, q.Since, q.Until
+}
@@ -1,216 +1,841 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
-	"math"
 	"net/http"
-	"strconv"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
 	"time"
 
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/audit"
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/events"
+	"flue-frontend/pkg/i18n"
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/metrics"
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/queue"
 	"flue-frontend/pkg/render"
+	"flue-frontend/pkg/store"
+	"flue-frontend/pkg/tracing"
 
 	"github.com/charmbracelet/log"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
+// templateDir is the directory the HTML templates are loaded from, relative
+// to the working directory.
+const templateDir = "templates"
+
 type Server struct {
-	Echo    *echo.Echo
-	Host    string
-	Port    int
-	Backend string
-}
+	Echo     *echo.Echo
+	Host     string
+	Port     int
+	Backends []string
 
-func New(host string, port int, backend string) *Server {
-	return &Server{
-		Echo:    echo.New(),
-		Host:    host,
-		Port:    port,
-		Backend: backend,
-	}
-}
+	// BreakerThreshold is the number of consecutive failures after which a
+	// backend's circuit opens and requests to it fast-fail.
+	BreakerThreshold int
+	// BreakerCooldown is how long an open circuit waits before letting a
+	// single probe request through.
+	BreakerCooldown time.Duration
+	// BackendTimeout bounds each backend generation request, including
+	// reading the full response. Requests exceeding it fail with 504. Zero
+	// means no timeout.
+	BackendTimeout time.Duration
+	// SlowThreshold is the generation time above which a generation is
+	// logged as slow and counted in flue_slow_generations_total. Zero
+	// disables the warning.
+	SlowThreshold time.Duration
+	// BackendHeaders are static headers added to every backend request,
+	// such as a tenant ID a gateway requires.
+	BackendHeaders map[string]string
+	// ForwardHeaders names the headers of client requests passed on to the
+	// backends, such as trace headers. Hop-by-hop headers are never passed.
+	ForwardHeaders []string
+	// SigningSecret, if set, is the secret backend requests are signed
+	// with, for backends that reject unsigned requests. The HMAC of the
+	// request's timestamp and body is sent in SignatureHeader.
+	SigningSecret string
+	// SigningAlgorithm is the hash of the request signatures: sha256,
+	// sha384 or sha512.
+	SigningAlgorithm string
+	// SignatureHeader is the header the request signatures are sent in.
+	SignatureHeader string
+	// PayloadKeys renames the keys of generation payloads for backend
+	// versions expecting other names, such as steps=num_inference_steps or
+	// guidance=guidance_scale. Keys it leaves out keep their names.
+	PayloadKeys map[string]string
+	// ProbeBackendVersion queries the backends for their version at
+	// startup and logs it along with the payload keys in use.
+	ProbeBackendVersion bool
+	// MaxBackendResponse is the maximum size in bytes of a backend
+	// response. Larger responses fail with 502. Zero derives a limit from
+	// the maximum image dimensions.
+	MaxBackendResponse int64
 
-func (s *Server) Run(ctx context.Context, stop context.CancelFunc) error {
-	s.setupMiddleware()
-	s.Echo.HideBanner = true
+	// DefaultQuality is the encoder quality used for lossy output formats
+	// when the request does not specify one.
+	DefaultQuality int
 
-	// Set the template renderer
-	s.Echo.Renderer = &render.TemplateRenderer{
-		Templates: template.Must(template.ParseGlob("templates/*.html")),
-	}
+	// DefaultModel is sent to the backend when a request omits the model.
+	DefaultModel string
+	// AvailableModels restricts the models a request may select. When empty
+	// any model name is accepted and left to the backend to validate.
+	AvailableModels []string
+	// ModelConfig is the path of a JSON file mapping model names to their
+	// default steps and guidance and narrower limits, loaded into
+	// ModelDefaults unless that is already set.
+	ModelConfig string
+	// ModelDefaults are the default settings and limits of models. Requests
+	// are validated against the limits of the model they select.
+	ModelDefaults map[string]params.ModelDefaults
+	// ExamplePrompts is the path of a JSON file listing example prompts,
+	// loaded into Examples unless that is already set.
+	ExamplePrompts string
+	// Examples are offered on the index page to fill in the form with.
+	Examples []ExamplePrompt
 
-	// Define routes
-	s.Echo.GET("/", s.index) // Serve the index page
-	s.Echo.POST("/", s.generate) // Handle form submission
+	// PNGMetadata is the convention the generation parameters are embedded
+	// in PNG images with: PNGMetadataParameters, PNGMetadataFields or
+	// PNGMetadataNone.
+	PNGMetadata string
+	// Version is the release reported in embedded metadata.
+	Version string
+	// SafetyMode controls how images the backend flags as NSFW are shown:
+	// SafetyOff, SafetyBlur or SafetyBlock.
+	SafetyMode string
+	// AuditLog is the path of a file receiving one JSON line per
+	// generation, reopened on SIGHUP for rotation. If empty, no audit log is
+	// kept.
+	AuditLog string
+	// ImageStore selects where generated images are archived: StoreDisk,
+	// StoreMemory or StoreS3.
+	ImageStore string
+	// OutputDir is a directory where every generated image is archived
+	// along with a JSON sidecar of its metadata when ImageStore is
+	// StoreDisk. If empty, images are not kept.
+	OutputDir string
+	// S3 locates the bucket images are archived in when ImageStore is
+	// StoreS3.
+	S3 archive.S3Config
+	// PresignExpiry, if positive, redirects requests for archived images to
+	// URLs of the image store valid this long, when the store serves
+	// clients directly. Otherwise images are streamed through the server.
+	PresignExpiry time.Duration
+	// ShareExpiry, if positive, is how long public links to archived
+	// images stay valid. Otherwise they last until revoked.
+	ShareExpiry time.Duration
+	// BaseURL is the external URL the server is reached at, such as
+	// https://images.example.com, used for absolute links in the feed and
+	// public links. If empty, it is derived from each request.
+	BaseURL string
+	// FeedSize is the number of generations listed in the Atom feed at
+	// /feed.atom. Zero disables the feed.
+	FeedSize int
+	// FeedScope selects the generations the feed lists: FeedPublic or
+	// FeedAll.
+	FeedScope string
+	// RetentionMaxAge, RetentionMaxBytes and RetentionMaxCount limit the
+	// age of archived images and their total size and number. The oldest
+	// images that are not favorites are removed to stay within them. Zero
+	// disables a limit.
+	RetentionMaxAge   time.Duration
+	RetentionMaxBytes int64
+	RetentionMaxCount int
+	// RetentionInterval is how often the retention limits are enforced
+	// after the cleanup on startup. Zero cleans up only on startup.
+	RetentionInterval time.Duration
+	// RetentionDryRun only logs the images retention cleanup would remove.
+	RetentionDryRun bool
+	// ThumbnailSize is the longest side, in pixels, of the thumbnails of
+	// archived images.
+	ThumbnailSize int
+	// ThumbnailFormat is the format thumbnails are encoded in, one this
+	// build supports.
+	ThumbnailFormat string
+	// GalleryPageSize is the number of archived images per gallery page.
+	GalleryPageSize int
+	// PerUserGalleries scopes the gallery, job history, favorites and
+	// deletion to the anonymous session, kept in a long-lived cookie, that
+	// an image or job was created in. Administrators see everyone's images
+	// at /admin/gallery and jobs at /admin/history.
+	PerUserGalleries bool
+	// LegacyOwner is the session images archived before PerUserGalleries
+	// was set are assigned to.
+	LegacyOwner string
+	// ImageCacheSize is the number of recent images kept in memory for
+	// separate retrieval.
+	ImageCacheSize int
+	// InlineMaxBytes is the largest image, in encoded bytes, embedded in
+	// the result page as a data URI. Larger ones are linked instead.
+	InlineMaxBytes int
+	// PreviewMaxDimension scales the image shown in the browser down so
+	// neither side exceeds it, keeping the full resolution image for
+	// download. Zero disables downscaling.
+	PreviewMaxDimension int
+	// AltText is a text/template of the alt text of result images, given the
+	// Prompt, shortened, along with the Seed, Width, Height, Steps and
+	// Model. Empty uses a generic text.
+	AltText string
+	// BlockingSubmit makes the browser form wait for the generation to
+	// finish, rather than queueing a job and polling its status.
+	BlockingSubmit bool
 
-	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
-	go func() {
-		if err := s.Echo.Start(addr); err != nil && err != http.ErrServerClosed {
-			log.Error("Failed to start server", "error", err)
-			stop()
-		}
-	}()
+	// MaxConcurrent is the maximum number of generations sent to the
+	// backends at once. Further requests wait in FIFO order. Zero means
+	// unlimited.
+	MaxConcurrent int
+	// MaxQueued is the maximum number of generations waiting for a slot.
+	// Further requests are rejected with 503. Zero means unbounded.
+	MaxQueued int
+	// MaxQueueWait bounds how long a synchronous request waits for a slot
+	// before it is rejected with 503. Zero rejects requests as soon as all
+	// slots are busy. Asynchronous jobs wait without bound.
+	MaxQueueWait time.Duration
+	// MaxRunningPerClient and MaxQueuedPerClient limit the generations a
+	// single client IP may have running and waiting. Excess requests are
+	// rejected with 429. Zero means unlimited.
+	MaxRunningPerClient int
+	MaxQueuedPerClient  int
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies whose
+	// X-Forwarded-For header is believed when determining client IPs. If
+	// empty, the peer address is used.
+	TrustedProxies []string
 
-	// Wait for the context to be cancelled
-	<-ctx.Done()
-	log.Info("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := s.Echo.Shutdown(ctx); err != nil {
-		log.Error("Failed to shutdown server", "error", err)
-		return err
-	}
-	log.Info("Server shutdown complete")
-	return nil
-}
+	// PromptFilter rejects disallowed prompts before they reach the backend.
+	// If nil, a PatternFilter is built from BlockedPatterns.
+	PromptFilter PromptFilter
+	// BlockedPatterns are case-insensitive regular expressions for prompts
+	// to reject.
+	BlockedPatterns []string
+	// RedactFilteredPrompts omits the prompt text when logging rejections.
+	RedactFilteredPrompts bool
 
-func (s *Server) setupMiddleware() {
-	s.Echo.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogStatus:   true,
-		LogURI:      true,
-		LogError:    true,
-		HandleError: true, // forwards error to the global error handler, so it can decide appropriate status code
-		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			if v.Error == nil {
-				log.Info("REQUEST", "client", c.RealIP(), "uri", v.URI, "status", v.Status)
-			} else {
-				log.Error("REQUEST_ERROR", "client", c.RealIP(), "uri", v.URI, "status", v.Status, "err", v.Error.Error())
-			}
-			return nil
-		},
-	}))
+	// DedupWindow is how long after a generation request an identical one
+	// from the same client shares its outcome instead of generating again.
+	// Zero disables deduplication.
+	DedupWindow time.Duration
 
-	s.Echo.Use(middleware.Recover())
+	// MaxBatchSize is the maximum number of prompts in a batch submission.
+	// Zero means unlimited.
+	MaxBatchSize int
+	// MaxScheduleHorizon is how far ahead a job may be scheduled. Zero
+	// means no limit.
+	MaxScheduleHorizon time.Duration
+	// JobTTL is how long finished asynchronous jobs remain retrievable.
+	JobTTL time.Duration
+	// JobHistory is how long finished jobs stay in the job history, which
+	// may be longer than JobTTL.
+	JobHistory time.Duration
+	// Database is the path of a SQLite database keeping the metadata of
+	// archived images, and jobs unless JobStore is set. If empty, the
+	// metadata is kept in memory, indexed from the OutputDir sidecars.
+	Database string
+	// JobStore is the path of the database persisting jobs across
+	// restarts. If empty, jobs are kept in memory only.
+	JobStore string
+
+	// Limits are the static parameter limits, used for any range the
+	// backends do not report through their capabilities endpoint.
+	Limits params.Limits
+	// HealthPollInterval is how often the backends are probed to notice
+	// them going down or recovering. Zero disables polling.
+	HealthPollInterval time.Duration
+	// ConnectionCheckInterval is how often the backends are checked for
+	// having been redeployed or restarted, closing the idle connections to
+	// them when they were. Zero disables the check.
+	ConnectionCheckInterval time.Duration
+	// CapabilitiesRefresh is how often the backends' capabilities are
+	// queried again. Zero queries them only at startup.
+	CapabilitiesRefresh time.Duration
+
+	// StreamProgress asks the backends to stream per-step progress as
+	// newline-delimited JSON.
+	StreamProgress bool
+
+	// WarmupOnStart issues a throwaway generation after startup so the
+	// backend loads its model before real traffic arrives.
+	WarmupOnStart bool
+	// WarmupParams are the parameters of the warmup generation.
+	WarmupParams params.Params
+
+	// DrainDelay is how long the server keeps answering once shutdown
+	// starts, failing readiness checks and refusing new generations with
+	// 503, so load balancers stop sending traffic before connections are
+	// refused.
+	DrainDelay time.Duration
+	// DrainTimeout is how long in-flight requests may take to finish
+	// during shutdown, after DrainDelay.
+	DrainTimeout time.Duration
+
+	// NoCompression turns off gzipping responses, such as when a reverse
+	// proxy compresses them already.
+	NoCompression bool
+	// CompressionMinBytes is the size below which responses are not
+	// gzipped, since compressing them gains little.
+	CompressionMinBytes int
+
+	// AdminUsers maps the names of administrators to their passwords, which
+	// they present with HTTP basic auth to use the /admin endpoints. The
+	// endpoints are disabled if it is empty.
+	AdminUsers map[string]string
+
+	// Branding sets the site title, logo and footer of the HTML UI.
+	Branding Branding
+	// TimeFormat is the Go layout times are shown with in the HTML UI.
+	TimeFormat string
+	// TimeZone is the IANA name of the zone times are shown in by the HTML
+	// UI, such as Europe/Berlin. If empty, the server's local zone is used.
+	TimeZone string
+	// PrefsSecret is the key the preferences cookie is signed with. If
+	// empty, a random key is used, so preferences reset on restart.
+	PrefsSecret string
+	// SessionSecret is the key session IDs are digested with before they
+	// are stored as the owner of images and jobs. If empty, a random key is
+	// kept in the job store.
+	SessionSecret string
+
+	// APIOnly disables the HTML UI, serving only the JSON API without
+	// loading any templates.
+	APIOnly bool
+
+	// MaintenanceMode starts the server refusing generations with 503 while
+	// the UI stays up with a banner. Administrators can toggle it at runtime.
+	MaintenanceMode bool
+
+	// OTLPEndpoint is the OTLP/HTTP URL generation traces are exported to.
+	// If empty, traces are not recorded.
+	OTLPEndpoint string
+
+	// Debug enables diagnostic endpoints such as the raw backend
+	// passthrough, and logs the payload of every backend request with the
+	// status and length of its response. They expose backend details and
+	// prompts and should not be used in production.
+	Debug bool
+	// Pprof serves runtime profiles under /debug/pprof to administrators.
+	Pprof bool
+
+	client    *backend.Client
+	images    *imageCache
+	limiter   *queue.Limiter
+	durations *queue.Estimator
+	running   runningGenerations
+	clients   *clientLimiters
+	catalog   *i18n.Catalog
+	prefsKey  []byte
+	// sessionSecret is the key sessionOwner digests session IDs with.
+	sessionSecret []byte
+
+	generateDedup *deduper[*ResultView]
+	jobDedup      *deduper[jobs.Job]
+	waiting       waitingRequests
+	probes        backendProbes
+	thumbnails    singleflight.Group
+	altTemplate   *texttemplate.Template
+	retention     retentionRun
+	archive       archive.ImageStore
+	links         *publicLinks
+	outcomes      *outcomes
+	usage         usageCache
+	audit         *audit.Log
+	progress      *events.Broker
+	jobs          *jobs.Manager
+	limits        atomic.Pointer[params.Limits]
+	draining      atomic.Bool
+	maintenance   atomic.Bool
+	started       time.Time
+	// stopping is closed as shutdown starts, ending open event streams.
+	stopping chan struct{}
+	// jobWork tracks the goroutines working on jobs, which shutdown waits
+	// for before the job store is closed.
+	jobWork sync.WaitGroup
 }
 
-func (s *Server) index(c echo.Context) error {
-	return c.Render(http.StatusOK, "index.html", nil)
+// New returns a Server listening on host and port and sending generations to
+// the given backend base URLs, with defaults for all other settings. It fails
+// if the port is out of range or a backend URL is not an absolute HTTP URL.
+func New(host string, port int, backends []string) (*Server, error) {
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("port %d is out of range 1-65535", port)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+	for _, b := range backends {
+		if err := validateBackendURL(b); err != nil {
+			return nil, fmt.Errorf("backend %q: %w", b, err)
+		}
+	}
+
+	return &Server{
+		Echo:                echo.New(),
+		Host:                host,
+		Port:                port,
+		Backends:            backends,
+		BreakerThreshold:    5,
+		BreakerCooldown:     30 * time.Second,
+		SigningAlgorithm:    "sha256",
+		SignatureHeader:     backend.DefaultSignatureHeader,
+		BackendTimeout:      5 * time.Minute,
+		SlowThreshold:       2 * time.Minute,
+		DefaultQuality:      90,
+		SafetyMode:          SafetyOff,
+		PNGMetadata:         PNGMetadataParameters,
+		ImageStore:          StoreDisk,
+		ImageCacheSize:      100,
+		InlineMaxBytes:      32 << 10,
+		AltText:             DefaultAltText,
+		GalleryPageSize:     24,
+		FeedSize:            20,
+		FeedScope:           FeedPublic,
+		TimeFormat:          "2006-01-02 15:04:05 MST",
+		LegacyOwner:         "legacy",
+		RetentionInterval:   time.Hour,
+		ThumbnailSize:       256,
+		ThumbnailFormat:     string(imaging.JPEG),
+		MaxConcurrent:       1,
+		MaxQueued:           32,
+		MaxQueueWait:        5 * time.Minute,
+		DedupWindow:         2 * time.Second,
+		JobTTL:              time.Hour,
+		JobHistory:          7 * 24 * time.Hour,
+		MaxBatchSize:        50,
+		MaxScheduleHorizon:  24 * time.Hour,
+		Limits:              params.DefaultLimits(),
+		CapabilitiesRefresh: 10 * time.Minute,
+		HealthPollInterval:  15 * time.Second,
+		DrainDelay:          5 * time.Second,
+		DrainTimeout:        10 * time.Second,
+		CompressionMinBytes: 1024,
+		WarmupParams: params.Params{
+			Prompt: "warmup",
+			Width:  256,
+			Height: 256,
+			Steps:  1,
+		},
+	}, nil
 }
 
-func (s *Server) generate(c echo.Context) error {
-	// Extract form-encoded fields.
-	prompt := c.FormValue("prompt")
-	widthStr := c.FormValue("width")
-	heightStr := c.FormValue("height")
-	numStepsStr := c.FormValue("num_steps")
-	guidanceScaleStr := c.FormValue("guidance_scale")
-	seedStr := c.FormValue("seed")
+// validateBackendURL checks that raw is an absolute HTTP or HTTPS URL.
+func validateBackendURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("host is missing")
+	}
+	return nil
+}
 
-	// Validate required fields.
-	if prompt == "" {
-		return c.String(http.StatusBadRequest, "Prompt is required")
+func (s *Server) Run(ctx context.Context, stop context.CancelFunc) error {
+	s.started = time.Now()
+	s.setupMiddleware()
+	s.Echo.HideBanner = true
+	s.client = backend.NewClient(s.Backends, s.BreakerThreshold, s.BreakerCooldown)
+	s.client.Timeout = s.BackendTimeout
+	s.client.MaxResponseSize = s.MaxBackendResponse
+	if s.client.MaxResponseSize == 0 {
+		s.client.MaxResponseSize = responseLimit(s.Limits)
 	}
-	width, err := parseFormInt(widthStr, 64, 2048)
+	s.client.Header = backendHeader(s.BackendHeaders, s.ForwardHeaders)
+	if s.SigningSecret != "" {
+		signer, err := backend.NewSigner(s.SigningAlgorithm, s.SigningSecret, s.SignatureHeader)
+		if err != nil {
+			return err
+		}
+		s.client.Signer = signer
+	}
+	payloadKeys, err := backend.NewPayloadKeys(s.PayloadKeys, append(slices.Clone(params.PayloadKeys), "stream"))
 	if err != nil {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Width is invalid: %v", err))
+		return err
+	}
+	s.client.PayloadKeys = payloadKeys
+	if s.Debug {
+		s.client.OnExchange = logExchange
 	}
-	height, err := parseFormInt(heightStr, 64, 2048)
+	s.images = newImageCache(s.ImageCacheSize)
+	s.maintenance.Store(s.MaintenanceMode)
+	var records store.Store
+	var db *store.SQLite
+	if s.Database != "" {
+		var err error
+		db, err = store.OpenSQLite(s.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		records = db
+	}
+	archived, err := s.openImageStore(ctx, records)
 	if err != nil {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Height is invalid: %v", err))
+		return err
 	}
-	numSteps, err := parseFormInt(numStepsStr, 1, 100)
+	s.archive = archived
+	shutdownTracing, err := tracing.Setup(ctx, s.OTLPEndpoint)
 	if err != nil {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Number of steps is invalid: %v", err))
+		return err
 	}
-	guidanceScale, err := parseFormFloat(guidanceScaleStr, 0.0, 10.0)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warn("Failed to flush traces", "error", err)
+		}
+	}()
+	if s.AuditLog != "" {
+		l, err := audit.Open(s.AuditLog)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		s.audit = l
+		go s.reopenAuditOnHangup(ctx)
+	}
+	s.limiter = queue.NewLimiter(s.MaxConcurrent, s.MaxQueued)
+	s.limiter.Observe = func(running, queued int) {
+		metrics.QueueRunning.Set(float64(running))
+		metrics.QueueDepth.Set(float64(queued))
+	}
+	s.clients = newClientLimiters(s.MaxRunningPerClient, s.MaxQueuedPerClient)
+	s.durations = queue.NewEstimator(20)
+	s.progress = events.NewBroker()
+	s.stopping = make(chan struct{})
+	catalog, err := i18n.Load()
 	if err != nil {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Guidance scale is invalid: %v", err))
+		return err
 	}
-
-	// Prepare the JSON payload.
-	payload := map[string]any{
-		"prompt":   prompt,
-		"width":    width,
-		"height":   height,
-		"steps":    numSteps,
-		"guidance": guidanceScale,
+	s.catalog = catalog
+	var jobStore jobs.Store
+	switch {
+	case s.JobStore != "":
+		bolt, err := jobs.OpenBoltStore(s.JobStore)
+		if err != nil {
+			return err
+		}
+		defer bolt.Close()
+		jobStore = bolt
+	case db != nil:
+		jobStore = db.Jobs()
 	}
-
-	// Handle optional seed parameter.
-	if seedStr != "" {
-		seed, err := parseFormInt(seedStr, math.MinInt, math.MaxInt)
+	s.loadSessionSecret(jobStore)
+	if s.archive != nil && s.PerUserGalleries {
+		n, err := s.archive.Adopt(ctx, s.sessionOwner(s.LegacyOwner))
 		if err != nil {
-			c.String(http.StatusBadRequest, fmt.Sprintf("Seed is invalid: %v", err))
+			return fmt.Errorf("assign archived images to %s: %w", s.LegacyOwner, err)
+		}
+		if n > 0 {
+			log.Info("Assigned archived images without an owner", "owner", s.LegacyOwner, "count", n)
 		}
-		payload["seed"] = seed
 	}
+	s.jobs = jobs.NewManager(s.JobTTL, jobStore)
+	s.jobs.History = s.JobHistory
+	s.loadStats(jobStore)
+	s.loadLinks(jobStore)
+	s.loadOutcomes(jobStore)
+	s.generateDedup = newDeduper[*ResultView](s.DedupWindow)
+	s.jobDedup = newDeduper[jobs.Job](s.DedupWindow)
 
-	jsonData, err := json.Marshal(payload)
+	extractor, err := ipExtractor(s.TrustedProxies)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to encode JSON")
+		return err
 	}
+	s.Echo.IPExtractor = extractor
 
-	// Measure the time taken for the generation call.
-	start := time.Now()
+	mode, err := parseSafetyMode(s.SafetyMode)
+	if err != nil {
+		return err
+	}
+	s.SafetyMode = mode
 
-	// Call the local Flue server.
-	resp, err := http.Post("http://localhost:8000/v1/images/generations", "application/json", bytes.NewReader(jsonData))
+	pngMetadata, err := parsePNGMetadata(s.PNGMetadata)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to call Flue server")
+		return err
 	}
-	defer resp.Body.Close()
+	s.PNGMetadata = pngMetadata
 
-	// Read the response body from the Flue server.
-	body, err := io.ReadAll(resp.Body)
+	feedScope, err := parseFeedScope(s.FeedScope)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to read response from Flue server")
+		return err
 	}
+	if feedScope == FeedAll && s.PerUserGalleries {
+		return errors.New("the feed cannot list all generations with per-user galleries")
+	}
+	s.FeedScope = feedScope
 
-	// Decode the JSON response.
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to parse JSON response")
+	if s.BaseURL != "" {
+		u, err := url.Parse(s.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base URL must be an absolute http or https URL: %s", s.BaseURL)
+		}
+		s.BaseURL = strings.TrimSuffix(s.BaseURL, "/")
 	}
 
-	// Compute generation time as fallback if response doesn't provide it
-	genTime := time.Since(start).Seconds()
-	if respGenTime, ok := result["gen_time"].(float64); ok {
-		genTime = respGenTime
+	thumbFormat, err := imaging.ParseFormat(s.ThumbnailFormat)
+	if err == nil && !thumbFormat.Supported() {
+		err = fmt.Errorf("%w: %s", imaging.ErrUnsupportedFormat, thumbFormat)
 	}
+	if err != nil {
+		return fmt.Errorf("thumbnail format: %w", err)
+	}
+	s.ThumbnailFormat = string(thumbFormat)
 
-	// Prepare data for rendering the result template.
-	data := map[string]any{
-		"image":    result["image"],
-		"gen_time": roundFloat(genTime, 2),
+	if s.PromptFilter == nil && len(s.BlockedPatterns) > 0 {
+		filter, err := NewPatternFilter(s.BlockedPatterns)
+		if err != nil {
+			return err
+		}
+		s.PromptFilter = filter
+	}
+
+	if s.ModelDefaults == nil && s.ModelConfig != "" {
+		models, err := params.LoadModelDefaults(s.ModelConfig)
+		if err != nil {
+			return err
+		}
+		s.ModelDefaults = models
+	}
+
+	if s.Examples == nil && s.ExamplePrompts != "" {
+		examples, err := loadExamples(s.ExamplePrompts, s.AvailableModels)
+		if err != nil {
+			return err
+		}
+		s.Examples = examples
+	}
+
+	// Define the API routes. Generations posted to / answer with JSON
+	// without the HTML UI.
+	s.Echo.POST("/", s.generate, s.traceRequest, s.refuseWhileDraining, s.refuseInMaintenance)
+	s.Echo.GET("/raw/:id", s.rawImage)
+	s.Echo.GET("/generated/:id", s.generatedImage)
+	s.Echo.GET("/generated/:id/download", s.downloadGeneratedImage)
+	s.Echo.DELETE("/generated/:id", s.deleteGeneratedImage)
+	s.Echo.GET("/images/:id", s.redirectImage)
+	s.Echo.DELETE("/images/:id", s.deleteGeneratedImage)
+	s.Echo.POST("/generated/:id/favorite", s.toggleFavorite)
+	s.Echo.POST("/generated/:id/share", s.sharePublicLink)
+	s.Echo.DELETE("/generated/:id/share", s.revokePublicLinks)
+	s.Echo.GET("/thumbs/:id", s.thumbnail)
+	s.Echo.GET("/tiled/:id", s.tiledImage)
+	s.Echo.POST("/batches", s.submitBatch, s.traceRequest, s.refuseWhileDraining, s.refuseInMaintenance)
+	s.Echo.GET("/batches/:id", s.getBatch)
+	s.Echo.GET("/jobs", s.listJobs)
+	s.Echo.POST("/jobs", s.submitJob, s.traceRequest, s.refuseWhileDraining, s.refuseInMaintenance)
+	s.Echo.GET("/jobs/:id", s.getJob)
+	s.Echo.DELETE("/jobs/:id", s.cancelJob)
+	s.Echo.GET("/jobs/:id/events", s.jobEvents)
+	s.Echo.GET("/jobs/:id/ws", s.jobPreviews)
+	s.Echo.GET("/healthz", s.health)
+	s.Echo.GET("/stats", s.usageStats)
+	s.Echo.GET("/metrics", echo.WrapHandler(promhttp.Handler())) // Prometheus metrics
+	if s.Debug {
+		s.Echo.POST("/api/v1/generate/raw", s.rawGenerate, s.traceRequest, s.refuseWhileDraining, s.refuseInMaintenance)
+	}
+	if s.Pprof {
+		if len(s.AdminUsers) == 0 {
+			return errors.New("profiling requires administrators to be configured")
+		}
+		s.registerPprof()
+	}
+	var admin *echo.Group
+	if len(s.AdminUsers) > 0 {
+		admin = s.Echo.Group("/admin", s.adminAuth())
+		admin.GET("/status/events", s.statusEvents)
+		admin.GET("/jobs", s.adminJobs)
+		admin.GET("/history", s.listJobs)
+		admin.POST("/jobs/:id/cancel", s.adminCancelJob)
+		admin.POST("/drain", s.adminDrain)
+		admin.POST("/resume", s.adminResume)
+		admin.POST("/maintenance", s.adminMaintenance)
+		admin.GET("/config", s.adminConfig)
+		if s.archive != nil {
+			admin.GET("/storage", s.adminStorage)
+			admin.POST("/import", s.adminImport)
+			s.Echo.GET("/export", s.exportArchive, s.adminAuth())
+		}
+	}
+	if s.archive != nil {
+		s.Echo.GET("/batches/:id/download.zip", s.batchDownload)
+		// The batch download was first published under this path.
+		s.Echo.GET("/batch/:id/download", s.batchDownload)
+		s.Echo.POST("/download.zip", s.selectionDownload)
+	}
+
+	if s.AltText != "" {
+		tmpl, err := parseAltText(s.AltText)
+		if err != nil {
+			return err
+		}
+		s.altTemplate = tmpl
+	}
+
+	// Set the template renderer and define the HTML UI routes, unless
+	// running API-only.
+	if !s.APIOnly {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone: %w", err)
+		}
+		s.prefsKey = []byte(s.PrefsSecret)
+		if s.PrefsSecret == "" {
+			s.prefsKey = []byte(newToken())
+		}
+		funcs := render.Funcs(loc, s.TimeFormat)
+		funcs["t"] = fmt.Sprintf
+		templates, err := render.ParseDir(templateDir, funcs)
+		if err != nil {
+			return fmt.Errorf("load templates: %w", err)
+		}
+		s.Echo.Renderer = pageRenderer{
+			Renderer: &render.TemplateRenderer{
+				Templates: templates,
+				Locale:    locale,
+				LocaleFuncs: func(l string) template.FuncMap {
+					return template.FuncMap{"t": func(key string, args ...any) string { return s.catalog.Translate(l, key, args...) }}
+				},
+			},
+			branding: s.Branding,
+			globals:  s.globals,
+		}
+		s.Echo.GET("/", s.index) // Serve the index page
+		s.Echo.GET("/progress/:id", s.progressEvents)
+		s.Echo.GET("/queue/:id", s.queuePosition)
+		s.Echo.GET("/jobs/:id/fragment", s.jobFragment)
+		s.Echo.POST("/settings/from-image", s.settingsFromImage)
+		s.Echo.POST("/prefs", s.updatePrefs)
+		s.Echo.POST("/prefs/theme", s.updatePrefs)
+		if s.archive != nil {
+			s.Echo.GET("/gallery", s.gallery)
+			s.Echo.GET("/gallery/:id", s.galleryImage)
+			s.Echo.GET("/s/:token", s.publicImage)
+			if s.FeedSize > 0 {
+				s.Echo.GET("/feed.atom", s.feed)
+			}
+		}
+		if admin != nil {
+			admin.GET("/status", s.statusPage)
+			if s.archive != nil {
+				admin.GET("/gallery", s.gallery)
+			}
+		}
+	} else {
+		// There is no index page, rather than a method not allowed.
+		s.Echo.GET("/", echo.NotFoundHandler)
 	}
 
-	// Render the fragment template.
-	return c.Render(http.StatusOK, "result.html", data)
+	if err := s.resumeJobs(); err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	go func() {
+		if err := s.Echo.Start(addr); err != nil && err != http.ErrServerClosed {
+			log.Error("Failed to start server", "error", err)
+			stop()
+		}
+	}()
+
+	if s.ProbeBackendVersion {
+		go s.probeVersions(ctx)
+	}
+	go s.refreshCapabilities(ctx)
+	go s.pollHealth(ctx)
+	go s.reapIdleConnections(ctx)
+	go s.enforceRetention(ctx)
+	if s.WarmupOnStart {
+		go s.warmup(ctx)
+	}
+
+	// Wait for the context to be cancelled
+	<-ctx.Done()
+	return s.shutdown()
 }
 
-// roundFloat rounds a float64 to a specified number of decimal places.
-func roundFloat(val float64, precision int) float64 {
-	ratio := math.Pow(10, float64(precision))
-	return math.Round(val*ratio) / ratio
+// responseLimit returns a backend response size limit generous enough for
+// the largest allowed image: uncompressed RGBA pixels, base64-encoded, plus
+// room for the rest of the response.
+func responseLimit(l params.Limits) int64 {
+	pixels := int64(l.Width.Max) * int64(l.Height.Max)
+	return pixels*4*4/3 + 1<<20
 }
 
-func parseFormInt(field string, min, max int) (int, error) {
-	// Helper function to parse form values as integers with min/max constraints
-	valStr := field
-	val, err := strconv.Atoi(valStr)
-	if err != nil {
-		return 0, fmt.Errorf("invalid integer: %s", valStr)
-	}
-	if val < min || val > max {
-		return 0, fmt.Errorf("value out of range: %d (expected between %d and %d)", val, min, max)
+// warmup sends a small throwaway generation to the backends so the model is
+// loaded before the first real request. Failures are logged and ignored.
+func (s *Server) warmup(ctx context.Context) {
+	log.Info("Warming up backend", "prompt", s.WarmupParams.Prompt, "width", s.WarmupParams.Width, "height", s.WarmupParams.Height)
+	start := time.Now()
+	if _, err := s.client.Generate(ctx, s.WarmupParams.Payload(), nil); err != nil {
+		log.Warn("Backend warmup failed", "error", err)
+		return
 	}
-	return val, nil
+	log.Info("Backend warmup complete", "duration", time.Since(start).Round(time.Millisecond))
 }
 
-func parseFormFloat(field string, min, max float64) (float64, error) {
-	// Helper function to parse form values as floats with min/max constraints
-	valStr := field
-	val, err := strconv.ParseFloat(valStr, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid float: %s", valStr)
+func (s *Server) setupMiddleware() {
+	s.Echo.HTTPErrorHandler = s.handleError
+	s.Echo.Use(middleware.RequestID())
+	s.Echo.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogStatus:    true,
+		LogURI:       true,
+		LogError:     true,
+		LogRequestID: true,
+		HandleError:  true, // forwards error to the global error handler, so it can decide appropriate status code
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			if v.Error == nil {
+				log.Info("REQUEST", "client", c.RealIP(), "uri", v.URI, "status", v.Status, "request_id", v.RequestID)
+			} else {
+				log.Error("REQUEST_ERROR", "client", c.RealIP(), "uri", v.URI, "status", v.Status, "request_id", v.RequestID, "err", v.Error.Error())
+			}
+			return nil
+		},
+	}))
+
+	s.Echo.Use(middleware.Recover())
+	if !s.NoCompression {
+		s.Echo.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+			Skipper:   skipCompression,
+			MinLength: s.CompressionMinBytes,
+		}))
 	}
-	if val < min || val > max {
-		return 0, fmt.Errorf("value out of range: %f (expected between %f and %f)", val, min, max)
+	s.Echo.Use(s.localize)
+	s.Echo.Use(s.session)
+	s.Echo.Use(s.csrf())
+}
+
+func (s *Server) index(c echo.Context) error {
+	form := s.formDefaults(c)
+	data := map[string]any{
+		"limits":         s.modelLimits(form["model"]),
+		"general_limits": s.currentLimits(),
+		"model_settings": s.modelSettings(),
+		"models":         s.AvailableModels,
+		"default_model":  s.DefaultModel,
+		"examples":       s.exampleChips(),
+		"form":           form,
+		"autosubmit":     c.QueryParam("autosubmit") == "1",
+		"blocking":       s.BlockingSubmit,
+		"maintenance":    s.maintenance.Load(),
+		"gallery":        s.archive != nil,
+		"lang":           locale(c),
+		"locales":        s.catalog.Locales(),
+		"webp":           imaging.WebP.Supported(),
 	}
-	return val, nil
+	return c.Render(http.StatusOK, "index.html", data)
 }
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The server loads its templates relative to the working directory,
+	// which is the repository root when it is run.
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeBackend is a Flue backend answering generations with a small PNG.
+type fakeBackend struct {
+	*httptest.Server
+	// Delay is how long each generation takes.
+	Delay time.Duration
+	// Steps is the number of progress updates streamed before the result
+	// when the payload asks for a stream.
+	Steps int
+
+	// received gets a value as each generation request arrives, and
+	// finished as each response has been written.
+	received chan struct{}
+	finished chan struct{}
+}
+
+// newFakeBackend starts a fake backend taking delay for each generation,
+// stopped when the test ends.
+func newFakeBackend(t *testing.T, delay time.Duration) *fakeBackend {
+	t.Helper()
+	b := &fakeBackend{
+		Delay:    delay,
+		Steps:    3,
+		received: make(chan struct{}, 16),
+		finished: make(chan struct{}, 16),
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *fakeBackend) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != generationsPath {
+		http.NotFound(w, r)
+		return
+	}
+	var payload map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.received <- struct{}{}
+	defer func() { b.finished <- struct{}{} }()
+
+	enc := json.NewEncoder(w)
+	if payload["stream"] == true {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 1; i <= b.Steps; i++ {
+			time.Sleep(b.Delay / time.Duration(b.Steps))
+			enc.Encode(map[string]any{"step": i, "total": b.Steps})
+			w.(http.Flusher).Flush()
+		}
+	} else {
+		time.Sleep(b.Delay)
+	}
+	enc.Encode(map[string]any{"image": testPNG(8, 8), "gen_time": 0.5, "seed": 42})
+}
+
+// generationsPath is the backend endpoint generations are posted to.
+const generationsPath = "/v1/images/generations"
+
+// testPNG returns a base64-encoded PNG gradient of the given size.
+func testPNG(width, height int) string {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// testServer is a Server running on a loopback port.
+type testServer struct {
+	*Server
+	URL string
+
+	cancel context.CancelFunc
+	// stopped is closed once Run has returned err.
+	stopped chan struct{}
+	err     error
+}
+
+// startServer runs a server sending generations to backend, configured by
+// configure before it starts. It is shut down when the test ends, unless
+// the test does so itself.
+func startServer(t *testing.T, backend string, configure func(s *Server)) *testServer {
+	t.Helper()
+	s, err := New("127.0.0.1", 1, []string{backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DrainDelay = 0
+	s.DrainTimeout = 5 * time.Second
+	if configure != nil {
+		configure(s)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Echo.Listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &testServer{Server: s, URL: "http://" + l.Addr().String(), cancel: cancel, stopped: make(chan struct{})}
+	go func() {
+		ts.err = s.Run(ctx, cancel)
+		close(ts.stopped)
+	}()
+	t.Cleanup(func() {
+		ts.shutdown()
+		if err := ts.wait(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Wait for the routes to be registered.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				return ts
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shutdown cancels the context of Run, as an interrupt would. It first
+// closes the idle client connections, since one the client dialed but never
+// sent a request on holds up the server's shutdown for seconds.
+func (ts *testServer) shutdown() {
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	ts.cancel()
+}
+
+// wait waits for Run to return and returns its error.
+func (ts *testServer) wait() error {
+	select {
+	case <-ts.stopped:
+		return ts.err
+	case <-time.After(10 * time.Second):
+		return errors.New("server did not shut down")
+	}
+}
+
+// generationForm returns the form of a small generation of prompt.
+func generationForm(prompt string) url.Values {
+	return url.Values{
+		"prompt":         {prompt},
+		"width":          {"64"},
+		"height":         {"64"},
+		"num_steps":      {"4"},
+		"guidance_scale": {"1"},
+	}
+}
+
+// postRequest returns a request posting form to path with the given
+// headers.
+func (ts *testServer) postRequest(path string, form url.Values, header http.Header) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return req
+}
+
+// post posts form to path with the given headers.
+func (ts *testServer) post(t *testing.T, path string, form url.Values, header http.Header) *http.Response {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(ts.postRequest(path, form, header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// sessionCookie keeps the anonymous session a browser's images and jobs
+// belong to when PerUserGalleries is set.
+const sessionCookie = "session"
+
+// sessionMaxAge is how long a session lasts without generating anything.
+const sessionMaxAge = 400 * 24 * time.Hour
+
+// sessionKey is the context key holding the owner of the request's session.
+const sessionKey = "session"
+
+// sessionSecretKey is the key under which a generated session secret is
+// persisted.
+const sessionSecretKey = "session_secret"
+
+// sessionPattern matches the session IDs newToken returns.
+var sessionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{27}$`)
+
+// newToken returns a random token, long enough not to be guessed.
+func newToken() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// session assigns each browser a long-lived anonymous session through a
+// cookie, if PerUserGalleries is set, so casual users keep their own
+// gallery and history without logging in.
+func (s *Server) session(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !s.PerUserGalleries {
+			return next(c)
+		}
+		id := ""
+		if cookie, err := c.Cookie(sessionCookie); err == nil && sessionPattern.MatchString(cookie.Value) {
+			id = cookie.Value
+		} else {
+			id = newToken()
+		}
+		// Renew the cookie on every visit, so only abandoned sessions end.
+		c.SetCookie(&http.Cookie{
+			Name:     sessionCookie,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(sessionMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   c.Scheme() == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		c.Set(sessionKey, s.sessionOwner(id))
+		return next(c)
+	}
+}
+
+// sessionOwner returns the owner images and jobs of the session id are
+// stored under: a digest of the ID, since the ID itself lets whoever holds it
+// act as the session, and stored owners end up in sidecars, exports and
+// download manifests.
+func (s *Server) sessionOwner(id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// loadSessionSecret sets the key sessionOwner digests session IDs with:
+// SessionSecret, or else a random key persisted in the store, if it can keep
+// one, so sessions keep their images and jobs across restarts.
+func (s *Server) loadSessionSecret(store jobs.Store) {
+	if s.SessionSecret != "" {
+		s.sessionSecret = []byte(s.SessionSecret)
+		return
+	}
+	meta, ok := store.(jobs.MetaStore)
+	if ok {
+		data, err := meta.LoadMeta(sessionSecretKey)
+		if err != nil {
+			log.Warn("Failed to load session secret", "error", err)
+		} else if data != nil {
+			s.sessionSecret = data
+			return
+		}
+	}
+	s.sessionSecret = []byte(newToken())
+	if !ok {
+		if s.PerUserGalleries {
+			log.Warn("Sessions lose their images on restart without a session secret or a job store")
+		}
+		return
+	}
+	if err := meta.SaveMeta(sessionSecretKey, s.sessionSecret); err != nil {
+		log.Warn("Failed to save session secret", "error", err)
+	}
+}
+
+// owner returns the owner of the session of a request, or "" if
+// PerUserGalleries is not set.
+func (s *Server) owner(c echo.Context) string {
+	id, _ := c.Get(sessionKey).(string)
+	return id
+}
+
+// ownerKey is the context key carrying the session a generation runs for.
+type ownerKey struct{}
+
+// withOwner returns ctx carrying the session a generation runs for, which
+// its archived images are assigned to.
+func withOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// ownerFrom returns the session carried by ctx, if any.
+func ownerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
+
+// owns reports whether the request's session may manage an archived image
+// or job of owner. Without PerUserGalleries, everything is shared.
+func (s *Server) owns(c echo.Context, owner string) bool {
+	return !s.PerUserGalleries || owner == s.owner(c)
+}
+
+// submitted reports whether the request comes from whoever submitted an
+// archived image or job from client for owner: with PerUserGalleries its
+// session, and otherwise its IP.
+func (s *Server) submitted(c echo.Context, client, owner string) bool {
+	if s.PerUserGalleries {
+		return s.owns(c, owner)
+	}
+	return client == c.RealIP()
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// sessionClient returns a client keeping its own session cookie.
+func sessionClient(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// do sends req with client and returns the response status, decoding a
+// JSON body into v if it is not nil.
+func do(t *testing.T, client *http.Client, req *http.Request, v any) int {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestOtherSessionsCannotManage(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, func(s *Server) {
+		withAdmin(s)
+		s.PerUserGalleries = true
+	})
+	owner, other := sessionClient(t), sessionClient(t)
+	accept := http.Header{"Accept": {"application/json"}}
+
+	t.Run("gallery image", func(t *testing.T) {
+		var result struct{ ID string }
+		if status := do(t, owner, ts.postRequest("/", generationForm("a lighthouse"), accept), &result); status != http.StatusOK {
+			t.Fatalf("generation status = %d", status)
+		}
+		get := func(client *http.Client) int {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/gallery/"+result.ID, nil)
+			return do(t, client, req, nil)
+		}
+		if status := get(other); status != http.StatusNotFound {
+			t.Errorf("other session got status %d, want %d", status, http.StatusNotFound)
+		}
+		if status := get(owner); status != http.StatusOK {
+			t.Errorf("owner got status %d, want %d", status, http.StatusOK)
+		}
+	})
+
+	t.Run("cancel job", func(t *testing.T) {
+		var job struct{ ID string }
+		if status := do(t, owner, ts.postRequest("/jobs", generationForm("a lighthouse"), accept), &job); status != http.StatusAccepted {
+			t.Fatalf("submit status = %d", status)
+		}
+		cancel := func(client *http.Client) int {
+			req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/"+job.ID, nil)
+			req.Header.Set("Accept", "application/json")
+			return do(t, client, req, nil)
+		}
+		if status := cancel(other); status != http.StatusNotFound {
+			t.Errorf("other session got status %d, want %d", status, http.StatusNotFound)
+		}
+		if status := cancel(owner); status != http.StatusOK {
+			t.Errorf("owner got status %d, want %d", status, http.StatusOK)
+		}
+	})
+	t.Run("job status", func(t *testing.T) {
+		var job struct{ ID string }
+		if status := do(t, owner, ts.postRequest("/jobs", generationForm("a harbor"), accept), &job); status != http.StatusAccepted {
+			t.Fatalf("submit status = %d", status)
+		}
+		for _, path := range []string{"/jobs/" + job.ID, "/jobs/" + job.ID + "/fragment", "/jobs/" + job.ID + "/events"} {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			req.Header.Set("Accept", "application/json")
+			if status := do(t, other, req, nil); status != http.StatusNotFound {
+				t.Errorf("GET %s: other session got status %d, want %d", path, status, http.StatusNotFound)
+			}
+		}
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+job.ID, nil)
+		req.Header.Set("Accept", "application/json")
+		if status := do(t, owner, req, nil); status != http.StatusOK {
+			t.Errorf("owner got status %d, want %d", status, http.StatusOK)
+		}
+		req = adminRequest(t, http.MethodGet, ts.URL+"/jobs/"+job.ID, nil)
+		req.Header.Set("Accept", "application/json")
+		if status := do(t, http.DefaultClient, req, nil); status != http.StatusOK {
+			t.Errorf("administrator got status %d, want %d", status, http.StatusOK)
+		}
+	})
+
+	t.Run("duplicate submissions", func(t *testing.T) {
+		// Both sessions share an address, but not their jobs.
+		var first, second struct{ ID string }
+		do(t, owner, ts.postRequest("/jobs", generationForm("a windmill"), accept), &first)
+		do(t, other, ts.postRequest("/jobs", generationForm("a windmill"), accept), &second)
+		if first.ID == "" || first.ID == second.ID {
+			t.Errorf("sessions got jobs %q and %q, want different ones", first.ID, second.ID)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		var session string
+		u, _ := url.Parse(ts.URL)
+		for _, cookie := range owner.Jar.Cookies(u) {
+			if cookie.Name == sessionCookie {
+				session = cookie.Value
+			}
+		}
+		// listed returns the prompts of the jobs listed, by their IDs.
+		listed := func(client *http.Client, req *http.Request) map[string]string {
+			req.Header.Set("Accept", "application/json")
+			var list struct {
+				Jobs []struct{ ID, Prompt string }
+			}
+			if status := do(t, client, req, &list); status != http.StatusOK {
+				t.Fatalf("GET %s: status %d", req.URL, status)
+			}
+			prompts := make(map[string]string)
+			for _, job := range list.Jobs {
+				prompts[job.ID] = job.Prompt
+			}
+			return prompts
+		}
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/jobs", nil)
+		if jobs := listed(other, req); len(jobs) != 1 {
+			t.Errorf("other session lists %v, want only its own job", jobs)
+		}
+		if all := listed(http.DefaultClient, adminRequest(t, http.MethodGet, ts.URL+"/admin/history", nil)); len(all) != 4 {
+			t.Errorf("administrator lists %v, want the jobs of both sessions", all)
+		}
+		if mine := listed(http.DefaultClient, adminRequest(t, http.MethodGet, ts.URL+"/admin/history?owner="+session, nil)); len(mine) != 3 {
+			t.Errorf("administrator lists %v for the owner, want its 3 jobs", mine)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		form := generationForm("")
+		form.Set("prompts", "a lighthouse\na harbor")
+		// Forms are redirected to the status of the batch.
+		var batch struct{ ID string }
+		if status := do(t, owner, ts.postRequest("/batches", form, accept), &batch); status != http.StatusOK {
+			t.Fatalf("submit status = %d", status)
+		}
+		for _, path := range []string{"/batches/" + batch.ID, "/batches/" + batch.ID + "/download.zip"} {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			req.Header.Set("Accept", "application/json")
+			if status := do(t, other, req, nil); status != http.StatusNotFound {
+				t.Errorf("GET %s: other session got status %d, want %d", path, status, http.StatusNotFound)
+			}
+		}
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/batches/"+batch.ID, nil)
+		req.Header.Set("Accept", "application/json")
+		if status := do(t, owner, req, nil); status != http.StatusOK {
+			t.Errorf("owner got status %d, want %d", status, http.StatusOK)
+		}
+	})
+
+	t.Run("selection download", func(t *testing.T) {
+		var result struct{ ID string }
+		if status := do(t, owner, ts.postRequest("/", generationForm("a lighthouse"), accept), &result); status != http.StatusOK {
+			t.Fatalf("generation status = %d", status)
+		}
+		// manifest returns the manifest of the selection client downloads.
+		manifest := func(client *http.Client) bundleManifest {
+			resp, err := client.Do(ts.postRequest("/download.zip", url.Values{"id": {result.ID}}, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m bundleManifest
+			for _, f := range zr.File {
+				if f.Name == "manifest.json" {
+					r, _ := f.Open()
+					err = json.NewDecoder(r).Decode(&m)
+					r.Close()
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+		if m := manifest(other); len(m.Images) != 0 || len(m.Skipped) != 1 || m.Skipped[0].Reason != "image not found" {
+			t.Errorf("other session got images %v, skipped %v, want the image not found", m.Images, m.Skipped)
+		}
+		if m := manifest(owner); len(m.Images) != 1 {
+			t.Errorf("owner got images %v, skipped %v, want the image", m.Images, m.Skipped)
+		}
+	})
+}
+
+func TestSessionIDsAreNotStored(t *testing.T) {
+	backend := newFakeBackend(t, 0)
+	ts := startServer(t, backend.URL, func(s *Server) {
+		withAdmin(s)
+		s.PerUserGalleries = true
+	})
+	owner := sessionClient(t)
+	var result struct{ ID string }
+	if status := do(t, owner, ts.postRequest("/", generationForm("a lighthouse"), http.Header{"Accept": {"application/json"}}), &result); status != http.StatusOK {
+		t.Fatalf("generation status = %d", status)
+	}
+	var session string
+	u, _ := url.Parse(ts.URL)
+	for _, cookie := range owner.Jar.Cookies(u) {
+		if cookie.Name == sessionCookie {
+			session = cookie.Value
+		}
+	}
+
+	meta, err := ts.archive.Metadata(context.Background(), result.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner == "" || meta.Owner == session {
+		t.Errorf("image owner = %q, want a digest of session %q", meta.Owner, session)
+	}
+
+	resp, err := owner.Do(ts.postRequest("/download.zip", url.Values{"id": {result.ID}}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "manifest.json" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, _ := io.ReadAll(r)
+		r.Close()
+		if strings.Contains(string(manifest), meta.Owner) || strings.Contains(string(manifest), session) {
+			t.Errorf("manifest shows the owner:\n%s", manifest)
+		}
+	}
+}
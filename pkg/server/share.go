@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/url"
+	"strconv"
+
+	"flue-frontend/pkg/imaging"
+	"flue-frontend/pkg/params"
+
+	"github.com/labstack/echo/v4"
+)
+
+// formFields are the request parameters that can be prefilled on the index
+// page from the query string.
+var formFields = []string{
+	"prompt", "model", "width", "height", "num_steps", "guidance_scale",
+	"seed", "tiling", "format", "quality",
+}
+
+// formDefaults returns the index form values, starting from the built-in
+// defaults and the browser's preferred size, and overridden by any
+// parameters in the query string.
+func (s *Server) formDefaults(c echo.Context) map[string]string {
+	form := map[string]string{
+		"prompt":         "A futuristic cybercat",
+		"model":          s.DefaultModel,
+		"width":          "512",
+		"height":         "384",
+		"num_steps":      "4",
+		"guidance_scale": "0.0",
+		"format":         string(imaging.PNG),
+	}
+	prefs := s.prefs(c)
+	if prefs.Width > 0 {
+		form["width"] = strconv.Itoa(prefs.Width)
+	}
+	if prefs.Height > 0 {
+		form["height"] = strconv.Itoa(prefs.Height)
+	}
+	query := c.QueryParams()
+	for _, name := range formFields {
+		if query.Has(name) {
+			form[name] = query.Get(name)
+		}
+	}
+	if m, ok := s.ModelDefaults[form["model"]]; ok {
+		if m.Steps > 0 && !query.Has("num_steps") {
+			form["num_steps"] = strconv.Itoa(m.Steps)
+		}
+		if m.Guidance != nil && !query.Has("guidance_scale") {
+			form["guidance_scale"] = strconv.FormatFloat(*m.Guidance, 'f', -1, 64)
+		}
+	}
+	if f, err := imaging.ParseFormat(form["format"]); err == nil {
+		form["format"] = string(f)
+	}
+	return form
+}
+
+// shareURL returns an index page URL that prefills the form with p.
+func shareURL(p params.Params) string {
+	return formURL(formValues(p))
+}
+
+// formValues returns the index form values that reproduce p.
+func formValues(p params.Params) map[string]string {
+	form := map[string]string{
+		"prompt":         p.Prompt,
+		"width":          strconv.Itoa(p.Width),
+		"height":         strconv.Itoa(p.Height),
+		"num_steps":      strconv.Itoa(p.Steps),
+		"guidance_scale": strconv.FormatFloat(p.Guidance, 'f', -1, 64),
+		"format":         string(p.Format),
+	}
+	if p.Model != "" {
+		form["model"] = p.Model
+	}
+	if p.Seed != nil {
+		form["seed"] = strconv.Itoa(*p.Seed)
+	}
+	if p.Tiling {
+		form["tiling"] = "1"
+	}
+	if p.Format.Lossy() {
+		form["quality"] = strconv.Itoa(p.Quality)
+	}
+	return form
+}
+
+// formURL returns an index page URL that prefills the form with form.
+func formURL(form map[string]string) string {
+	q := url.Values{}
+	for name, v := range form {
+		q.Set(name, v)
+	}
+	return "/?" + q.Encode()
+}
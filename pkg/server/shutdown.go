@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// drainRetryAfter is the Retry-After, in seconds, sent to submissions
+// refused during shutdown, by which time a restarted server should be up.
+const drainRetryAfter = 10
+
+// refuseWhileDraining is middleware rejecting new generations with 503 once
+// shutdown has started, rather than racing them against it.
+func (s *Server) refuseWhileDraining(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !s.draining.Load() {
+			return next(c)
+		}
+		c.Response().Header().Set("Retry-After", strconv.Itoa(drainRetryAfter))
+		return s.jobError(c, errorf(http.StatusServiceUnavailable, "The server is restarting, please try again shortly"))
+	}
+}
+
+// shutdown stops accepting generations and readiness checks at once and
+// ends open event streams, which would otherwise hold the server up until
+// DrainTimeout. Jobs still waiting leave the queues to be resumed on the
+// next start. It keeps answering for DrainDelay so load balancers notice,
+// then shuts the HTTP server down, letting in-flight requests and running
+// jobs finish within DrainTimeout, before Run closes the stores they write
+// to.
+func (s *Server) shutdown() error {
+	s.draining.Store(true)
+	close(s.stopping)
+	log.Info("Shutting down server...", "drain_delay", s.DrainDelay, "drain_timeout", s.DrainTimeout)
+	time.Sleep(s.DrainDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+	if err := s.Echo.Shutdown(ctx); err != nil {
+		log.Error("Failed to shutdown server", "error", err)
+		return err
+	}
+	if err := s.waitForJobs(ctx); err != nil {
+		log.Error("Failed to finish running jobs", "error", err)
+		return err
+	}
+	log.Info("Server shutdown complete")
+	return nil
+}
+
+// waitForJobs waits for the goroutines working on jobs to return, or for
+// ctx to be done.
+func (s *Server) waitForJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.jobWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+)
+
+func TestRunDrainsInFlightRequests(t *testing.T) {
+	backend := newFakeBackend(t, time.Second)
+	ts := startServer(t, backend.URL, nil)
+
+	// Follow the progress of the generation, which streams until shutdown.
+	stream, err := http.Get(ts.URL + "/progress/drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		form := generationForm("in flight")
+		form.Set("progress_id", "drain")
+		req := ts.postRequest("/", form, http.Header{"Accept": {"application/json"}})
+		resp, err := http.DefaultClient.Do(req)
+		inFlight <- result{resp, err}
+	}()
+
+	select {
+	case <-backend.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation did not reach the backend")
+	}
+	ts.shutdown()
+
+	if err := ts.wait(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// Run returns once the HTTP server is shut down, which waits for the
+	// in-flight generation to be answered but not for the event stream.
+	select {
+	case <-backend.finished:
+	default:
+		t.Fatal("Run returned before the in-flight generation finished")
+	}
+	if _, err := io.Copy(io.Discard, stream.Body); err != nil {
+		t.Errorf("progress stream did not end cleanly: %v", err)
+	}
+
+	r := <-inFlight
+	if r.err != nil {
+		t.Fatalf("in-flight request failed: %v", r.err)
+	}
+	defer r.resp.Body.Close()
+	if r.resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want %d", r.resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestShutdownRefusesNewGenerations(t *testing.T) {
+	backend := newFakeBackend(t, 1500*time.Millisecond)
+	ts := startServer(t, backend.URL, func(s *Server) {
+		s.DrainDelay = time.Second
+	})
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		req := ts.postRequest("/", generationForm("in flight"), http.Header{"Accept": {"application/json"}})
+		resp, err := http.DefaultClient.Do(req)
+		inFlight <- result{resp, err}
+	}()
+	select {
+	case <-backend.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation did not reach the backend")
+	}
+	ts.shutdown()
+
+	// Readiness fails while the server still answers.
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/healthz")
+		if err != nil {
+			t.Fatalf("health check during drain: %v", err)
+		}
+		var health struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable && health.Status == "draining" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health status = %d %q, want 503 draining", resp.StatusCode, health.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"JSON", http.Header{"Accept": {"application/json"}}, `"error":"The server is restarting`},
+		{"HTMX", http.Header{"Hx-Request": {"true"}, "Hx-Trigger": {"promptForm"}}, "The server is restarting"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := ts.post(t, "/", generationForm("late"), tc.header)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+			}
+			if got := resp.Header.Get("Retry-After"); got == "" {
+				t.Error("Retry-After is missing")
+			}
+			if !strings.Contains(string(body), tc.want) {
+				t.Errorf("body %q does not contain %q", body, tc.want)
+			}
+		})
+	}
+
+	if err := ts.wait(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	r := <-inFlight
+	if r.err != nil {
+		t.Fatalf("in-flight request failed: %v", r.err)
+	}
+	defer r.resp.Body.Close()
+	if r.resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want %d", r.resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	flue := newFakeBackend(t, 0)
+	ts := startServer(t, flue.URL, nil)
+
+	resp, err := http.Get(ts.URL + "/progress/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	start := time.Now()
+	ts.shutdown()
+	if err := ts.wait(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= ts.DrainTimeout {
+		t.Errorf("Run returned after %v, held up by the open stream", elapsed)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("event stream did not end cleanly: %v", err)
+	}
+}
+
+func TestShutdownWaitsForRunningJobs(t *testing.T) {
+	backend := newFakeBackend(t, time.Second)
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	ts := startServer(t, backend.URL, func(s *Server) {
+		s.JobStore = path
+		s.MaxConcurrent = 1
+	})
+
+	submit := func(prompt string) string {
+		resp := ts.post(t, "/jobs", generationForm(prompt), http.Header{"Accept": {"application/json"}})
+		defer resp.Body.Close()
+		var job struct{ ID string }
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		return job.ID
+	}
+	running := submit("running")
+	select {
+	case <-backend.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not reach the backend")
+	}
+	queued := submit("queued")
+	ts.shutdown()
+	if err := ts.wait(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// The store is closed once Run returns, holding the running job done
+	// and the queued one still queued for the next start.
+	store, err := jobs.OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]jobs.Status)
+	for _, j := range stored {
+		status[j.ID] = j.Status
+	}
+	if status[running] != jobs.Done {
+		t.Errorf("running job is %q, want %q", status[running], jobs.Done)
+	}
+	if status[queued] != jobs.Queued {
+		t.Errorf("queued job is %q, want %q", status[queued], jobs.Queued)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/events"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// statusTopic is the event broker topic of backend status changes.
+const statusTopic = "backends"
+
+// backendHealth is the state of a backend as seen by the readiness check.
+type backendHealth struct {
+	URL      string `json:"url"`
+	State    string `json:"state"`
+	InFlight int64  `json:"in_flight"`
+}
+
+// up reports whether the backend can take generations.
+func (h backendHealth) up() bool {
+	return h.State != backend.StateOpen.String() && h.State != "unreachable"
+}
+
+// backendProbes holds the outcome of the latest health poll of each backend.
+type backendProbes struct {
+	mu          sync.Mutex
+	unreachable map[string]bool
+}
+
+func (p *backendProbes) set(url string, unreachable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unreachable == nil {
+		p.unreachable = make(map[string]bool)
+	}
+	p.unreachable[url] = unreachable
+}
+
+func (p *backendProbes) get(url string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unreachable[url]
+}
+
+// backendHealth returns the state of every backend, combining its circuit
+// breaker with the latest health poll, and "ok" if any of them is up or
+// "unavailable" otherwise.
+func (s *Server) backendHealth() (string, []backendHealth) {
+	var backends []backendHealth
+	status := "unavailable"
+	for _, b := range s.client.Backends() {
+		h := backendHealth{URL: b.URL, State: b.Breaker.State().String(), InFlight: b.InFlight()}
+		if h.State != backend.StateOpen.String() && s.probes.get(b.URL) {
+			h.State = "unreachable"
+		}
+		if h.up() {
+			status = "ok"
+		}
+		backends = append(backends, h)
+	}
+	return status, backends
+}
+
+// statusChange is the event published when a backend goes up or down.
+type statusChange struct {
+	URL      string    `json:"url"`
+	State    string    `json:"state"`
+	Previous string    `json:"previous"`
+	Up       bool      `json:"up"`
+	Status   string    `json:"status"`
+	At       time.Time `json:"at"`
+}
+
+// pollHealth probes the backends every HealthPollInterval until ctx is done,
+// publishing an event whenever one goes up or down.
+func (s *Server) pollHealth(ctx context.Context) {
+	if s.HealthPollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.HealthPollInterval)
+	defer ticker.Stop()
+
+	_, initial := s.backendHealth()
+	up := make(map[string]backendHealth, len(initial))
+	for _, h := range initial {
+		up[h.URL] = h
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, b := range s.client.Backends() {
+			probeCtx, cancel := context.WithTimeout(ctx, s.HealthPollInterval)
+			err := s.client.Ping(probeCtx, b)
+			cancel()
+			s.probes.set(b.URL, err != nil)
+		}
+
+		status, backends := s.backendHealth()
+		for _, h := range backends {
+			prev := up[h.URL]
+			up[h.URL] = h
+			if prev.up() == h.up() {
+				continue
+			}
+			if h.up() {
+				log.Info("Backend recovered", "backend", h.URL, "state", h.State)
+			} else {
+				log.Warn("Backend down", "backend", h.URL, "state", h.State)
+			}
+			data, _ := json.Marshal(statusChange{URL: h.URL, State: h.State, Previous: prev.State, Up: h.up(), Status: status, At: time.Now()})
+			s.progress.Publish(statusTopic, events.Event{Name: "backend-status", Data: string(data)})
+		}
+	}
+}
+
+// statusPage renders the backend states, showing a toast for every change
+// while open.
+func (s *Server) statusPage(c echo.Context) error {
+	status, backends := s.backendHealth()
+	return c.Render(http.StatusOK, "status.html", map[string]any{
+		"status":   status,
+		"backends": backends,
+		"lang":     locale(c),
+	})
+}
+
+// statusEvents streams backend status changes as server-sent events.
+func (s *Server) statusEvents(c echo.Context) error {
+	ch, unsubscribe := s.progress.Subscribe(statusTopic)
+	defer unsubscribe()
+	return s.streamEvents(c, ch)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/store"
+)
+
+// Image stores selectable with ImageStore.
+const (
+	// StoreDisk keeps images in OutputDir, or none at all if it is empty.
+	StoreDisk = "disk"
+	// StoreMemory keeps images in memory until the server restarts.
+	StoreMemory = "memory"
+	// StoreS3 keeps images in the S3 compatible bucket configured in S3.
+	StoreS3 = "s3"
+)
+
+// openImageStore returns the configured image store, keeping the metadata of
+// images on disk in records, or nil if generated images are not kept.
+func (s *Server) openImageStore(ctx context.Context, records store.Store) (archive.ImageStore, error) {
+	switch s.ImageStore {
+	case "", StoreDisk:
+		if s.OutputDir == "" {
+			return nil, nil
+		}
+		dir, err := archive.OpenDir(ctx, s.OutputDir, records)
+		if err != nil {
+			return nil, err
+		}
+		return dir, nil
+	case StoreS3:
+		blobs, err := archive.NewS3(ctx, s.S3)
+		if err != nil {
+			return nil, err
+		}
+		return archive.Open(ctx, blobs, records)
+	case StoreMemory:
+		// The images are gone after a restart, so their records must not
+		// outlive them in a database.
+		return archive.NewMemory(nil), nil
+	}
+	return nil, fmt.Errorf("unknown image store: %s", s.ImageStore)
+}
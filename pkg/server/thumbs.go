@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"flue-frontend/pkg/archive"
+	"flue-frontend/pkg/imaging"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// thumbnailQuality is the encoder quality of lossy thumbnails.
+const thumbnailQuality = 80
+
+// thumbnailPlaceholder is served in place of thumbnails that cannot be made.
+const thumbnailPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256" viewBox="0 0 256 256"><rect width="256" height="256" fill="#6c757d"/></svg>`
+
+// thumbnailVariant names the thumbnails of the configured size and format,
+// so changing either does not serve stale ones.
+func (s *Server) thumbnailVariant() string {
+	return fmt.Sprintf("%d.%s", s.ThumbnailSize, s.ThumbnailFormat)
+}
+
+// thumbnail serves a small version of an archived image, rendering it on the
+// first request and keeping it next to the original. Concurrent first
+// requests share a single rendering.
+func (s *Server) thumbnail(c echo.Context) error {
+	if s.archive == nil {
+		return s.pageError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	id := c.Param("id")
+	meta, err := s.archivedMetadata(c, id)
+	if err != nil {
+		return s.pageError(c, err)
+	}
+	variant := s.thumbnailVariant()
+	v, err, _ := s.thumbnails.Do(id+"."+variant, func() (any, error) {
+		// The rendering is shared, so it must not stop when the request
+		// that started it goes away.
+		return s.loadThumbnail(context.WithoutCancel(c.Request().Context()), id, variant)
+	})
+	if errors.Is(err, archive.ErrNotFound) {
+		return s.pageError(c, errorf(http.StatusNotFound, "Image not found"))
+	}
+	if err != nil {
+		log.Error("Failed to render thumbnail", "id", id, "error", err)
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.Blob(http.StatusOK, "image/svg+xml", []byte(thumbnailPlaceholder))
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, imaging.Format(s.ThumbnailFormat).MIMEType())
+	h.Set("ETag", `"`+id+"-"+variant+`"`)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(c.Response(), c.Request(), "", meta.CreatedAt, bytes.NewReader(v.([]byte)))
+	return nil
+}
+
+// loadThumbnail returns the stored thumbnail of an archived image, rendering
+// and storing it if there is none yet.
+func (s *Server) loadThumbnail(ctx context.Context, id, variant string) ([]byte, error) {
+	thumb, err := s.archive.Thumbnail(ctx, id, variant)
+	if err == nil {
+		return thumb, nil
+	}
+	if !errors.Is(err, archive.ErrNotFound) {
+		log.Warn("Failed to read thumbnail, rendering it again", "id", id, "error", err)
+	}
+
+	data, _, err := s.archive.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode original: %w", err)
+	}
+	small, _ := imaging.Fit(img, s.ThumbnailSize)
+	thumb, err = imaging.Encode(small, imaging.Format(s.ThumbnailFormat), thumbnailQuality)
+	if err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+	if err := s.archive.SaveThumbnail(ctx, id, variant, thumb); err != nil {
+		log.Warn("Failed to store thumbnail", "id", id, "error", err)
+	}
+	return thumb, nil
+}
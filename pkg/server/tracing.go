@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"flue-frontend/pkg/params"
+	"flue-frontend/pkg/tracing"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("flue-frontend/pkg/server")
+
+// traceRequest is middleware wrapping a generation request in a span,
+// continuing the trace of a caller that sent a traceparent header.
+func (s *Server) traceRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+c.Path(), trace.WithSpanKind(trace.SpanKindServer))
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		status := c.Response().Status
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if err == nil && status >= http.StatusBadRequest {
+			err = fmt.Errorf("responded with status %d", status)
+		}
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// paramAttributes describes p in span attributes. The prompt is only
+// described by its length.
+func paramAttributes(p params.Params) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("flue.prompt_length", len(p.Prompt)),
+		attribute.Int("flue.width", p.Width),
+		attribute.Int("flue.height", p.Height),
+		attribute.Int("flue.steps", p.Steps),
+		attribute.Float64("flue.guidance", p.Guidance),
+		attribute.String("flue.model", p.Model),
+		attribute.Bool("flue.tiling", p.Tiling),
+		attribute.String("flue.format", string(p.Format)),
+		attribute.String("flue.params_hash", p.Hash()),
+	}
+	if p.Seed != nil {
+		attrs = append(attrs, attribute.Int("flue.seed", *p.Seed))
+	}
+	return attrs
+}
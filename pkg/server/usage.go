@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"flue-frontend/pkg/backend"
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/store"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+)
+
+// outcomesKey is the key under which generation outcomes are persisted.
+const outcomesKey = "generation_outcomes"
+
+// usageDays is the number of days the usage statistics count generations
+// for, today included.
+const usageDays = 30
+
+// usageTop is the number of most used dimensions and step counts listed.
+const usageTop = 5
+
+// usageCacheTTL is how long the usage statistics read from the archive are
+// reused before they are read again.
+const usageCacheTTL = time.Minute
+
+// Classes of failed generations.
+const (
+	failureUnavailable = "unavailable"
+	failureTimeout     = "timeout"
+	failureOversized   = "oversized"
+	failureRejected    = "rejected"
+	failureBackend     = "backend_error"
+	failureNoImage     = "no_image"
+	failureOther       = "other"
+)
+
+// failureLabels describe the failure classes on the statistics page.
+var failureLabels = map[string]string{
+	failureUnavailable: "No backend available",
+	failureTimeout:     "Timed out",
+	failureOversized:   "Oversized response",
+	failureRejected:    "Rejected by the backend",
+	failureBackend:     "Backend error",
+	failureNoImage:     "No image returned",
+	failureOther:       "Other error",
+}
+
+// failureClass returns the class of an error returned by the backends, or
+// "" for a generation that was canceled rather than failed.
+func failureClass(err error) string {
+	var backendErr *backend.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ""
+	case errors.Is(err, backend.ErrNoBackends):
+		return failureUnavailable
+	case errors.Is(err, backend.ErrTimeout):
+		return failureTimeout
+	case errors.Is(err, backend.ErrResponseTooLarge):
+		return failureOversized
+	case errors.As(err, &backendErr) && backendErr.Rejected():
+		return failureRejected
+	case errors.As(err, &backendErr):
+		return failureBackend
+	case errors.Is(err, backend.ErrNoImage):
+		return failureNoImage
+	}
+	return failureOther
+}
+
+// outcomeCounts counts generations by outcome since a point in time.
+type outcomeCounts struct {
+	Since     time.Time        `json:"since"`
+	Succeeded int64            `json:"succeeded"`
+	Failed    map[string]int64 `json:"failed"`
+}
+
+// outcomes counts the outcomes of generations. OnChange, if set, is called
+// with a copy of the counts after every change, for persisting them.
+type outcomes struct {
+	mu     sync.Mutex
+	counts outcomeCounts
+
+	OnChange func(outcomeCounts)
+}
+
+func newOutcomes() *outcomes {
+	return &outcomes{counts: outcomeCounts{Since: time.Now(), Failed: make(map[string]int64)}}
+}
+
+// record counts the outcome of a call to the backends, a success if err is
+// nil. Canceled generations are not counted.
+func (o *outcomes) record(err error) {
+	class := ""
+	if err != nil {
+		if class = failureClass(err); class == "" {
+			return
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if class == "" {
+		o.counts.Succeeded++
+	} else {
+		o.counts.Failed[class]++
+	}
+	if o.OnChange != nil {
+		o.OnChange(o.snapshotLocked())
+	}
+}
+
+// snapshot returns a copy of the counts.
+func (o *outcomes) snapshot() outcomeCounts {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.snapshotLocked()
+}
+
+// snapshotLocked does the work of snapshot. The caller must hold o.mu.
+func (o *outcomes) snapshotLocked() outcomeCounts {
+	counts := o.counts
+	counts.Failed = make(map[string]int64, len(o.counts.Failed))
+	for class, n := range o.counts.Failed {
+		counts.Failed[class] = n
+	}
+	return counts
+}
+
+// loadOutcomes restores the generation outcomes from the store, if it can
+// keep them, and saves them there after every generation.
+func (s *Server) loadOutcomes(store jobs.Store) {
+	s.outcomes = newOutcomes()
+	meta, ok := store.(jobs.MetaStore)
+	if !ok {
+		return
+	}
+	data, err := meta.LoadMeta(outcomesKey)
+	if err != nil {
+		log.Warn("Failed to load generation outcomes", "error", err)
+	} else if data != nil {
+		var counts outcomeCounts
+		if err := json.Unmarshal(data, &counts); err != nil {
+			log.Warn("Failed to decode generation outcomes", "error", err)
+		} else {
+			if counts.Failed == nil {
+				counts.Failed = make(map[string]int64)
+			}
+			s.outcomes.counts = counts
+		}
+	}
+	s.outcomes.OnChange = func(counts outcomeCounts) {
+		data, err := json.Marshal(counts)
+		if err == nil {
+			err = meta.SaveMeta(outcomesKey, data)
+		}
+		if err != nil {
+			log.Warn("Failed to save generation outcomes", "error", err)
+		}
+	}
+}
+
+// dayCount is the number of generations on a day.
+type dayCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// failureCount is the number of generations failed for a reason.
+type failureCount struct {
+	Class string  `json:"class"`
+	Count int64   `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// usageReport summarizes the use of the instance for people rather than
+// monitoring.
+type usageReport struct {
+	// Generations is the number of archived images.
+	Generations int        `json:"generations"`
+	Daily       []dayCount `json:"daily"`
+	// MeanGenTime and P95GenTime are in seconds.
+	MeanGenTime float64       `json:"mean_gen_time"`
+	P95GenTime  float64       `json:"p95_gen_time"`
+	Sizes       []store.Count `json:"sizes"`
+	Steps       []store.Count `json:"steps"`
+	// DiskUsageBytes is the size of the stored images, counting images
+	// shared by identical generations once.
+	DiskUsageBytes int64 `json:"disk_usage_bytes"`
+
+	// OutcomesSince is when the outcomes started being counted.
+	OutcomesSince time.Time      `json:"outcomes_since"`
+	Succeeded     int64          `json:"succeeded"`
+	Failed        int64          `json:"failed"`
+	FailureRate   float64        `json:"failure_rate"`
+	Failures      []failureCount `json:"failures"`
+
+	// UpdatedAt is when the figures read from the archive were read.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// usageCache keeps the latest figures read from the archive.
+type usageCache struct {
+	mu     sync.Mutex
+	report usageReport
+}
+
+// usageStats reports how the instance has been used, as a page for
+// browsers and JSON otherwise. The figures read from the archive are reused
+// for usageCacheTTL, while the outcome counts are always current.
+func (s *Server) usageStats(c echo.Context) error {
+	report, err := s.archiveUsage(c.Request().Context())
+	if err != nil {
+		log.Error("Failed to read usage statistics", "error", err)
+		return s.jobError(c, errorf(http.StatusInternalServerError, "Failed to list images"))
+	}
+
+	counts := s.outcomes.snapshot()
+	report.OutcomesSince = counts.Since
+	report.Succeeded = counts.Succeeded
+	for _, n := range counts.Failed {
+		report.Failed += n
+	}
+	report.Failures = []failureCount{}
+	if total := report.Succeeded + report.Failed; total > 0 {
+		report.FailureRate = roundFloat(float64(report.Failed)/float64(total), 4)
+		for class, n := range counts.Failed {
+			report.Failures = append(report.Failures, failureCount{Class: class, Count: n, Rate: roundFloat(float64(n)/float64(total), 4)})
+		}
+		slices.SortFunc(report.Failures, func(a, b failureCount) int {
+			if a.Count != b.Count {
+				return int(b.Count - a.Count)
+			}
+			return strings.Compare(a.Class, b.Class)
+		})
+	}
+
+	if !s.acceptsHTML(c) {
+		return c.JSON(http.StatusOK, report)
+	}
+	type dayBar struct {
+		dayCount
+		Percent float64
+	}
+	type failureRow struct {
+		failureCount
+		Label   string
+		Percent float64
+	}
+	busiest := 0
+	for _, d := range report.Daily {
+		busiest = max(busiest, d.Count)
+	}
+	daily := make([]dayBar, len(report.Daily))
+	for i, d := range report.Daily {
+		daily[i] = dayBar{dayCount: d}
+		if busiest > 0 {
+			daily[i].Percent = roundFloat(100*float64(d.Count)/float64(busiest), 1)
+		}
+	}
+	failures := make([]failureRow, len(report.Failures))
+	for i, f := range report.Failures {
+		label, ok := failureLabels[f.Class]
+		if !ok {
+			label = failureLabels[failureOther]
+		}
+		failures[i] = failureRow{failureCount: f, Label: s.t(c, label), Percent: 100 * f.Rate}
+	}
+	return c.Render(http.StatusOK, "stats.html", map[string]any{
+		"report":          report,
+		"daily":           daily,
+		"busiest":         busiest,
+		"attempts":        report.Succeeded + report.Failed,
+		"failures":        failures,
+		"failure_percent": 100 * report.FailureRate,
+		"lang":            locale(c),
+	})
+}
+
+// archiveUsage returns the figures of the usage report read from the
+// archive, reading them again if they are older than usageCacheTTL. Without
+// an archive there is nothing to report.
+func (s *Server) archiveUsage(ctx context.Context) (usageReport, error) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.usage.report.UpdatedAt) < usageCacheTTL {
+		return s.usage.report, nil
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(usageDays - 1))
+	var stats store.Stats
+	usage := store.Usage{Sizes: []store.Count{}, Steps: []store.Count{}}
+	if s.archive != nil {
+		var err error
+		if stats, err = s.archive.Stats(ctx); err != nil {
+			return usageReport{}, err
+		}
+		if usage, err = s.archive.Usage(ctx, since, usageTop); err != nil {
+			return usageReport{}, err
+		}
+	}
+
+	report := usageReport{
+		Generations:    stats.Images,
+		MeanGenTime:    roundFloat(usage.MeanGenTime, 2),
+		P95GenTime:     roundFloat(usage.P95GenTime, 2),
+		Sizes:          usage.Sizes,
+		Steps:          usage.Steps,
+		DiskUsageBytes: stats.Bytes - stats.SavedBytes,
+		UpdatedAt:      now,
+	}
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		report.Daily = append(report.Daily, dayCount{Date: date, Count: usage.Daily[date]})
+	}
+	s.usage.report = report
+	return report, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// versionProbeTimeout bounds the version query of each backend.
+const versionProbeTimeout = 10 * time.Second
+
+// probeVersions logs the version each backend reports along with the payload
+// keys in use, so a backend expecting other keys than it is sent, and thus
+// silently dropping parameters, can be spotted. Backends reporting different
+// versions are warned about, since they may expect different keys.
+func (s *Server) probeVersions(ctx context.Context) {
+	versions := make(map[string]bool)
+	for _, b := range s.client.Backends() {
+		probeCtx, cancel := context.WithTimeout(ctx, versionProbeTimeout)
+		version, err := s.client.Version(probeCtx, b)
+		cancel()
+		switch {
+		case err != nil:
+			log.Warn("Failed to query backend version", "backend", b.URL, "error", err)
+		case version == "":
+			log.Info("Backend does not report its version", "backend", b.URL, "payload_keys", s.PayloadKeys)
+		default:
+			log.Info("Backend version", "backend", b.URL, "version", version, "payload_keys", s.PayloadKeys)
+			versions[version] = true
+		}
+	}
+	if len(versions) > 1 {
+		log.Warn("Backends report different versions and may expect different payload keys", "count", len(versions))
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"flue-frontend/pkg/events"
+	"flue-frontend/pkg/jobs"
+
+	"github.com/charmbracelet/log"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket close codes sent when a job's preview channel ends.
+const (
+	closeNormal        = 1000
+	closeInternalError = 1011
+)
+
+// previewMessage is a message sent over a job's preview WebSocket.
+type previewMessage struct {
+	Type    string `json:"type"` // "status", "progress", "done" or "error"
+	Status  string `json:"status,omitempty"`
+	Step    int    `json:"step,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	Preview string `json:"preview,omitempty"`
+	Image   string `json:"image,omitempty"`
+	MIME    string `json:"mime,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// jobPreviews pushes a job's intermediate previews and final image over a
+// WebSocket. Previews only arrive if the backend streams them; otherwise the
+// client just receives the final image. Slow clients miss intermediate
+// frames rather than buffering them.
+func (s *Server) jobPreviews(c echo.Context) error {
+	id := c.Param("id")
+	ch, unsubscribe := s.progress.Subscribe(jobTopic(id))
+	defer unsubscribe()
+
+	job, ok := s.visibleJob(c, id)
+	if !ok {
+		return s.jobError(c, errorf(http.StatusNotFound, "Job not found"))
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// Watch for the client going away; it never sends anything.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var discard string
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		if !job.Status.Finished() {
+			if !s.forwardPreviews(ws, ch, gone) {
+				return
+			}
+			job, _ = s.jobs.Get(id)
+		}
+
+		final, code := finalPreviewMessage(job)
+		if err := websocket.JSON.Send(ws, final); err != nil {
+			return
+		}
+		if err := ws.WriteClose(code); err != nil {
+			log.Debug("Failed to close preview socket", "job", id, "error", err)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// forwardPreviews relays job events to ws until the job finishes. It returns
+// false if the client went away first.
+func (s *Server) forwardPreviews(ws *websocket.Conn, ch <-chan events.Event, gone <-chan struct{}) bool {
+	for {
+		select {
+		case <-gone:
+			return false
+		case ev, ok := <-ch:
+			if !ok {
+				return true
+			}
+			msg, ok := previewFromEvent(ev)
+			if !ok {
+				continue
+			}
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// previewFromEvent converts an intermediate job event to a WebSocket
+// message. Final events are skipped since the job record is authoritative.
+func previewFromEvent(ev events.Event) (previewMessage, bool) {
+	var msg previewMessage
+	switch ev.Name {
+	case "queued", "running":
+		msg.Type = "status"
+	case "progress", "preview":
+		msg.Type = "progress"
+	default:
+		return msg, false
+	}
+	if err := json.Unmarshal([]byte(ev.Data), &msg); err != nil {
+		return msg, false
+	}
+	if msg.Preview != "" {
+		msg.MIME = sniffBase64(msg.Preview)
+	}
+	return msg, true
+}
+
+// finalPreviewMessage returns the last message and close code for a
+// finished job.
+func finalPreviewMessage(job jobs.Job) (previewMessage, int) {
+	if job.Status == jobs.Canceled {
+		return previewMessage{Type: "error", Status: string(job.Status), Error: "Job was canceled"}, closeNormal
+	}
+	if job.Status == jobs.Failed {
+		return previewMessage{Type: "error", Error: job.Error}, closeInternalError
+	}
+	msg := previewMessage{Type: "done", Status: string(job.Status)}
+	if result, ok := jobResult(job); ok {
+		msg.Image = result.Image
+		msg.MIME = result.MIME
+	}
+	return msg, closeNormal
+}
+
+// sniffBase64 detects the media type of a base64-encoded image.
+func sniffBase64(b64 string) string {
+	head, err := base64.StdEncoding.DecodeString(b64[:min(len(b64), 64)/4*4])
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head)
+}
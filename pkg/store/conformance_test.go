@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// listIDs returns the IDs of the records List returns for q, offset and
+// limit, with the total.
+func listIDs(t *testing.T, s Store, q Query, offset, limit int) (string, int) {
+	t.Helper()
+	page, total, err := s.List(context.Background(), q, offset, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(page))
+	for i, meta := range page {
+		ids[i] = meta.ID
+	}
+	return fmt.Sprint(ids), total
+}
+
+// TestStoreConformance runs the same cases against every Store, which must
+// behave alike.
+func TestStoreConformance(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"list newest first", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a", "b", "c")
+			if ids, total := listIDs(t, s, Query{}, 0, 10); ids != "[image02 image01 image00]" || total != 3 {
+				t.Errorf("List = %s (total %d)", ids, total)
+			}
+		}},
+		{"paging", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a", "b", "c", "d", "e")
+			for _, tt := range []struct {
+				offset, limit int
+				want          string
+			}{
+				{0, 2, "[image04 image03]"},
+				{2, 2, "[image02 image01]"},
+				{4, 2, "[image00]"},
+				{5, 2, "[]"},
+				{0, 0, "[]"},
+			} {
+				if ids, total := listIDs(t, s, Query{}, tt.offset, tt.limit); ids != tt.want || total != 5 {
+					t.Errorf("List offset %d limit %d = %s (total %d), want %s (total 5)", tt.offset, tt.limit, ids, total, tt.want)
+				}
+			}
+		}},
+		{"get", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a lighthouse")
+			meta, err := s.Get(ctx, "image00")
+			if err != nil || meta.Prompt != "a lighthouse" {
+				t.Errorf("Get = %+v, %v", meta, err)
+			}
+			if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a missing record = %v, want %v", err, ErrNotFound)
+			}
+		}},
+		{"owner", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a", "b", "c")
+			for id, owner := range map[string]string{"image00": "alice", "image02": "bob"} {
+				meta, _ := s.Get(ctx, id)
+				meta.Owner = owner
+				if err := s.Put(ctx, meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ids, total := listIDs(t, s, Query{Owner: "alice"}, 0, 10); ids != "[image00]" || total != 1 {
+				t.Errorf("List of alice = %s (total %d)", ids, total)
+			}
+			n, err := s.Adopt(ctx, "carol")
+			if err != nil || n != 1 {
+				t.Errorf("Adopt = %d, %v, want 1", n, err)
+			}
+			if ids, _ := listIDs(t, s, Query{Owner: "carol"}, 0, 10); ids != "[image01]" {
+				t.Errorf("List of carol = %s", ids)
+			}
+			if meta, _ := s.Get(ctx, "image01"); meta.Owner != "carol" {
+				t.Errorf("adopted record has owner %q", meta.Owner)
+			}
+		}},
+		{"favorites", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a", "b", "c")
+			meta, _ := s.Get(ctx, "image01")
+			meta.Favorite = true
+			if err := s.Put(ctx, meta); err != nil {
+				t.Fatal(err)
+			}
+			if ids, total := listIDs(t, s, Query{Favorites: true}, 0, 10); ids != "[image01]" || total != 1 {
+				t.Errorf("List of favorites = %s (total %d)", ids, total)
+			}
+			// Replacing a record keeps its place.
+			if ids, _ := listIDs(t, s, Query{}, 0, 10); ids != "[image02 image01 image00]" {
+				t.Errorf("List = %s", ids)
+			}
+			if stats, err := s.Stats(ctx); err != nil || stats.Images != 3 || stats.Favorites != 1 {
+				t.Errorf("Stats = %+v, %v", stats, err)
+			}
+		}},
+		{"delete", func(t *testing.T, s Store) {
+			putPrompts(t, s, "a", "b", "c")
+			if err := s.Delete(ctx, "image01"); err != nil {
+				t.Fatal(err)
+			}
+			if ids, total := listIDs(t, s, Query{}, 0, 10); ids != "[image02 image00]" || total != 2 {
+				t.Errorf("List after delete = %s (total %d)", ids, total)
+			}
+			if _, err := s.Get(ctx, "image01"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a deleted record = %v, want %v", err, ErrNotFound)
+			}
+			if err := s.Delete(ctx, "image01"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Delete of a deleted record = %v, want %v", err, ErrNotFound)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, s := range testStores(t) {
+				t.Run(name, func(t *testing.T) { tt.run(t, s) })
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory keeps records in memory, so nothing survives a restart.
+type Memory struct {
+	mu    sync.RWMutex
+	byID  map[string]Metadata
+	order []string // IDs from oldest to newest
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{byID: make(map[string]Metadata)}
+}
+
+// Put creates or replaces a record. A new record is listed as the newest
+// one.
+func (m *Memory) Put(_ context.Context, meta Metadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[meta.ID]; !ok {
+		m.order = append(m.order, meta.ID)
+	}
+	m.byID[meta.ID] = meta
+	return nil
+}
+
+func (m *Memory) Get(_ context.Context, id string) (Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	meta, ok := m.byID[id]
+	if !ok {
+		return Metadata{}, ErrNotFound
+	}
+	return meta, nil
+}
+
+func (m *Memory) List(_ context.Context, q Query, offset, limit int) ([]Metadata, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var page []Metadata
+	total := 0
+	for i := len(m.order) - 1; i >= 0; i-- {
+		meta := m.byID[m.order[i]]
+		if !q.matches(meta) {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, meta)
+		}
+		total++
+	}
+	return page, total, nil
+}
+
+func (m *Memory) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.byID, id)
+	m.order = slices.DeleteFunc(m.order, func(other string) bool { return other == id })
+	return nil
+}
+
+func (m *Memory) Stats(_ context.Context) (Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var stats Stats
+	shared := make(map[string]bool)
+	for _, meta := range m.byID {
+		stats.Images++
+		stats.Bytes += meta.Size
+		if meta.Favorite {
+			stats.Favorites++
+		}
+		if meta.Hash != "" {
+			if shared[meta.Hash] {
+				stats.SavedBytes += meta.Size
+			}
+			shared[meta.Hash] = true
+		}
+	}
+	return stats, nil
+}
+
+func (m *Memory) Usage(_ context.Context, since time.Time, top int) (Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	usage := Usage{Daily: make(map[string]int)}
+	genTimes := make([]float64, 0, len(m.byID))
+	sizes := make(map[string]int)
+	steps := make(map[string]int)
+	for _, meta := range m.byID {
+		if !meta.CreatedAt.Before(since) {
+			usage.Daily[meta.CreatedAt.UTC().Format(time.DateOnly)]++
+		}
+		genTimes = append(genTimes, meta.GenTime)
+		sizes[fmt.Sprintf("%dx%d", meta.Width, meta.Height)]++
+		steps[strconv.Itoa(meta.Steps)]++
+	}
+	if len(genTimes) > 0 {
+		slices.Sort(genTimes)
+		var sum float64
+		for _, t := range genTimes {
+			sum += t
+		}
+		usage.MeanGenTime = sum / float64(len(genTimes))
+		usage.P95GenTime = genTimes[p95Index(len(genTimes))]
+	}
+	usage.Sizes = topCounts(sizes, top)
+	usage.Steps = topCounts(steps, top)
+	return usage, nil
+}
+
+func (m *Memory) Adopt(_ context.Context, owner string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, meta := range m.byID {
+		if meta.Owner == "" {
+			meta.Owner = owner
+			m.byID[id] = meta
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,386 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"flue-frontend/pkg/jobs"
+	"flue-frontend/pkg/params"
+
+	"modernc.org/sqlite"
+)
+
+func init() {
+	// prompt_contains(prompt, query) matches prompts the way the in-memory
+	// store does, which SQLite's ASCII-only lower() cannot.
+	sqlite.MustRegisterDeterministicScalarFunction("prompt_contains", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		prompt, _ := args[0].(string)
+		query, _ := args[1].(string)
+		return params.PromptContains(prompt, query), nil
+	})
+}
+
+// migrations are the schema changes applied in order, each exactly once.
+// The number applied is kept as the database's user_version, so new
+// migrations must only ever be appended.
+var migrations = []string{
+	`CREATE TABLE generations (
+		id         TEXT PRIMARY KEY,
+		prompt     TEXT NOT NULL,
+		seed       INTEGER,
+		model      TEXT NOT NULL,
+		favorite   INTEGER NOT NULL,
+		size       INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		record     TEXT NOT NULL
+	);
+	CREATE INDEX generations_created_at ON generations (created_at, id);
+	CREATE TABLE jobs (
+		id     TEXT PRIMARY KEY,
+		record TEXT NOT NULL
+	);
+	CREATE TABLE meta (
+		key  TEXT PRIMARY KEY,
+		data BLOB NOT NULL
+	);`,
+	`ALTER TABLE generations ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+	CREATE INDEX generations_hash ON generations (hash) WHERE hash != '';`,
+	`ALTER TABLE generations ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+	CREATE INDEX generations_owner ON generations (owner, created_at, id);`,
+}
+
+// SQLite keeps generation records in a SQLite database file. Jobs may be
+// kept in the same database through Jobs.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens or creates the database at path and brings its schema up
+// to date.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	s := &SQLite{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations the database has not seen yet.
+func (s *SQLite) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this release supports (%d)", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate schema to version %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate schema to version %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrate schema to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) Put(ctx context.Context, meta Metadata) error {
+	record, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO generations
+		(id, prompt, seed, model, favorite, size, hash, owner, created_at, record)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		meta.ID, meta.Prompt, meta.Seed, meta.Model, meta.Favorite, meta.Size, meta.Hash, meta.Owner, meta.CreatedAt.UnixNano(), string(record))
+	return err
+}
+
+func (s *SQLite) Get(ctx context.Context, id string) (Metadata, error) {
+	var record string
+	err := s.db.QueryRowContext(ctx, "SELECT record FROM generations WHERE id = ?", id).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Metadata{}, ErrNotFound
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	return decodeMetadata(id, record)
+}
+
+func (s *SQLite) List(ctx context.Context, q Query, offset, limit int) ([]Metadata, int, error) {
+	where, args := q.where()
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM generations"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if total <= offset || limit <= 0 {
+		return nil, total, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, record FROM generations"+where+" ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var page []Metadata
+	for rows.Next() {
+		var id, record string
+		if err := rows.Scan(&id, &record); err != nil {
+			return nil, 0, err
+		}
+		meta, err := decodeMetadata(id, record)
+		if err != nil {
+			return nil, 0, err
+		}
+		page = append(page, meta)
+	}
+	return page, total, rows.Err()
+}
+
+// where returns the SQL condition selecting the records matching q, and its
+// arguments.
+func (q Query) where() (string, []any) {
+	var conds []string
+	var args []any
+	if q.Prompt != "" {
+		conds = append(conds, "prompt_contains(prompt, ?)")
+		args = append(args, q.Prompt)
+	}
+	if q.Seed != nil {
+		conds = append(conds, "seed = ?")
+		args = append(args, *q.Seed)
+	}
+	if q.Model != "" {
+		conds = append(conds, "model = ?")
+		args = append(args, q.Model)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.Favorites {
+		conds = append(conds, "favorite")
+	}
+	if q.Hash != "" {
+		conds = append(conds, "hash = ?")
+		args = append(args, q.Hash)
+	}
+	if q.Owner != "" {
+		conds = append(conds, "owner = ?")
+		args = append(args, q.Owner)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func decodeMetadata(id, record string) (Metadata, error) {
+	var meta Metadata
+	if err := json.Unmarshal([]byte(record), &meta); err != nil {
+		return Metadata{}, fmt.Errorf("decode metadata of %s: %w", id, err)
+	}
+	return meta, nil
+}
+
+func (s *SQLite) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM generations WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(favorite), 0), COALESCE(SUM(size), 0) FROM generations").
+		Scan(&stats.Images, &stats.Favorites, &stats.Bytes)
+	if err != nil {
+		return Stats{}, err
+	}
+	// Every image sharing its hash with an earlier one saves its size.
+	err = s.db.QueryRowContext(ctx, `SELECT COALESCE(SUM((n - 1) * size), 0) FROM
+		(SELECT COUNT(*) AS n, MAX(size) AS size FROM generations WHERE hash != '' GROUP BY hash)`).
+		Scan(&stats.SavedBytes)
+	return stats, err
+}
+
+func (s *SQLite) Usage(ctx context.Context, since time.Time, top int) (Usage, error) {
+	usage := Usage{Daily: make(map[string]int)}
+	rows, err := s.db.QueryContext(ctx, `SELECT date(created_at / 1000000000, 'unixepoch'), COUNT(*) FROM generations
+		WHERE created_at >= ? GROUP BY 1`, since.UnixNano())
+	if err != nil {
+		return Usage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			return Usage{}, err
+		}
+		usage.Daily[day] = n
+	}
+	if err := rows.Err(); err != nil {
+		return Usage{}, err
+	}
+
+	var n int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(AVG(json_extract(record, '$.gen_time')), 0) FROM generations").
+		Scan(&n, &usage.MeanGenTime)
+	if err != nil {
+		return Usage{}, err
+	}
+	if n > 0 {
+		err = s.db.QueryRowContext(ctx, `SELECT COALESCE(json_extract(record, '$.gen_time'), 0) AS gen_time FROM generations
+			ORDER BY gen_time LIMIT 1 OFFSET ?`, p95Index(n)).Scan(&usage.P95GenTime)
+		if err != nil {
+			return Usage{}, err
+		}
+	}
+
+	usage.Sizes, err = s.topCounts(ctx, "json_extract(record, '$.width') || 'x' || json_extract(record, '$.height')", top)
+	if err != nil {
+		return Usage{}, err
+	}
+	usage.Steps, err = s.topCounts(ctx, "CAST(json_extract(record, '$.steps') AS TEXT)", top)
+	return usage, err
+}
+
+// topCounts returns the top most frequent values of the expression expr
+// over all records, most frequent first.
+func (s *SQLite) topCounts(ctx context.Context, expr string, top int) ([]Count, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+expr+` AS value, COUNT(*) AS n FROM generations
+		GROUP BY value ORDER BY n DESC, value LIMIT ?`, top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []Count{}
+	for rows.Next() {
+		var c Count
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+func (s *SQLite) Adopt(ctx context.Context, owner string) (int, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE generations SET owner = ?, record = json_set(record, '$.owner', ?)
+		WHERE owner = ''`, owner, owner)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// jobRecord is the stored form of a job, keeping the fields hidden from
+// clients.
+type jobRecord struct {
+	Job    jobs.Job `json:"job"`
+	Client string   `json:"client"`
+	Owner  string   `json:"owner,omitempty"`
+}
+
+// Jobs returns a jobs.Store, which is also a jobs.MetaStore, keeping jobs in
+// the database. Closing it leaves the database open.
+func (s *SQLite) Jobs() jobs.Store {
+	return sqliteJobs{s.db}
+}
+
+// sqliteJobs keeps jobs in the jobs table of a SQLite database.
+type sqliteJobs struct {
+	db *sql.DB
+}
+
+func (s sqliteJobs) Save(j jobs.Job) error {
+	data, err := json.Marshal(jobRecord{Job: j, Client: j.Client, Owner: j.Owner})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO jobs (id, record) VALUES (?, ?)", j.ID, string(data))
+	return err
+}
+
+func (s sqliteJobs) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM jobs WHERE id = ?", id)
+	return err
+}
+
+func (s sqliteJobs) Load() ([]jobs.Job, error) {
+	rows, err := s.db.Query("SELECT id, record FROM jobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []jobs.Job
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var r jobRecord
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, fmt.Errorf("decode job %s: %w", id, err)
+		}
+		r.Job.Client = r.Client
+		r.Job.Owner = r.Owner
+		list = append(list, r.Job)
+	}
+	return list, rows.Err()
+}
+
+func (s sqliteJobs) SaveMeta(key string, data []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO meta (key, data) VALUES (?, ?)", key, data)
+	return err
+}
+
+func (s sqliteJobs) LoadMeta(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM meta WHERE key = ?", key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s sqliteJobs) Close() error {
+	return nil
+}
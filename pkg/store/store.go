@@ -0,0 +1,154 @@
+// Package store keeps the metadata records of generated images, for
+// searching, paging and accounting without touching the images themselves.
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"flue-frontend/pkg/params"
+)
+
+// ErrNotFound is returned for IDs with no record.
+var ErrNotFound = errors.New("image not found")
+
+// Metadata is the recipe and provenance of a generated image.
+type Metadata struct {
+	ID       string  `json:"id"`
+	Prompt   string  `json:"prompt"`
+	Seed     *int    `json:"seed,omitempty"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Steps    int     `json:"steps"`
+	Guidance float64 `json:"guidance"`
+	Model    string  `json:"model,omitempty"`
+	Tiling   bool    `json:"tiling,omitempty"`
+	Format   string  `json:"format"`
+	Quality  int     `json:"quality,omitempty"`
+	// Size is the size of the stored image in bytes.
+	Size int64 `json:"size,omitempty"`
+	// Hash is the hex SHA-256 of the image bytes. Images with the same hash
+	// share one stored copy.
+	Hash string `json:"hash,omitempty"`
+
+	// GenTime is the generation time reported by the backend and Elapsed
+	// the time the whole backend request took, both in seconds.
+	GenTime float64 `json:"gen_time"`
+	Elapsed float64 `json:"elapsed"`
+
+	CreatedAt time.Time `json:"created_at"`
+	Client    string    `json:"client,omitempty"`
+	// Owner is the session the image was generated in, if sessions are in
+	// use.
+	Owner string `json:"owner,omitempty"`
+
+	// Favorite marks an image as a keeper, exempting it from retention
+	// cleanup.
+	Favorite bool `json:"favorite,omitempty"`
+}
+
+// Query selects generation records. Zero fields match everything.
+type Query struct {
+	// Prompt matches images whose prompt contains it, ignoring case.
+	Prompt string
+	Seed   *int
+	Model  string
+	Since  time.Time
+	Until  time.Time
+	// Favorites matches only favorite images.
+	Favorites bool
+	// Hash matches images with the given content hash.
+	Hash string
+	// Owner matches images generated in the given session.
+	Owner string
+}
+
+func (q Query) matches(m Metadata) bool {
+	return (q.Prompt == "" || params.PromptContains(m.Prompt, q.Prompt)) &&
+		(q.Seed == nil || (m.Seed != nil && *m.Seed == *q.Seed)) &&
+		(q.Model == "" || m.Model == q.Model) &&
+		(q.Since.IsZero() || !m.CreatedAt.Before(q.Since)) &&
+		(q.Until.IsZero() || m.CreatedAt.Before(q.Until)) &&
+		(!q.Favorites || m.Favorite) &&
+		(q.Hash == "" || m.Hash == q.Hash) &&
+		(q.Owner == "" || m.Owner == q.Owner)
+}
+
+// Stats sums up the records in a store.
+type Stats struct {
+	Images    int   `json:"images"`
+	Favorites int   `json:"favorites"`
+	Bytes     int64 `json:"bytes"`
+	// SavedBytes is the part of Bytes not stored, as images sharing their
+	// content with others share a single copy.
+	SavedBytes int64 `json:"saved_bytes"`
+}
+
+// Usage breaks the records in a store down for reporting.
+type Usage struct {
+	// Daily counts the records created each day since the time given to
+	// Usage, keyed by the UTC date as 2006-01-02. Days without records are
+	// left out.
+	Daily map[string]int `json:"daily"`
+	// MeanGenTime and P95GenTime are the mean and 95th percentile of the
+	// generation time of all records in seconds.
+	MeanGenTime float64 `json:"mean_gen_time"`
+	P95GenTime  float64 `json:"p95_gen_time"`
+	// Sizes counts the records by their dimensions, such as 1024x768, and
+	// Steps by their step count, most frequent first.
+	Sizes []Count `json:"sizes"`
+	Steps []Count `json:"steps"`
+}
+
+// Count is the number of records sharing a value.
+type Count struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// p95Index returns the index of the 95th percentile in n sorted values.
+func p95Index(n int) int {
+	return max((n*95+99)/100-1, 0)
+}
+
+// topCounts returns the top most frequent values of counts, most frequent
+// first.
+func topCounts(counts map[string]int, top int) []Count {
+	list := make([]Count, 0, len(counts))
+	for value, n := range counts {
+		list = append(list, Count{Value: value, Count: n})
+	}
+	slices.SortFunc(list, func(a, b Count) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	return list[:min(top, len(list))]
+}
+
+// Store keeps generation records.
+type Store interface {
+	// Put creates or replaces the record of an image.
+	Put(ctx context.Context, meta Metadata) error
+	// Get returns the record of an image, or ErrNotFound.
+	Get(ctx context.Context, id string) (Metadata, error)
+	// List returns up to limit records matching q newest first, skipping
+	// the offset newest, along with the total number of matching records.
+	List(ctx context.Context, q Query, offset, limit int) ([]Metadata, int, error)
+	// Delete removes the record of an image, or returns ErrNotFound.
+	Delete(ctx context.Context, id string) error
+	// Stats sums up the stored records.
+	Stats(ctx context.Context) (Stats, error)
+	// Usage breaks the stored records down, counting them per day since
+	// since and listing the top most frequent dimensions and step counts.
+	Usage(ctx context.Context, since time.Time, top int) (Usage, error)
+	// Adopt assigns the records without an owner to owner, returning how
+	// many it assigned.
+	Adopt(ctx context.Context, owner string) (int, error)
+	// Close releases the store's resources.
+	Close() error
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores returns an empty store of each kind, closed when the test
+// ends.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "flue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Store{"memory": NewMemory(), "sqlite": db}
+}
+
+// putPrompts stores a record for each prompt, the last one newest, and
+// returns their IDs.
+func putPrompts(t *testing.T, s Store, prompts ...string) []string {
+	t.Helper()
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := make([]string, len(prompts))
+	for i, prompt := range prompts {
+		ids[i] = fmt.Sprintf("image%02d", i)
+		meta := Metadata{ID: ids[i], Prompt: prompt, Format: "png", CreatedAt: created.Add(time.Duration(i) * time.Minute)}
+		if err := s.Put(context.Background(), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestListPromptSearch(t *testing.T) {
+	prompts := []string{
+		"Ein Straßencafé in MÜNCHEN",
+		"ΚΑΛΗΜΈΡΑ κόσμε",
+		"東京の夜景",
+		"a cat",
+		"A CAT in a hat",
+	}
+	tests := []struct {
+		query string
+		want  []int // indexes into prompts, newest first
+	}{
+		{"", []int{4, 3, 2, 1, 0}},
+		{"münchen", []int{0}},
+		{"straßencafé", []int{0}},
+		{"καλημέρα", []int{1}},
+		{"東京", []int{2}},
+		{"Cat", []int{4, 3}},
+		{"dog", nil},
+	}
+	for name, s := range testStores(t) {
+		ids := putPrompts(t, s, prompts...)
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.query, func(t *testing.T) {
+				page, total, err := s.List(context.Background(), Query{Prompt: tt.query}, 0, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, meta := range page {
+					got = append(got, meta.ID)
+				}
+				var want []string
+				for _, i := range tt.want {
+					want = append(want, ids[i])
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) || total != len(want) {
+					t.Errorf("List(%q) = %v (total %d), want %v", tt.query, got, total, want)
+				}
+			})
+		}
+	}
+}
+
+func TestPromptContainsFunction(t *testing.T) {
+	db := testStores(t)["sqlite"].(*SQLite)
+	for _, tt := range []struct {
+		prompt, query string
+		want          bool
+	}{
+		{"Ein Straßencafé in MÜNCHEN", "münchen", true},
+		{"ΚΑΛΗΜΈΡΑ κόσμε", "καλημέρα", true},
+		{"東京の夜景", "夜景", true},
+		{"a cat", "", true},
+		{"", "", true},
+		{"", "cat", false},
+		{"a cat", "dog", false},
+	} {
+		var got bool
+		if err := db.db.QueryRow("SELECT prompt_contains(?, ?)", tt.prompt, tt.query).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("prompt_contains(%q, %q) = %v, want %v", tt.prompt, tt.query, got, tt.want)
+		}
+		if matched := (Query{Prompt: tt.query}).matches(Metadata{Prompt: tt.prompt}); matched != tt.want {
+			t.Errorf("Query{Prompt: %q}.matches(%q) = %v, want %v", tt.query, tt.prompt, matched, tt.want)
+		}
+	}
+}